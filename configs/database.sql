@@ -13,13 +13,39 @@ location_id INTEGER REFERENCES locations(location_id) ON DELETE CASCADE,
 temperature numeric(6,2),
 temp_min numeric(6,2),
 temp_max numeric(6,2),
-date DATE NOT NULL default CURRENT_DATE
+humidity numeric(5,2), -- %
+pressure numeric(6,1), -- hPa
+wind_speed numeric(5,2), -- m/s
+wind_deg smallint,
+source VARCHAR NOT NULL default 'owm', -- origin of the sample, e.g. owm, import, metar
+measured_at TIMESTAMP WITH TIME ZONE NOT NULL default now(),
+date DATE NOT NULL default CURRENT_DATE,
+UNIQUE(location_id, measured_at)
 );
 
 CREATE INDEX weather_location ON weather(location_id);
 
+CREATE TABLE descriptions(
+id INTEGER PRIMARY KEY, -- weather condition code in open weather map service
+main VARCHAR NOT NULL, -- group of weather conditions, e.g. Rain
+description VARCHAR NOT NULL,
+icon VARCHAR NOT NULL
+);
+
 CREATE TABLE conditions(
 statistic_id INTEGER REFERENCES weather(id) ON DELETE CASCADE,
-type VARCHAR NOT NULL, -- It should be int and we should have dictionary of weather descriptions (It's not a goal of that task)
-PRIMARY KEY(statistic_id, type)
-);
\ No newline at end of file
+code INTEGER NOT NULL REFERENCES descriptions(id),
+date DATE NOT NULL default CURRENT_DATE, -- the same as weather.date, so both tables can be partitioned by month
+PRIMARY KEY(statistic_id, code)
+);
+
+CREATE TABLE personal_stations(
+station_id VARCHAR PRIMARY KEY, -- 'ID' of Weather Underground protocol or identifier in Ecowitt path
+key_hash VARCHAR NOT NULL, -- HMAC-SHA256 of the key of the station with the hash key of the server
+location_id INTEGER NOT NULL REFERENCES locations(location_id) ON DELETE CASCADE
+);
+
+CREATE TABLE owm_usage(
+day DATE PRIMARY KEY, -- UTC day
+calls INTEGER NOT NULL default 0 -- requests to open weather map API of all instances
+);
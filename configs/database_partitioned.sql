@@ -0,0 +1,59 @@
+-- Alternative schema with 'weather' and 'conditions' partitioned by month.
+-- Use it instead of database.sql and start the service with DB_PARTITIONING=true,
+-- so partitions are created ahead of time and detached after the retention period.
+-- PostgreSQL 11 does not support foreign keys referencing partitioned tables,
+-- therefore conditions are removed together with weather by the application.
+-- Partitions are created by the application, there is no default partition.
+
+CREATE TABLE locations (
+location_id INTEGER PRIMARY KEY,
+city_name VARCHAR NOT NULL,
+country_code CHAR(4) NOT NULL,
+latitude numeric(6,2),
+longitude numeric(6,2),
+UNIQUE(city_name, country_code)
+);
+
+CREATE TABLE weather(
+id SERIAL,
+location_id INTEGER REFERENCES locations(location_id) ON DELETE CASCADE,
+temperature numeric(6,2),
+temp_min numeric(6,2),
+temp_max numeric(6,2),
+humidity numeric(5,2), -- %
+pressure numeric(6,1), -- hPa
+wind_speed numeric(5,2), -- m/s
+wind_deg smallint,
+source VARCHAR NOT NULL default 'owm', -- origin of the sample, e.g. owm, import, metar
+measured_at TIMESTAMP WITH TIME ZONE NOT NULL default now(),
+date DATE NOT NULL default CURRENT_DATE,
+PRIMARY KEY(id, date),
+UNIQUE(location_id, measured_at, date)
+) PARTITION BY RANGE (date);
+
+CREATE INDEX weather_location ON weather(location_id, date);
+
+CREATE TABLE descriptions(
+id INTEGER PRIMARY KEY, -- weather condition code in open weather map service
+main VARCHAR NOT NULL, -- group of weather conditions, e.g. Rain
+description VARCHAR NOT NULL,
+icon VARCHAR NOT NULL
+);
+
+CREATE TABLE conditions(
+statistic_id INTEGER NOT NULL,
+code INTEGER NOT NULL REFERENCES descriptions(id),
+date DATE NOT NULL default CURRENT_DATE,
+PRIMARY KEY(statistic_id, code, date)
+) PARTITION BY RANGE (date);
+
+CREATE TABLE personal_stations(
+station_id VARCHAR PRIMARY KEY, -- 'ID' of Weather Underground protocol or identifier in Ecowitt path
+key_hash VARCHAR NOT NULL, -- HMAC-SHA256 of the key of the station with the hash key of the server
+location_id INTEGER NOT NULL REFERENCES locations(location_id) ON DELETE CASCADE
+);
+
+CREATE TABLE owm_usage(
+day DATE PRIMARY KEY, -- UTC day
+calls INTEGER NOT NULL default 0 -- requests to open weather map API of all instances
+);
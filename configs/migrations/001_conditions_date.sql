@@ -0,0 +1,4 @@
+-- Conditions have the date of their weather, so both tables can be partitioned by month.
+ALTER TABLE conditions ADD COLUMN IF NOT EXISTS date DATE;
+UPDATE conditions AS c SET date = w.date FROM weather AS w WHERE w.id = c.statistic_id AND c.date IS NULL;
+ALTER TABLE conditions ALTER COLUMN date SET DEFAULT CURRENT_DATE, ALTER COLUMN date SET NOT NULL;
@@ -0,0 +1,23 @@
+-- Free text types of conditions are replaced by codes of the dictionary. Statistics only use the group of
+-- the condition (main), so the type gets the code of its group whose description is the group (e.g. Snow -> 601 snow)
+-- or the lowest code of the group (e.g. Rain -> 500 light rain). Types which are not groups of the dictionary
+-- stop the migration, they are listed in the error.
+DO $$
+BEGIN
+IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema()
+        AND table_name = 'conditions' AND column_name = 'type') THEN
+    ALTER TABLE conditions ADD COLUMN IF NOT EXISTS code INTEGER;
+    UPDATE conditions AS c SET code = (SELECT d.id FROM descriptions AS d WHERE lower(d.main) = lower(c.type)
+        ORDER BY lower(d.description) <> lower(d.main), d.id LIMIT 1);
+    IF EXISTS (SELECT 1 FROM conditions WHERE code IS NULL) THEN
+        RAISE EXCEPTION 'types of conditions are not groups of descriptions: %',
+            (SELECT string_agg(DISTINCT type, ', ') FROM conditions WHERE code IS NULL);
+    END IF;
+    ALTER TABLE conditions DROP CONSTRAINT conditions_pkey;
+    ALTER TABLE conditions DROP COLUMN type;
+    ALTER TABLE conditions ALTER COLUMN code SET NOT NULL;
+    ALTER TABLE conditions ADD PRIMARY KEY (statistic_id, code);
+    ALTER TABLE conditions ADD FOREIGN KEY (code) REFERENCES descriptions(id);
+END IF;
+END
+$$;
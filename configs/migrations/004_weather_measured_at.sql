@@ -0,0 +1,18 @@
+-- Weather has the time of measurement, it is unique for the location. The time of existing samples is unknown,
+-- they get midnight UTC of their date plus one second per earlier sample of the location of that day,
+-- so they keep their order and do not collide.
+DO $$
+BEGIN
+IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema()
+        AND table_name = 'weather' AND column_name = 'measured_at') THEN
+    ALTER TABLE weather ADD COLUMN measured_at TIMESTAMP WITH TIME ZONE;
+    UPDATE weather AS w SET measured_at = s.measured_at
+        FROM (SELECT id, (date::timestamp AT TIME ZONE 'UTC') +
+            (row_number() OVER (PARTITION BY location_id, date ORDER BY id) - 1) * interval '1 second' AS measured_at
+            FROM weather) AS s
+        WHERE s.id = w.id;
+    ALTER TABLE weather ALTER COLUMN measured_at SET DEFAULT now(), ALTER COLUMN measured_at SET NOT NULL;
+    ALTER TABLE weather ADD UNIQUE (location_id, measured_at);
+END IF;
+END
+$$;
@@ -0,0 +1,7 @@
+-- Weather has measurements of stations and the origin of the sample, existing samples are of open weather map.
+ALTER TABLE weather
+    ADD COLUMN IF NOT EXISTS humidity numeric(5,2), -- %
+    ADD COLUMN IF NOT EXISTS pressure numeric(6,1), -- hPa
+    ADD COLUMN IF NOT EXISTS wind_speed numeric(5,2), -- m/s
+    ADD COLUMN IF NOT EXISTS wind_deg smallint,
+    ADD COLUMN IF NOT EXISTS source VARCHAR NOT NULL default 'owm'; -- origin of the sample, e.g. owm, import, metar
@@ -0,0 +1,6 @@
+-- Personal weather stations which upload samples of their location.
+CREATE TABLE IF NOT EXISTS personal_stations(
+station_id VARCHAR PRIMARY KEY, -- 'ID' of Weather Underground protocol or identifier in Ecowitt path
+key_hash VARCHAR NOT NULL, -- HMAC-SHA256 of the key of the station with the hash key of the server
+location_id INTEGER NOT NULL REFERENCES locations(location_id) ON DELETE CASCADE
+);
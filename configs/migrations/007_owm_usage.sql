@@ -0,0 +1,5 @@
+-- Requests to open weather map API of all instances by UTC day, they are limited by the quota.
+CREATE TABLE IF NOT EXISTS owm_usage(
+day DATE PRIMARY KEY, -- UTC day
+calls INTEGER NOT NULL default 0 -- requests to open weather map API of all instances
+);
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/mieczyslaw1980/weather/internal/app"
+)
+
+// export writes raw weather samples of all locations to the file or to the standard output
+func export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "csv", "output format: json, csv or ndjson")
+	from := flags.String("from", "", "the first date, inclusive (YYYY-MM-DD)")
+	to := flags.String("to", "", "the last date, inclusive (YYYY-MM-DD)")
+	location := flags.Int("location", 0, "identifier of the location, all locations by default")
+	output := flags.String("output", "", "output file, the standard output by default")
+	config, err := loadConfig(flags, args)
+	if err != nil {
+		return err
+	}
+
+	filter, err := app.NewObservationFilter(*from, *to, "", "")
+	if err != nil {
+		return err
+	}
+	filter.LocationID = *location
+
+	db, err := app.NewDB(config.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var w io.Writer = os.Stdout
+	if len(*output) > 0 {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	buffered := bufio.NewWriter(w)
+	if err = app.ExportObservations(db, buffered, *format, filter); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
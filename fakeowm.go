@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mieczyslaw1980/weather/internal/app"
+	"github.com/mieczyslaw1980/weather/internal/fakeowm"
+)
+
+// fakeOWM serves open weather map API from fixtures, with -record it records responses of open weather map instead
+func fakeOWM(args []string) error {
+	flags := flag.NewFlagSet("fake-owm", flag.ContinueOnError)
+	address := flags.String("address", ":8090", "address of the server")
+	fixtures := flags.String("fixtures", "configs/fake-owm", "directory of fixtures")
+	record := flags.String("record", "", "open weather map which responses are recorded into fixtures, e.g. https://api.openweathermap.org")
+	keys := flags.String("keys", "", "comma separated accepted keys, any key is accepted when it is empty")
+	latency := flags.Duration("latency", 0, "latency of every response")
+	errorRate := flags.Float64("error-rate", 0, "share of requests which get 500")
+	tooManyRequestsRate := flags.Float64("too-many-requests-rate", 0, "share of requests which get 429")
+	retryAfter := flags.Duration("retry-after", time.Minute, "Retry-After of 429 responses")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	o := fakeowm.Options{
+		Fixtures:            *fixtures,
+		Upstream:            strings.TrimSuffix(*record, "/"),
+		Latency:             *latency,
+		ErrorRate:           *errorRate,
+		TooManyRequestsRate: *tooManyRequestsRate,
+		RetryAfter:          *retryAfter,
+	}
+	if len(*keys) > 0 {
+		o.Keys = strings.Split(*keys, ",")
+	}
+
+	logger := app.ServiceLogger()
+	server := fakeowm.New(o)
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		server.ServeHTTP(rw, req)
+		logger.Info("Fake open weather map request", "path", req.URL.Path, "duration", time.Since(start))
+	})
+
+	logger.Info("Fake open weather map start", "address", *address, "fixtures", *fixtures, "record", o.Upstream)
+	return http.ListenAndServe(*address, handler)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/mieczyslaw1980/weather/internal/app"
+)
+
+// importCommand loads historical weather samples of the location from files or from the standard input
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	location := flags.Int("location", 0, "identifier of the location (required)")
+	format := flags.String("format", "csv", "input format: csv or ndjson")
+	columns := flags.String("columns", "", "mapping of fields to columns, e.g. measured_at=time,temperature=temp")
+	units := flags.String("units", "kelvin", "units of temperature: kelvin, celsius or fahrenheit")
+	timeLayout := flags.String("time-layout", "", "layout of the time of measurement in Go format, e.g. 2006-01-02 15:04")
+	dryRun := flags.Bool("dry-run", false, "validate observations without saving them")
+	config, err := loadConfig(flags, args)
+	if err != nil {
+		return err
+	}
+	if *location == 0 {
+		return errors.New("-location is required")
+	}
+
+	options, err := app.NewImportOptions(*location, *format, *columns, *units, *timeLayout, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	db, err := app.NewDB(config.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", " ")
+	for _, name := range files {
+		var r io.Reader = os.Stdin
+		if name != "-" {
+			file, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			r = file
+		}
+
+		report, err := app.ImportObservations(db, r, options)
+		if err != nil {
+			return err
+		}
+		if err = encoder.Encode(report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/emicklei/go-restful"
+	"github.com/emicklei/go-restful-openapi"
+)
+
+// LogLevel is the level of logs of the service
+type LogLevel struct {
+	Level string `json:"level" description:"debug, info, warning or error"`
+}
+
+// AdminEndpoint changes settings of the running service and reports its budgets
+type AdminEndpoint struct {
+	auth  *Authenticator
+	quota *Quota
+}
+
+// NewAdminEndpoint returns AdminEndpoint instance, the quota is the quota of open weather map
+func NewAdminEndpoint(auth *Authenticator, quota *Quota) *AdminEndpoint {
+	return &AdminEndpoint{
+		auth:  auth,
+		quota: quota,
+	}
+}
+
+// Endpoint is a webservice for administration of the service, all routes require a token
+func (a *AdminEndpoint) Endpoint() *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path("/admin").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	tags := []string{"admin"}
+
+	ws.Route(ws.GET("/log-level").To(a.getLogLevel).
+		Filter(a.auth.Filter).
+		Doc("get the level of logs").
+		Param(ws.HeaderParameter("Authorization", "Bearer <token>").DataType("string").Required(true)).
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(LogLevel{}).
+		Returns(http.StatusOK, "OK", LogLevel{}).
+		Returns(http.StatusUnauthorized, unauthorized, nil))
+
+	ws.Route(ws.PUT("/log-level").To(a.setLogLevel).
+		Filter(a.auth.Filter).
+		Doc("change the level of logs until the service is restarted").
+		Param(ws.HeaderParameter("Authorization", "Bearer <token>").DataType("string").Required(true)).
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Reads(LogLevel{}).
+		Writes(LogLevel{}).
+		Returns(http.StatusOK, "OK", LogLevel{}).
+		Returns(http.StatusBadRequest, "invalid level", nil).
+		Returns(http.StatusUnauthorized, unauthorized, nil))
+
+	ws.Route(ws.GET("/quota").To(a.getQuota).
+		Filter(a.auth.Filter).
+		Doc("get budgets and usage of open weather map API").
+		Param(ws.HeaderParameter("Authorization", "Bearer <token>").DataType("string").Required(true)).
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(QuotaReport{}).
+		Returns(http.StatusOK, "OK", QuotaReport{}).
+		Returns(http.StatusUnauthorized, unauthorized, nil))
+
+	return ws
+}
+
+func (a *AdminEndpoint) getLogLevel(request *restful.Request, response *restful.Response) {
+	response.WriteEntity(LogLevel{Level: logger.Level()})
+}
+
+func (a *AdminEndpoint) setLogLevel(request *restful.Request, response *restful.Response) {
+	var level LogLevel
+	if err := request.ReadEntity(&level); err != nil {
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	previous := logger.Level()
+	if err := logger.SetLevel(level.Level); err != nil {
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+	requestLogger(request).Warning("Level of logs has been changed", "previous", previous, "level", logger.Level())
+	response.WriteEntity(LogLevel{Level: logger.Level()})
+}
+
+func (a *AdminEndpoint) getQuota(request *restful.Request, response *restful.Response) {
+	response.WriteEntity(a.quota.report())
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLevelEndpoint(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		body         string
+		token        string
+		expectedCode int
+		expectedBody string
+		level        string
+	}{
+		{
+			name:         "Get level",
+			method:       "GET",
+			token:        "secret",
+			expectedCode: http.StatusOK,
+			expectedBody: "{\n \"level\": \"info\"\n}",
+			level:        "info",
+		},
+		{
+			name:         "Change level",
+			method:       "PUT",
+			body:         `{"level": "debug"}`,
+			token:        "secret",
+			expectedCode: http.StatusOK,
+			expectedBody: "{\n \"level\": \"debug\"\n}",
+			level:        "debug",
+		},
+		{
+			name:         "Invalid level",
+			method:       "PUT",
+			body:         `{"level": "trace"}`,
+			token:        "secret",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "level must be one of: debug, info, warning, error, got (trace)",
+			level:        "info",
+		},
+		{
+			name:         "Missing token",
+			method:       "PUT",
+			body:         `{"level": "debug"}`,
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: unauthorized,
+			level:        "info",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			_, restore := captureLogs()
+			defer restore()
+			logger.SetLevel("info")
+
+			container := restful.NewContainer()
+			container.Add(NewAdminEndpoint(NewAuthenticator("secret"), nil).Endpoint())
+			req := httptest.NewRequest(test.method, "/admin/log-level", strings.NewReader(test.body))
+			req.Header.Set("Content-Type", restful.MIME_JSON)
+			if len(test.token) > 0 {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			recorder := httptest.NewRecorder()
+
+			// Act
+			container.ServeHTTP(recorder, req)
+
+			// Assert
+			assert.Equal(t, test.expectedCode, recorder.Code)
+			assert.Equal(t, test.expectedBody, recorder.Body.String())
+			assert.Equal(t, test.level, logger.Level())
+		})
+	}
+}
+
+func TestQuotaEndpoint(t *testing.T) {
+	// Arrange
+	quota := NewQuota(QuotaOptions{PerMinute: 60, PerDay: 1000, Reserve: 0.2}, nil)
+	quota.now = func() time.Time { return time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC) }
+	quota.acquire(context.Background(), priorityUser)
+
+	container := restful.NewContainer()
+	container.Add(NewAdminEndpoint(NewAuthenticator("secret"), quota).Endpoint())
+	req := httptest.NewRequest("GET", "/admin/quota", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+
+	// Act
+	container.ServeHTTP(recorder, req)
+
+	// Assert
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var report QuotaReport
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	remaining := 999
+	assert.Equal(t, QuotaReport{PerMinute: 60, PerDay: 1000, Reserve: 0.2, Available: 59, Day: "2026-10-18",
+		UsedToday: 1, RemainingToday: &remaining}, report)
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/emicklei/go-restful"
+)
+
+const unauthorized = "valid bearer token is required"
+
+// Authenticator protects routes with bearer tokens
+type Authenticator struct {
+	tokens [][]byte
+}
+
+// NewAuthenticator returns Authenticator which accepts the tokens, empty tokens are ignored.
+// Without any token all protected routes are rejected.
+func NewAuthenticator(tokens ...string) *Authenticator {
+	a := &Authenticator{}
+	for _, t := range tokens {
+		if t = strings.TrimSpace(t); len(t) > 0 {
+			a.tokens = append(a.tokens, []byte(t))
+		}
+	}
+	return a
+}
+
+// valid compares the token with all known tokens in constant time
+func (a *Authenticator) valid(token string) bool {
+	valid := 0
+	if a != nil {
+		for _, t := range a.tokens {
+			valid |= subtle.ConstantTimeCompare(t, []byte(token))
+		}
+	}
+	return valid == 1
+}
+
+// Filter is go-restful filter which rejects requests without valid 'Authorization: Bearer <token>' header
+func (a *Authenticator) Filter(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	header := request.HeaderParameter("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") || !a.valid(strings.TrimPrefix(header, "Bearer ")) {
+		response.AddHeader("WWW-Authenticate", "Bearer")
+		response.WriteErrorString(http.StatusUnauthorized, unauthorized)
+		return
+	}
+	chain.ProcessFilter(request, response)
+}
+
+// TokenFilter is go-restful filter like Filter which also accepts 'Authorization: Token <token>' header of Influx clients
+func (a *Authenticator) TokenFilter(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	header := request.HeaderParameter("Authorization")
+	if strings.HasPrefix(header, "Token ") {
+		request.Request.Header.Set("Authorization", "Bearer "+strings.TrimPrefix(header, "Token "))
+	}
+	a.Filter(request, response, chain)
+}
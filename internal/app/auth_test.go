@@ -0,0 +1,98 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticatorFilter(t *testing.T) {
+	tests := []struct {
+		name          string
+		tokens        []string
+		authorization string
+		HTTPStatus    int
+	}{
+		{
+			name:       "Missing header",
+			tokens:     []string{"secret"},
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "Invalid token",
+			tokens:        []string{"secret"},
+			authorization: "Bearer invalid",
+			HTTPStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "Not a bearer token",
+			tokens:        []string{"secret"},
+			authorization: "Basic secret",
+			HTTPStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "No tokens configured",
+			tokens:        []string{""},
+			authorization: "Bearer ",
+			HTTPStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "Valid token",
+			tokens:        []string{"first", " secret "},
+			authorization: "Bearer secret",
+			HTTPStatus:    http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			a := NewAuthenticator(test.tokens...)
+			httpRequest, _ := http.NewRequest("POST", "/", nil)
+			if len(test.authorization) > 0 {
+				httpRequest.Header.Set("Authorization", test.authorization)
+			}
+			request := restful.NewRequest(httpRequest)
+			httpWriter := httptest.NewRecorder()
+			response := restful.NewResponse(httpWriter)
+			chain := &restful.FilterChain{Target: func(request *restful.Request, response *restful.Response) {
+				response.WriteHeader(http.StatusOK)
+			}}
+
+			// Act
+			a.Filter(request, response, chain)
+
+			// Assert
+			assert.Equal(t, test.HTTPStatus, response.StatusCode())
+		})
+	}
+}
+
+func TestAuthenticatorTokenFilter(t *testing.T) {
+	for authorization, status := range map[string]int{
+		"Token secret":  http.StatusOK,
+		"Bearer secret": http.StatusOK,
+		"Token invalid": http.StatusUnauthorized,
+	} {
+		t.Run(authorization, func(t *testing.T) {
+			// Arrange
+			a := NewAuthenticator("secret")
+			httpRequest, _ := http.NewRequest("POST", "/", nil)
+			httpRequest.Header.Set("Authorization", authorization)
+			request := restful.NewRequest(httpRequest)
+			response := restful.NewResponse(httptest.NewRecorder())
+			chain := &restful.FilterChain{Target: func(request *restful.Request, response *restful.Response) {
+				response.WriteHeader(http.StatusOK)
+			}}
+
+			// Act
+			a.TokenFilter(request, response, chain)
+
+			// Assert
+			assert.Equal(t, status, response.StatusCode())
+		})
+	}
+}
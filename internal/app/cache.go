@@ -0,0 +1,236 @@
+package app
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// minWeatherCacheTTL keeps weather which is older than the update cadence of open weather map for a while,
+// so clients asking for it are not sent to open weather map until it is updated
+const minWeatherCacheTTL = time.Minute
+
+// weatherCache stores responses of open weather map by keys of their queries
+type weatherCache interface {
+	get(key string) ([]byte, bool, error)
+	set(key string, value []byte, ttl time.Duration) error
+}
+
+// CacheOptions configures the cache of open weather map responses, Redis replaces in-memory cache when it is configured
+type CacheOptions struct {
+	Size  int           `yaml:"size"` // entries of in-memory LRU cache, 0 disables it
+	TTL   time.Duration `yaml:"ttl"`  // update cadence of open weather map, weather is not cached beyond it
+	Redis RedisOptions  `yaml:"redis"`
+}
+
+// RedisOptions configures Redis which is shared by instances of the service, it is not used without the address
+type RedisOptions struct {
+	Address  string        `yaml:"address"` // e.g. redis:6379
+	Password string        `yaml:"password"`
+	DB       int           `yaml:"db"`
+	Timeout  time.Duration `yaml:"timeout"` // of commands, weather is requested from open weather map when Redis is slow
+}
+
+func (o CacheOptions) validate(p *configProblems) {
+	if o.Size < 0 {
+		p.add("open_weather_map.cache.size", "must not be negative, got (%d)", o.Size)
+	}
+	if o.Size > 0 || len(o.Redis.Address) > 0 {
+		p.positive("open_weather_map.cache.ttl", o.TTL)
+	}
+	if len(o.Redis.Address) > 0 {
+		if o.Redis.DB < 0 {
+			p.add("open_weather_map.cache.redis.db", "must not be negative, got (%d)", o.Redis.DB)
+		}
+		p.positive("open_weather_map.cache.redis.timeout", o.Redis.Timeout)
+	}
+}
+
+// newWeatherCache returns the cache of the options, nil means that responses are not cached
+func newWeatherCache(o CacheOptions) weatherCache {
+	switch {
+	case o.TTL <= 0:
+		return nil
+	case len(o.Redis.Address) > 0:
+		return newRedisCache(o.Redis)
+	case o.Size > 0:
+		return newLRUCache(o.Size)
+	}
+	return nil
+}
+
+// weatherCacheKey returns the key of the query, e.g. 'weather?id=2643743', the token is not a part of it
+func weatherCacheKey(endpoint string, params map[string]string) string {
+	return endpoint + "?" + encodeParams(params)
+}
+
+// weatherTTL returns how long the weather is cached. Open weather map updates weather once per TTL,
+// so the weather is kept until the next update after its calculation.
+func weatherTTL(w *OpenMapWeather, ttl time.Duration, now time.Time) time.Duration {
+	if w.Dt == 0 {
+		return ttl
+	}
+	min := minWeatherCacheTTL
+	if min > ttl {
+		min = ttl
+	}
+	remaining := time.Unix(w.Dt, 0).Add(ttl).Sub(now)
+	switch {
+	case remaining < min:
+		return min
+	case remaining > ttl:
+		return ttl
+	}
+	return remaining
+}
+
+// lruCache is in-memory cache which drops the least recently used entries when it is full
+type lruCache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // the most recently used entries are at the front
+	now     func() time.Time
+}
+
+type lruEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+func (c *lruCache) get(key string) ([]byte, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := element.Value.(*lruEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false, nil
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true, nil
+}
+
+func (c *lruCache) set(key string, value []byte, ttl time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := &lruEntry{key: key, value: value, expiresAt: c.now().Add(ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+	return nil
+}
+
+// weatherResult is the result of the request of weather to open weather map
+type weatherResult struct {
+	weather *OpenMapWeather
+	status  int
+	err     error
+}
+
+// weatherFlights coalesces concurrent identical requests, only the first one is sent to open weather map
+// and all of them wait for its result until their own context is done
+type weatherFlights struct {
+	mutex sync.Mutex
+	calls map[string]*weatherFlight
+}
+
+type weatherFlight struct {
+	done   chan struct{}
+	result weatherResult
+}
+
+func newWeatherFlights() *weatherFlights {
+	return &weatherFlights{calls: make(map[string]*weatherFlight)}
+}
+
+// do returns the result of fetch for the key, true means that the result has been shared by another request.
+// The shared fetch runs with the context detached from the request which has started it, so the others are not
+// canceled with it, the timeout bounds the fetch unless it is zero.
+func (g *weatherFlights) do(ctx context.Context, key string, timeout time.Duration,
+	fetch func(ctx context.Context) weatherResult) (weatherResult, bool) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if g == nil {
+		return fetch(ctx), false
+	}
+	g.mutex.Lock()
+	call, shared := g.calls[key]
+	if !shared {
+		call = &weatherFlight{done: make(chan struct{})}
+		g.calls[key] = call
+		go g.fetch(detachedContext{ctx}, key, timeout, call, fetch)
+	}
+	g.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.result, shared
+	case <-ctx.Done():
+		status := http.StatusBadGateway
+		if ctx.Err() == context.DeadlineExceeded {
+			status = http.StatusGatewayTimeout
+		}
+		return weatherResult{status: status, err: ctx.Err()}, shared
+	}
+}
+
+func (g *weatherFlights) fetch(ctx context.Context, key string, timeout time.Duration, call *weatherFlight,
+	fetch func(ctx context.Context) weatherResult) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	defer func() {
+		g.mutex.Lock()
+		delete(g.calls, key)
+		g.mutex.Unlock()
+		close(call.done)
+	}()
+	call.result = fetch(ctx)
+}
+
+// detachedContext keeps values of the context, e.g. its logger and span, but it is never canceled with it
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
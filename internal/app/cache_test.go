@@ -0,0 +1,317 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUCache(t *testing.T) {
+	// Arrange
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	c := newLRUCache(2)
+	c.now = func() time.Time { return now }
+
+	// Act
+	c.set("a", []byte("1"), time.Minute)
+	c.set("b", []byte("2"), time.Minute)
+	c.get("a")
+	c.set("c", []byte("3"), 2*time.Minute)
+	_, evicted, _ := c.get("b")
+	a, cachedA, _ := c.get("a")
+	now = now.Add(time.Minute)
+	_, expired, _ := c.get("a")
+	value, cachedC, err := c.get("c")
+
+	// Assert
+	assert.Nil(t, err)
+	assert.False(t, evicted)
+	assert.True(t, cachedA)
+	assert.Equal(t, []byte("1"), a)
+	assert.False(t, expired)
+	assert.True(t, cachedC)
+	assert.Equal(t, []byte("3"), value)
+	assert.Equal(t, 1, c.order.Len())
+}
+
+func TestWeatherCacheKey(t *testing.T) {
+	assert.Equal(t, "weather?id=2643743&units=metric", weatherCacheKey("weather", map[string]string{"units": "metric", "id": "2643743"}))
+	assert.Equal(t, "weather?", weatherCacheKey("weather", nil))
+}
+
+func TestWeatherTTL(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		dt       time.Time
+		ttl      time.Duration
+		expected time.Duration
+	}{
+		{name: "Unknown calculation", ttl: 10 * time.Minute, expected: 10 * time.Minute},
+		{name: "Until the next update", dt: now.Add(-4 * time.Minute), ttl: 10 * time.Minute, expected: 6 * time.Minute},
+		{name: "Update is late", dt: now.Add(-time.Hour), ttl: 10 * time.Minute, expected: minWeatherCacheTTL},
+		{name: "Short TTL", dt: now.Add(-time.Hour), ttl: 30 * time.Second, expected: 30 * time.Second},
+		{name: "Calculated in the future", dt: now.Add(time.Minute), ttl: 10 * time.Minute, expected: 10 * time.Minute},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			w := &OpenMapWeather{}
+			if !test.dt.IsZero() {
+				w.Dt = test.dt.Unix()
+			}
+
+			// Act
+			ttl := weatherTTL(w, test.ttl, now)
+
+			// Assert
+			assert.Equal(t, test.expected, ttl)
+		})
+	}
+}
+
+func TestWeatherFlights(t *testing.T) {
+	// Arrange
+	g := newWeatherFlights()
+	release := make(chan struct{})
+	var calls, shared int32
+	var wg sync.WaitGroup
+
+	// Act
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, ok := g.do(context.Background(), "weather?id=1", 0, func(context.Context) weatherResult {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return weatherResult{status: http.StatusOK}
+			})
+			assert.Equal(t, http.StatusOK, result.status)
+			if ok {
+				atomic.AddInt32(&shared, 1)
+			}
+		}()
+	}
+	// the first request waits until the others join it
+	for {
+		g.mutex.Lock()
+		call := g.calls["weather?id=1"]
+		g.mutex.Unlock()
+		if call != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// Assert
+	assert.Equal(t, int32(1), calls)
+	assert.Equal(t, int32(4), shared)
+	assert.Empty(t, g.calls)
+}
+
+func TestWeatherFlightsContext(t *testing.T) {
+	t.Run("Canceled request does not cancel the others", func(t *testing.T) {
+		// Arrange
+		g := newWeatherFlights()
+		release := make(chan struct{})
+		first, cancel := context.WithCancel(context.Background())
+		canceled := make(chan weatherResult, 1)
+		go func() {
+			result, _ := g.do(first, "weather?id=1", time.Minute, func(ctx context.Context) weatherResult {
+				select {
+				case <-release:
+					return weatherResult{status: http.StatusOK}
+				case <-ctx.Done():
+					return weatherResult{status: http.StatusBadGateway, err: ctx.Err()}
+				}
+			})
+			canceled <- result
+		}()
+		require.True(t, waitFor(func() bool {
+			g.mutex.Lock()
+			defer g.mutex.Unlock()
+			return g.calls["weather?id=1"] != nil
+		}))
+		shared := make(chan weatherResult, 1)
+		go func() {
+			result, _ := g.do(context.Background(), "weather?id=1", time.Minute, func(context.Context) weatherResult {
+				t.Error("request has not been shared")
+				return weatherResult{}
+			})
+			shared <- result
+		}()
+		// the second request joins the first one
+		time.Sleep(20 * time.Millisecond)
+
+		// Act
+		cancel()
+		result := <-canceled
+		close(release)
+
+		// Assert
+		assert.Equal(t, context.Canceled, result.err)
+		select {
+		case result = <-shared:
+			assert.Nil(t, result.err)
+			assert.Equal(t, http.StatusOK, result.status)
+		case <-time.After(5 * time.Second):
+			t.Fatal("shared request has not finished")
+		}
+	})
+
+	t.Run("Waiting request is done with its context", func(t *testing.T) {
+		// Arrange
+		g := newWeatherFlights()
+		release := make(chan struct{})
+		defer close(release)
+		go g.do(context.Background(), "weather?id=1", time.Minute, func(context.Context) weatherResult {
+			<-release
+			return weatherResult{status: http.StatusOK}
+		})
+		require.True(t, waitFor(func() bool {
+			g.mutex.Lock()
+			defer g.mutex.Unlock()
+			return g.calls["weather?id=1"] != nil
+		}))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		// Act
+		result, shared := g.do(ctx, "weather?id=1", time.Minute, nil)
+
+		// Assert
+		assert.True(t, shared)
+		assert.Equal(t, context.DeadlineExceeded, result.err)
+		assert.Equal(t, http.StatusGatewayTimeout, result.status)
+	})
+
+	t.Run("Shared request is limited by the timeout", func(t *testing.T) {
+		// Arrange
+		g := newWeatherFlights()
+
+		// Act
+		result, _ := g.do(context.Background(), "weather?id=1", 10*time.Millisecond, func(ctx context.Context) weatherResult {
+			<-ctx.Done()
+			return weatherResult{status: http.StatusGatewayTimeout, err: ctx.Err()}
+		})
+
+		// Assert
+		assert.Equal(t, context.DeadlineExceeded, result.err)
+	})
+}
+
+func TestSharedWeatherIsCopied(t *testing.T) {
+	// Arrange
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+		rw.Write([]byte(`{"id": 2643743, "name": "London", "weather": [{"id": 500}], "main": {"temp": 284.15, "humidity": 81}}`))
+	}))
+	defer server.Close()
+	o, err := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, Token: "secret"})
+	require.Nil(t, err)
+	results := make(chan *OpenMapWeather, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w, _, _ := o.getWeather(map[string]string{"id": "2643743"})
+			results <- w
+		}()
+	}
+	require.True(t, waitFor(func() bool {
+		o.flights.mutex.Lock()
+		defer o.flights.mutex.Unlock()
+		return len(o.flights.calls) == 1
+	}))
+	time.Sleep(20 * time.Millisecond)
+
+	// Act
+	close(release)
+	first, second := <-results, <-results
+
+	// Assert
+	require.NotNil(t, first)
+	require.NotNil(t, second)
+	assert.Equal(t, first, second)
+	first.Description[0].ID = 501
+	*first.Main.Humidity = 50
+	assert.Equal(t, 500, second.Description[0].ID)
+	assert.Equal(t, float32(81), *second.Main.Humidity)
+}
+
+func TestCachedWeather(t *testing.T) {
+	tests := []struct {
+		name             string
+		cache            CacheOptions
+		status           int
+		expectedStatus   int
+		expectedRequests int32
+	}{
+		{
+			name:             "Cached",
+			cache:            CacheOptions{Size: 10, TTL: 10 * time.Minute},
+			status:           http.StatusOK,
+			expectedStatus:   http.StatusOK,
+			expectedRequests: 1,
+		},
+		{
+			name:             "Cache is disabled",
+			status:           http.StatusOK,
+			expectedStatus:   http.StatusOK,
+			expectedRequests: 3,
+		},
+		{
+			name:             "Errors are not cached",
+			cache:            CacheOptions{Size: 10, TTL: 10 * time.Minute},
+			status:           http.StatusNotFound,
+			expectedStatus:   http.StatusNotFound,
+			expectedRequests: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				rw.WriteHeader(test.status)
+				if test.status == http.StatusOK {
+					rw.Write([]byte(`{"id": 2643743, "name": "London", "dt": ` + formatValue(float64(time.Now().Unix())) + `, "main": {"temp": 284.15}}`))
+					return
+				}
+				rw.Write([]byte(`{"message": "city not found"}`))
+			}))
+			defer server.Close()
+			o, err := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, Token: "secret", Cache: test.cache})
+			require.Nil(t, err)
+
+			// Act
+			var w *OpenMapWeather
+			var status int
+			for i := 0; i < 3; i++ {
+				w, status, _ = o.getWeather(map[string]string{"id": "2643743"})
+			}
+
+			// Assert
+			assert.Equal(t, test.expectedStatus, status)
+			assert.Equal(t, test.expectedRequests, atomic.LoadInt32(&requests))
+			if test.expectedStatus == http.StatusOK {
+				assert.Equal(t, "London", w.Name)
+				assert.Equal(t, float32(284.15), w.Main.Temp)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/emicklei/go-restful"
+	"github.com/emicklei/go-restful-openapi"
+)
+
+// ConditionEndpoint stores connection to database
+type ConditionEndpoint struct {
+	db databaseWeatherProvider
+}
+
+// NewConditionEndpoint returns ConditionEndpoint instance
+func NewConditionEndpoint(db databaseWeatherProvider) *ConditionEndpoint {
+	return &ConditionEndpoint{
+		db: db,
+	}
+}
+
+// Endpoint is a webservice for dictionary of weather conditions
+func (c *ConditionEndpoint) Endpoint() *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path("/conditions").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	tags := []string{"conditions"}
+
+	ws.Route(ws.GET("").To(c.getConditions).
+		Doc("get dictionary of weather conditions").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes([]Description{}).
+		Returns(http.StatusOK, "OK", []Description{}).
+		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil))
+
+	return ws
+}
+
+func (c *ConditionEndpoint) getConditions(request *restful.Request, response *restful.Response) {
+	db := c.db.withContext(requestContext(request))
+
+	list, err := db.getDescriptions()
+	if err != nil {
+		requestLogger(request).Error("Get conditions", "error", err)
+		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
+		return
+	}
+
+	if list == nil {
+		response.WriteEntity(make([]Description, 0))
+		return
+	}
+	response.WriteEntity(list)
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetConditions(t *testing.T) {
+	// Arrange
+	tests := []struct {
+		name          string
+		expectedError error
+		db            fakeDatabase
+		HTTPStatus    int
+	}{
+		{
+			name: "Database error",
+			db: fakeDatabase{
+				err: errors.New("database error"),
+			},
+			expectedError: errors.New(serviceIsUnavailable),
+			HTTPStatus:    http.StatusServiceUnavailable,
+		},
+		{
+			name:       "The empty dictionary",
+			HTTPStatus: http.StatusOK,
+		},
+		{
+			name:       "The dictionary with two conditions",
+			HTTPStatus: http.StatusOK,
+			db: fakeDatabase{
+				descriptions: []Description{
+					{
+						ID:          500,
+						Main:        "Rain",
+						Description: "light rain",
+						Icon:        "10d",
+					},
+					{
+						ID:          800,
+						Main:        "Clear",
+						Description: "clear sky",
+						Icon:        "01d",
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			c := NewConditionEndpoint(test.db)
+			request := restful.NewRequest(nil)
+			httpWriter := httptest.NewRecorder()
+			response := restful.NewResponse(httpWriter)
+			response.SetRequestAccepts(restful.MIME_JSON)
+
+			// Act
+			c.getConditions(request, response)
+
+			// Assert
+			assert.Equal(t, test.HTTPStatus, response.StatusCode())
+			if test.expectedError != nil {
+				assert.EqualError(t, response.Error(), test.expectedError.Error())
+				return
+			}
+			assert.Nil(t, response.Error())
+			if test.db.descriptions == nil {
+				test.db.descriptions = make([]Description, 0) //because it should return empty list
+			}
+			var result []Description
+			err := json.Unmarshal(httpWriter.Body.Bytes(), &result)
+			assert.Nil(t, err)
+			assert.Equal(t, test.db.descriptions, result)
+		})
+	}
+}
+
+func TestConditionEndpoint(t *testing.T) {
+	t.Run("Check condition endpoint settings", func(t *testing.T) {
+		// Arrange
+		c := NewConditionEndpoint(nil)
+
+		// Act
+		ws := c.Endpoint()
+
+		// Assert
+		require.NotNil(t, ws)
+		assert.Equal(t, "/conditions", ws.RootPath())
+		assert.Len(t, ws.Routes(), 1)
+	})
+}
@@ -0,0 +1,35 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/emicklei/go-restful"
+	"github.com/emicklei/go-restful-openapi"
+)
+
+// Register adds web services with filters of requests and the OpenAPI specification of them to the container.
+// Root paths are checked first, restful.Container exits the process on a duplicate root path.
+func Register(container *restful.Container, services ...*restful.WebService) error {
+	spec := restfulspec.Config{WebServices: services}
+	all := append(append([]*restful.WebService{}, services...), restfulspec.NewOpenAPIService(spec))
+
+	roots := map[string]bool{}
+	for _, ws := range all {
+		root := ws.RootPath()
+		if len(root) == 0 {
+			root = "/"
+		}
+		if roots[root] {
+			return fmt.Errorf("web services have duplicate root path %s", root)
+		}
+		roots[root] = true
+	}
+
+	for _, ws := range all {
+		container.Add(ws)
+	}
+	container.Filter(RequestID)
+	container.Filter(Tracing(container))
+	container.Filter(RequestMetrics(container))
+	return nil
+}
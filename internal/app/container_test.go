@@ -0,0 +1,58 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegister(t *testing.T) {
+	// Arrange
+	db := fakeDatabase{version: "11.2"}
+	o, err := NewOpenWeatherAPI(http.DefaultClient, OpenWeatherMapOptions{URL: "http://localhost", Token: "token"})
+	require.Nil(t, err)
+	auth := NewAuthenticator()
+	services := []*restful.WebService{
+		NewLocationEndpoint(db, o).Endpoint(),
+		NewGeocodeEndpoint(o).Endpoint(),
+		NewWeatherEndpoint(db, o, auth).Endpoint(),
+		NewConditionEndpoint(db).Endpoint(),
+		NewIconEndpoint(db, o, "").Endpoint(),
+		NewStationEndpoint(db, nil, 0, "", auth).Endpoint(),
+		NewPersonalStationEndpoint(db, "").Endpoint(),
+		NewInfluxEndpoint(db, auth).Endpoint(),
+		NewMetricsEndpoint(db).Endpoint(),
+		NewAdminEndpoint(auth, nil).Endpoint(),
+	}
+	services = append(services, NewHealthEndpoint(db, o).Endpoints()...)
+	container := restful.NewContainer()
+
+	// Act
+	err = Register(container, services...)
+
+	// Assert
+	require.Nil(t, err)
+	for _, uri := range []string{"/", "/healthz"} {
+		httpWriter := httptest.NewRecorder()
+		container.ServeHTTP(httpWriter, httptest.NewRequest("GET", uri, nil))
+		assert.Equal(t, http.StatusOK, httpWriter.Code, uri)
+	}
+}
+
+func TestRegisterDuplicateRootPath(t *testing.T) {
+	// Arrange
+	ws := new(restful.WebService)
+	ws.Route(ws.GET("/").To(func(request *restful.Request, response *restful.Response) {}))
+	container := restful.NewContainer()
+
+	// Act
+	err := Register(container, ws)
+
+	// Assert
+	assert.EqualError(t, err, "web services have duplicate root path /")
+	assert.Empty(t, container.RegisteredWebServices())
+}
@@ -1,9 +1,12 @@
 package app
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
-	"os"
+	"errors"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/go-pg/pg"
 )
@@ -14,40 +17,123 @@ type databaseWeatherProvider interface {
 	saveLocation(Location) error
 	deleteLocation(int) error
 	saveWeather(Weather) error
+	saveWeathers([]Weather) (int, error)
 	getStatistics(id int) (Statistics, error)
+	getDescriptions() ([]Description, error)
+	getDescription(int) (Description, error)
+	getObservations(ObservationFilter, func(Observation) error) error
+	existingWeather([]Weather) ([]Weather, error)
+	getPersonalStation(string) (PersonalStation, error)
+	getPersonalStations() ([]PersonalStation, error)
+	savePersonalStation(PersonalStation) error
+	deletePersonalStation(string) error
+	getSummary() (Summary, error)
+	getLatestWeather() ([]LatestWeather, error)
+	ping() (string, error)
+	missingColumns() ([]string, error)
+	withContext(context.Context) databaseWeatherProvider
 }
 
-// Database is config struct for postgres connection
+// errDuplicateObservation is returned when weather for the location and the time of measurement already exists
+var errDuplicateObservation = errors.New("observation already exists")
+
+// Database is a pool of postgres connections
 type Database struct {
-	config *pg.Options
+	config       *pg.Options
+	pool         *pg.DB
+	partitioning *partitioning   // nil when tables are not partitioned
+	saveHooks    []func(Weather) // called after weather has been saved
 }
 
-// NewDB creates new config for database connection
-func NewDB() (db *Database, err error) {
-	user := os.Getenv("DB_USER")
-	database := os.Getenv("DB_DATABASE")
-	password := os.Getenv("DB_PASSWORD")
-	address := os.Getenv("DB_ADDRESS")
+// DatabaseOptions configures connections to postgres and partitioning of tables
+type DatabaseOptions struct {
+	User            string `yaml:"user"`
+	Password        string `yaml:"password"`
+	Database        string `yaml:"database"`
+	Address         string `yaml:"address"`          // e.g. 'localhost:5432'
+	Partitioning    bool   `yaml:"partitioning"`     // tables are partitioned by month
+	PartitionsAhead int    `yaml:"partitions_ahead"` // next months with partitions created in advance
+	RetentionMonths int    `yaml:"retention_months"` // months kept attached, 0 means forever
 
-	if len(user) == 0 || len(database) == 0 || len(address) == 0 {
-		err = fmt.Errorf("database configuration is not provided, user=(%s), address=(%s), databases=(%s)",
-			user, address, database)
-		return
+	MaintenanceInterval time.Duration `yaml:"maintenance_interval"` // of creating and detaching partitions
+}
+
+func (o DatabaseOptions) validate(p *configProblems) {
+	required := []struct{ key, value string }{
+		{"database.user", o.User},
+		{"database.database", o.Database},
+		{"database.address", o.Address},
+	}
+	for _, r := range required {
+		if len(r.value) == 0 {
+			p.add(r.key, "is required")
+		}
+	}
+	if o.PartitionsAhead < 0 {
+		p.add("database.partitions_ahead", "must be a non-negative integer, got (%d)", o.PartitionsAhead)
 	}
+	if o.RetentionMonths < 0 {
+		p.add("database.retention_months", "must be a non-negative integer, got (%d)", o.RetentionMonths)
+	}
+	if o.Partitioning {
+		p.positive("database.maintenance_interval", o.MaintenanceInterval)
+	}
+}
 
-	return &Database{
-		&pg.Options{
-			User:     user,
-			Database: database,
-			Password: password,
-			Addr:     address,
+// NewDB creates the pool of connections to the database
+func NewDB(o DatabaseOptions) (*Database, error) {
+	var p configProblems
+	o.validate(&p)
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	db := &Database{
+		config: &pg.Options{
+			User:     o.User,
+			Database: o.Database,
+			Password: o.Password,
+			Addr:     o.Address,
 		},
-	}, err
+	}
+	if o.Partitioning {
+		db.partitioning = &partitioning{ahead: o.PartitionsAhead, retention: o.RetentionMonths}
+	}
+
+	db.pool = pg.Connect(db.config)
+	db.pool.AddQueryHook(queryMetrics{})
+	return db, nil
+}
+
+// connect returns the pool of connections, they are opened when queries need them
+func (d *Database) connect() *pg.DB {
+	return d.pool
+}
+
+// withContext returns the database which sends queries with the context, so they are logged with its request
+func (d *Database) withContext(ctx context.Context) databaseWeatherProvider {
+	c := *d
+	c.pool = d.pool.WithContext(ctx)
+	return &c
+}
+
+// Close closes all connections, it must be called after all queries are finished
+func (d *Database) Close() error {
+	return d.pool.Close()
+}
+
+// AddSaveHook registers the function called with every newly saved weather, it must not block
+func (d *Database) AddSaveHook(hook func(Weather)) {
+	d.saveHooks = append(d.saveHooks, hook)
+}
+
+// Partitioned returns true when tables 'weather' and 'conditions' are partitioned by month
+func (d *Database) Partitioned() bool {
+	return d.partitioning != nil
 }
 
 func (d *Database) getLocation(id int) (location Location, err error) {
-	db := pg.Connect(d.config)
-	defer db.Close()
+	db := d.connect()
 
 	err = db.Model(&location).Where("location_id = ?", id).Select()
 	if err == pg.ErrNoRows {
@@ -57,61 +143,208 @@ func (d *Database) getLocation(id int) (location Location, err error) {
 }
 
 func (d *Database) getLocations() (locations []Location, err error) {
-	db := pg.Connect(d.config)
-	defer db.Close()
+	db := d.connect()
 
 	err = db.Model(&locations).Order("country_code ASC", "city_name ASC").Select()
 	return
 }
 
 func (d *Database) saveLocation(location Location) error {
-	db := pg.Connect(d.config)
-	defer db.Close()
+	db := d.connect()
 
 	err := db.Insert(&location)
 	return err
 }
 
 func (d *Database) deleteLocation(id int) error {
-	db := pg.Connect(d.config)
-	defer db.Close()
+	db := d.connect()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// partitioned conditions can not reference weather, so they are not removed by cascade
+	_, err = tx.Exec("DELETE FROM conditions WHERE statistic_id IN (SELECT id FROM weather WHERE location_id = ?)", id)
+	if err != nil {
+		return err
+	}
 
 	location := Location{LocationID: id}
-	v, err := db.Model(&location).Where("location_id = ?", id).Delete()
-	if err == nil && v.RowsAffected() == 0 {
+	v, err := tx.Model(&location).Where("location_id = ?", id).Delete()
+	if err != nil {
+		return err
+	}
+	if v.RowsAffected() == 0 {
 		return sql.ErrNoRows
 	}
-	return err
+	return tx.Commit()
 }
 
 func (d *Database) saveWeather(s Weather) error {
-	db := pg.Connect(d.config)
-	defer db.Close()
+	db := d.connect()
+
+	prepareWeather(&s)
+	err := insertWeather(db, &s)
+	if err != nil && d.partitioning != nil && isMissingPartition(err) {
+		if err = createPartitions(db, s.Date); err != nil {
+			return err
+		}
+		err = insertWeather(db, &s)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range d.saveHooks {
+		hook(s)
+	}
+	return nil
+}
 
+// prepareWeather sets the time of measurement in precision of postgres and the date of partitions,
+// weather and its conditions must land in partitions of the same month
+func prepareWeather(s *Weather) {
+	if s.MeasuredAt.IsZero() {
+		s.MeasuredAt = time.Now()
+	}
+	s.MeasuredAt = s.MeasuredAt.UTC().Truncate(time.Microsecond)
+	s.Date = s.MeasuredAt
+	for k := range s.Conditions {
+		s.Conditions[k].Date = s.Date
+	}
+}
+
+// saveWeathers inserts the batch of observations in one transaction, observations which already exist are skipped,
+// it returns the number of inserted observations
+func (d *Database) saveWeathers(batch []Weather) (int, error) {
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	db := d.connect()
+
+	batch = append([]Weather(nil), batch...)
+	for k := range batch {
+		prepareWeather(&batch[k])
+	}
+
+	inserted, err := insertWeathers(db, batch, d.observationConstraint())
+	if err != nil && d.partitioning != nil && isMissingPartition(err) {
+		months := make(map[time.Time]bool)
+		for _, s := range batch {
+			if month := monthStart(s.Date); !months[month] {
+				months[month] = true
+				if err = createPartitions(db, month); err != nil {
+					return 0, err
+				}
+			}
+		}
+		inserted, err = insertWeathers(db, batch, d.observationConstraint())
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, s := range inserted {
+		for _, hook := range d.saveHooks {
+			hook(s)
+		}
+	}
+	return len(inserted), nil
+}
+
+// observationConstraint returns columns of the unique constraint of observations,
+// the constraint of partitioned weather has the partition key too
+func (d *Database) observationConstraint() string {
+	if d.partitioning != nil {
+		return "(location_id, measured_at, date)"
+	}
+	return "(location_id, measured_at)"
+}
+
+// insertWeathers inserts observations and their conditions by one statement each, it returns inserted observations
+func insertWeathers(db *pg.DB, batch []Weather, constraint string) ([]Weather, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// only inserted rows are returned, they are matched to the batch by the location and the time of measurement
+	var rows []Weather
+	_, err = tx.Model(&batch).
+		OnConflict(constraint + " DO NOTHING").
+		Returning("id, location_id, measured_at").
+		Insert(&rows)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[observationKey]int, len(rows))
+	for _, r := range rows {
+		ids[weatherKey(r)] = r.ID
+	}
+
+	var inserted []Weather
+	var conditions []Condition
+	for _, s := range batch {
+		id, ok := ids[weatherKey(s)]
+		if !ok {
+			continue
+		}
+		s.ID = id
+		for k := range s.Conditions {
+			s.Conditions[k].StatisticID = id
+			if err = insertDescription(tx, s.Conditions[k]); err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, s.Conditions[k])
+		}
+		inserted = append(inserted, s)
+	}
+	if len(conditions) > 0 {
+		if err = tx.Insert(&conditions); err != nil {
+			return nil, err
+		}
+	}
+	return inserted, tx.Commit()
+}
+
+func insertWeather(db *pg.DB, s *Weather) error {
 	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
 
-	if err = tx.Insert(&s); err == nil {
+	// observations are unique for the location and the time of measurement
+	res, err := tx.Model(s).OnConflict("DO NOTHING").Insert()
+	if err == nil && res.RowsAffected() == 0 {
+		err = errDuplicateObservation
+	}
+
+	if err == nil && len(s.Conditions) > 0 {
 		// Unfortunately there is no possibility to write record with relations
 		for k := range s.Conditions {
 			s.Conditions[k].StatisticID = s.ID
+			if err = insertDescription(tx, s.Conditions[k]); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = tx.Insert(&s.Conditions)
 		}
-		err = tx.Insert(&s.Conditions)
 	}
 
 	if err != nil {
 		tx.Rollback()
-	} else {
-		tx.Commit()
+		return err
 	}
-	return err
+	// hooks of saved observations run after the commit, so its error must not be lost
+	return tx.Commit()
 }
 
 func (d *Database) getStatistics(id int) (Statistics, error) {
-	db := pg.Connect(d.config)
-	defer db.Close()
+	db := d.connect()
 
 	var err error
 	s := Statistics{}
@@ -134,15 +367,13 @@ func (d *Database) getStatistics(id int) (Statistics, error) {
 		return s, err
 	}
 
-	// get type of the weather and occurrence for each day for that type
-	st, err := db.Prepare("SELECT date,type FROM weather AS w LEFT JOIN conditions AS c ON w.id=c.statistic_id " +
-		"GROUP BY date,type ORDER BY date,type")
-	if err != nil {
-		return s, err
-	}
-
+	// get type of the weather and occurrence for each day for that type, days without conditions have an empty type
+	// join on date as well, so only partitions of the same month are matched
 	var lk []DailyConditionStatistics
-	_, err = st.Query(&lk)
+	_, err = db.Query(&lk, "SELECT w.date,d.main AS type FROM weather AS w "+
+		"LEFT JOIN conditions AS c ON w.id=c.statistic_id AND w.date=c.date "+
+		"LEFT JOIN descriptions AS d ON d.id=c.code "+
+		"WHERE w.location_id = ? GROUP BY w.date,d.main ORDER BY w.date,d.main", id)
 	if err != nil {
 		return s, err
 	}
@@ -153,3 +384,257 @@ func (d *Database) getStatistics(id int) (Statistics, error) {
 	}
 	return s, err
 }
+
+// insertDescription adds weather condition to the dictionary unless it is already there,
+// conditions without description (e.g. imported) must already be in the dictionary
+func insertDescription(tx *pg.Tx, c Condition) error {
+	if len(c.Type) == 0 {
+		return nil
+	}
+
+	description := Description{
+		ID:          c.Code,
+		Main:        c.Type,
+		Description: c.Description,
+		Icon:        dayIcon(c.Icon),
+	}
+	_, err := tx.Model(&description).OnConflict("(id) DO NOTHING").Insert()
+	return err
+}
+
+// dayIcon returns day variant of the icon (e.g. '10n' -> '10d'), the dictionary keeps day icons
+func dayIcon(icon string) string {
+	if isNightIcon(icon) {
+		return strings.TrimSuffix(icon, "n") + "d"
+	}
+	return icon
+}
+
+// nightIcon returns night variant of the icon (e.g. '10d' -> '10n'), every icon of open weather map has both
+func nightIcon(icon string) string {
+	if strings.HasSuffix(icon, "d") {
+		return strings.TrimSuffix(icon, "d") + "n"
+	}
+	return icon
+}
+
+func isNightIcon(icon string) bool {
+	return strings.HasSuffix(icon, "n")
+}
+
+// getSummary returns the number of locations and the time of the newest weather sample, it is read on every scrape
+// of metrics, so the newest sample of each location is found by the index of (location_id, measured_at)
+// instead of scanning the whole table
+func (d *Database) getSummary() (s Summary, err error) {
+	db := d.connect()
+
+	if s.Locations, err = db.Model(&Location{}).Count(); err != nil {
+		return
+	}
+	var last pg.NullTime
+	if _, err = db.QueryOne(pg.Scan(&last), "SELECT max(w.measured_at) FROM locations AS l "+
+		"CROSS JOIN LATERAL (SELECT measured_at FROM weather WHERE location_id = l.location_id "+
+		"ORDER BY measured_at DESC LIMIT 1) AS w"); err != nil {
+		return
+	}
+	s.LastMeasuredAt = last.Time
+	return
+}
+
+func (d *Database) getDescriptions() (descriptions []Description, err error) {
+	db := d.connect()
+
+	err = db.Model(&descriptions).Order("id ASC").Select()
+	return
+}
+
+func (d *Database) getDescription(id int) (description Description, err error) {
+	db := d.connect()
+
+	err = db.Model(&description).Where("id = ?", id).Select()
+	if err == pg.ErrNoRows {
+		err = sql.ErrNoRows
+	}
+	return
+}
+
+// schema lists columns of tables which are used by the service, see configs/database.sql
+var schema = map[string][]string{
+	"locations":         {"location_id", "city_name", "country_code", "latitude", "longitude"},
+	"weather":           {"id", "location_id", "temperature", "temp_min", "temp_max", "humidity", "pressure", "wind_speed", "wind_deg", "source", "measured_at", "date"},
+	"descriptions":      {"id", "main", "description", "icon"},
+	"conditions":        {"statistic_id", "code", "date"},
+	"personal_stations": {"station_id", "key_hash", "location_id"},
+	"owm_usage":         {"day", "calls"},
+}
+
+// ping returns version of the database server
+func (d *Database) ping() (version string, err error) {
+	db := d.connect()
+
+	_, err = db.QueryOne(pg.Scan(&version), "SHOW server_version")
+	return
+}
+
+// missingColumns returns 'table.column' of the schema which do not exist, so the database is not migrated
+func (d *Database) missingColumns() ([]string, error) {
+	db := d.connect()
+
+	var columns []struct {
+		TableName  string
+		ColumnName string
+	}
+	_, err := db.Query(&columns, "SELECT table_name, column_name FROM information_schema.columns "+
+		"WHERE table_schema = current_schema()")
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		existing[c.TableName+"."+c.ColumnName] = true
+	}
+	var missing []string
+	for table, names := range schema {
+		for _, name := range names {
+			if !existing[table+"."+name] {
+				missing = append(missing, table+"."+name)
+			}
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// getLatestWeather returns the newest weather sample of every location which has any
+func (d *Database) getLatestWeather() (latest []LatestWeather, err error) {
+	db := d.connect()
+
+	_, err = db.Query(&latest, "SELECT l.location_id, l.city_name, l.country_code, w.measured_at, w.temperature, "+
+		"w.humidity, w.pressure, w.wind_speed, w.wind_deg FROM locations AS l "+
+		"CROSS JOIN LATERAL (SELECT * FROM weather WHERE location_id = l.location_id "+
+		"ORDER BY measured_at DESC LIMIT 1) AS w ORDER BY l.location_id")
+	return
+}
+
+// getObservations calls the function for each observation without loading all of them into the memory
+func (d *Database) getObservations(f ObservationFilter, fn func(Observation) error) error {
+	db := d.connect()
+
+	q := db.Model(&Observation{}).
+		ColumnExpr("w.id, w.location_id, w.measured_at, w.date, w.temperature, w.temp_min, w.temp_max").
+		ColumnExpr("w.humidity, w.pressure, w.wind_speed, w.wind_deg, w.source").
+		ColumnExpr("array_remove(array_agg(c.code ORDER BY c.code), NULL) AS conditions").
+		Join("LEFT JOIN conditions AS c ON w.id=c.statistic_id AND w.date=c.date").
+		Group("w.id", "w.location_id", "w.measured_at", "w.date", "w.temperature", "w.temp_min", "w.temp_max",
+			"w.humidity", "w.pressure", "w.wind_speed", "w.wind_deg", "w.source").
+		Order("w.location_id ASC", "w.measured_at ASC", "w.id ASC")
+
+	if f.LocationID > 0 {
+		q = q.Where("w.location_id = ?", f.LocationID)
+	}
+	if !f.From.IsZero() {
+		q = q.Where("w.date >= ?", f.From.Format(dateLayout))
+	}
+	if !f.To.IsZero() {
+		q = q.Where("w.date <= ?", f.To.Format(dateLayout))
+	}
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit)
+	}
+	if f.Offset > 0 {
+		q = q.Offset(f.Offset)
+	}
+
+	return q.ForEach(func(o *Observation) error {
+		return fn(*o)
+	})
+}
+
+// existingWeather returns the location and the time of measurement of saved observations of the batch,
+// it may return other observations of the same locations and times, so they are matched by the caller
+func (d *Database) existingWeather(batch []Weather) (existing []Weather, err error) {
+	if len(batch) == 0 {
+		return nil, nil
+	}
+	db := d.connect()
+
+	var locations []int
+	var times []time.Time
+	seen := make(map[int]bool)
+	from, to := batch[0].MeasuredAt.UTC(), batch[0].MeasuredAt.UTC()
+	for _, s := range batch {
+		if !seen[s.LocationID] {
+			seen[s.LocationID] = true
+			locations = append(locations, s.LocationID)
+		}
+		t := s.MeasuredAt.UTC()
+		times = append(times, t)
+		if t.Before(from) {
+			from = t
+		}
+		if t.After(to) {
+			to = t
+		}
+	}
+
+	// the range of dates limits the query to partitions of the batch
+	err = db.Model(&existing).
+		Column("location_id", "measured_at").
+		Where("location_id IN (?)", pg.In(locations)).
+		Where("measured_at IN (?)", pg.In(times)).
+		Where("date BETWEEN ? AND ?", from.Format(dateLayout), to.Format(dateLayout)).
+		Select()
+	return
+}
+
+func (d *Database) getPersonalStation(id string) (station PersonalStation, err error) {
+	db := d.connect()
+
+	err = db.Model(&station).Where("station_id = ?", id).Select()
+	if err == pg.ErrNoRows {
+		err = sql.ErrNoRows
+	}
+	return
+}
+
+func (d *Database) getPersonalStations() (stations []PersonalStation, err error) {
+	db := d.connect()
+
+	err = db.Model(&stations).Order("station_id ASC").Select()
+	return
+}
+
+// savePersonalStation registers the station or replaces its key and location
+func (d *Database) savePersonalStation(station PersonalStation) error {
+	db := d.connect()
+
+	_, err := db.Model(&station).
+		OnConflict("(station_id) DO UPDATE").
+		Set("key_hash = EXCLUDED.key_hash, location_id = EXCLUDED.location_id").
+		Insert()
+	return err
+}
+
+func (d *Database) deletePersonalStation(id string) error {
+	db := d.connect()
+
+	v, err := db.Model(&PersonalStation{}).Where("station_id = ?", id).Delete()
+	if err != nil {
+		return err
+	}
+	if v.RowsAffected() == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// addOWMUsage adds requests to open weather map of the UTC day, e.g. '2026-10-18', and returns requests
+// of the day of all instances
+func (d *Database) addOWMUsage(day string, calls int) (total int, err error) {
+	db := d.connect()
+
+	_, err = db.QueryOne(pg.Scan(&total), "INSERT INTO owm_usage (day, calls) VALUES (?, ?) "+
+		"ON CONFLICT (day) DO UPDATE SET calls = owm_usage.calls + EXCLUDED.calls RETURNING calls", day, calls)
+	return
+}
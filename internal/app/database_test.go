@@ -1,19 +1,31 @@
 package app
 
 import (
-	"os"
+	"context"
+	"database/sql"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type fakeDatabase struct {
-	err        error
-	errSave    error
-	errStat    error
-	locations  []Location
-	weather    Weather
-	statistics Statistics
+	err          error
+	errSave      error
+	errStat      error
+	locations    []Location
+	weather      Weather
+	statistics   Statistics
+	descriptions []Description
+	observations []Observation
+	exists       bool
+	stations     []PersonalStation
+	summary      Summary
+	latest       []LatestWeather
+	version      string
+	missing      []string
 }
 
 func (f fakeDatabase) getLocation(id int) (Location, error) {
@@ -43,44 +55,139 @@ func (f fakeDatabase) getStatistics(id int) (Statistics, error) {
 	return f.statistics, f.errStat
 }
 
+func (f fakeDatabase) getDescriptions() ([]Description, error) {
+	return f.descriptions, f.err
+}
+
+func (f fakeDatabase) getObservations(filter ObservationFilter, fn func(Observation) error) error {
+	for _, o := range f.observations {
+		if err := fn(o); err != nil {
+			return err
+		}
+	}
+	return f.errStat
+}
+
+func (f fakeDatabase) saveWeathers(batch []Weather) (int, error) {
+	if f.errSave == errDuplicateObservation {
+		return 0, nil
+	}
+	if f.errSave != nil {
+		return 0, f.errSave
+	}
+	return len(batch), nil
+}
+
+func (f fakeDatabase) existingWeather(batch []Weather) ([]Weather, error) {
+	if f.exists {
+		return batch, f.errStat
+	}
+	return nil, f.errStat
+}
+
+func (f fakeDatabase) getDescription(id int) (Description, error) {
+	if f.err != nil {
+		return Description{}, f.err
+	}
+	for _, d := range f.descriptions {
+		if d.ID == id {
+			return d, nil
+		}
+	}
+	return Description{}, sql.ErrNoRows
+}
+
+func (f fakeDatabase) getPersonalStation(id string) (PersonalStation, error) {
+	if len(f.stations) > 0 {
+		return f.stations[0], f.err
+	}
+	return PersonalStation{}, f.err
+}
+
+func (f fakeDatabase) getPersonalStations() ([]PersonalStation, error) {
+	return f.stations, f.err
+}
+
+func (f fakeDatabase) savePersonalStation(station PersonalStation) error {
+	return f.errSave
+}
+
+func (f fakeDatabase) deletePersonalStation(id string) error {
+	return f.err
+}
+
+func (f fakeDatabase) getSummary() (Summary, error) {
+	return f.summary, f.err
+}
+
+func (f fakeDatabase) getLatestWeather() ([]LatestWeather, error) {
+	return f.latest, f.err
+}
+
+func (f fakeDatabase) ping() (string, error) {
+	return f.version, f.err
+}
+
+func (f fakeDatabase) missingColumns() ([]string, error) {
+	return f.missing, f.err
+}
+
+func (f fakeDatabase) withContext(context.Context) databaseWeatherProvider {
+	return f
+}
+
 func TestNewDB(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       DatabaseOptions
+		partitioned   bool
+		expectedError error
+	}{
+		{
+			name:          "Invalid database configuration",
+			options:       DatabaseOptions{User: "user", Database: "db"},
+			expectedError: errors.New("invalid configuration: database.address is required"),
+		},
+		{
+			name:    "Valid database configuration",
+			options: DatabaseOptions{User: "user", Database: "db", Address: "localhost:5432"},
+		},
+		{
+			name:    "Invalid partitioning configuration",
+			options: DatabaseOptions{User: "user", Database: "db", Address: "localhost:5432", Partitioning: true, RetentionMonths: -1},
+			expectedError: errors.New("invalid configuration: database.retention_months must be a non-negative integer, got (-1); " +
+				"database.maintenance_interval must be a positive duration, e.g. 30s, got (0s)"),
+		},
+		{
+			name:        "Valid partitioning configuration",
+			options:     DatabaseOptions{User: "user", Database: "db", Address: "localhost:5432", Partitioning: true, RetentionMonths: 12, MaintenanceInterval: time.Hour},
+			partitioned: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			db, err := NewDB(test.options)
+
+			// Assert
+			if test.expectedError != nil {
+				assert.EqualError(t, err, test.expectedError.Error())
+				assert.Nil(t, db)
+				return
+			}
+			require.Nil(t, err)
+			defer db.Close()
+			assert.Equal(t, test.partitioned, db.Partitioned())
+			if test.partitioned {
+				assert.Equal(t, 12, db.partitioning.retention)
+			}
+		})
+	}
+}
 
-	t.Run("Invalid database configuration", func(t *testing.T) {
-		user := os.Getenv("DB_USER")
-		database := os.Getenv("DB_DATABASE")
-		password := os.Getenv("DB_PASSWORD")
-		address := os.Getenv("DB_ADDRESS")
-		defer func() {
-			os.Setenv("DB_USER", user)
-			os.Setenv("DB_DATABASE", database)
-			os.Setenv("DB_PASSWORD", password)
-			os.Setenv("DB_ADDRESS", address)
-		}()
-
-		os.Setenv("DB_ADDRESS", "")
-		db, err := NewDB()
-		assert.NotNil(t, err)
-		assert.Nil(t, db)
-	})
-
-	t.Run("Valid database configuration", func(t *testing.T) {
-		user := os.Getenv("DB_USER")
-		database := os.Getenv("DB_DATABASE")
-		password := os.Getenv("DB_PASSWORD")
-		address := os.Getenv("DB_ADDRESS")
-		defer func() {
-			os.Setenv("DB_USER", user)
-			os.Setenv("DB_DATABASE", database)
-			os.Setenv("DB_PASSWORD", password)
-			os.Setenv("DB_ADDRESS", address)
-		}()
-
-		os.Setenv("DB_USER", "user")
-		os.Setenv("DB_DATABASE", "db")
-		os.Setenv("DB_PASSWORD", "")
-		os.Setenv("DB_ADDRESS", "localhost:5432")
-		db, err := NewDB()
-		assert.Nil(t, err)
-		assert.NotNil(t, db)
-	})
+func TestDayIcon(t *testing.T) {
+	assert.Equal(t, "10d", dayIcon("10n"))
+	assert.Equal(t, "10d", dayIcon("10d"))
+	assert.Equal(t, "", dayIcon(""))
 }
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/emicklei/go-restful"
+	"github.com/emicklei/go-restful-openapi"
+)
+
+const (
+	// defaultGeocodingURL is a location of geocoding API of open weather map service
+	defaultGeocodingURL = "http://api.openweathermap.org/geo/1.0"
+	defaultGeocodeLimit = 5
+	maxGeocodeLimit     = 5 // of open weather map
+)
+
+// GeocodeCandidate is a place which matches the search, it may be given to POST /locations
+type GeocodeCandidate struct {
+	Name        string  `json:"name" description:"name of the place"`
+	State       string  `json:"state,omitempty" description:"state or region, it distinguishes places with the same name"`
+	CountryCode string  `json:"country_code" description:"country code"`
+	Latitude    float32 `json:"latitude" description:"latitude of the place"`
+	Longitude   float32 `json:"longitude" description:"longitude of the place"`
+}
+
+// String returns the name with the state and the country, e.g. 'Springfield, Illinois, US'
+func (c GeocodeCandidate) String() string {
+	parts := []string{c.Name}
+	for _, p := range []string{c.State, c.CountryCode} {
+		if len(p) > 0 {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Geocoder finds places which match the query, e.g. 'Springfield' or 'Springfield,US'
+type Geocoder interface {
+	Geocode(ctx context.Context, query string, limit int) ([]GeocodeCandidate, error)
+}
+
+// owmPlace is a place of geocoding API of open weather map
+type owmPlace struct {
+	Name      string  `json:"name"`
+	State     string  `json:"state"`
+	Country   string  `json:"country"`
+	Latitude  float32 `json:"lat"`
+	Longitude float32 `json:"lon"`
+}
+
+// Geocode finds places by geocoding API of open weather map, requests are limited by the quota
+func (o *OpenWeatherAPI) Geocode(ctx context.Context, query string, limit int) ([]GeocodeCandidate, error) {
+	c := o.withContext(ctx)
+	uri := buildURL(c.geocodingURL, "direct", map[string]string{"q": query, "limit": strconv.Itoa(limit)})
+	resp, err := c.get("geocode", uri, priorityUser)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("open weather map responded with status=(%d): %s", resp.StatusCode, c.parseErrorResponse(resp))
+	}
+
+	var places []owmPlace
+	if err = json.NewDecoder(resp.Body).Decode(&places); err != nil {
+		return nil, err
+	}
+	candidates := make([]GeocodeCandidate, 0, len(places))
+	for _, p := range places {
+		candidates = append(candidates, GeocodeCandidate{
+			Name:        p.Name,
+			State:       p.State,
+			CountryCode: p.Country,
+			Latitude:    p.Latitude,
+			Longitude:   p.Longitude,
+		})
+	}
+	return candidates, nil
+}
+
+// GeocodeEndpoint searches places, so a location is created for the chosen one
+type GeocodeEndpoint struct {
+	geocoder Geocoder
+}
+
+// NewGeocodeEndpoint returns GeocodeEndpoint instance
+func NewGeocodeEndpoint(geocoder Geocoder) *GeocodeEndpoint {
+	return &GeocodeEndpoint{
+		geocoder: geocoder,
+	}
+}
+
+// Endpoint is a webservice for geocoding
+func (g *GeocodeEndpoint) Endpoint() *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path("/geocode").
+		Produces(restful.MIME_JSON)
+
+	tags := []string{"locations"}
+
+	ws.Route(ws.GET("").To(g.geocode).
+		Doc("find places by name, a candidate may be given to POST /locations").
+		Param(ws.QueryParameter("q", "name of the place with optional state and country code, e.g. Springfield,IL,US").DataType("string").Required(true)).
+		Param(ws.QueryParameter("limit", "maximum number of candidates, at most 5").DataType("integer").DefaultValue(strconv.Itoa(defaultGeocodeLimit))).
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes([]GeocodeCandidate{}).
+		Returns(http.StatusOK, "OK", []GeocodeCandidate{}).
+		Returns(http.StatusBadRequest, "invalid query parameters", nil).
+		Returns(http.StatusGatewayTimeout, "open weather api timeout", nil).
+		Returns(http.StatusBadGateway, "open weather api error", nil).
+		Returns(http.StatusTooManyRequests, quotaExhausted, nil))
+
+	return ws
+}
+
+func (g *GeocodeEndpoint) geocode(request *restful.Request, response *restful.Response) {
+	query, limit, err := validateGeocode(request.QueryParameter("q"), request.QueryParameter("limit"))
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	candidates, err := g.geocoder.Geocode(requestContext(request), query, limit)
+	if err != nil {
+		requestLogger(request).Error("Geocode", "error", err)
+		if writeQuotaError(response, err) {
+			return
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			response.WriteErrorString(http.StatusGatewayTimeout, serviceIsUnavailable)
+			return
+		}
+		response.WriteErrorString(http.StatusBadGateway, serviceIsUnavailable)
+		return
+	}
+	response.WriteEntity(candidates)
+}
+
+func validateGeocode(query, limit string) (string, int, error) {
+	query = strings.TrimSpace(query)
+	if len(query) == 0 {
+		return "", 0, errors.New("query parameter 'q' is required")
+	}
+	if len(limit) == 0 {
+		return query, defaultGeocodeLimit, nil
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n < 1 || n > maxGeocodeLimit {
+		return "", 0, fmt.Errorf("limit must be an integer from 1 to %d", maxGeocodeLimit)
+	}
+	return query, n, nil
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGeocoder returns the candidates or the error
+type fakeGeocoder struct {
+	candidates []GeocodeCandidate
+	err        error
+	query      string
+	limit      int
+}
+
+func (f *fakeGeocoder) Geocode(ctx context.Context, query string, limit int) ([]GeocodeCandidate, error) {
+	f.query, f.limit = query, limit
+	return f.candidates, f.err
+}
+
+func TestGeocode(t *testing.T) {
+	// Arrange
+	var path string
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		path, query = req.URL.Path, req.URL.Query()
+		rw.Write([]byte(`[
+			{"name": "Springfield", "local_names": {"en": "Springfield"}, "lat": 39.7990175, "lon": -89.6439575, "country": "US", "state": "Illinois"},
+			{"name": "Springfield", "lat": 37.2081729, "lon": -93.2922715, "country": "US", "state": "Missouri"}
+		]`))
+	}))
+	defer server.Close()
+	o, err := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL + "/data/2.5", GeocodingURL: server.URL + "/geo/1.0", Token: "secret"})
+	require.Nil(t, err)
+
+	// Act
+	candidates, err := o.Geocode(context.Background(), "Springfield,US", 2)
+
+	// Assert
+	require.Nil(t, err)
+	assert.Equal(t, "/geo/1.0/direct", path)
+	assert.Equal(t, url.Values{"q": {"Springfield,US"}, "limit": {"2"}, "appid": {"secret"}}, query)
+	assert.Equal(t, []GeocodeCandidate{
+		{Name: "Springfield", State: "Illinois", CountryCode: "US", Latitude: 39.7990175, Longitude: -89.6439575},
+		{Name: "Springfield", State: "Missouri", CountryCode: "US", Latitude: 37.2081729, Longitude: -93.2922715},
+	}, candidates)
+	assert.Equal(t, "Springfield, Missouri, US", candidates[1].String())
+}
+
+func TestGeocodeError(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(`{"cod": "400", "message": "Nothing to geocode"}`))
+	}))
+	defer server.Close()
+	o, err := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, GeocodingURL: server.URL, Token: "secret"})
+	require.Nil(t, err)
+
+	// Act
+	candidates, err := o.Geocode(context.Background(), "?", 5)
+
+	// Assert
+	assert.Nil(t, candidates)
+	assert.EqualError(t, err, "open weather map responded with status=(400): Nothing to geocode")
+}
+
+func TestGeocodeEndpoint(t *testing.T) {
+	springfield := GeocodeCandidate{Name: "Springfield", State: "Illinois", CountryCode: "US", Latitude: 39.8, Longitude: -89.64}
+
+	tests := []struct {
+		name          string
+		uri           string
+		geocoder      fakeGeocoder
+		expectedLimit int
+		HTTPStatus    int
+		expectedBody  string
+	}{
+		{
+			name:          "Candidates",
+			uri:           "/geocode?q=Springfield",
+			geocoder:      fakeGeocoder{candidates: []GeocodeCandidate{springfield}},
+			expectedLimit: defaultGeocodeLimit,
+			HTTPStatus:    http.StatusOK,
+			expectedBody: "[\n {\n  \"name\": \"Springfield\",\n  \"state\": \"Illinois\",\n  \"country_code\": \"US\",\n" +
+				"  \"latitude\": 39.8,\n  \"longitude\": -89.64\n }\n]",
+		},
+		{
+			name:          "No candidates",
+			uri:           "/geocode?q=Nowhere&limit=1",
+			geocoder:      fakeGeocoder{candidates: []GeocodeCandidate{}},
+			expectedLimit: 1,
+			HTTPStatus:    http.StatusOK,
+			expectedBody:  "[]",
+		},
+		{
+			name:         "Missing query",
+			uri:          "/geocode?q=%20",
+			HTTPStatus:   http.StatusBadRequest,
+			expectedBody: "query parameter 'q' is required",
+		},
+		{
+			name:         "Invalid limit",
+			uri:          "/geocode?q=Springfield&limit=10",
+			HTTPStatus:   http.StatusBadRequest,
+			expectedBody: "limit must be an integer from 1 to 5",
+		},
+		{
+			name:          "Quota is exhausted",
+			uri:           "/geocode?q=Springfield",
+			geocoder:      fakeGeocoder{err: &quotaError{reason: "per-minute budget", retryAfter: time.Second}},
+			expectedLimit: defaultGeocodeLimit,
+			HTTPStatus:    http.StatusTooManyRequests,
+			expectedBody:  quotaExhausted,
+		},
+		{
+			name:          "Open weather map fails",
+			uri:           "/geocode?q=Springfield",
+			geocoder:      fakeGeocoder{err: errors.New("connection refused")},
+			expectedLimit: defaultGeocodeLimit,
+			HTTPStatus:    http.StatusBadGateway,
+			expectedBody:  serviceIsUnavailable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			container := restful.NewContainer()
+			container.Add(NewGeocodeEndpoint(&test.geocoder).Endpoint())
+			httpWriter := httptest.NewRecorder()
+
+			// Act
+			container.ServeHTTP(httpWriter, httptest.NewRequest("GET", test.uri, nil))
+
+			// Assert
+			assert.Equal(t, test.HTTPStatus, httpWriter.Code)
+			assert.Equal(t, test.expectedBody, httpWriter.Body.String())
+			assert.Equal(t, test.expectedLimit, test.geocoder.limit)
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/emicklei/go-restful-openapi"
+)
+
+// Version of the service, it is set when it is built: -ldflags "-X github.com/mieczyslaw1980/weather/internal/app.Version=1.0.0"
+var Version = "dev"
+
+// statuses of the service and its components
+const (
+	statusOK       = "ok"
+	statusDegraded = "degraded" // the service works, but some requests may fail
+	statusFailed   = "failed"   // the service can not handle requests
+)
+
+// credentialsCheckInterval limits requests to open weather map which only check the token
+const credentialsCheckInterval = 10 * time.Minute
+
+// ComponentStatus is a result of the check of a component of the service
+type ComponentStatus struct {
+	Name    string  `json:"name" description:"database, migrations or open_weather_map"`
+	Status  string  `json:"status" description:"ok, degraded or failed"`
+	Version string  `json:"version,omitempty"`
+	Message string  `json:"message,omitempty"`
+	Latency float64 `json:"latency_seconds" description:"duration of the check"`
+}
+
+// Status describes the service and its components
+type Status struct {
+	Status     string            `json:"status" description:"ok, degraded or failed"`
+	Version    string            `json:"version,omitempty"`
+	GoVersion  string            `json:"go_version,omitempty"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"`
+	Uptime     float64           `json:"uptime_seconds,omitempty"`
+	Components []ComponentStatus `json:"components,omitempty"`
+}
+
+// credentialsCheck is the cached result of the check of open weather map token
+type credentialsCheck struct {
+	checkedAt time.Time
+	status    ComponentStatus
+	running   chan struct{} // it is closed when the running check is done, nil when no check is running
+}
+
+// HealthEndpoint provides probes for orchestrators and the detailed status of the service
+type HealthEndpoint struct {
+	db                databaseWeatherProvider
+	openWeatherMapAPI *OpenWeatherAPI
+	startedAt         time.Time
+
+	mutex       sync.Mutex
+	credentials credentialsCheck
+}
+
+// NewHealthEndpoint returns HealthEndpoint instance, the service is started now
+func NewHealthEndpoint(db databaseWeatherProvider, o *OpenWeatherAPI) *HealthEndpoint {
+	return &HealthEndpoint{
+		db:                db,
+		openWeatherMapAPI: o,
+		startedAt:         time.Now(),
+	}
+}
+
+// Endpoints are webservices of probes, each of them has its own root path, so probes have short paths
+// and the root path is left to the OpenAPI specification
+func (h *HealthEndpoint) Endpoints() []*restful.WebService {
+	tags := []string{"health"}
+
+	healthz := new(restful.WebService)
+	healthz.Path("/healthz").
+		Produces(restful.MIME_JSON)
+	healthz.Route(healthz.GET("").To(h.healthz).
+		Doc("check that the process is up, it is a liveness probe").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Returns(http.StatusOK, "OK", Status{}))
+
+	readyz := new(restful.WebService)
+	readyz.Path("/readyz").
+		Produces(restful.MIME_JSON)
+	readyz.Route(readyz.GET("").To(h.readyz).
+		Doc("check that database is reachable and migrated, the service is degraded when open weather map rejects the token, it is a readiness probe").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Returns(http.StatusOK, "OK", Status{}).
+		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, Status{}))
+
+	status := new(restful.WebService)
+	status.Path("/status").
+		Produces(restful.MIME_JSON)
+	status.Route(status.GET("").To(h.status).
+		Doc("get status of components and versions of the service").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Returns(http.StatusOK, "OK", Status{}).
+		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, Status{}))
+
+	return []*restful.WebService{healthz, readyz, status}
+}
+
+// checkDatabase returns status of the connection and of the schema
+func (h *HealthEndpoint) checkDatabase(ctx context.Context) []ComponentStatus {
+	db := h.db.withContext(ctx)
+	start := time.Now()
+	database := ComponentStatus{Name: "database", Status: statusOK}
+	migrations := ComponentStatus{Name: "migrations", Status: statusOK}
+
+	version, err := db.ping()
+	database.Latency = time.Since(start).Seconds()
+	if err != nil {
+		loggerFrom(ctx).Error("Check database", "error", err)
+		database.Status, database.Message = statusFailed, err.Error()
+		migrations.Status, migrations.Message = statusFailed, "database is unreachable"
+		return []ComponentStatus{database, migrations}
+	}
+	database.Version = version
+
+	start = time.Now()
+	missing, err := db.missingColumns()
+	migrations.Latency = time.Since(start).Seconds()
+	switch {
+	case err != nil:
+		loggerFrom(ctx).Error("Check migrations", "error", err)
+		migrations.Status, migrations.Message = statusFailed, err.Error()
+	case len(missing) > 0:
+		migrations.Status = statusFailed
+		migrations.Message = fmt.Sprintf("missing columns: %s, run: weather migrate", strings.Join(missing, ", "))
+	}
+	return []ComponentStatus{database, migrations}
+}
+
+// checkCredentials returns the cached status of open weather map token, it is checked in the background once
+// per interval, so probes do not wait for open weather map. Only the first check is waited for.
+// The service is degraded when the token is rejected or open weather map is unavailable, reads of the database work.
+func (h *HealthEndpoint) checkCredentials(ctx context.Context) ComponentStatus {
+	h.mutex.Lock()
+	c := h.credentials
+	if c.running == nil && (c.checkedAt.IsZero() || time.Since(c.checkedAt) >= credentialsCheckInterval) {
+		c.running = make(chan struct{})
+		h.credentials.running = c.running
+		go h.refreshCredentials(c.running)
+	}
+	h.mutex.Unlock()
+
+	if !c.checkedAt.IsZero() {
+		return c.status
+	}
+	select {
+	case <-c.running:
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		return h.credentials.status
+	case <-ctx.Done():
+		return ComponentStatus{Name: "open_weather_map", Status: statusDegraded, Message: "token is being checked"}
+	}
+}
+
+// refreshCredentials checks open weather map token and caches the result, done is closed then
+func (h *HealthEndpoint) refreshCredentials(done chan struct{}) {
+	start := time.Now()
+	status := ComponentStatus{Name: "open_weather_map", Status: statusOK}
+	valid, err := h.openWeatherMapAPI.withContext(context.Background()).checkCredentials()
+	status.Latency = time.Since(start).Seconds()
+	switch {
+	case !valid:
+		logger.Error("Check open weather map", "error", err)
+		status.Status, status.Message = statusDegraded, fmt.Sprintf("token is rejected: %s", err)
+	case err != nil:
+		logger.Warning("Check open weather map", "error", err)
+		status.Status, status.Message = statusDegraded, err.Error()
+	}
+
+	h.mutex.Lock()
+	h.credentials = credentialsCheck{checkedAt: start, status: status}
+	h.mutex.Unlock()
+	close(done)
+}
+
+// check returns overall status of components, it is the worst status of them
+func (h *HealthEndpoint) check(ctx context.Context) Status {
+	s := Status{Status: statusOK, Components: h.checkDatabase(ctx)}
+	if h.openWeatherMapAPI != nil {
+		s.Components = append(s.Components, h.checkCredentials(ctx))
+	}
+
+	for _, c := range s.Components {
+		if c.Status == statusFailed || (c.Status == statusDegraded && s.Status == statusOK) {
+			s.Status = c.Status
+		}
+	}
+	return s
+}
+
+func (h *HealthEndpoint) write(response *restful.Response, s Status) {
+	status := http.StatusOK
+	if s.Status == statusFailed {
+		status = http.StatusServiceUnavailable
+	}
+	response.WriteHeaderAndEntity(status, s)
+}
+
+func (h *HealthEndpoint) healthz(request *restful.Request, response *restful.Response) {
+	response.WriteEntity(Status{Status: statusOK})
+}
+
+func (h *HealthEndpoint) readyz(request *restful.Request, response *restful.Response) {
+	h.write(response, h.check(requestContext(request)))
+}
+
+func (h *HealthEndpoint) status(request *restful.Request, response *restful.Response) {
+	s := h.check(requestContext(request))
+	s.Version = Version
+	s.GoVersion = runtime.Version()
+	s.StartedAt = &h.startedAt
+	s.Uptime = time.Since(h.startedAt).Seconds()
+	h.write(response, s)
+}
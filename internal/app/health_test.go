@@ -0,0 +1,198 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthz(t *testing.T) {
+	// Arrange
+	container := restful.NewContainer()
+	require.Nil(t, Register(container, NewHealthEndpoint(fakeDatabase{err: errors.New("can not connect to database")}, nil).Endpoints()...))
+	httpWriter := httptest.NewRecorder()
+
+	// Act
+	container.ServeHTTP(httpWriter, httptest.NewRequest("GET", "/healthz", nil))
+
+	// Assert
+	assert.Equal(t, http.StatusOK, httpWriter.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, httpWriter.Body.String())
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name       string
+		db         fakeDatabase
+		owmStatus  int
+		owmBody    string
+		HTTPStatus int
+		expected   Status
+	}{
+		{
+			name:       "Database is unreachable",
+			db:         fakeDatabase{err: errors.New("can not connect to database")},
+			owmStatus:  http.StatusOK,
+			HTTPStatus: http.StatusServiceUnavailable,
+			expected: Status{Status: statusFailed, Components: []ComponentStatus{
+				{Name: "database", Status: statusFailed, Message: "can not connect to database"},
+				{Name: "migrations", Status: statusFailed, Message: "database is unreachable"},
+				{Name: "open_weather_map", Status: statusOK},
+			}},
+		},
+		{
+			name:       "Database is not migrated",
+			db:         fakeDatabase{version: "11.2", missing: []string{"weather.source", "weather.wind_deg"}},
+			owmStatus:  http.StatusOK,
+			HTTPStatus: http.StatusServiceUnavailable,
+			expected: Status{Status: statusFailed, Components: []ComponentStatus{
+				{Name: "database", Status: statusOK, Version: "11.2"},
+				{Name: "migrations", Status: statusFailed, Message: "missing columns: weather.source, weather.wind_deg, run: weather migrate"},
+				{Name: "open_weather_map", Status: statusOK},
+			}},
+		},
+		{
+			name:       "Token is rejected",
+			db:         fakeDatabase{version: "11.2"},
+			owmStatus:  http.StatusUnauthorized,
+			owmBody:    `{"cod": 401, "message": "Invalid API key"}`,
+			HTTPStatus: http.StatusOK,
+			expected: Status{Status: statusDegraded, Components: []ComponentStatus{
+				{Name: "database", Status: statusOK, Version: "11.2"},
+				{Name: "migrations", Status: statusOK},
+				{Name: "open_weather_map", Status: statusDegraded, Message: "token is rejected: Invalid API key"},
+			}},
+		},
+		{
+			name:       "Open weather map is unavailable",
+			db:         fakeDatabase{version: "11.2"},
+			owmStatus:  http.StatusInternalServerError,
+			HTTPStatus: http.StatusOK,
+			expected: Status{Status: statusDegraded, Components: []ComponentStatus{
+				{Name: "database", Status: statusOK, Version: "11.2"},
+				{Name: "migrations", Status: statusOK},
+				{Name: "open_weather_map", Status: statusDegraded, Message: "open weather map responded with status=(500)"},
+			}},
+		},
+		{
+			name:       "Ready",
+			db:         fakeDatabase{version: "11.2"},
+			owmStatus:  http.StatusOK,
+			HTTPStatus: http.StatusOK,
+			expected: Status{Status: statusOK, Components: []ComponentStatus{
+				{Name: "database", Status: statusOK, Version: "11.2"},
+				{Name: "migrations", Status: statusOK},
+				{Name: "open_weather_map", Status: statusOK},
+			}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(test.owmStatus)
+				rw.Write([]byte(test.owmBody))
+			}))
+			defer server.Close()
+			o, _ := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, Token: "token"})
+
+			container := restful.NewContainer()
+			require.Nil(t, Register(container, NewHealthEndpoint(test.db, o).Endpoints()...))
+			httpWriter := httptest.NewRecorder()
+
+			// Act
+			container.ServeHTTP(httpWriter, httptest.NewRequest("GET", "/readyz", nil))
+
+			// Assert
+			assert.Equal(t, test.HTTPStatus, httpWriter.Code)
+			result := Status{}
+			require.Nil(t, json.Unmarshal(httpWriter.Body.Bytes(), &result))
+			for i := range result.Components {
+				result.Components[i].Latency = 0
+			}
+			assert.Equal(t, test.expected, result)
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	// Arrange
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+	o, _ := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, Token: "token"})
+
+	container := restful.NewContainer()
+	services := append(NewHealthEndpoint(fakeDatabase{version: "11.2"}, o).Endpoints(),
+		NewLocationEndpoint(fakeDatabase{locations: []Location{{LocationID: 2643743}}}, o).Endpoint())
+	require.Nil(t, Register(container, services...))
+
+	for i := 0; i < 2; i++ {
+		httpWriter := httptest.NewRecorder()
+
+		// Act
+		container.ServeHTTP(httpWriter, httptest.NewRequest("GET", "/status", nil))
+
+		// Assert
+		assert.Equal(t, http.StatusOK, httpWriter.Code)
+		result := Status{}
+		require.Nil(t, json.Unmarshal(httpWriter.Body.Bytes(), &result))
+		assert.Equal(t, statusOK, result.Status)
+		assert.Equal(t, Version, result.Version)
+		assert.NotEmpty(t, result.GoVersion)
+		require.NotNil(t, result.StartedAt)
+		assert.WithinDuration(t, time.Now(), *result.StartedAt, time.Minute)
+		assert.Len(t, result.Components, 3)
+	}
+	assert.Equal(t, 1, requests, "token is checked once per interval")
+
+	t.Run("Other web services are routed", func(t *testing.T) {
+		httpWriter := httptest.NewRecorder()
+		container.ServeHTTP(httpWriter, httptest.NewRequest("GET", "/locations/2643743", nil))
+		assert.Equal(t, http.StatusOK, httpWriter.Code)
+	})
+}
+
+func TestCheckCredentialsInBackground(t *testing.T) {
+	// Arrange
+	release := make(chan struct{})
+	requests := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests <- struct{}{}
+		<-release
+		rw.WriteHeader(http.StatusUnauthorized)
+		rw.Write([]byte(`{"cod": 401, "message": "Invalid API key"}`))
+	}))
+	defer server.Close()
+	o, _ := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, Token: "token"})
+	h := NewHealthEndpoint(fakeDatabase{version: "11.2"}, o)
+	cached := ComponentStatus{Name: "open_weather_map", Status: statusOK}
+	h.credentials = credentialsCheck{checkedAt: time.Now().Add(-2 * credentialsCheckInterval), status: cached}
+
+	// Act
+	first := h.checkCredentials(context.Background())
+	second := h.checkCredentials(context.Background())
+	<-requests
+	running := h.credentials.running
+	close(release)
+	<-running
+	refreshed := h.checkCredentials(context.Background())
+
+	// Assert
+	assert.Equal(t, cached, first, "the cached status is returned while open weather map is checked")
+	assert.Equal(t, cached, second)
+	assert.Len(t, requests, 0, "one check runs at a time")
+	assert.Equal(t, statusDegraded, refreshed.Status)
+	assert.Equal(t, "token is rejected: Invalid API key", refreshed.Message)
+}
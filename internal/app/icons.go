@@ -0,0 +1,173 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/emicklei/go-restful"
+	"github.com/emicklei/go-restful-openapi"
+)
+
+const (
+	conditionNotFound     = "condition '%d' not found"
+	conditionInvalidID    = "code must be an integer"
+	iconInvalidVariant    = "variant must be day or night"
+	iconCacheControl      = "public, max-age=86400"
+	iconVariantDay        = "day"
+	iconVariantNight      = "night"
+	iconVariantQueryParam = "variant"
+)
+
+// IconEndpoint serves icons of weather conditions cached on disk
+type IconEndpoint struct {
+	db                databaseWeatherProvider
+	openWeatherMapAPI *OpenWeatherAPI
+	dir               string
+
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex // of icons, so one request fetches the icon and requests of other icons do not wait
+}
+
+// NewIconEndpoint returns IconEndpoint instance, icons are cached in the directory
+func NewIconEndpoint(db databaseWeatherProvider, o *OpenWeatherAPI, dir string) *IconEndpoint {
+	return &IconEndpoint{
+		db:                db,
+		openWeatherMapAPI: o,
+		dir:               dir,
+	}
+}
+
+// iconURL returns link to the icon of weather condition, e.g. '/icons/500' or '/icons/500?variant=night'
+// for the night icon of open weather map, e.g. '10n'
+func iconURL(code int, icon string) string {
+	if isNightIcon(icon) {
+		return fmt.Sprintf("/icons/%d?%s=%s", code, iconVariantQueryParam, iconVariantNight)
+	}
+	return fmt.Sprintf("/icons/%d", code)
+}
+
+// Endpoint is a webservice for icons of weather conditions
+func (i *IconEndpoint) Endpoint() *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path("/icons").
+		Produces("image/png", "image/svg+xml")
+
+	tags := []string{"conditions"}
+
+	ws.Route(ws.GET("/{code}").To(i.getIcon).
+		Doc("get icon of the weather condition").
+		Param(ws.PathParameter("code", "weather condition code, see /conditions").DataType("integer")).
+		Param(ws.QueryParameter(iconVariantQueryParam, "day or night").DataType("string").DefaultValue(iconVariantDay)).
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Returns(http.StatusOK, "OK", nil).
+		Returns(http.StatusBadRequest, conditionInvalidID+" and "+iconInvalidVariant, nil).
+		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil).
+		Returns(http.StatusNotFound, "condition does not exist", nil))
+
+	return ws
+}
+
+func (i *IconEndpoint) getIcon(request *restful.Request, response *restful.Response) {
+	db := i.db.withContext(requestContext(request))
+
+	code, err := strconv.Atoi(request.PathParameter("code"))
+	if err != nil {
+		requestLogger(request).Error("Get icon", "error", err)
+		response.WriteErrorString(http.StatusBadRequest, conditionInvalidID)
+		return
+	}
+	variant := request.QueryParameter(iconVariantQueryParam)
+	if len(variant) > 0 && variant != iconVariantDay && variant != iconVariantNight {
+		response.WriteErrorString(http.StatusBadRequest, iconInvalidVariant)
+		return
+	}
+
+	description, err := db.getDescription(code)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			response.WriteErrorString(http.StatusNotFound, fmt.Sprintf(conditionNotFound, code))
+			return
+		}
+		requestLogger(request).Error("Get icon", "error", err)
+		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
+		return
+	}
+
+	// the dictionary keeps day icons, night icons differ only by the suffix
+	name := description.Icon
+	if variant == iconVariantNight {
+		name = nightIcon(name)
+	}
+
+	icon, err := i.cachedIcon(requestContext(request), name)
+	if err != nil {
+		requestLogger(request).Error("Get icon", "error", err)
+		// fallback icons are not cached, so the next request tries to fetch the icon again
+		response.AddHeader("Content-Type", "image/svg+xml")
+		response.WriteHeader(http.StatusOK)
+		response.Write([]byte(fallbackIcon(name)))
+		return
+	}
+
+	response.AddHeader("Content-Type", "image/png")
+	response.AddHeader("Cache-Control", iconCacheControl)
+	response.WriteHeader(http.StatusOK)
+	response.Write(icon)
+}
+
+// iconLock returns the lock of the icon
+func (i *IconEndpoint) iconLock(icon string) *sync.Mutex {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.locks == nil {
+		i.locks = make(map[string]*sync.Mutex)
+	}
+	l, ok := i.locks[icon]
+	if !ok {
+		l = &sync.Mutex{}
+		i.locks[icon] = l
+	}
+	return l
+}
+
+// cachedIcon reads the icon from disk or fetches it from open weather map service with the context of the request
+func (i *IconEndpoint) cachedIcon(ctx context.Context, icon string) ([]byte, error) {
+	if len(icon) == 0 || filepath.Base(icon) != icon {
+		return nil, fmt.Errorf("invalid icon name '%s'", icon)
+	}
+	path := filepath.Join(i.dir, icon+".png")
+
+	// requests of the icon wait for the one which fetches it, then they read it from disk
+	l := i.iconLock(icon)
+	l.Lock()
+	defer l.Unlock()
+
+	if b, err := ioutil.ReadFile(path); err == nil {
+		return b, nil
+	}
+
+	b, _, err := i.openWeatherMapAPI.withContext(ctx).getIcon(icon)
+	if err != nil {
+		return nil, err
+	}
+
+	// the icon is renamed when it has been written completely, so a broken file is never served
+	if err = os.MkdirAll(i.dir, 0755); err == nil {
+		tmp := path + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Cache icon", "icon", icon, "error", err)
+	}
+	return b, nil
+}
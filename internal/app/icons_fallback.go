@@ -0,0 +1,49 @@
+package app
+
+// fallbackIcons are served when icons can not be fetched from open weather map service,
+// they are keyed by icon number without day/night suffix
+var fallbackIcons = map[string]string{
+	// clear sky
+	"01": `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">` +
+		`<circle cx="50" cy="50" r="22" fill="#f5b400"/></svg>`,
+	// few clouds
+	"02": `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">` +
+		`<circle cx="40" cy="40" r="18" fill="#f5b400"/>` +
+		`<ellipse cx="58" cy="62" rx="28" ry="16" fill="#d0d4d9"/></svg>`,
+	// scattered clouds
+	"03": `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">` +
+		`<ellipse cx="50" cy="55" rx="32" ry="18" fill="#d0d4d9"/></svg>`,
+	// broken clouds
+	"04": `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">` +
+		`<ellipse cx="42" cy="45" rx="26" ry="15" fill="#9aa1a9"/>` +
+		`<ellipse cx="58" cy="60" rx="30" ry="17" fill="#d0d4d9"/></svg>`,
+	// shower rain
+	"09": `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">` +
+		`<ellipse cx="50" cy="40" rx="32" ry="18" fill="#9aa1a9"/>` +
+		`<path d="M35 65l-5 15M50 65l-5 15M65 65l-5 15" stroke="#2f80ed" stroke-width="4"/></svg>`,
+	// rain
+	"10": `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">` +
+		`<circle cx="38" cy="32" r="16" fill="#f5b400"/>` +
+		`<ellipse cx="55" cy="45" rx="30" ry="17" fill="#d0d4d9"/>` +
+		`<path d="M42 68l-4 12M58 68l-4 12" stroke="#2f80ed" stroke-width="4"/></svg>`,
+	// thunderstorm
+	"11": `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">` +
+		`<ellipse cx="50" cy="38" rx="32" ry="18" fill="#6b737c"/>` +
+		`<path d="M52 52l-12 18h10l-6 18 18-24h-10l6-12z" fill="#f5b400"/></svg>`,
+	// snow
+	"13": `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">` +
+		`<path d="M50 20v60M24 35l52 30M24 65l52-30" stroke="#7fb2e5" stroke-width="5"/></svg>`,
+	// mist
+	"50": `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">` +
+		`<path d="M20 35h60M15 50h70M20 65h60" stroke="#9aa1a9" stroke-width="6" stroke-linecap="round"/></svg>`,
+}
+
+// fallbackIcon returns icon for e.g. '10d', clear sky is returned for unknown icons
+func fallbackIcon(icon string) string {
+	if len(icon) >= 2 {
+		if svg, ok := fallbackIcons[icon[:2]]; ok {
+			return svg
+		}
+	}
+	return fallbackIcons["01"]
+}
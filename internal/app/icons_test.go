@@ -0,0 +1,226 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pngIcon is the smallest data recognized as PNG image
+var pngIcon = []byte("\x89PNG\r\n\x1a\n" + "icon")
+
+func TestGetIcon(t *testing.T) {
+	// Arrange
+	rain := []Description{{ID: 500, Main: "Rain", Description: "light rain", Icon: "10d"}}
+	tests := []struct {
+		name          string
+		expectedError error
+		code          string
+		query         string
+		icon          string
+		body          []byte // of open weather map, the icon by default
+		db            fakeDatabase
+		HTTPStatus    int
+		iconStatus    int
+		contentType   string
+		cached        bool
+	}{
+		{
+			name:          "Invalid code",
+			code:          "invalid",
+			expectedError: errors.New(conditionInvalidID),
+			HTTPStatus:    http.StatusBadRequest,
+		},
+		{
+			name:          "Condition not found in database",
+			code:          "999",
+			db:            fakeDatabase{descriptions: rain},
+			expectedError: errors.New("condition '999' not found"),
+			HTTPStatus:    http.StatusNotFound,
+		},
+		{
+			name:          "Invalid variant",
+			code:          "500",
+			query:         "?variant=evening",
+			db:            fakeDatabase{descriptions: rain},
+			expectedError: errors.New(iconInvalidVariant),
+			HTTPStatus:    http.StatusBadRequest,
+		},
+		{
+			name:          "Database error",
+			code:          "500",
+			db:            fakeDatabase{err: errors.New("database error")},
+			expectedError: errors.New(serviceIsUnavailable),
+			HTTPStatus:    http.StatusServiceUnavailable,
+		},
+		{
+			name:        "Icon is fetched and cached",
+			code:        "500",
+			db:          fakeDatabase{descriptions: rain},
+			HTTPStatus:  http.StatusOK,
+			iconStatus:  http.StatusOK,
+			contentType: "image/png",
+			cached:      true,
+		},
+		{
+			name:        "Night icon is fetched and cached",
+			code:        "500",
+			query:       "?variant=night",
+			icon:        "10n",
+			db:          fakeDatabase{descriptions: rain},
+			HTTPStatus:  http.StatusOK,
+			iconStatus:  http.StatusOK,
+			contentType: "image/png",
+			cached:      true,
+		},
+		{
+			name:        "Fallback icon when open weather map service fails",
+			code:        "500",
+			db:          fakeDatabase{descriptions: rain},
+			HTTPStatus:  http.StatusOK,
+			iconStatus:  http.StatusInternalServerError,
+			contentType: "image/svg+xml",
+		},
+		{
+			name:        "Fallback icon when icon is too large",
+			code:        "500",
+			body:        append(append([]byte{}, pngIcon...), make([]byte, maxIconSize)...),
+			db:          fakeDatabase{descriptions: rain},
+			HTTPStatus:  http.StatusOK,
+			iconStatus:  http.StatusOK,
+			contentType: "image/svg+xml",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			icon := test.icon
+			if len(icon) == 0 {
+				icon = "10d"
+			}
+			body := test.body
+			if body == nil {
+				body = pngIcon
+			}
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				assert.Equal(t, "/"+icon+"@2x.png", req.URL.Path)
+				rw.WriteHeader(test.iconStatus)
+				rw.Write(body)
+			}))
+			defer server.Close()
+
+			dir, err := ioutil.TempDir("", "icons")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			fakeAPI, _ := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: "http://test_url", Token: "token", IconURL: server.URL})
+			i := NewIconEndpoint(test.db, fakeAPI, dir)
+
+			request := restful.NewRequest(httptest.NewRequest("GET", "/icons/"+test.code+test.query, nil))
+			httpWriter := httptest.NewRecorder()
+			response := restful.NewResponse(httpWriter)
+			params := request.PathParameters()
+			params["code"] = test.code
+
+			// Act
+			i.getIcon(request, response)
+
+			// Assert
+			assert.Equal(t, test.HTTPStatus, response.StatusCode())
+			if test.expectedError != nil {
+				assert.EqualError(t, response.Error(), test.expectedError.Error())
+				return
+			}
+			assert.Equal(t, test.contentType, httpWriter.Header().Get("Content-Type"))
+
+			b, err := ioutil.ReadFile(filepath.Join(dir, icon+".png"))
+			if test.cached {
+				assert.Nil(t, err)
+				assert.Equal(t, pngIcon, b)
+				assert.Equal(t, pngIcon, httpWriter.Body.Bytes())
+			} else {
+				assert.NotNil(t, err)
+				assert.Equal(t, fallbackIcon(icon), httpWriter.Body.String())
+			}
+		})
+	}
+
+	t.Run("Icon is served while another icon is fetched", func(t *testing.T) {
+		// Arrange
+		fetching := make(chan struct{})
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/10d@2x.png" {
+				close(fetching)
+				<-release
+			}
+			rw.Write(pngIcon)
+		}))
+		defer server.Close()
+
+		dir, err := ioutil.TempDir("", "icons")
+		require.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		fakeAPI, _ := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: "http://test_url", Token: "token", IconURL: server.URL})
+		i := NewIconEndpoint(nil, fakeAPI, dir)
+		done := make(chan error)
+		go func() {
+			_, err := i.cachedIcon(context.Background(), "10d")
+			done <- err
+		}()
+		<-fetching
+
+		// Act
+		b, err := i.cachedIcon(context.Background(), "01d")
+
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, pngIcon, b)
+		close(release)
+		assert.Nil(t, <-done)
+	})
+
+	t.Run("Cached icon is not fetched again", func(t *testing.T) {
+		// Arrange
+		dir, err := ioutil.TempDir("", "icons")
+		require.Nil(t, err)
+		defer os.RemoveAll(dir)
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "10d.png"), pngIcon, 0644))
+
+		fakeAPI, _ := NewOpenWeatherAPI(nil, OpenWeatherMapOptions{URL: "http://test_url", Token: "token", IconURL: "http://invalid.invalid"})
+		i := NewIconEndpoint(nil, fakeAPI, dir)
+
+		// Act
+		b, err := i.cachedIcon(context.Background(), "10d")
+
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, pngIcon, b)
+	})
+}
+
+func TestIconEndpoint(t *testing.T) {
+	t.Run("Check icon endpoint settings", func(t *testing.T) {
+		// Arrange
+		i := NewIconEndpoint(nil, nil, "")
+
+		// Act
+		ws := i.Endpoint()
+
+		// Assert
+		require.NotNil(t, ws)
+		assert.Equal(t, "/icons", ws.RootPath())
+		assert.Len(t, ws.Routes(), 1)
+	})
+}
@@ -0,0 +1,458 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	unitsKelvin     = "kelvin"
+	unitsCelsius    = "celsius"
+	unitsFahrenheit = "fahrenheit"
+
+	fieldMeasuredAt  = "measured_at"
+	fieldTemperature = "temperature"
+	fieldTempMin     = "temp_min"
+	fieldTempMax     = "temp_max"
+	fieldConditions  = "conditions"
+	fieldHumidity    = "humidity"
+	fieldPressure    = "pressure"
+	fieldWindSpeed   = "wind_speed"
+	fieldWindDeg     = "wind_deg"
+
+	maxImportErrors = 100      // number of reported invalid records
+	importBatchSize = 500      // observations saved in one transaction
+	maxImportBody   = 32 << 20 // bytes of a file imported by a request, larger files are imported by the command
+
+	importBodyTooLarge = "request body must not be larger than 32 MiB, larger files are imported by the command"
+)
+
+// importFields are fields of an observation which may be mapped to columns of an imported file
+var importFields = []string{fieldMeasuredAt, fieldTemperature, fieldTempMin, fieldTempMax,
+	fieldHumidity, fieldPressure, fieldWindSpeed, fieldWindDeg, fieldConditions}
+
+// timeLayouts are tried one by one when layout of the time of measurement is not given
+var timeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", dateLayout}
+
+// ImportOptions describes imported observations
+type ImportOptions struct {
+	LocationID int
+	Format     string            // csv or ndjson
+	Columns    map[string]string // field of observation -> column in the file
+	Units      string            // units of temperature: kelvin, celsius or fahrenheit
+	TimeLayout string            // layout of the time of measurement, empty means any known layout or unix time
+	DryRun     bool              // observations are validated but not saved
+}
+
+// ImportReport summarizes imported observations
+type ImportReport struct {
+	Imported   int      `json:"imported" description:"number of saved observations, or observations which would be saved in dry run"`
+	Duplicates int      `json:"duplicates" description:"number of observations which already exist"`
+	Invalid    int      `json:"invalid" description:"number of rejected records"`
+	Unmatched  int      `json:"unmatched,omitempty" description:"number of station records without any location nearby"`
+	Errors     []string `json:"errors" description:"reasons of rejection of the first records"`
+	DryRun     bool     `json:"dry_run"`
+}
+
+// NewImportOptions validates options of the import, columns are given as 'field=column,...',
+// fields which are not mapped are read from columns with the same name
+func NewImportOptions(locationID int, format, columns, units, timeLayout string, dryRun bool) (ImportOptions, error) {
+	o := ImportOptions{
+		LocationID: locationID,
+		Format:     format,
+		Columns:    make(map[string]string),
+		Units:      units,
+		TimeLayout: timeLayout,
+		DryRun:     dryRun,
+	}
+
+	if o.Format != formatCSV && o.Format != formatNDJSON {
+		return o, fmt.Errorf("format must be one of: %s, %s", formatCSV, formatNDJSON)
+	}
+
+	if len(o.Units) == 0 {
+		o.Units = unitsKelvin
+	}
+	if o.Units != unitsKelvin && o.Units != unitsCelsius && o.Units != unitsFahrenheit {
+		return o, fmt.Errorf("units must be one of: %s, %s, %s", unitsKelvin, unitsCelsius, unitsFahrenheit)
+	}
+
+	for _, f := range importFields {
+		o.Columns[f] = f
+	}
+	if len(columns) > 0 {
+		for _, mapping := range strings.Split(columns, ",") {
+			kv := strings.SplitN(mapping, "=", 2)
+			if len(kv) != 2 || len(strings.TrimSpace(kv[1])) == 0 {
+				return o, fmt.Errorf("column mapping must be 'field=column', got '%s'", mapping)
+			}
+			field := strings.TrimSpace(kv[0])
+			if _, ok := o.Columns[field]; !ok {
+				return o, fmt.Errorf("unknown field '%s', fields: %s", field, strings.Join(importFields, ", "))
+			}
+			o.Columns[field] = strings.TrimSpace(kv[1])
+		}
+	}
+	return o, nil
+}
+
+// toKelvin converts temperature to kelvins which are stored in database
+func toKelvin(v float64, units string) float64 {
+	switch units {
+	case unitsCelsius:
+		return v + 273.15
+	case unitsFahrenheit:
+		return (v-32)*5/9 + 273.15
+	}
+	return v
+}
+
+// parseTime parses the time of measurement, times without zone are in UTC
+func parseTime(v, layout string) (time.Time, error) {
+	if len(layout) > 0 {
+		return time.Parse(layout, v)
+	}
+	for _, l := range timeLayouts {
+		if t, err := time.Parse(l, v); err == nil {
+			return t, nil
+		}
+	}
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown format of time '%s'", v)
+}
+
+// parseObservation maps the record read from the file to weather of the location
+func (o ImportOptions) parseObservation(record map[string]string) (Weather, error) {
+	w := Weather{LocationID: o.LocationID, Source: sourceImport}
+
+	v := strings.TrimSpace(record[o.Columns[fieldMeasuredAt]])
+	if len(v) == 0 {
+		return w, fmt.Errorf("column '%s' is required", o.Columns[fieldMeasuredAt])
+	}
+	t, err := parseTime(v, o.TimeLayout)
+	if err != nil {
+		return w, err
+	}
+	w.MeasuredAt = t.UTC()
+
+	temperatures := []*float32{&w.Temperature, &w.TempMin, &w.TempMax}
+	for k, field := range []string{fieldTemperature, fieldTempMin, fieldTempMax} {
+		v = strings.TrimSpace(record[o.Columns[field]])
+		if len(v) == 0 {
+			if field == fieldTemperature {
+				return w, fmt.Errorf("column '%s' is required", o.Columns[field])
+			}
+			// minimum and maximum are the same as a single measurement
+			*temperatures[k] = w.Temperature
+			continue
+		}
+
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return w, fmt.Errorf("column '%s' must be a number, got '%s'", o.Columns[field], v)
+		}
+		*temperatures[k] = float32(toKelvin(f, o.Units))
+	}
+
+	// optional measurements are not converted, they must be in %, hPa, m/s and degrees
+	optional := []**float32{&w.Humidity, &w.Pressure, &w.WindSpeed}
+	for k, field := range []string{fieldHumidity, fieldPressure, fieldWindSpeed} {
+		if v = strings.TrimSpace(record[o.Columns[field]]); len(v) > 0 {
+			f, err := strconv.ParseFloat(v, 32)
+			if err != nil {
+				return w, fmt.Errorf("column '%s' must be a number, got '%s'", o.Columns[field], v)
+			}
+			value := float32(f)
+			*optional[k] = &value
+		}
+	}
+	if v = strings.TrimSpace(record[o.Columns[fieldWindDeg]]); len(v) > 0 {
+		deg, err := strconv.Atoi(v)
+		if err != nil {
+			return w, fmt.Errorf("column '%s' must be an integer, got '%s'", o.Columns[fieldWindDeg], v)
+		}
+		w.WindDeg = &deg
+	}
+
+	if v = strings.TrimSpace(record[o.Columns[fieldConditions]]); len(v) > 0 {
+		for _, c := range strings.Split(v, ";") {
+			code, err := strconv.Atoi(strings.TrimSpace(c))
+			if err != nil {
+				return w, fmt.Errorf("column '%s' must contain codes separated by ';', got '%s'", o.Columns[fieldConditions], v)
+			}
+			w.Conditions = append(w.Conditions, Condition{Code: code})
+		}
+	}
+	return w, nil
+}
+
+// recordReader returns records of the imported file as column -> value
+type recordReader interface {
+	// read returns io.EOF at the end of the file and invalidRecordError when the record can be skipped
+	read() (map[string]string, error)
+}
+
+// invalidRecordError is returned for a malformed record which does not stop the import
+type invalidRecordError struct {
+	error
+}
+
+// invalidFileError is returned when the imported file can not be read at all
+type invalidFileError struct {
+	error
+}
+
+type csvRecordReader struct {
+	r      *csv.Reader
+	header []string
+}
+
+func newCSVRecordReader(r io.Reader) (*csvRecordReader, error) {
+	c := &csvRecordReader{r: csv.NewReader(r)}
+	c.r.FieldsPerRecord = -1
+
+	header, err := c.r.Read()
+	if err != nil {
+		return nil, invalidFileError{fmt.Errorf("can not read header: %s", err)}
+	}
+	for _, h := range header {
+		c.header = append(c.header, strings.TrimSpace(h))
+	}
+	return c, nil
+}
+
+func (c *csvRecordReader) read() (map[string]string, error) {
+	row, err := c.r.Read()
+	if _, ok := err.(*csv.ParseError); ok {
+		return nil, invalidRecordError{err}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	record := make(map[string]string, len(c.header))
+	for k, v := range row {
+		if k < len(c.header) {
+			record[c.header[k]] = v
+		}
+	}
+	return record, nil
+}
+
+type ndjsonRecordReader struct {
+	r *bufio.Reader
+}
+
+func (n *ndjsonRecordReader) read() (map[string]string, error) {
+	for {
+		line, err := n.r.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) == 0 {
+			if err != nil {
+				return nil, err
+			}
+			continue // empty lines are skipped
+		}
+
+		return jsonRecord(line)
+	}
+}
+
+// jsonRecord converts JSON object to the record of fields, arrays are joined with ';'
+func jsonRecord(data []byte) (map[string]string, error) {
+	var values map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, invalidRecordError{fmt.Errorf("invalid JSON: %s", err)}
+	}
+
+	record := make(map[string]string, len(values))
+	for k, v := range values {
+		switch value := v.(type) {
+		case nil:
+		case string:
+			record[k] = value
+		case []interface{}:
+			// conditions may be given as an array of codes
+			items := make([]string, 0, len(value))
+			for _, item := range value {
+				items = append(items, fmt.Sprint(item))
+			}
+			record[k] = strings.Join(items, ";")
+		default:
+			record[k] = fmt.Sprint(value)
+		}
+	}
+	return record, nil
+}
+
+// ImportObservations loads observations of the location from CSV or NDJSON
+func ImportObservations(d *Database, r io.Reader, o ImportOptions) (ImportReport, error) {
+	return importObservations(d, r, o)
+}
+
+func importObservations(db databaseWeatherProvider, r io.Reader, o ImportOptions) (ImportReport, error) {
+	if _, err := db.getLocation(o.LocationID); err != nil {
+		return ImportReport{}, err
+	}
+	i, err := newImporter(db, o.DryRun)
+	if err != nil {
+		return ImportReport{}, err
+	}
+
+	var reader recordReader
+	if o.Format == formatCSV {
+		c, err := newCSVRecordReader(r)
+		if err != nil {
+			return i.report, err
+		}
+		reader = c
+	} else {
+		reader = &ndjsonRecordReader{r: bufio.NewReader(r)}
+	}
+
+	for n := 1; ; n++ {
+		record, err := reader.read()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(invalidRecordError); ok {
+			i.invalid(n, err)
+			continue
+		}
+		if err != nil {
+			return i.report, err
+		}
+
+		w, err := o.parseObservation(record)
+		if err != nil {
+			i.invalid(n, err)
+			continue
+		}
+		if err = i.save(n, w); err != nil {
+			return i.report, err
+		}
+	}
+	return i.report, i.flush()
+}
+
+// observationKey identifies an observation of the location
+type observationKey struct {
+	locationID int
+	measuredAt int64
+}
+
+func weatherKey(w Weather) observationKey {
+	return observationKey{locationID: w.LocationID, measuredAt: w.MeasuredAt.UnixNano()}
+}
+
+// importer saves imported observations in batches and counts them in the report
+type importer struct {
+	db     databaseWeatherProvider
+	dryRun bool
+	report ImportReport
+	seen   map[observationKey]bool // observations repeated in the file are duplicates as well
+	codes  map[int]bool            // of the dictionary, conditions with other codes are invalid
+	batch  []Weather
+}
+
+func newImporter(db databaseWeatherProvider, dryRun bool) (*importer, error) {
+	descriptions, err := db.getDescriptions()
+	if err != nil {
+		return nil, err
+	}
+	codes := make(map[int]bool, len(descriptions))
+	for _, d := range descriptions {
+		codes[d.ID] = true
+	}
+
+	return &importer{
+		db:     db,
+		dryRun: dryRun,
+		report: ImportReport{DryRun: dryRun, Errors: make([]string, 0)},
+		seen:   make(map[observationKey]bool),
+		codes:  codes,
+	}, nil
+}
+
+// invalid counts the rejected record, only the first errors are reported
+func (i *importer) invalid(record int, err error) {
+	i.report.Invalid++
+	if len(i.report.Errors) < maxImportErrors {
+		i.report.Errors = append(i.report.Errors, fmt.Sprintf("record %d: %s", record, err))
+	}
+}
+
+// save queues the observation and saves the full batch, the returned error stops the import
+func (i *importer) save(record int, w Weather) error {
+	// a condition out of the dictionary would fail the whole batch
+	for _, c := range w.Conditions {
+		if !i.codes[c.Code] {
+			i.invalid(record, fmt.Errorf(conditionNotFound, c.Code))
+			return nil
+		}
+	}
+
+	key := weatherKey(w)
+	if i.seen[key] {
+		i.report.Duplicates++
+		return nil
+	}
+	i.seen[key] = true
+
+	i.batch = append(i.batch, w)
+	if len(i.batch) < importBatchSize {
+		return nil
+	}
+	return i.flush()
+}
+
+// flush saves queued observations in one transaction, the dry run looks up existing ones by one query
+func (i *importer) flush() error {
+	if len(i.batch) == 0 {
+		return nil
+	}
+	batch := i.batch
+	i.batch = nil
+
+	if i.dryRun {
+		existing, err := i.db.existingWeather(batch)
+		if err != nil {
+			return err
+		}
+		saved := make(map[observationKey]bool, len(existing))
+		for _, w := range existing {
+			saved[weatherKey(w)] = true
+		}
+		for _, w := range batch {
+			if saved[weatherKey(w)] {
+				i.report.Duplicates++
+			} else {
+				i.report.Imported++
+			}
+		}
+		return nil
+	}
+
+	n, err := i.db.saveWeathers(batch)
+	if err != nil {
+		return err
+	}
+	i.report.Imported += n
+	i.report.Duplicates += len(batch) - n
+	return nil
+}
+
+// bodyTooLarge returns true when the request body has exceeded http.MaxBytesReader, its error has no type
+func bodyTooLarge(err error) bool {
+	return strings.Contains(err.Error(), "http: request body too large")
+}
@@ -0,0 +1,418 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// importDictionary are weather conditions known to the database of imports
+var importDictionary = []Description{
+	{ID: 500, Main: "Rain", Description: "light rain", Icon: "10d"},
+	{ID: 800, Main: "Clear", Description: "clear sky", Icon: "01d"},
+}
+
+func TestNewImportOptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		format        string
+		columns       string
+		units         string
+		expectedError error
+	}{
+		{
+			name:          "Invalid format",
+			format:        "xml",
+			expectedError: errors.New("format must be one of: csv, ndjson"),
+		},
+		{
+			name:          "Invalid units",
+			format:        formatCSV,
+			units:         "rankine",
+			expectedError: errors.New("units must be one of: kelvin, celsius, fahrenheit"),
+		},
+		{
+			name:          "Invalid mapping",
+			format:        formatCSV,
+			columns:       "temperature",
+			expectedError: errors.New("column mapping must be 'field=column', got 'temperature'"),
+		},
+		{
+			name:          "Unknown field",
+			format:        formatCSV,
+			columns:       "dew_point=hum",
+			expectedError: errors.New("unknown field 'dew_point', fields: measured_at, temperature, temp_min, temp_max, humidity, pressure, wind_speed, wind_deg, conditions"),
+		},
+		{
+			name:    "Valid options",
+			format:  formatNDJSON,
+			columns: "measured_at=Time, temperature=Temp (C)",
+			units:   unitsCelsius,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			o, err := NewImportOptions(123, test.format, test.columns, test.units, "", false)
+
+			// Assert
+			if test.expectedError != nil {
+				assert.EqualError(t, err, test.expectedError.Error())
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, "Time", o.Columns[fieldMeasuredAt])
+			assert.Equal(t, "Temp (C)", o.Columns[fieldTemperature])
+			assert.Equal(t, fieldTempMin, o.Columns[fieldTempMin])
+		})
+	}
+}
+
+func TestParseObservation(t *testing.T) {
+	tests := []struct {
+		name          string
+		units         string
+		timeLayout    string
+		record        map[string]string
+		expected      Weather
+		expectedError error
+	}{
+		{
+			name: "Kelvins with all fields",
+			record: map[string]string{"measured_at": "2019-03-30T12:00:00+01:00", "temperature": "280.5", "temp_min": "279", "temp_max": "281",
+				"humidity": "81", "pressure": "1013.5", "wind_speed": "3.6", "wind_deg": "270", "conditions": "500;801"},
+			expected: Weather{
+				LocationID:  123,
+				Source:      sourceImport,
+				Humidity:    float32Ptr(81),
+				Pressure:    float32Ptr(1013.5),
+				WindSpeed:   float32Ptr(3.6),
+				WindDeg:     intPtr(270),
+				MeasuredAt:  time.Date(2019, time.March, 30, 11, 0, 0, 0, time.UTC),
+				Temperature: 280.5,
+				TempMin:     279,
+				TempMax:     281,
+				Conditions:  []Condition{{Code: 500}, {Code: 801}},
+			},
+		},
+		{
+			name:   "Celsius without minimum and maximum",
+			units:  unitsCelsius,
+			record: map[string]string{"measured_at": "2019-03-30 12:00", "temperature": "10"},
+			expected: Weather{
+				LocationID:  123,
+				Source:      sourceImport,
+				MeasuredAt:  time.Date(2019, time.March, 30, 12, 0, 0, 0, time.UTC),
+				Temperature: 283.15,
+				TempMin:     283.15,
+				TempMax:     283.15,
+			},
+		},
+		{
+			name:       "Fahrenheit with custom layout",
+			units:      unitsFahrenheit,
+			timeLayout: "02/01/2006 15h",
+			record:     map[string]string{"measured_at": "30/03/2019 12h", "temperature": "32"},
+			expected: Weather{
+				LocationID:  123,
+				Source:      sourceImport,
+				MeasuredAt:  time.Date(2019, time.March, 30, 12, 0, 0, 0, time.UTC),
+				Temperature: 273.15,
+				TempMin:     273.15,
+				TempMax:     273.15,
+			},
+		},
+		{
+			name:   "Unix time",
+			record: map[string]string{"measured_at": "1553947200", "temperature": "280"},
+			expected: Weather{
+				LocationID:  123,
+				Source:      sourceImport,
+				MeasuredAt:  time.Date(2019, time.March, 30, 12, 0, 0, 0, time.UTC),
+				Temperature: 280,
+				TempMin:     280,
+				TempMax:     280,
+			},
+		},
+		{
+			name:          "Missing time",
+			record:        map[string]string{"temperature": "280"},
+			expectedError: errors.New("column 'measured_at' is required"),
+		},
+		{
+			name:          "Invalid time",
+			record:        map[string]string{"measured_at": "yesterday", "temperature": "280"},
+			expectedError: errors.New("unknown format of time 'yesterday'"),
+		},
+		{
+			name:          "Missing temperature",
+			record:        map[string]string{"measured_at": "2019-03-30"},
+			expectedError: errors.New("column 'temperature' is required"),
+		},
+		{
+			name:          "Invalid temperature",
+			record:        map[string]string{"measured_at": "2019-03-30", "temperature": "warm"},
+			expectedError: errors.New("column 'temperature' must be a number, got 'warm'"),
+		},
+		{
+			name:          "Invalid wind direction",
+			record:        map[string]string{"measured_at": "2019-03-30", "temperature": "280", "wind_deg": "W"},
+			expectedError: errors.New("column 'wind_deg' must be an integer, got 'W'"),
+		},
+		{
+			name:          "Invalid conditions",
+			record:        map[string]string{"measured_at": "2019-03-30", "temperature": "280", "conditions": "Rain"},
+			expectedError: errors.New("column 'conditions' must contain codes separated by ';', got 'Rain'"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			o, err := NewImportOptions(123, formatCSV, "", test.units, test.timeLayout, false)
+			require.Nil(t, err)
+
+			// Act
+			w, err := o.parseObservation(test.record)
+
+			// Assert
+			if test.expectedError != nil {
+				assert.EqualError(t, err, test.expectedError.Error())
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, w)
+		})
+	}
+}
+
+func TestImportObservations(t *testing.T) {
+	tests := []struct {
+		name          string
+		format        string
+		dryRun        bool
+		input         string
+		db            fakeDatabase
+		expected      ImportReport
+		expectedError error
+	}{
+		{
+			name:          "Location does not exist",
+			format:        formatCSV,
+			db:            fakeDatabase{err: sql.ErrNoRows},
+			expectedError: sql.ErrNoRows,
+		},
+		{
+			name:          "Empty file",
+			format:        formatCSV,
+			expectedError: errors.New("can not read header: EOF"),
+		},
+		{
+			name:   "CSV with invalid and repeated records",
+			format: formatCSV,
+			input: "measured_at,temperature\n" +
+				"2019-03-30 12:00,280\n" +
+				"2019-03-30 13:00,warm\n" +
+				"2019-03-30 12:00,281\n" +
+				"2019-03-30 14:00,282\n",
+			expected: ImportReport{
+				Imported:   2,
+				Duplicates: 1,
+				Invalid:    1,
+				Errors:     []string{"record 2: column 'temperature' must be a number, got 'warm'"},
+			},
+		},
+		{
+			name:   "NDJSON with observations already in database",
+			format: formatNDJSON,
+			input: `{"measured_at": "2019-03-30T12:00:00Z", "temperature": 280, "conditions": [500]}` + "\n\n" +
+				`{invalid}` + "\n",
+			db: fakeDatabase{errSave: errDuplicateObservation, descriptions: importDictionary},
+			expected: ImportReport{
+				Duplicates: 1,
+				Invalid:    1,
+				Errors:     []string{"record 2: invalid JSON: invalid character 'i' looking for beginning of object key string"},
+			},
+		},
+		{
+			name:   "Unknown weather condition",
+			format: formatNDJSON,
+			input: `{"measured_at": "2019-03-30T12:00:00Z", "temperature": 280, "conditions": [500, 999]}` + "\n" +
+				`{"measured_at": "2019-03-30T13:00:00Z", "temperature": 281, "conditions": [800]}` + "\n",
+			db: fakeDatabase{descriptions: importDictionary},
+			expected: ImportReport{
+				Imported: 1,
+				Invalid:  1,
+				Errors:   []string{"record 1: condition '999' not found"},
+			},
+		},
+		{
+			name:   "Observations are saved in batches",
+			format: formatCSV,
+			input:  "measured_at,temperature\n" + strings.Repeat("2019-03-30 12:00,280\n", 2) + observationsCSV(importBatchSize+1),
+			expected: ImportReport{
+				Imported:   importBatchSize + 2,
+				Duplicates: 1,
+			},
+		},
+		{
+			name:   "Dry run with observations in database",
+			format: formatCSV,
+			dryRun: true,
+			input:  "measured_at,temperature\n" + observationsCSV(importBatchSize+1),
+			db:     fakeDatabase{exists: true},
+			expected: ImportReport{
+				Duplicates: importBatchSize + 1,
+				DryRun:     true,
+			},
+		},
+		{
+			name:   "Dry run",
+			format: formatNDJSON,
+			dryRun: true,
+			input:  `{"measured_at": "2019-03-30T12:00:00Z", "temperature": 280}`,
+			db:     fakeDatabase{errSave: errors.New("must not be saved")},
+			expected: ImportReport{
+				Imported: 1,
+				Errors:   []string{},
+				DryRun:   true,
+			},
+		},
+		{
+			name:          "Database error",
+			format:        formatNDJSON,
+			input:         `{"measured_at": "2019-03-30T12:00:00Z", "temperature": 280}`,
+			db:            fakeDatabase{errSave: errors.New("database error")},
+			expectedError: errors.New("database error"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			o, err := NewImportOptions(123, test.format, "", "", "", test.dryRun)
+			require.Nil(t, err)
+
+			// Act
+			report, err := importObservations(test.db, strings.NewReader(test.input), o)
+
+			// Assert
+			if test.expectedError != nil {
+				assert.EqualError(t, err, test.expectedError.Error())
+				return
+			}
+			assert.Nil(t, err)
+			if test.expected.Errors == nil {
+				test.expected.Errors = []string{}
+			}
+			assert.Equal(t, test.expected, report)
+		})
+	}
+}
+
+func TestImportObservationsEndpoint(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		contentType   string
+		query         string
+		body          string
+		db            fakeDatabase
+		HTTPStatus    int
+	}{
+		{
+			name:        "Unauthorized",
+			contentType: "text/csv",
+			HTTPStatus:  http.StatusUnauthorized,
+		},
+		{
+			name:          "Unknown format",
+			authorization: "Bearer secret",
+			contentType:   "text/csv",
+			query:         "?format=xml",
+			HTTPStatus:    http.StatusBadRequest,
+		},
+		{
+			name:          "Location does not exist",
+			authorization: "Bearer secret",
+			contentType:   "text/csv",
+			db:            fakeDatabase{err: sql.ErrNoRows},
+			HTTPStatus:    http.StatusNotFound,
+		},
+		{
+			name:          "Invalid file",
+			authorization: "Bearer secret",
+			contentType:   "text/csv",
+			HTTPStatus:    http.StatusBadRequest,
+		},
+		{
+			name:          "Too large file",
+			authorization: "Bearer secret",
+			contentType:   "text/csv",
+			body:          "measured_at,temperature\n" + strings.Repeat("x", maxImportBody),
+			HTTPStatus:    http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "Observations have been imported",
+			authorization: "Bearer secret",
+			contentType:   "application/x-ndjson",
+			query:         "?units=celsius&columns=measured_at=time",
+			body:          `{"time": "2019-03-30T12:00:00Z", "temperature": 10}`,
+			HTTPStatus:    http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			container := restful.NewContainer()
+			container.Add(NewWeatherEndpoint(test.db, nil, NewAuthenticator("secret")).Endpoint())
+			httpRequest := httptest.NewRequest("POST", "/weather/123/observations:import"+test.query, strings.NewReader(test.body))
+			httpRequest.Header.Set("Content-Type", test.contentType)
+			if len(test.authorization) > 0 {
+				httpRequest.Header.Set("Authorization", test.authorization)
+			}
+			httpWriter := httptest.NewRecorder()
+
+			// Act
+			container.ServeHTTP(httpWriter, httpRequest)
+
+			// Assert
+			assert.Equal(t, test.HTTPStatus, httpWriter.Code)
+			if test.HTTPStatus == http.StatusOK {
+				report := ImportReport{}
+				require.Nil(t, json.Unmarshal(httpWriter.Body.Bytes(), &report))
+				assert.Equal(t, 1, report.Imported)
+			}
+		})
+	}
+}
+
+// observationsCSV returns records of observations an hour apart since 2019-04-01
+func observationsCSV(n int) string {
+	var b strings.Builder
+	start := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	for k := 0; k < n; k++ {
+		fmt.Fprintf(&b, "%s,280\n", start.Add(time.Duration(k)*time.Hour).Format(time.RFC3339))
+	}
+	return b.String()
+}
+
+func float32Ptr(v float32) *float32 {
+	return &v
+}
+
+func intPtr(v int) *int {
+	return &v
+}
@@ -0,0 +1,511 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/emicklei/go-restful-openapi"
+)
+
+const (
+	influxMeasurement   = "weather"
+	influxFlushInterval = 10 * time.Second
+	influxBatchSize     = 500   // lines sent in one request
+	influxBufferSize    = 10000 // lines kept while the server is unavailable
+	influxMaxErrors     = 10    // number of reported invalid lines
+	tagUnits            = "units"
+	tagLocationID       = "location_id"
+)
+
+// influxPrecisions are units of timestamps in line protocol
+var influxPrecisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `)
+	influxStringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// influxLine encodes the observation as a line of Influx line protocol, temperatures are in kelvins
+func influxLine(o Observation) string {
+	b := &strings.Builder{}
+	b.WriteString(influxMeasurementEscaper.Replace(influxMeasurement))
+	fmt.Fprintf(b, ",%s=%d", tagLocationID, o.LocationID)
+	if len(o.Source) > 0 {
+		fmt.Fprintf(b, ",source=%s", influxTagEscaper.Replace(o.Source))
+	}
+
+	fields := []string{
+		fmt.Sprintf("%s=%s", fieldTemperature, strconv.FormatFloat(float64(o.Temperature), 'f', -1, 32)),
+		fmt.Sprintf("%s=%s", fieldTempMin, strconv.FormatFloat(float64(o.TempMin), 'f', -1, 32)),
+		fmt.Sprintf("%s=%s", fieldTempMax, strconv.FormatFloat(float64(o.TempMax), 'f', -1, 32)),
+	}
+	optional := map[string]*float32{fieldHumidity: o.Humidity, fieldPressure: o.Pressure, fieldWindSpeed: o.WindSpeed}
+	for _, field := range []string{fieldHumidity, fieldPressure, fieldWindSpeed} {
+		if v := optional[field]; v != nil {
+			fields = append(fields, fmt.Sprintf("%s=%s", field, strconv.FormatFloat(float64(*v), 'f', -1, 32)))
+		}
+	}
+	if o.WindDeg != nil {
+		fields = append(fields, fmt.Sprintf("%s=%di", fieldWindDeg, *o.WindDeg))
+	}
+	if len(o.Conditions) > 0 {
+		codes := make([]string, 0, len(o.Conditions))
+		for _, code := range o.Conditions {
+			codes = append(codes, strconv.Itoa(code))
+		}
+		fields = append(fields, fmt.Sprintf(`%s="%s"`, fieldConditions, influxStringEscaper.Replace(strings.Join(codes, ";"))))
+	}
+
+	fmt.Fprintf(b, " %s %d", strings.Join(fields, ","), o.MeasuredAt.UnixNano())
+	return b.String()
+}
+
+// splitInfluxLine splits the line by the separator which is not escaped and not quoted
+func splitInfluxLine(line string, separator byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(line); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case line[i] == '\\':
+			escaped = true
+		case line[i] == '"':
+			quoted = !quoted
+		case line[i] == separator && !quoted:
+			parts = append(parts, line[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, line[start:])
+}
+
+// unescapeInflux removes backslashes of escaped characters
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// influxPoint is a parsed line of line protocol
+type influxPoint struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]string // values without type suffixes and quotes
+	timestamp   time.Time         // zero when the line has no timestamp
+}
+
+// parseInfluxLine parses 'measurement,tag=value field=value timestamp', the timestamp is in the precision
+func parseInfluxLine(line string, precision time.Duration) (influxPoint, error) {
+	p := influxPoint{tags: make(map[string]string), fields: make(map[string]string)}
+
+	sections := splitInfluxLine(line, ' ')
+	if len(sections) < 2 || len(sections) > 3 {
+		return p, errors.New("line must be 'measurement[,tags] fields [timestamp]'")
+	}
+
+	keys := splitInfluxLine(sections[0], ',')
+	p.measurement = unescapeInflux(keys[0])
+	if len(p.measurement) == 0 {
+		return p, errors.New("missing measurement")
+	}
+	for _, tag := range keys[1:] {
+		kv := splitInfluxLine(tag, '=')
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return p, fmt.Errorf("invalid tag '%s'", tag)
+		}
+		p.tags[unescapeInflux(kv[0])] = unescapeInflux(kv[1])
+	}
+
+	for _, field := range splitInfluxLine(sections[1], ',') {
+		kv := splitInfluxLine(field, '=')
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return p, fmt.Errorf("invalid field '%s'", field)
+		}
+		v := kv[1]
+		switch {
+		case len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"':
+			v = unescapeInflux(v[1 : len(v)-1])
+		case strings.HasSuffix(v, "i") || strings.HasSuffix(v, "u"):
+			v = v[:len(v)-1]
+		}
+		p.fields[unescapeInflux(kv[0])] = v
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid timestamp '%s'", sections[2])
+		}
+		p.timestamp = time.Unix(0, ts*int64(precision)).UTC()
+	}
+	return p, nil
+}
+
+// weather maps the point to weather of the location given by the tag 'location_id',
+// temperatures are in kelvins unless the tag 'units' says otherwise. Only the measurement written
+// by the mirror and known sources are accepted, so they are safe in lines written to Influx.
+func (p influxPoint) weather(now time.Time) (Weather, error) {
+	if p.measurement != influxMeasurement {
+		return Weather{}, fmt.Errorf("measurement must be '%s', got '%s'", influxMeasurement, p.measurement)
+	}
+	source, ok := p.tags["source"]
+	if ok && !validSource(source) {
+		return Weather{}, fmt.Errorf("tag 'source' must be one of: %s, got '%s'", strings.Join(sources, ", "), source)
+	}
+
+	locationID, err := strconv.Atoi(p.tags[tagLocationID])
+	if err != nil {
+		return Weather{}, fmt.Errorf("tag '%s' must be an integer, got '%s'", tagLocationID, p.tags[tagLocationID])
+	}
+
+	o, err := NewImportOptions(locationID, formatNDJSON, "", p.tags[tagUnits], time.RFC3339Nano, false)
+	if err != nil {
+		return Weather{}, err
+	}
+
+	record := make(map[string]string, len(p.fields)+1)
+	for k, v := range p.fields {
+		record[k] = v
+	}
+	t := p.timestamp
+	if t.IsZero() {
+		t = now
+	}
+	record[fieldMeasuredAt] = t.UTC().Format(time.RFC3339Nano)
+
+	w, err := o.parseObservation(record)
+	if err != nil {
+		return w, err
+	}
+	w.Source = sourceInflux
+	if ok {
+		w.Source = source
+	}
+	return w, nil
+}
+
+// InfluxMirror writes saved weather to Influx compatible HTTP endpoint in batches
+type InfluxMirror struct {
+	client   *http.Client
+	url      string // e.g. http://influx:8086/api/v2/write?org=org&bucket=weather
+	token    string
+	interval time.Duration
+
+	mutex   sync.Mutex
+	lines   []string
+	trimmed int // lines dropped from the front of the queue, so flush knows which of its lines are still queued
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// InfluxMirrorOptions configures InfluxMirror, the mirror is disabled without the URL
+type InfluxMirrorOptions struct {
+	URL     string        `yaml:"url"` // e.g. http://influx:8086/api/v2/write?org=org&bucket=weather
+	Token   string        `yaml:"token"`
+	Timeout time.Duration `yaml:"timeout"` // of writes
+}
+
+func (o InfluxMirrorOptions) validate(p *configProblems) {
+	if len(o.URL) == 0 {
+		p.add("influx.url", "is required")
+	}
+	p.positive("influx.timeout", o.Timeout)
+}
+
+// NewInfluxMirror returns InfluxMirror configured by the options
+func NewInfluxMirror(o InfluxMirrorOptions) (*InfluxMirror, error) {
+	var p configProblems
+	o.validate(&p)
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+	return newInfluxMirror(&http.Client{Timeout: o.Timeout}, o.URL, o.Token, influxFlushInterval), nil
+}
+
+func newInfluxMirror(client *http.Client, url, token string, interval time.Duration) *InfluxMirror {
+	return &InfluxMirror{
+		client:   client,
+		url:      url,
+		token:    token,
+		interval: interval,
+		quit:     make(chan struct{}),
+	}
+}
+
+// Mirror queues the saved weather, it is a save hook of Database.
+// The oldest lines are dropped when Influx is unavailable for a long time.
+func (m *InfluxMirror) Mirror(w Weather) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.lines = append(m.lines, influxLine(newObservation(w)))
+	if dropped := len(m.lines) - influxBufferSize; dropped > 0 {
+		m.lines = m.lines[dropped:]
+		m.trimmed += dropped
+		logger.Warning("Influx mirror: samples have been dropped", "dropped", dropped)
+	}
+}
+
+// write sends the lines, the token is sent as Influx 2 token
+func (m *InfluxMirror) write(lines []string) error {
+	request, err := http.NewRequest("POST", m.url, strings.NewReader(strings.Join(lines, "\n")+"\n"))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(m.token) > 0 {
+		request.Header.Set("Authorization", "Token "+m.token)
+	}
+
+	resp, err := m.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("influx write failed, status=(%d) body=(%s)", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// flush writes queued lines in batches, lines which are not written stay in the queue
+func (m *InfluxMirror) flush() (err error) {
+	start := time.Now()
+	defer func() {
+		observeCollectorRun("influx", start, err)
+	}()
+	for {
+		m.mutex.Lock()
+		n := len(m.lines)
+		if n > influxBatchSize {
+			n = influxBatchSize
+		}
+		batch := append([]string(nil), m.lines[:n]...)
+		trimmed := m.trimmed
+		m.mutex.Unlock()
+
+		if len(batch) == 0 {
+			return nil
+		}
+		if err = m.write(batch); err != nil {
+			return err
+		}
+
+		m.mutex.Lock()
+		// the queue may have been trimmed while writing, only written lines which are still queued are removed
+		if written := n - (m.trimmed - trimmed); written > 0 {
+			m.lines = m.lines[written:]
+		}
+		m.mutex.Unlock()
+	}
+}
+
+// Start writes queued weather every interval
+func (m *InfluxMirror) Start() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-m.quit:
+				if err := m.flush(); err != nil {
+					logger.Error("Influx mirror", "error", err)
+				}
+				return
+			}
+			if err := m.flush(); err != nil {
+				logger.Error("Influx mirror", "error", err)
+			}
+		}
+	}()
+}
+
+// Stop writes queued weather and waits until it is finished
+func (m *InfluxMirror) Stop() {
+	close(m.quit)
+	m.wg.Wait()
+}
+
+// influxError is the body of error responses of Influx 2 API
+type influxError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// InfluxEndpoint accepts weather in Influx line protocol
+type InfluxEndpoint struct {
+	db   databaseWeatherProvider
+	auth *Authenticator
+}
+
+// NewInfluxEndpoint returns InfluxEndpoint instance, the authenticator protects all routes
+func NewInfluxEndpoint(db databaseWeatherProvider, auth *Authenticator) *InfluxEndpoint {
+	return &InfluxEndpoint{
+		db:   db,
+		auth: auth,
+	}
+}
+
+// Endpoint is a webservice compatible with /api/v2/write of Influx 2
+func (i *InfluxEndpoint) Endpoint() *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path("/api/v2").
+		Produces(restful.MIME_JSON)
+
+	tags := []string{"influx"}
+
+	ws.Route(ws.POST("/write").To(i.write).
+		Filter(i.auth.TokenFilter).
+		Doc("write weather in Influx line protocol, lines need tag 'location_id' and field 'temperature'").
+		Param(ws.HeaderParameter("Authorization", "Token <token> or Bearer <token>").DataType("string").Required(true)).
+		Param(ws.QueryParameter("org", "ignored").DataType("string")).
+		Param(ws.QueryParameter("bucket", "ignored").DataType("string")).
+		Param(ws.QueryParameter("precision", "precision of timestamps: ns, us, ms or s").DataType("string").DefaultValue("ns")).
+		Consumes("text/plain", restful.MIME_OCTET).
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Returns(http.StatusNoContent, "written", nil).
+		Returns(http.StatusBadRequest, "invalid lines", influxError{}).
+		Returns(http.StatusRequestEntityTooLarge, importBodyTooLarge, influxError{}).
+		Returns(http.StatusUnauthorized, unauthorized, nil).
+		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil))
+
+	return ws
+}
+
+func (i *InfluxEndpoint) writeError(response *restful.Response, status int, code, message string) {
+	response.WriteHeaderAndJson(status, influxError{Code: code, Message: message}, restful.MIME_JSON)
+}
+
+// write validates all lines before any of them is saved, they are saved in transactions of importBatchSize lines
+// and lines which already exist are skipped, so a failed write may be repeated
+func (i *InfluxEndpoint) write(request *restful.Request, response *restful.Response) {
+	db := i.db.withContext(requestContext(request))
+
+	precision := request.QueryParameter("precision")
+	if len(precision) == 0 {
+		precision = "ns"
+	}
+	unit, ok := influxPrecisions[precision]
+	if !ok {
+		i.writeError(response, http.StatusBadRequest, "invalid", "precision must be one of: ns, us, ms, s")
+		return
+	}
+
+	body := request.Request.Body
+	if request.HeaderParameter("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			i.writeError(response, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	// the limit applies to decompressed lines, so a small compressed body can not exhaust memory
+	body = http.MaxBytesReader(response, body, maxImportBody)
+
+	now := time.Now()
+	var samples []Weather
+	var errs []string
+	scanner := bufio.NewScanner(body)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p, err := parseInfluxLine(line, unit)
+		if err == nil {
+			var w Weather
+			if w, err = p.weather(now); err == nil {
+				samples = append(samples, w)
+				continue
+			}
+		}
+		if len(errs) < influxMaxErrors {
+			errs = append(errs, fmt.Sprintf("line %d: %s", n, err))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if bodyTooLarge(err) {
+			i.writeError(response, http.StatusRequestEntityTooLarge, "request too large", importBodyTooLarge)
+			return
+		}
+		i.writeError(response, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	if len(errs) > 0 {
+		i.writeError(response, http.StatusBadRequest, "invalid", strings.Join(errs, "; "))
+		return
+	}
+
+	locations := make(map[int]bool)
+	for _, w := range samples {
+		locations[w.LocationID] = true
+	}
+	ids := make([]int, 0, len(locations))
+	for id := range locations {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if _, err := db.getLocation(id); err != nil {
+			if err == sql.ErrNoRows {
+				i.writeError(response, http.StatusBadRequest, "invalid", fmt.Sprintf("location '%d' does not exist", id))
+				return
+			}
+			requestLogger(request).Error("Influx write", "error", err)
+			i.writeError(response, http.StatusServiceUnavailable, "unavailable", serviceIsUnavailable)
+			return
+		}
+	}
+
+	for len(samples) > 0 {
+		n := len(samples)
+		if n > importBatchSize {
+			n = importBatchSize
+		}
+		if _, err := db.saveWeathers(samples[:n]); err != nil {
+			requestLogger(request).Error("Influx write", "error", err)
+			i.writeError(response, http.StatusServiceUnavailable, "unavailable", serviceIsUnavailable)
+			return
+		}
+		samples = samples[n:]
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
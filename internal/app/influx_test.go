@@ -0,0 +1,410 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInfluxLine(t *testing.T) {
+	// Arrange
+	o := Observation{
+		LocationID:  2643743,
+		MeasuredAt:  time.Date(2019, 3, 30, 12, 0, 0, 0, time.UTC),
+		Temperature: 283.15,
+		TempMin:     282.15,
+		TempMax:     284.15,
+		Humidity:    float32Ptr(81),
+		WindDeg:     intPtr(240),
+		Source:      `weather station\`,
+		Conditions:  []int{500, 701},
+	}
+
+	// Act
+	line := influxLine(o)
+
+	// Assert
+	assert.Equal(t, `weather,location_id=2643743,source=weather\ station\\ `+
+		`temperature=283.15,temp_min=282.15,temp_max=284.15,humidity=81,wind_deg=240i,conditions="500;701" 1553947200000000000`, line)
+}
+
+func TestParseInfluxLine(t *testing.T) {
+	tests := []struct {
+		name          string
+		line          string
+		precision     time.Duration
+		expected      influxPoint
+		expectedError error
+	}{
+		{
+			name:      "Tags, fields and timestamp",
+			line:      `weather,location_id=2643743,units=celsius temperature=10.5,wind_deg=240i,conditions="500;701" 1553947200`,
+			precision: time.Second,
+			expected: influxPoint{
+				measurement: "weather",
+				tags:        map[string]string{"location_id": "2643743", "units": "celsius"},
+				fields:      map[string]string{"temperature": "10.5", "wind_deg": "240", "conditions": "500;701"},
+				timestamp:   time.Date(2019, 3, 30, 12, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:      "Escaped characters and no timestamp",
+			line:      `weather,location_id=1,station=roof\ top note="a, b=c" `,
+			precision: time.Nanosecond,
+			expected: influxPoint{
+				measurement: "weather",
+				tags:        map[string]string{"location_id": "1", "station": "roof top"},
+				fields:      map[string]string{"note": "a, b=c"},
+			},
+		},
+		{
+			name:          "Missing fields",
+			line:          "weather,location_id=1",
+			expectedError: errors.New("line must be 'measurement[,tags] fields [timestamp]'"),
+		},
+		{
+			name:          "Invalid field",
+			line:          "weather,location_id=1 temperature 1553947200",
+			expectedError: errors.New("invalid field 'temperature'"),
+		},
+		{
+			name:          "Invalid timestamp",
+			line:          "weather,location_id=1 temperature=283.15 yesterday",
+			expectedError: errors.New("invalid timestamp 'yesterday'"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			p, err := parseInfluxLine(strings.TrimSpace(test.line), test.precision)
+
+			// Assert
+			if test.expectedError != nil {
+				assert.EqualError(t, err, test.expectedError.Error())
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, test.expected, p)
+		})
+	}
+}
+
+func TestInfluxPointWeather(t *testing.T) {
+	now := time.Date(2019, 3, 30, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Line written by the mirror is read back", func(t *testing.T) {
+		// Arrange
+		w := Weather{LocationID: 2643743, Temperature: 283.15, TempMin: 282.15, TempMax: 284.15, Pressure: float32Ptr(1012),
+			Source: sourceOWM, MeasuredAt: now, Date: now, Conditions: []Condition{{Code: 500}}}
+		p, err := parseInfluxLine(influxLine(newObservation(w)), time.Nanosecond)
+		require.Nil(t, err)
+
+		// Act
+		result, err := p.weather(time.Now())
+
+		// Assert
+		require.Nil(t, err)
+		assert.Equal(t, w.LocationID, result.LocationID)
+		assert.Equal(t, w.Temperature, result.Temperature)
+		assert.Equal(t, w.Pressure, result.Pressure)
+		assert.Equal(t, sourceOWM, result.Source)
+		assert.Equal(t, []Condition{{Code: 500}}, result.Conditions)
+		assert.True(t, now.Equal(result.MeasuredAt))
+	})
+
+	t.Run("Missing timestamp and units", func(t *testing.T) {
+		// Arrange
+		p, err := parseInfluxLine("weather,location_id=2643743,units=celsius temperature=10", time.Nanosecond)
+		require.Nil(t, err)
+
+		// Act
+		result, err := p.weather(now)
+
+		// Assert
+		require.Nil(t, err)
+		assert.Equal(t, float32(283.15), result.Temperature)
+		assert.Equal(t, sourceInflux, result.Source)
+		assert.True(t, now.Equal(result.MeasuredAt))
+	})
+
+	t.Run("Invalid measurement and source", func(t *testing.T) {
+		for line, expected := range map[string]string{
+			"temperature,location_id=2643743 value=283.15":           "measurement must be 'weather', got 'temperature'",
+			"weather,location_id=2643743,source=x\\,y temperature=1": "tag 'source' must be one of: " + strings.Join(sources, ", ") + ", got 'x,y'",
+		} {
+			// Arrange
+			p, err := parseInfluxLine(line, time.Nanosecond)
+			require.Nil(t, err)
+
+			// Act
+			_, err = p.weather(now)
+
+			// Assert
+			assert.EqualError(t, err, expected, line)
+		}
+	})
+
+	t.Run("Missing location", func(t *testing.T) {
+		// Arrange
+		p, err := parseInfluxLine("weather temperature=283.15", time.Nanosecond)
+		require.Nil(t, err)
+
+		// Act
+		_, err = p.weather(now)
+
+		// Assert
+		assert.EqualError(t, err, "tag 'location_id' must be an integer, got ''")
+	})
+}
+
+func TestInfluxMirror(t *testing.T) {
+	// Arrange
+	bodies := make(chan string, 10)
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Authorization") != "Token secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(status)
+		if status == http.StatusNoContent {
+			bodies <- string(body)
+		}
+	}))
+	defer server.Close()
+
+	m := newInfluxMirror(server.Client(), server.URL+"/api/v2/write?org=home&bucket=weather", "secret", time.Hour)
+	measuredAt := time.Date(2019, 3, 30, 12, 0, 0, 0, time.UTC)
+	m.Mirror(Weather{LocationID: 2643743, Temperature: 283.15, MeasuredAt: measuredAt, Date: measuredAt})
+
+	t.Run("Unavailable server keeps lines", func(t *testing.T) {
+		// Act
+		err := m.flush()
+
+		// Assert
+		assert.EqualError(t, err, "influx write failed, status=(503) body=()")
+		assert.Len(t, m.lines, 1)
+	})
+
+	t.Run("Lines are written when stopped", func(t *testing.T) {
+		// Arrange
+		status = http.StatusNoContent
+		m.Start()
+
+		// Act
+		m.Stop()
+
+		// Assert
+		select {
+		case body := <-bodies:
+			assert.Equal(t, "weather,location_id=2643743 temperature=283.15,temp_min=0,temp_max=0 1553947200000000000\n", body)
+		default:
+			t.Fatal("lines have not been written")
+		}
+		assert.Empty(t, m.lines)
+	})
+}
+
+func TestInfluxMirrorTrimmedWhileWriting(t *testing.T) {
+	// Arrange
+	var m *InfluxMirror
+	written := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(written) == 0 {
+			// the full queue is trimmed by new samples while the first batch is written
+			for i := influxBufferSize; i < influxBufferSize+100; i++ {
+				m.Mirror(Weather{LocationID: i, MeasuredAt: time.Unix(0, 0)})
+			}
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			written[line]++
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	m = newInfluxMirror(server.Client(), server.URL, "", time.Hour)
+	for i := 0; i < influxBufferSize; i++ {
+		m.Mirror(Weather{LocationID: i, MeasuredAt: time.Unix(0, 0)})
+	}
+
+	// Act
+	err := m.flush()
+
+	// Assert
+	require.Nil(t, err)
+	assert.Empty(t, m.lines)
+	assert.Len(t, written, influxBufferSize+100, "every line is written")
+	for line, n := range written {
+		assert.Equal(t, 1, n, "line is written once: %s", line)
+	}
+}
+
+func TestInfluxWrite(t *testing.T) {
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	gz.Write([]byte("weather,location_id=2643743 temperature=283.15 1553947200000\n"))
+	gz.Close()
+	bomb := &bytes.Buffer{}
+	gz = gzip.NewWriter(bomb)
+	gz.Write(bytes.Repeat([]byte("\n"), maxImportBody+1))
+	gz.Close()
+
+	tests := []struct {
+		name          string
+		query         string
+		authorization string
+		encoding      string
+		body          string
+		db            fakeDatabase
+		HTTPStatus    int
+		response      string
+	}{
+		{
+			name:       "Unauthorized",
+			body:       "weather,location_id=2643743 temperature=283.15",
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "Invalid precision",
+			query:         "?precision=h",
+			authorization: "Token token",
+			body:          "weather,location_id=2643743 temperature=283.15",
+			HTTPStatus:    http.StatusBadRequest,
+			response:      `{"code":"invalid","message":"precision must be one of: ns, us, ms, s"}`,
+		},
+		{
+			name:          "Invalid lines",
+			authorization: "Token token",
+			body:          "weather,location_id=2643743 temperature=283.15\n\nweather,location_id=2643743 humidity=80\nweather temperature=1",
+			HTTPStatus:    http.StatusBadRequest,
+			response: `{"code":"invalid","message":"line 3: column 'temperature' is required; ` +
+				`line 4: tag 'location_id' must be an integer, got ''"}`,
+		},
+		{
+			name:          "Unknown location",
+			authorization: "Token token",
+			body:          "weather,location_id=2643743 temperature=283.15",
+			db:            fakeDatabase{err: sql.ErrNoRows},
+			HTTPStatus:    http.StatusBadRequest,
+			response:      `{"code":"invalid","message":"location '2643743' does not exist"}`,
+		},
+		{
+			name:          "Database error",
+			authorization: "Token token",
+			body:          "weather,location_id=2643743 temperature=283.15",
+			db:            fakeDatabase{errSave: errors.New("can not connect to database")},
+			HTTPStatus:    http.StatusServiceUnavailable,
+		},
+		{
+			name:          "Lines have been written",
+			query:         "?org=home&bucket=weather&precision=s",
+			authorization: "Bearer token",
+			body:          "# comment\nweather,location_id=2643743,units=celsius temperature=10,humidity=81 1553947200\n",
+			HTTPStatus:    http.StatusNoContent,
+		},
+		{
+			name:          "Compressed duplicates have been written",
+			query:         "?precision=ms",
+			authorization: "Token token",
+			encoding:      "gzip",
+			body:          gzipped.String(),
+			db:            fakeDatabase{errSave: errDuplicateObservation},
+			HTTPStatus:    http.StatusNoContent,
+		},
+		{
+			name:          "Too large body",
+			authorization: "Token token",
+			body:          strings.Repeat("\n", maxImportBody+1),
+			HTTPStatus:    http.StatusRequestEntityTooLarge,
+			response:      `{"code":"request too large","message":"` + importBodyTooLarge + `"}`,
+		},
+		{
+			name:          "Too large decompressed body",
+			authorization: "Token token",
+			encoding:      "gzip",
+			body:          bomb.String(),
+			HTTPStatus:    http.StatusRequestEntityTooLarge,
+			response:      `{"code":"request too large","message":"` + importBodyTooLarge + `"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			container := restful.NewContainer()
+			container.Add(NewInfluxEndpoint(test.db, NewAuthenticator("token")).Endpoint())
+			httpRequest := httptest.NewRequest("POST", "/api/v2/write"+test.query, strings.NewReader(test.body))
+			httpRequest.Header.Set("Content-Type", "text/plain; charset=utf-8")
+			if len(test.authorization) > 0 {
+				httpRequest.Header.Set("Authorization", test.authorization)
+			}
+			if len(test.encoding) > 0 {
+				httpRequest.Header.Set("Content-Encoding", test.encoding)
+			}
+			httpWriter := httptest.NewRecorder()
+
+			// Act
+			container.ServeHTTP(httpWriter, httpRequest)
+
+			// Assert
+			assert.Equal(t, test.HTTPStatus, httpWriter.Code)
+			if len(test.response) > 0 {
+				assert.JSONEq(t, test.response, httpWriter.Body.String())
+			}
+		})
+	}
+}
+
+// batchRecordingDatabase keeps sizes of saved batches
+type batchRecordingDatabase struct {
+	fakeDatabase
+	batches *[]int
+}
+
+func (r batchRecordingDatabase) saveWeathers(batch []Weather) (int, error) {
+	*r.batches = append(*r.batches, len(batch))
+	return r.fakeDatabase.saveWeathers(batch)
+}
+
+func (r batchRecordingDatabase) withContext(context.Context) databaseWeatherProvider {
+	return r
+}
+
+func TestInfluxWriteBatches(t *testing.T) {
+	// Arrange
+	var batches []int
+	db := batchRecordingDatabase{batches: &batches}
+	container := restful.NewContainer()
+	container.Add(NewInfluxEndpoint(db, NewAuthenticator("token")).Endpoint())
+	var body strings.Builder
+	for k := 0; k < importBatchSize+1; k++ {
+		fmt.Fprintf(&body, "weather,location_id=2643743 temperature=283.15 %d\n", 1553947200+k)
+	}
+	httpRequest := httptest.NewRequest("POST", "/api/v2/write?precision=s", strings.NewReader(body.String()))
+	httpRequest.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	httpRequest.Header.Set("Authorization", "Token token")
+	httpWriter := httptest.NewRecorder()
+
+	// Act
+	container.ServeHTTP(httpWriter, httpRequest)
+
+	// Assert
+	assert.Equal(t, http.StatusNoContent, httpWriter.Code)
+	assert.Equal(t, []int{importBatchSize, 1}, batches)
+}
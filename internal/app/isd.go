@@ -0,0 +1,114 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isdMandatoryLength is the length of the control and mandatory data sections of ISD record
+const isdMandatoryLength = 105
+
+// isdField returns the field of ISD record at 1-based positions, both inclusive
+func isdField(record string, from, to int) string {
+	return record[from-1 : to]
+}
+
+// isdValue parses scaled numeric field, false means the value is missing or erroneous
+func isdValue(record string, from, to int, missing string, scale float64, quality int) (float64, bool, error) {
+	v := isdField(record, from, to)
+	if v == missing {
+		return 0, false, nil
+	}
+	if quality > 0 {
+		// suspect values are kept, erroneous values are skipped
+		if q := record[quality-1]; q == '3' || q == '7' {
+			return 0, false, nil
+		}
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid value '%s' at position %d", v, from)
+	}
+	return float64(n) / scale, true, nil
+}
+
+// parseISD parses NOAA Integrated Surface Data record, only the mandatory data section is used
+func parseISD(record string) (stationObservation, error) {
+	o := stationObservation{Weather: Weather{Source: sourceISD}}
+
+	record = strings.TrimRight(record, "\r\n")
+	if len(record) < isdMandatoryLength {
+		return o, fmt.Errorf("record must have at least %d characters, got %d", isdMandatoryLength, len(record))
+	}
+	o.Station = isdField(record, 5, 10) + "-" + isdField(record, 11, 15)
+
+	t, err := time.Parse("200601021504", isdField(record, 16, 27))
+	if err != nil {
+		return o, fmt.Errorf("invalid time '%s'", isdField(record, 16, 27))
+	}
+	o.Weather.MeasuredAt = t
+
+	lat, ok, err := isdValue(record, 29, 34, "+99999", 1000, 0)
+	if err != nil {
+		return o, err
+	}
+	lon, ok2, err := isdValue(record, 35, 41, "+999999", 1000, 0)
+	if err != nil {
+		return o, err
+	}
+	if ok && ok2 {
+		o.Latitude, o.Longitude = &lat, &lon
+	}
+
+	temperature, ok, err := isdValue(record, 88, 92, "+9999", 10, 93)
+	if err != nil {
+		return o, err
+	}
+	if !ok {
+		return o, errors.New("record does not contain temperature")
+	}
+	o.Weather.Temperature = float32(toKelvin(temperature, unitsCelsius))
+	o.Weather.TempMin = o.Weather.Temperature
+	o.Weather.TempMax = o.Weather.Temperature
+
+	dewPoint, ok, err := isdValue(record, 94, 98, "+9999", 10, 99)
+	if err != nil {
+		return o, err
+	}
+	if ok {
+		h := relativeHumidity(temperature, dewPoint)
+		o.Weather.Humidity = &h
+	}
+
+	pressure, ok, err := isdValue(record, 100, 104, "99999", 10, 105)
+	if err != nil {
+		return o, err
+	}
+	if ok {
+		p := float32(pressure)
+		o.Weather.Pressure = &p
+	}
+
+	speed, ok, err := isdValue(record, 66, 69, "9999", 10, 70)
+	if err != nil {
+		return o, err
+	}
+	if ok {
+		s := float32(speed)
+		o.Weather.WindSpeed = &s
+	}
+
+	// direction of calm wind is not defined
+	direction, ok, err := isdValue(record, 61, 63, "999", 1, 64)
+	if err != nil {
+		return o, err
+	}
+	if ok && record[64] != 'C' {
+		deg := int(direction)
+		o.Weather.WindDeg = &deg
+	}
+	return o, nil
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// isdHeathrow is the mandatory part of ISD record of London Heathrow
+const isdHeathrow = "0105037720999992019033011504+51478-000461FM-15+0025EGLL V0202401N006210061019N010000199+00561+00321101531"
+
+// withField replaces the field of ISD record starting at 1-based position
+func withField(record string, from int, value string) string {
+	return record[:from-1] + value + record[from-1+len(value):]
+}
+
+func TestParseISD(t *testing.T) {
+	lat, lon := 51.478, -0.461
+
+	tests := []struct {
+		name          string
+		record        string
+		expected      stationObservation
+		expectedError error
+	}{
+		{
+			name:   "Complete record with additional data",
+			record: isdHeathrow + "ADDMA1101591999999\r\n",
+			expected: stationObservation{
+				Station:   "037720-99999",
+				Latitude:  &lat,
+				Longitude: &lon,
+				Weather: Weather{
+					Temperature: float32(toKelvin(5.6, unitsCelsius)),
+					TempMin:     float32(toKelvin(5.6, unitsCelsius)),
+					TempMax:     float32(toKelvin(5.6, unitsCelsius)),
+					Humidity:    float32Ptr(85),
+					Pressure:    float32Ptr(1015.3),
+					WindSpeed:   float32Ptr(6.2),
+					WindDeg:     intPtr(240),
+					Source:      sourceISD,
+					MeasuredAt:  time.Date(2019, 3, 30, 11, 50, 0, 0, time.UTC),
+				},
+			},
+		},
+		{
+			name: "Missing and erroneous values",
+			record: withField(withField(withField(withField(withField(isdHeathrow,
+				29, "+99999"), 61, "999"), 66, "99991"), 94, "+00327"), 100, "99999"),
+			expected: stationObservation{
+				Station: "037720-99999",
+				Weather: Weather{
+					Temperature: float32(toKelvin(5.6, unitsCelsius)),
+					TempMin:     float32(toKelvin(5.6, unitsCelsius)),
+					TempMax:     float32(toKelvin(5.6, unitsCelsius)),
+					Source:      sourceISD,
+					MeasuredAt:  time.Date(2019, 3, 30, 11, 50, 0, 0, time.UTC),
+				},
+			},
+		},
+		{
+			name:   "Calm wind",
+			record: withField(withField(isdHeathrow, 61, "0001C"), 66, "0000"),
+			expected: stationObservation{
+				Station:   "037720-99999",
+				Latitude:  &lat,
+				Longitude: &lon,
+				Weather: Weather{
+					Temperature: float32(toKelvin(5.6, unitsCelsius)),
+					TempMin:     float32(toKelvin(5.6, unitsCelsius)),
+					TempMax:     float32(toKelvin(5.6, unitsCelsius)),
+					Humidity:    float32Ptr(85),
+					Pressure:    float32Ptr(1015.3),
+					WindSpeed:   float32Ptr(0),
+					Source:      sourceISD,
+					MeasuredAt:  time.Date(2019, 3, 30, 11, 50, 0, 0, time.UTC),
+				},
+			},
+		},
+		{
+			name:          "Too short",
+			record:        isdHeathrow[:100],
+			expectedError: errors.New("record must have at least 105 characters, got 100"),
+		},
+		{
+			name:          "Invalid time",
+			record:        withField(isdHeathrow, 16, "2019133"),
+			expectedError: errors.New("invalid time '201913301150'"),
+		},
+		{
+			name:          "Invalid temperature",
+			record:        withField(isdHeathrow, 88, "+0x56"),
+			expectedError: errors.New("invalid value '+0x56' at position 88"),
+		},
+		{
+			name:          "Missing temperature",
+			record:        withField(isdHeathrow, 88, "+9999"),
+			expectedError: errors.New("record does not contain temperature"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			o, err := parseISD(test.record)
+
+			// Assert
+			if test.expectedError != nil {
+				assert.EqualError(t, err, test.expectedError.Error())
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, o)
+		})
+	}
+}
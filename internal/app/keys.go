@@ -0,0 +1,230 @@
+package app
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keyReloadInterval  = 10 * time.Second // checks of modification of the file of keys are limited to one per interval
+	defaultKeyCooldown = time.Hour
+)
+
+// selections of the key of the next request to open weather map
+const (
+	keySelectionRoundRobin = "round_robin"
+	keySelectionLeastUsed  = "least_used" // the key with the fewest requests since the start
+)
+
+// errKeysRejected is returned when all keys have been rejected by open weather map with 401
+var errKeysRejected = errors.New("all open weather map keys are rejected")
+
+// KeyOptions configures the pool of open weather map API keys, keys of the file are added to keys of the token
+type KeyOptions struct {
+	File      string        `yaml:"file"`      // one key per line, it is reloaded when it is modified, e.g. a mounted secret
+	Selection string        `yaml:"selection"` // round_robin (default) or least_used
+	Cooldown  time.Duration `yaml:"cooldown"`  // of keys rejected with 401, until then the key is not used
+}
+
+func (o KeyOptions) validate(p *configProblems) {
+	if len(o.Selection) > 0 && o.Selection != keySelectionRoundRobin && o.Selection != keySelectionLeastUsed {
+		p.add("open_weather_map.keys.selection", "must be one of: %s, %s, got (%s)",
+			keySelectionRoundRobin, keySelectionLeastUsed, o.Selection)
+	}
+	p.positive("open_weather_map.keys.cooldown", o.Cooldown)
+}
+
+// owmKey is a key of the pool with its usage
+type owmKey struct {
+	value         string
+	requests      int
+	disabledUntil time.Time
+	status        int // of the response which has disabled the key
+}
+
+// keyPool selects keys of requests to open weather map, keys rejected with 401 or 429 are skipped until
+// they may be accepted again
+type keyPool struct {
+	token    string // comma separated keys
+	options  KeyOptions
+	interval time.Duration
+	now      func() time.Time
+
+	mutex     sync.Mutex
+	keys      []*owmKey
+	next      int // of round robin
+	checkedAt time.Time
+	modified  time.Time // of the loaded file
+}
+
+// newKeyPool loads keys of the token and the file, errors are returned, so missing keys stop the service
+func newKeyPool(token string, o KeyOptions, interval time.Duration) (*keyPool, error) {
+	if o.Cooldown <= 0 {
+		o.Cooldown = defaultKeyCooldown
+	}
+	k := &keyPool{token: token, options: o, interval: interval, now: time.Now}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// load reads the keys again, usage of kept keys is not changed, the previous keys are kept on errors
+func (k *keyPool) load() error {
+	values := splitKeys(k.token, ",")
+	var modified time.Time
+	if len(k.options.File) > 0 {
+		info, err := os.Stat(k.options.File)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(k.options.File)
+		if err != nil {
+			return err
+		}
+		modified = info.ModTime()
+		values = append(values, splitKeys(string(content), "\n")...)
+	}
+	if len(values) == 0 {
+		return errors.New("open weather map keys are not provided")
+	}
+
+	previous := make(map[string]*owmKey)
+	for _, key := range k.keys {
+		previous[key.value] = key
+	}
+	keys := make([]*owmKey, 0, len(values))
+	seen := make(map[string]bool)
+	for _, v := range values {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		key, ok := previous[v]
+		if !ok {
+			key = &owmKey{value: v}
+		}
+		keys = append(keys, key)
+	}
+	k.keys, k.modified = keys, modified
+	return nil
+}
+
+// splitKeys returns keys separated by the separator without blanks and # comments
+func splitKeys(s, separator string) []string {
+	var keys []string
+	for _, line := range strings.Split(s, separator) {
+		if line = strings.TrimSpace(line); len(line) > 0 && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
+
+// reload loads keys again when the file is modified, it is checked once per interval.
+// The mutex must be locked.
+func (k *keyPool) reload() {
+	if len(k.options.File) == 0 || k.now().Sub(k.checkedAt) < k.interval {
+		return
+	}
+	k.checkedAt = k.now()
+
+	info, err := os.Stat(k.options.File)
+	if err == nil && info.ModTime().Equal(k.modified) {
+		return
+	}
+	if err := k.load(); err != nil {
+		logger.Error("Reload open weather map keys", "error", err)
+		return
+	}
+	logger.Info("Open weather map keys have been reloaded", "file", k.options.File, "keys", len(k.keys))
+}
+
+// pick returns the key of the next request, quotaError is returned when all keys are limited by open weather map
+func (k *keyPool) pick() (string, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.reload()
+
+	now := k.now()
+	var selected, soonest *owmKey
+	for i := range k.keys {
+		key := k.keys[(k.next+i)%len(k.keys)]
+		if now.Before(key.disabledUntil) {
+			if soonest == nil || key.disabledUntil.Before(soonest.disabledUntil) {
+				soonest = key
+			}
+			continue
+		}
+		if selected == nil {
+			selected = key
+			if k.options.Selection != keySelectionLeastUsed {
+				k.next = (k.next + i + 1) % len(k.keys)
+				break
+			}
+		} else if key.requests < selected.requests {
+			selected = key
+		}
+	}
+
+	if selected == nil {
+		if soonest.status == http.StatusTooManyRequests {
+			return "", &quotaError{reason: "all keys are limited by open weather map", retryAfter: soonest.disabledUntil.Sub(now)}
+		}
+		return "", errKeysRejected
+	}
+	selected.requests++
+	return selected.value, nil
+}
+
+// size returns the number of keys
+func (k *keyPool) size() int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return len(k.keys)
+}
+
+// disable skips the key rejected by open weather map with the status, 401 for the cooldown and 429 for retryAfter.
+// It returns how long all keys are disabled, 0 means that another key may be used.
+func (k *keyPool) disable(value string, status int, retryAfter time.Duration) time.Duration {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	now := k.now()
+	d := retryAfter
+	if status == http.StatusUnauthorized {
+		d = k.options.Cooldown
+	}
+	for _, key := range k.keys {
+		if key.value == value {
+			key.disabledUntil, key.status = now.Add(d), status
+		}
+	}
+	owmKeysDisabled.inc(redactKey(value), strconv.Itoa(status))
+	logger.Warning("Open weather map key has been disabled", "key", redactKey(value), "status", status, "duration", d)
+
+	var wait time.Duration
+	for _, key := range k.keys {
+		if !now.Before(key.disabledUntil) {
+			return 0
+		}
+		if w := key.disabledUntil.Sub(now); wait == 0 || w < wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// redactKey returns the last characters of the key, so it can be identified in logs and metrics
+func redactKey(key string) string {
+	if len(key) <= 8 {
+		return "***"
+	}
+	return "***" + key[len(key)-4:]
+}
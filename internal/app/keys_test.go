@@ -0,0 +1,166 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyPoolSelection(t *testing.T) {
+	tests := []struct {
+		name      string
+		selection string
+		disabled  string
+		expected  []string
+	}{
+		{
+			name:     "Round robin",
+			expected: []string{"key-a", "key-b", "key-c", "key-a", "key-b", "key-c"},
+		},
+		{
+			name:     "Round robin skips disabled keys",
+			disabled: "key-b",
+			expected: []string{"key-a", "key-c", "key-a", "key-c", "key-a", "key-c"},
+		},
+		{
+			name:      "Least used",
+			selection: keySelectionLeastUsed,
+			expected:  []string{"key-a", "key-b", "key-c", "key-a", "key-b", "key-c"},
+		},
+		{
+			name:      "Least used skips disabled keys",
+			selection: keySelectionLeastUsed,
+			disabled:  "key-a",
+			expected:  []string{"key-b", "key-c", "key-b", "key-c", "key-b", "key-c"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			k, err := newKeyPool(" key-a, key-b,key-c,key-a", KeyOptions{Selection: test.selection}, keyReloadInterval)
+			require.Nil(t, err)
+			if len(test.disabled) > 0 {
+				k.disable(test.disabled, http.StatusUnauthorized, 0)
+			}
+
+			// Act
+			var keys []string
+			for range test.expected {
+				key, err := k.pick()
+				require.Nil(t, err)
+				keys = append(keys, key)
+			}
+
+			// Assert
+			assert.Equal(t, test.expected, keys)
+		})
+	}
+}
+
+func TestKeyPoolDisable(t *testing.T) {
+	// Arrange
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	k, err := newKeyPool("key-a,key-b", KeyOptions{Cooldown: time.Hour}, keyReloadInterval)
+	require.Nil(t, err)
+	k.now = func() time.Time { return now }
+
+	// Act
+	rejected := k.disable("key-a", http.StatusUnauthorized, 0)
+	limited := k.disable("key-b", http.StatusTooManyRequests, time.Minute)
+	_, limitedErr := k.pick()
+	now = now.Add(time.Minute)
+	key, err := k.pick()
+	k.disable("key-b", http.StatusUnauthorized, 0)
+	_, rejectedErr := k.pick()
+	now = now.Add(time.Hour)
+	_, enabledErr := k.pick()
+
+	// Assert
+	assert.Equal(t, time.Duration(0), rejected)
+	assert.Equal(t, time.Minute, limited)
+	assert.EqualError(t, limitedErr, "open weather map quota is exhausted: all keys are limited by open weather map, retry after 1m0s")
+	assert.Nil(t, err)
+	assert.Equal(t, "key-b", key)
+	assert.Equal(t, errKeysRejected, rejectedErr)
+	assert.Nil(t, enabledErr)
+}
+
+func TestKeyPoolReload(t *testing.T) {
+	// Arrange
+	dir, err := ioutil.TempDir("", "keys")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "keys")
+	require.Nil(t, ioutil.WriteFile(file, []byte("# rotated monthly\nkey-a\n\nkey-b\n"), 0600))
+	k, err := newKeyPool("", KeyOptions{File: file}, 0)
+	require.Nil(t, err)
+	k.disable("key-b", http.StatusUnauthorized, 0)
+
+	// Act
+	loaded := k.size()
+	require.Nil(t, ioutil.WriteFile(file, []byte("key-b\nkey-c\n"), 0600))
+	require.Nil(t, os.Chtimes(file, time.Now(), time.Now().Add(time.Second)))
+	var keys []string
+	for i := 0; i < 2; i++ {
+		key, err := k.pick()
+		require.Nil(t, err)
+		keys = append(keys, key)
+	}
+	require.Nil(t, os.Remove(file))
+	kept, err := k.pick()
+
+	// Assert
+	assert.Equal(t, 2, loaded)
+	assert.Equal(t, []string{"key-c", "key-c"}, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, "key-c", kept)
+	assert.Equal(t, 2, k.size())
+}
+
+func TestOpenWeatherMapKeyRotation(t *testing.T) {
+	// Arrange
+	var mutex sync.Mutex
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		key := req.URL.Query().Get("appid")
+		mutex.Lock()
+		keys = append(keys, key)
+		mutex.Unlock()
+		switch key {
+		case "revoked":
+			rw.WriteHeader(http.StatusUnauthorized)
+			rw.Write([]byte(`{"cod": 401, "message": "Invalid API key"}`))
+		case "limited":
+			rw.Header().Set("Retry-After", "60")
+			rw.WriteHeader(http.StatusTooManyRequests)
+			rw.Write([]byte(`{"cod": 429, "message": "Your account is temporary blocked"}`))
+		default:
+			rw.Write([]byte(`{"id": 2643743, "name": "London", "main": {"temp": 284.15}}`))
+		}
+	}))
+	defer server.Close()
+	o, err := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, Token: "revoked,limited,valid"})
+	require.Nil(t, err)
+	o.SetQuota(NewQuota(QuotaOptions{PerMinute: 60}, nil))
+
+	// Act
+	_, status, err := o.getWeather(map[string]string{"id": "2643743"})
+	_, nextStatus, nextErr := o.getWeather(map[string]string{"id": "2988507"})
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, nextErr)
+	assert.Equal(t, http.StatusOK, nextStatus)
+	assert.Equal(t, []string{"revoked", "limited", "valid", "valid"}, keys)
+	assert.Nil(t, o.quota.report().PausedUntil)
+}
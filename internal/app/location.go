@@ -5,17 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/emicklei/go-restful"
 	"github.com/emicklei/go-restful-openapi"
-	"github.com/google/logger"
 )
 
 const (
 	locationNotFound     = "location '%s' not found"
 	locationInvalidID    = "location_id must be an integer"
 	serviceIsUnavailable = "service is unavailable"
+	maxLocationDistance  = 25.0 // km between coordinates and the location of open weather map which serves them
 )
 
 // Location refers to database table 'locations'
@@ -27,6 +29,23 @@ type Location struct {
 	Longitude   float32 `json:"longitude" description:"name of the city"`
 }
 
+// NewLocation describes the location to create by one of: the name of the city with optional country code,
+// the candidate chosen from GET /geocode, coordinates, the zip code with the country code or the location id
+type NewLocation struct {
+	CityName    string            `json:"city_name,omitempty" description:"name of the city"`
+	CountryCode string            `json:"country_code,omitempty" description:"country code of the city or the zip code"`
+	Candidate   *GeocodeCandidate `json:"candidate,omitempty" description:"the place chosen from GET /geocode"`
+	Latitude    *float32          `json:"latitude,omitempty" description:"latitude of the place, it requires longitude"`
+	Longitude   *float32          `json:"longitude,omitempty" description:"longitude of the place, it requires latitude"`
+	Zip         string            `json:"zip,omitempty" description:"zip code, it requires country_code"`
+	LocationID  int               `json:"location_id,omitempty" description:"identifier of the location in open weather map service"`
+}
+
+var (
+	zipCode     = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z -]{1,9}$`)
+	countryCode = regexp.MustCompile(`^[A-Za-z]{2}$`)
+)
+
 // LocationEndpoint stores connection to database and open weather API
 type LocationEndpoint struct {
 	db                databaseWeatherProvider
@@ -63,13 +82,15 @@ func (l *LocationEndpoint) Endpoint() *restful.WebService {
 	ws.Route(ws.POST("").To(l.createLocation).
 		Doc("create a location").
 		Metadata(restfulspec.KeyOpenAPITags, tags).
-		Reads(Location{}).
+		Reads(NewLocation{}).
 		Returns(http.StatusCreated, "OK", Location{}).
 		Returns(http.StatusBadRequest, "invalid input data", nil).
 		Returns(http.StatusGatewayTimeout, "open weather api timeout", nil).
 		Returns(http.StatusBadGateway, "open weather api error", nil).
+		Returns(http.StatusTooManyRequests, quotaExhausted, nil).
 		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil).
 		Returns(http.StatusConflict, "location already exist", nil).
+		Returns(http.StatusUnprocessableEntity, "the candidate or coordinates are not served by a location of open weather map", nil).
 		Returns(http.StatusNotFound, "location does not exist", nil))
 
 	ws.Route(ws.GET("/").To(l.getLocations).
@@ -92,20 +113,22 @@ func (l *LocationEndpoint) Endpoint() *restful.WebService {
 }
 
 func (l *LocationEndpoint) getLocation(request *restful.Request, response *restful.Response) {
+	db := l.db.withContext(requestContext(request))
+
 	locationID, err := strconv.Atoi(request.PathParameter("location_id"))
 	if err != nil {
-		logger.Error("Get location: ", err)
+		requestLogger(request).Error("Get location", "error", err)
 		response.WriteErrorString(http.StatusBadRequest, locationInvalidID)
 		return
 	}
 
-	loc, err := l.db.getLocation(locationID)
+	loc, err := db.getLocation(locationID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			response.WriteErrorString(http.StatusNotFound, fmt.Sprintf(locationNotFound, strconv.Itoa(locationID)))
 			return
 		}
-		logger.Error("Get location: ", err)
+		requestLogger(request).Error("Get location", "error", err)
 		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
 		return
 	}
@@ -114,17 +137,23 @@ func (l *LocationEndpoint) getLocation(request *restful.Request, response *restf
 }
 
 func (l *LocationEndpoint) createLocation(request *restful.Request, response *restful.Response) {
+	db := l.db.withContext(requestContext(request))
+	api := l.openWeatherMapAPI.withContext(requestContext(request))
 
-	search, err := l.validateLocation(request)
+	newLocation, err := l.validateLocation(request)
 	if err != nil {
-		logger.Error("Create location: ", err)
+		requestLogger(request).Error("Create location", "error", err)
 		response.WriteError(http.StatusBadRequest, err)
 		return
 	}
+	search := newLocation.String()
 
-	result, status, err := l.openWeatherMapAPI.getWeather(map[string]string{"q": search})
+	result, status, err := api.getWeather(newLocation.params())
 	if err != nil {
-		logger.Error("Create location: ", err)
+		requestLogger(request).Error("Create location", "error", err)
+		if writeQuotaError(response, err) {
+			return
+		}
 		if status == http.StatusNotFound {
 			response.WriteErrorString(status, fmt.Sprintf(locationNotFound, search))
 		} else {
@@ -133,9 +162,20 @@ func (l *LocationEndpoint) createLocation(request *restful.Request, response *re
 		return
 	}
 
-	if _, err = l.db.getLocation(result.ID); err == nil {
+	// locations are identified by open weather map, so the place must be the one which it serves
+	if err = newLocation.servedBy(result); err != nil {
+		requestLogger(request).Info("Create location", "error", err)
+		response.WriteErrorString(http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	if _, err = db.getLocation(result.ID); err == nil {
 		str := fmt.Sprintf("location '%s' already exist", search)
-		logger.Info("Create location: ", errors.New(str))
+		if newLocation.Candidate != nil || newLocation.Latitude != nil {
+			// places near each other are served by the same location
+			str = fmt.Sprintf("location '%s' already exist as '%s,%s' (%d)", search, result.Name, result.Sys.Country, result.ID)
+		}
+		requestLogger(request).Info("Create location", "error", str)
 		response.WriteErrorString(http.StatusConflict, str)
 		return
 	}
@@ -148,21 +188,23 @@ func (l *LocationEndpoint) createLocation(request *restful.Request, response *re
 		Longitude:   result.Coord.Longitude,
 	}
 
-	err = l.db.saveLocation(location)
+	err = db.saveLocation(location)
 	if err != nil {
-		logger.Error("Create location: ", err)
+		requestLogger(request).Error("Create location", "error", err)
 		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
 		return
 	}
 
-	logger.Info("New location has been created ", location)
+	requestLogger(request).Info("New location has been created", "location_id", location.LocationID, "city", location.CityName, "country", location.CountryCode)
 	response.WriteHeaderAndEntity(http.StatusCreated, &location)
 }
 
 func (l *LocationEndpoint) getLocations(request *restful.Request, response *restful.Response) {
-	list, err := l.db.getLocations()
+	db := l.db.withContext(requestContext(request))
+
+	list, err := db.getLocations()
 	if err != nil {
-		logger.Error("Get locations: ", err)
+		requestLogger(request).Error("Get locations", "error", err)
 		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
 		return
 	}
@@ -175,21 +217,23 @@ func (l *LocationEndpoint) getLocations(request *restful.Request, response *rest
 }
 
 func (l *LocationEndpoint) deleteLocation(request *restful.Request, response *restful.Response) {
+	db := l.db.withContext(requestContext(request))
+
 	id, err := strconv.Atoi(request.PathParameter("location_id"))
 	if err != nil {
-		logger.Error("Delete location: ", err)
+		requestLogger(request).Error("Delete location", "error", err)
 		response.WriteErrorString(http.StatusBadRequest, locationInvalidID)
 		return
 	}
 
-	if err = l.db.deleteLocation(id); err != nil {
+	if err = db.deleteLocation(id); err != nil {
 		if err == sql.ErrNoRows {
 			response.WriteErrorString(http.StatusNotFound,
 				fmt.Sprintf("location '%d' does not exist", id))
 			return
 		}
 
-		logger.Error("Delete location: ", err)
+		requestLogger(request).Error("Delete location", "error", err)
 		response.WriteErrorString(http.StatusServiceUnavailable,
 			fmt.Sprintf("can not delete location '%d'", id))
 		return
@@ -198,20 +242,133 @@ func (l *LocationEndpoint) deleteLocation(request *restful.Request, response *re
 	response.WriteEntity(nil)
 }
 
-func (l *LocationEndpoint) validateLocation(request *restful.Request) (string, error) {
-	location := Location{}
+func (l *LocationEndpoint) validateLocation(request *restful.Request) (NewLocation, error) {
+	location := NewLocation{}
 	err := request.ReadEntity(&location)
 	if err != nil {
-		return "", errors.New("invalid data input")
+		return location, errors.New("invalid data input")
+	}
+	return location, location.validate()
+}
+
+// validate checks that exactly one way of finding the location is given and that it is valid
+func (n NewLocation) validate() error {
+	var shapes []string
+	if len(n.CityName) > 0 {
+		shapes = append(shapes, "city_name")
+	}
+	if n.Candidate != nil {
+		shapes = append(shapes, "candidate")
+	}
+	if n.Latitude != nil || n.Longitude != nil {
+		shapes = append(shapes, "latitude")
+	}
+	if len(n.Zip) > 0 {
+		shapes = append(shapes, "zip")
+	}
+	if n.LocationID != 0 {
+		shapes = append(shapes, "location_id")
+	}
+	if len(shapes) == 0 {
+		return errors.New("one of input data fields 'city_name', 'candidate', 'latitude' and 'longitude', 'zip' or 'location_id' is required")
+	}
+	if len(shapes) > 1 {
+		return fmt.Errorf("input data fields '%s' and '%s' can not be given together", shapes[0], shapes[1])
 	}
+	if len(n.CountryCode) > 0 && shapes[0] != "city_name" && shapes[0] != "zip" {
+		return fmt.Errorf("input data field 'country_code' can not be given with '%s'", shapes[0])
+	}
+
+	switch shapes[0] {
+	case "candidate":
+		c := n.Candidate
+		if len(c.Name) == 0 {
+			return errors.New("input data field 'candidate.name' is required")
+		}
+		if !validCoordinates(c.Latitude, c.Longitude) {
+			return errors.New("input data fields 'candidate.latitude' and 'candidate.longitude' must be valid coordinates")
+		}
+	case "latitude":
+		if n.Latitude == nil || n.Longitude == nil {
+			return errors.New("input data fields 'latitude' and 'longitude' must be given together")
+		}
+		if !validCoordinates(*n.Latitude, *n.Longitude) {
+			return errors.New("input data fields 'latitude' and 'longitude' must be valid coordinates")
+		}
+	case "zip":
+		if !zipCode.MatchString(n.Zip) {
+			return errors.New("input data field 'zip' must be a zip code, e.g. 94040 or SW1A 1AA")
+		}
+		if !countryCode.MatchString(n.CountryCode) {
+			return errors.New("input data field 'zip' requires 'country_code' of 2 letters, e.g. US")
+		}
+	case "location_id":
+		if n.LocationID < 0 {
+			return errors.New("input data field 'location_id' must be a positive integer")
+		}
+	}
+	return nil
+}
 
-	if len(location.CityName) == 0 {
-		return "", errors.New("input data field 'city_name' is required")
+// servedBy checks that the location of open weather map found by coordinates is the chosen place: the candidate
+// must have its name and country, coordinates must be near it. Other searches find the location itself.
+func (n NewLocation) servedBy(result *OpenMapWeather) error {
+	found := fmt.Sprintf("'%s,%s' (location_id %d)", result.Name, result.Sys.Country, result.ID)
+	switch {
+	case n.Candidate != nil:
+		c := n.Candidate
+		if !strings.EqualFold(c.Name, result.Name) || (len(c.CountryCode) > 0 && !strings.EqualFold(c.CountryCode, result.Sys.Country)) {
+			return fmt.Errorf("candidate '%s' is not a location of open weather map, the nearest one is %s", c, found)
+		}
+	case n.Latitude != nil && n.Longitude != nil:
+		site := stationCoordinates{Latitude: float64(*n.Latitude), Longitude: float64(*n.Longitude)}
+		city := stationCoordinates{Latitude: float64(result.Coord.Latitude), Longitude: float64(result.Coord.Longitude)}
+		if d := distance(site, city); d > maxLocationDistance {
+			return fmt.Errorf("the nearest location of open weather map %s is %.0f km away, maximum is %g km", found, d, maxLocationDistance)
+		}
 	}
+	return nil
+}
 
-	s := location.CityName
-	if len(location.CountryCode) > 0 {
-		s += fmt.Sprintf(",%s", location.CountryCode)
+func validCoordinates(latitude, longitude float32) bool {
+	return latitude >= -90 && latitude <= 90 && longitude >= -180 && longitude <= 180
+}
+
+// params returns the query of open weather map of the location
+func (n NewLocation) params() map[string]string {
+	switch {
+	case n.Candidate != nil:
+		return map[string]string{"lat": formatCoordinate(n.Candidate.Latitude), "lon": formatCoordinate(n.Candidate.Longitude)}
+	case n.Latitude != nil:
+		return map[string]string{"lat": formatCoordinate(*n.Latitude), "lon": formatCoordinate(*n.Longitude)}
+	case len(n.Zip) > 0:
+		return map[string]string{"zip": n.String()}
+	case n.LocationID > 0:
+		return map[string]string{"id": strconv.Itoa(n.LocationID)}
 	}
-	return s, nil
+	return map[string]string{"q": n.String()}
+}
+
+// String returns the search of the location, e.g. 'Warsaw,PL', 'Springfield, Illinois, US' of the candidate,
+// '51.5,-0.13' of coordinates, '94040,US' of the zip code or '2643743' of the location id
+func (n NewLocation) String() string {
+	switch {
+	case n.Candidate != nil:
+		return n.Candidate.String()
+	case n.Latitude != nil && n.Longitude != nil:
+		return formatCoordinate(*n.Latitude) + "," + formatCoordinate(*n.Longitude)
+	case len(n.Zip) > 0:
+		return n.Zip + "," + n.CountryCode
+	case n.LocationID > 0:
+		return strconv.Itoa(n.LocationID)
+	}
+	s := n.CityName
+	if len(n.CountryCode) > 0 {
+		s += fmt.Sprintf(",%s", n.CountryCode)
+	}
+	return s
+}
+
+func formatCoordinate(v float32) string {
+	return strconv.FormatFloat(float64(v), 'f', -1, 32)
 }
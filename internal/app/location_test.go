@@ -7,7 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -280,7 +280,7 @@ func TestCreateLocation(t *testing.T) {
 		{
 			name:          "Bad request",
 			cityName:      "",
-			expectedError: fmt.Errorf("input data field 'city_name' is required"),
+			expectedError: fmt.Errorf("one of input data fields 'city_name', 'candidate', 'latitude' and 'longitude', 'zip' or 'location_id' is required"),
 			HTTPStatus:    http.StatusBadRequest,
 			externalAPI: ExternalAPI{
 				HTTPStatus: http.StatusOK,
@@ -366,14 +366,6 @@ func TestCreateLocation(t *testing.T) {
 		},
 	}
 
-	URLOriginal := os.Getenv("OPEN_WEATHER_MAP_URL")
-	URLToken := os.Getenv("OPEN_WEATHER_MAP_TOKEN")
-	defer func() {
-		os.Setenv("OPEN_WEATHER_MAP_URL", URLOriginal)
-		os.Setenv("OPEN_WEATHER_MAP_TOKEN", URLToken)
-	}()
-	os.Setenv("OPEN_WEATHER_MAP_TOKEN", "token")
-
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			// Arrange
@@ -390,8 +382,7 @@ func TestCreateLocation(t *testing.T) {
 			client := server.Client()
 			client.Timeout = time.Second
 
-			os.Setenv("OPEN_WEATHER_MAP_URL", server.URL)
-			fakeAPI, _ := NewOpenWeatherAPI(client)
+			fakeAPI, _ := NewOpenWeatherAPI(client, OpenWeatherMapOptions{URL: server.URL, Token: "token"})
 			l := NewLocationEndpoint(test.db, fakeAPI)
 
 			var bodyString string
@@ -444,7 +435,7 @@ func TestCreateLocation(t *testing.T) {
 func TestLocationEnpoint(t *testing.T) {
 	t.Run("Check location endpoint settings", func(t *testing.T) {
 		// Arrange
-		externalAPI, _ := NewOpenWeatherAPI(nil)
+		externalAPI, _ := NewOpenWeatherAPI(nil, OpenWeatherMapOptions{URL: "http://test_url", Token: "token"})
 		l := NewLocationEndpoint(nil, externalAPI)
 
 		// Act
@@ -457,3 +448,177 @@ func TestLocationEnpoint(t *testing.T) {
 		assert.Len(t, routes, 4)
 	})
 }
+
+func TestCreateLocationQuery(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		HTTPStatus    int
+		expectedQuery url.Values
+		response      string
+		exists        bool
+		expected      Location
+		expectedError string
+	}{
+		{
+			name:          "Chosen candidate",
+			body:          `{"candidate": {"name": "Springfield", "state": "Illinois", "country_code": "US", "latitude": 39.799, "longitude": -89.644}}`,
+			HTTPStatus:    http.StatusCreated,
+			expectedQuery: url.Values{"lat": {"39.799"}, "lon": {"-89.644"}, "appid": {"token"}},
+			response:      `{"id": 4250542, "name": "Springfield", "coord": {"lat": 39.8, "lon": -89.64}, "sys": {"country": "US"}}`,
+			expected:      Location{CityName: "Springfield", CountryCode: "US", LocationID: 4250542, Latitude: 39.8, Longitude: -89.64},
+		},
+		{
+			name:          "Candidate which is served by another location",
+			body:          `{"candidate": {"name": "Springfield", "state": "Illinois", "country_code": "US", "latitude": 39.799, "longitude": -89.644}}`,
+			HTTPStatus:    http.StatusUnprocessableEntity,
+			expectedQuery: url.Values{"lat": {"39.799"}, "lon": {"-89.644"}, "appid": {"token"}},
+			expectedError: "candidate 'Springfield, Illinois, US' is not a location of open weather map, " +
+				"the nearest one is 'Downtown,US' (location_id 4250542)",
+		},
+		{
+			name:          "Candidate of the existing location",
+			body:          `{"candidate": {"name": "Downtown", "country_code": "US", "latitude": 39.799, "longitude": -89.644}}`,
+			HTTPStatus:    http.StatusConflict,
+			expectedQuery: url.Values{"lat": {"39.799"}, "lon": {"-89.644"}, "appid": {"token"}},
+			exists:        true,
+			expectedError: "location 'Downtown, US' already exist as 'Downtown,US' (4250542)",
+		},
+		{
+			name:          "City name",
+			body:          `{"city_name": "Springfield", "country_code": "US"}`,
+			HTTPStatus:    http.StatusCreated,
+			expectedQuery: url.Values{"q": {"Springfield,US"}, "appid": {"token"}},
+			expected:      Location{CityName: "Downtown", CountryCode: "US", LocationID: 4250542, Latitude: 39.8, Longitude: -89.64},
+		},
+		{
+			name:          "City name and candidate",
+			body:          `{"city_name": "Springfield", "candidate": {"name": "Springfield", "latitude": 39.799, "longitude": -89.644}}`,
+			HTTPStatus:    http.StatusBadRequest,
+			expectedError: "input data fields 'city_name' and 'candidate' can not be given together",
+		},
+		{
+			name:          "Candidate without name",
+			body:          `{"candidate": {"latitude": 39.799, "longitude": -89.644}}`,
+			HTTPStatus:    http.StatusBadRequest,
+			expectedError: "input data field 'candidate.name' is required",
+		},
+		{
+			name:          "Candidate with invalid coordinates",
+			body:          `{"candidate": {"name": "Springfield", "latitude": 139.799, "longitude": -89.644}}`,
+			HTTPStatus:    http.StatusBadRequest,
+			expectedError: "input data fields 'candidate.latitude' and 'candidate.longitude' must be valid coordinates",
+		},
+		{
+			name:          "Coordinates",
+			body:          `{"latitude": 39.799, "longitude": -89.644}`,
+			HTTPStatus:    http.StatusCreated,
+			expectedQuery: url.Values{"lat": {"39.799"}, "lon": {"-89.644"}, "appid": {"token"}},
+			expected:      Location{CityName: "Downtown", CountryCode: "US", LocationID: 4250542, Latitude: 39.8, Longitude: -89.64},
+		},
+		{
+			name:          "Coordinates far from the location",
+			body:          `{"latitude": 0, "longitude": 0}`,
+			HTTPStatus:    http.StatusUnprocessableEntity,
+			expectedQuery: url.Values{"lat": {"0"}, "lon": {"0"}, "appid": {"token"}},
+			expectedError: "the nearest location of open weather map 'Downtown,US' (location_id 4250542) is 9977 km away, maximum is 25 km",
+		},
+		{
+			name:          "Latitude without longitude",
+			body:          `{"latitude": 39.799}`,
+			HTTPStatus:    http.StatusBadRequest,
+			expectedError: "input data fields 'latitude' and 'longitude' must be given together",
+		},
+		{
+			name:          "Invalid coordinates",
+			body:          `{"latitude": 39.799, "longitude": -189.644}`,
+			HTTPStatus:    http.StatusBadRequest,
+			expectedError: "input data fields 'latitude' and 'longitude' must be valid coordinates",
+		},
+		{
+			name:          "Coordinates and country code",
+			body:          `{"latitude": 39.799, "longitude": -89.644, "country_code": "US"}`,
+			HTTPStatus:    http.StatusBadRequest,
+			expectedError: "input data field 'country_code' can not be given with 'latitude'",
+		},
+		{
+			name:          "Zip code",
+			body:          `{"zip": "62701", "country_code": "US"}`,
+			HTTPStatus:    http.StatusCreated,
+			expectedQuery: url.Values{"zip": {"62701,US"}, "appid": {"token"}},
+			expected:      Location{CityName: "Downtown", CountryCode: "US", LocationID: 4250542, Latitude: 39.8, Longitude: -89.64},
+		},
+		{
+			name:          "Zip code without country code",
+			body:          `{"zip": "62701"}`,
+			HTTPStatus:    http.StatusBadRequest,
+			expectedError: "input data field 'zip' requires 'country_code' of 2 letters, e.g. US",
+		},
+		{
+			name:          "Invalid zip code",
+			body:          `{"zip": "62701&id=1", "country_code": "US"}`,
+			HTTPStatus:    http.StatusBadRequest,
+			expectedError: "input data field 'zip' must be a zip code, e.g. 94040 or SW1A 1AA",
+		},
+		{
+			name:          "Location id",
+			body:          `{"location_id": 4250542}`,
+			HTTPStatus:    http.StatusCreated,
+			expectedQuery: url.Values{"id": {"4250542"}, "appid": {"token"}},
+			expected:      Location{CityName: "Downtown", CountryCode: "US", LocationID: 4250542, Latitude: 39.8, Longitude: -89.64},
+		},
+		{
+			name:          "Negative location id",
+			body:          `{"location_id": -1}`,
+			HTTPStatus:    http.StatusBadRequest,
+			expectedError: "input data field 'location_id' must be a positive integer",
+		},
+		{
+			name:          "Zip code and location id",
+			body:          `{"zip": "62701", "country_code": "US", "location_id": 4250542}`,
+			HTTPStatus:    http.StatusBadRequest,
+			expectedError: "input data fields 'zip' and 'location_id' can not be given together",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			var query url.Values
+			if len(test.response) == 0 {
+				test.response = `{"id": 4250542, "name": "Downtown", "coord": {"lat": 39.8, "lon": -89.64}, "sys": {"country": "US"}}`
+			}
+			db := fakeDatabase{err: sql.ErrNoRows}
+			if test.exists {
+				db = fakeDatabase{}
+			}
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				query = req.URL.Query()
+				rw.Write([]byte(test.response))
+			}))
+			defer server.Close()
+			o, err := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, Token: "token"})
+			require.Nil(t, err)
+			container := restful.NewContainer()
+			container.Add(NewLocationEndpoint(db, o).Endpoint())
+			httpRequest := httptest.NewRequest("POST", "/locations", strings.NewReader(test.body))
+			httpRequest.Header.Set("Content-Type", restful.MIME_JSON)
+			httpWriter := httptest.NewRecorder()
+
+			// Act
+			container.ServeHTTP(httpWriter, httpRequest)
+
+			// Assert
+			assert.Equal(t, test.HTTPStatus, httpWriter.Code)
+			if len(test.expectedError) > 0 {
+				assert.Equal(t, test.expectedError, httpWriter.Body.String())
+				assert.Equal(t, test.expectedQuery, query)
+				return
+			}
+			assert.Equal(t, test.expectedQuery, query)
+			location := Location{}
+			require.Nil(t, json.Unmarshal(httpWriter.Body.Bytes(), &location))
+			assert.Equal(t, test.expected, location)
+		})
+	}
+}
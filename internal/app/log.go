@@ -0,0 +1,286 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+// levels of log lines, lines below the level of the logger are dropped
+const (
+	levelDebug int32 = iota
+	levelInfo
+	levelWarning
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	requestIDMaxLength = 128
+)
+
+type requestIDKey struct{}
+
+// parseLevel returns the level of its name, e.g. 'warning'
+func parseLevel(name string) (int32, error) {
+	for level, n := range levelNames {
+		if n == strings.ToLower(name) {
+			return int32(level), nil
+		}
+	}
+	return 0, fmt.Errorf("level must be one of: %s, got (%s)", strings.Join(levelNames, ", "), name)
+}
+
+// logSink is shared by the logger and loggers derived from it
+type logSink struct {
+	mutex sync.Mutex
+	out   io.Writer
+	level int32 // it is changed at runtime
+}
+
+// Logger writes structured log lines, one JSON object per line with time, level, message and fields
+type Logger struct {
+	sink   *logSink
+	fields []interface{} // key-value pairs written in every line
+}
+
+// logger is the logger of the service, it writes to the standard output until the configuration is applied
+var logger = NewLogger(os.Stdout, "info")
+
+// ServiceLogger returns the logger of the service
+func ServiceLogger() *Logger {
+	return logger
+}
+
+// NewLogger returns Logger which writes lines of the level and above to out
+func NewLogger(out io.Writer, level string) *Logger {
+	l, err := parseLevel(level)
+	if err != nil {
+		l = levelInfo
+	}
+	return &Logger{sink: &logSink{out: out, level: l}}
+}
+
+// LogOptions configures logs of the service
+type LogOptions struct {
+	Output string `yaml:"output"` // stdout, stderr or the path of the file
+	Level  string `yaml:"level"`  // debug, info, warning or error, it may be changed at runtime
+}
+
+func (o LogOptions) validate(p *configProblems) {
+	if len(o.Output) == 0 {
+		p.add("log.output", "is required")
+	}
+	if _, err := parseLevel(o.Level); err != nil {
+		p.add("log.level", "must be one of: %s, got (%s)", strings.Join(levelNames, ", "), o.Level)
+	}
+}
+
+// SetupLogger directs logs of the service to the output of the options, the returned function closes the file
+func SetupLogger(o LogOptions) (func() error, error) {
+	level, err := parseLevel(o.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	var out io.Writer
+	closer := func() error { return nil }
+	switch o.Output {
+	case "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		file, err := os.OpenFile(o.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %s", err)
+		}
+		out, closer = file, file.Close
+	}
+
+	logger.sink.mutex.Lock()
+	defer logger.sink.mutex.Unlock()
+	logger.sink.out = out
+	atomic.StoreInt32(&logger.sink.level, level)
+	return closer, nil
+}
+
+// With returns the logger which adds key-value pairs to every line
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	return &Logger{sink: l.sink, fields: append(fields, keyvals...)}
+}
+
+// Level returns the name of the current level
+func (l *Logger) Level() string {
+	return levelNames[atomic.LoadInt32(&l.sink.level)]
+}
+
+// SetLevel changes the level of the logger and all loggers derived from it
+func (l *Logger) SetLevel(name string) error {
+	level, err := parseLevel(name)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&l.sink.level, level)
+	return nil
+}
+
+// Debug writes the message with key-value pairs, e.g. logger.Debug("Query", "duration", d)
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(levelDebug, msg, keyvals)
+}
+
+// Info writes the message with key-value pairs
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(levelInfo, msg, keyvals)
+}
+
+// Warning writes the message with key-value pairs
+func (l *Logger) Warning(msg string, keyvals ...interface{}) {
+	l.log(levelWarning, msg, keyvals)
+}
+
+// Error writes the message with key-value pairs, the error is usually passed as 'error' key
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(levelError, msg, keyvals)
+}
+
+func (l *Logger) log(level int32, msg string, keyvals []interface{}) {
+	if level < atomic.LoadInt32(&l.sink.level) {
+		return
+	}
+
+	var line bytes.Buffer
+	line.WriteString(`{"time":`)
+	writeLogValue(&line, time.Now().UTC().Format(time.RFC3339Nano))
+	line.WriteString(`,"level":`)
+	writeLogValue(&line, levelNames[level])
+	line.WriteString(`,"msg":`)
+	writeLogValue(&line, msg)
+	for _, fields := range [][]interface{}{l.fields, keyvals} {
+		for i := 0; i < len(fields); i += 2 {
+			var value interface{} = "(missing)"
+			if i+1 < len(fields) {
+				value = fields[i+1]
+			}
+			line.WriteByte(',')
+			writeLogValue(&line, fmt.Sprint(fields[i]))
+			line.WriteByte(':')
+			writeLogValue(&line, value)
+		}
+	}
+	line.WriteString("}\n")
+
+	l.sink.mutex.Lock()
+	defer l.sink.mutex.Unlock()
+	l.sink.out.Write(line.Bytes())
+}
+
+// writeLogValue writes the value in JSON, errors and durations are written as strings
+func writeLogValue(line *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case time.Duration:
+		value = v.String()
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(value))
+	}
+	line.Write(b)
+}
+
+// newRequestID returns random identifier of the request
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts identifiers of printable ASCII characters, so they can be logged and returned safely
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > requestIDMaxLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' || c == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the identifier of the request stored in the context
+func requestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// loggerFrom returns the logger which adds identifiers of the request and of its trace from the context to every line
+func loggerFrom(ctx context.Context) *Logger {
+	var fields []interface{}
+	if id := requestID(ctx); len(id) > 0 {
+		fields = append(fields, "request_id", id)
+	}
+	if s := spanFrom(ctx); s != nil {
+		fields = append(fields, "trace_id", hex.EncodeToString(s.context.traceID[:]))
+	}
+	if len(fields) == 0 {
+		return logger
+	}
+	return logger.With(fields...)
+}
+
+// requestContext returns the context of the request handled by the endpoint
+func requestContext(request *restful.Request) context.Context {
+	if request.Request == nil {
+		return context.Background()
+	}
+	return request.Request.Context()
+}
+
+// requestLogger returns the logger of the request handled by the endpoint
+func requestLogger(request *restful.Request) *Logger {
+	return loggerFrom(requestContext(request))
+}
+
+// RequestID is container filter which propagates X-Request-ID or generates it, the identifier is returned
+// in the response and added to logs of the request. Every request is logged when it is handled.
+func RequestID(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	id := request.Request.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	request.Request = request.Request.WithContext(context.WithValue(request.Request.Context(), requestIDKey{}, id))
+	response.AddHeader(requestIDHeader, id)
+
+	start := time.Now()
+	chain.ProcessFilter(request, response)
+
+	requestLogger(request).Info("Request has been handled",
+		"method", request.Request.Method,
+		"path", request.Request.URL.Path,
+		"status", response.StatusCode(),
+		"duration", time.Since(start))
+}
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/go-pg/pg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureLogs directs logs of the service to the buffer at debug level until the returned function is called
+func captureLogs() (*bytes.Buffer, func()) {
+	var buffer bytes.Buffer
+	logger.sink.mutex.Lock()
+	out, level := logger.sink.out, atomic.LoadInt32(&logger.sink.level)
+	logger.sink.out = &buffer
+	logger.sink.mutex.Unlock()
+	atomic.StoreInt32(&logger.sink.level, levelDebug)
+
+	return &buffer, func() {
+		logger.sink.mutex.Lock()
+		logger.sink.out = out
+		logger.sink.mutex.Unlock()
+		atomic.StoreInt32(&logger.sink.level, level)
+	}
+}
+
+// logLines parses JSON lines written by the logger
+func logLines(t *testing.T, buffer *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		fields := make(map[string]interface{})
+		require.Nil(t, json.Unmarshal([]byte(line), &fields), line)
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+func TestLogger(t *testing.T) {
+	// Arrange
+	var buffer bytes.Buffer
+	l := NewLogger(&buffer, "info").With("component", "test")
+
+	// Act
+	l.Debug("Dropped")
+	l.Info("Saved", "location_id", 2643743, "duration", 1500*time.Millisecond)
+	l.Error("Failed", "error", errors.New(`can not "save"`), "odd")
+
+	// Assert
+	lines := logLines(t, &buffer)
+	require.Len(t, lines, 2)
+	assert.Equal(t, "info", lines[0]["level"])
+	assert.Equal(t, "Saved", lines[0]["msg"])
+	assert.Equal(t, "test", lines[0]["component"])
+	assert.Equal(t, float64(2643743), lines[0]["location_id"])
+	assert.Equal(t, "1.5s", lines[0]["duration"])
+	_, err := time.Parse(time.RFC3339Nano, lines[0]["time"].(string))
+	assert.Nil(t, err)
+	assert.Equal(t, "error", lines[1]["level"])
+	assert.Equal(t, `can not "save"`, lines[1]["error"])
+	assert.Equal(t, "(missing)", lines[1]["odd"])
+}
+
+func TestLoggerSetLevel(t *testing.T) {
+	// Arrange
+	var buffer bytes.Buffer
+	l := NewLogger(&buffer, "info")
+	derived := l.With("request_id", "1")
+
+	// Act
+	err := l.SetLevel("WARNING")
+	derived.Info("Dropped")
+	derived.Warning("Written")
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, "warning", derived.Level())
+	lines := logLines(t, &buffer)
+	require.Len(t, lines, 1)
+	assert.Equal(t, "Written", lines[0]["msg"])
+	assert.EqualError(t, l.SetLevel("trace"), "level must be one of: debug, info, warning, error, got (trace)")
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		generated bool
+	}{
+		{name: "Propagated", header: "edge-5f2c1a"},
+		{name: "Generated", generated: true},
+		{name: "Invalid is replaced", header: "id with spaces", generated: true},
+		{name: "Too long is replaced", header: strings.Repeat("x", requestIDMaxLength+1), generated: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			buffer, restore := captureLogs()
+			defer restore()
+
+			var handled string
+			ws := new(restful.WebService)
+			ws.Path("/test").Route(ws.GET("").To(func(request *restful.Request, response *restful.Response) {
+				handled = requestID(requestContext(request))
+				requestLogger(request).Info("Handler")
+				response.WriteHeader(http.StatusNoContent)
+			}))
+			container := restful.NewContainer()
+			container.Add(ws)
+			container.Filter(RequestID)
+
+			req := httptest.NewRequest("GET", "/test", nil)
+			if len(test.header) > 0 {
+				req.Header.Set(requestIDHeader, test.header)
+			}
+			recorder := httptest.NewRecorder()
+
+			// Act
+			container.ServeHTTP(recorder, req)
+
+			// Assert
+			id := recorder.Header().Get(requestIDHeader)
+			if test.generated {
+				assert.Len(t, id, 32)
+			} else {
+				assert.Equal(t, test.header, id)
+			}
+			assert.Equal(t, id, handled)
+
+			lines := logLines(t, buffer)
+			require.Len(t, lines, 2)
+			assert.Equal(t, "Handler", lines[0]["msg"])
+			assert.Equal(t, id, lines[0]["request_id"])
+			assert.Equal(t, "Request has been handled", lines[1]["msg"])
+			assert.Equal(t, id, lines[1]["request_id"])
+			assert.Equal(t, float64(http.StatusNoContent), lines[1]["status"])
+			assert.Equal(t, "/test", lines[1]["path"])
+		})
+	}
+}
+
+func TestQueryLogs(t *testing.T) {
+	// Arrange
+	buffer, restore := captureLogs()
+	defer restore()
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "edge-5f2c1a")
+	event := &pg.QueryEvent{Ctx: ctx, Query: "SELECT 1", Data: make(map[interface{}]interface{}), Error: errors.New("connection refused")}
+
+	// Act
+	queryMetrics{}.BeforeQuery(event)
+	queryMetrics{}.AfterQuery(event)
+
+	// Assert
+	lines := logLines(t, buffer)
+	require.Len(t, lines, 1)
+	assert.Equal(t, "warning", lines[0]["level"])
+	assert.Equal(t, "edge-5f2c1a", lines[0]["request_id"])
+	assert.Equal(t, "select", lines[0]["operation"])
+	assert.Equal(t, "connection refused", lines[0]["error"])
+}
+
+func TestOpenWeatherMapLogs(t *testing.T) {
+	// Arrange
+	buffer, restore := captureLogs()
+	defer restore()
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte(`{"message": "city not found"}`))
+	}))
+	defer server.Close()
+	o, err := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, Token: "secret"})
+	require.Nil(t, err)
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "edge-5f2c1a")
+
+	// Act
+	_, status, _ := o.withContext(ctx).getWeather(map[string]string{"q": "Atlantis"})
+
+	// Assert
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.NotContains(t, buffer.String(), "secret")
+	lines := logLines(t, buffer)
+	require.Len(t, lines, 1)
+	assert.Equal(t, "debug", lines[0]["level"])
+	assert.Equal(t, "edge-5f2c1a", lines[0]["request_id"])
+	assert.Equal(t, "weather", lines[0]["endpoint"])
+	assert.Equal(t, float64(http.StatusNotFound), lines[0]["status"])
+}
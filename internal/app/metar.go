@@ -0,0 +1,233 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metarHeaderLayout is the layout of the line which precedes reports in NOAA METAR files, e.g. '2019/03/30 11:50'
+const metarHeaderLayout = "2006/01/02 15:04"
+
+var (
+	metarStation     = regexp.MustCompile(`^[A-Z][A-Z0-9]{3}$`)
+	metarTime        = regexp.MustCompile(`^(\d{2})(\d{2})(\d{2})Z$`)
+	metarWind        = regexp.MustCompile(`^(\d{3}|VRB)(\d{2,3})(?:G\d{2,3})?(KT|MPS|KMH)$`)
+	metarTemperature = regexp.MustCompile(`^(M?\d{2})/(M?\d{2})?$`)
+	metarPressure    = regexp.MustCompile(`^([QA])(\d{4})$`)
+	metarCloud       = regexp.MustCompile(`^(FEW|SCT|BKN|OVC|VV)(\d{3}|///)`)
+	metarPhenomenon  = regexp.MustCompile(`^(-|\+|VC)?(MI|PR|BC|DR|BL|SH|TS|FZ)?((?:DZ|RA|SN|SG|IC|PL|GR|GS|UP)*)(BR|FG|FU|VA|DU|SA|HZ|PY|PO|SQ|FC|SS|DS)?$`)
+)
+
+// metarClouds maps cloud cover to codes of weather conditions, the last one is the most significant
+var metarClouds = map[string]int{"FEW": 801, "SCT": 802, "BKN": 803, "OVC": 804, "VV": 804}
+
+// metarObscurations maps obscurations and other phenomena to codes of weather conditions
+var metarObscurations = map[string]int{
+	"BR": 701, "FU": 711, "HZ": 721, "PO": 731, "FG": 741, "SA": 751, "DU": 761,
+	"VA": 762, "SQ": 771, "FC": 781, "SS": 731, "DS": 731, "PY": 701,
+}
+
+// stationObservation is a weather sample measured by a weather station
+type stationObservation struct {
+	Station   string   // ICAO code for METAR, USAF-WBAN for ISD
+	Latitude  *float64 // coordinates of the station when given by the record itself
+	Longitude *float64
+	Weather   Weather
+}
+
+// intensity returns index of light, moderate or heavy variant of the condition
+func intensity(prefix string) int {
+	switch prefix {
+	case "-":
+		return 0
+	case "+":
+		return 2
+	}
+	return 1
+}
+
+// phenomenonCode maps METAR present weather group, e.g. '-SHRA', to the code of weather condition
+func phenomenonCode(group string) (int, bool) {
+	m := metarPhenomenon.FindStringSubmatch(group)
+	if m == nil || len(m[2])+len(m[3])+len(m[4]) == 0 {
+		return 0, false
+	}
+	level, descriptor, precipitation, other := intensity(m[1]), m[2], m[3], m[4]
+
+	switch {
+	case descriptor == "TS":
+		if len(precipitation) > 0 {
+			return 200 + level, true
+		}
+		return 210 + level, true
+	case strings.Contains(precipitation, "RA") && strings.Contains(precipitation, "SN"):
+		return []int{615, 616, 616}[level], true
+	case descriptor == "FZ" && strings.Contains(precipitation, "RA"):
+		return 511, true
+	case strings.Contains(precipitation, "RA"):
+		if descriptor == "SH" {
+			return 520 + level, true
+		}
+		return 500 + level, true
+	case strings.Contains(precipitation, "SN"):
+		if descriptor == "SH" {
+			return 620 + level, true
+		}
+		return 600 + level, true
+	case strings.Contains(precipitation, "DZ"):
+		return 300 + level, true
+	case strings.Contains(precipitation, "PL") || strings.Contains(precipitation, "SG") ||
+		strings.Contains(precipitation, "GS") || strings.Contains(precipitation, "GR"):
+		return 611, true
+	case len(other) > 0:
+		return metarObscurations[other], true
+	}
+	return 0, false
+}
+
+// metarTemperatureValue parses temperature in Celsius, 'M' means minus
+func metarTemperatureValue(v string) float64 {
+	t, _ := strconv.Atoi(strings.TrimPrefix(v, "M"))
+	if strings.HasPrefix(v, "M") {
+		return float64(-t)
+	}
+	return float64(t)
+}
+
+// relativeHumidity computes humidity in % from temperature and dew point in Celsius (Magnus formula)
+func relativeHumidity(temperature, dewPoint float64) float32 {
+	h := 100 * math.Exp(17.625*dewPoint/(243.04+dewPoint)) / math.Exp(17.625*temperature/(243.04+temperature))
+	return float32(math.Round(math.Min(h, 100)))
+}
+
+// resolveDay returns the time of the report given as day of the month, hour and minute.
+// Reports refer to the month of the reference time, unless they would be in the future.
+func resolveDay(reference time.Time, day, hour, minute int) (time.Time, error) {
+	if day < 1 || day > 31 || hour > 23 || minute > 59 {
+		return time.Time{}, fmt.Errorf("invalid time %02d%02d%02dZ", day, hour, minute)
+	}
+	reference = reference.UTC()
+	for months := 0; months < 3; months++ {
+		month := monthStart(reference).AddDate(0, -months, 0)
+		t := time.Date(month.Year(), month.Month(), day, hour, minute, 0, 0, time.UTC)
+		if t.Month() == month.Month() && !t.After(reference.Add(24*time.Hour)) {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %02d%02d%02dZ", day, hour, minute)
+}
+
+// parseMETAR parses the METAR report, the reference time is used to resolve the month of the report
+func parseMETAR(report string, reference time.Time) (stationObservation, error) {
+	o := stationObservation{Weather: Weather{Source: sourceMETAR}}
+
+	fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(report), "="))
+	if len(fields) > 0 && (fields[0] == "METAR" || fields[0] == "SPECI") {
+		fields = fields[1:]
+	}
+	if len(fields) < 2 || !metarStation.MatchString(fields[0]) {
+		return o, errors.New("report must start with ICAO code of the station")
+	}
+	o.Station = fields[0]
+
+	m := metarTime.FindStringSubmatch(fields[1])
+	if m == nil {
+		return o, fmt.Errorf("time of the report must be in format DDHHMMZ, got '%s'", fields[1])
+	}
+	day, _ := strconv.Atoi(m[1])
+	hour, _ := strconv.Atoi(m[2])
+	minute, _ := strconv.Atoi(m[3])
+	t, err := resolveDay(reference, day, hour, minute)
+	if err != nil {
+		return o, err
+	}
+	o.Weather.MeasuredAt = t
+
+	temperature := false
+	cloud, clear := 0, false
+	seen := make(map[int]bool)
+	for _, f := range fields[2:] {
+		if f == "RMK" || f == "TEMPO" || f == "BECMG" || f == "NOSIG" {
+			// remarks and forecasts are not observations
+			break
+		}
+
+		if m = metarWind.FindStringSubmatch(f); m != nil {
+			speed, _ := strconv.ParseFloat(m[2], 64)
+			switch m[3] {
+			case "KT":
+				speed *= 0.514444
+			case "KMH":
+				speed /= 3.6
+			}
+			s := float32(math.Round(speed*10) / 10)
+			o.Weather.WindSpeed = &s
+			if m[1] != "VRB" {
+				deg, _ := strconv.Atoi(m[1])
+				o.Weather.WindDeg = &deg
+			}
+			continue
+		}
+
+		if m = metarTemperature.FindStringSubmatch(f); m != nil {
+			t := metarTemperatureValue(m[1])
+			o.Weather.Temperature = float32(toKelvin(t, unitsCelsius))
+			o.Weather.TempMin = o.Weather.Temperature
+			o.Weather.TempMax = o.Weather.Temperature
+			if len(m[2]) > 0 {
+				h := relativeHumidity(t, metarTemperatureValue(m[2]))
+				o.Weather.Humidity = &h
+			}
+			temperature = true
+			continue
+		}
+
+		if m = metarPressure.FindStringSubmatch(f); m != nil {
+			v, _ := strconv.ParseFloat(m[2], 64)
+			if m[1] == "A" {
+				// hundredths of inches of mercury
+				v = math.Round(v * 0.338639)
+			}
+			p := float32(v)
+			o.Weather.Pressure = &p
+			continue
+		}
+
+		if m = metarCloud.FindStringSubmatch(f); m != nil {
+			if c := metarClouds[m[1]]; c > cloud {
+				cloud = c
+			}
+			continue
+		}
+
+		switch f {
+		case "CAVOK", "SKC", "CLR", "NSC", "NCD":
+			clear = true
+			continue
+		}
+
+		if code, ok := phenomenonCode(f); ok && !seen[code] {
+			seen[code] = true
+			o.Weather.Conditions = append(o.Weather.Conditions, Condition{Code: code})
+		}
+	}
+
+	if !temperature {
+		return o, errors.New("report does not contain temperature")
+	}
+
+	// cloud cover describes the weather only when nothing else happens
+	if len(o.Weather.Conditions) == 0 {
+		if cloud > 0 {
+			o.Weather.Conditions = append(o.Weather.Conditions, Condition{Code: cloud})
+		} else if clear {
+			o.Weather.Conditions = append(o.Weather.Conditions, Condition{Code: 800})
+		}
+	}
+	return o, nil
+}
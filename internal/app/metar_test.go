@@ -0,0 +1,168 @@
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMETAR(t *testing.T) {
+	reference := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		report        string
+		expected      stationObservation
+		expectedError error
+	}{
+		{
+			name:   "European report with rain",
+			report: "METAR EGLL 301150Z 24012KT 9999 -RA BKN020 12/08 Q1015 NOSIG=",
+			expected: stationObservation{
+				Station: "EGLL",
+				Weather: Weather{
+					Temperature: 285.15,
+					TempMin:     285.15,
+					TempMax:     285.15,
+					Humidity:    float32Ptr(77),
+					Pressure:    float32Ptr(1015),
+					WindSpeed:   float32Ptr(6.2),
+					WindDeg:     intPtr(240),
+					Source:      sourceMETAR,
+					Conditions:  []Condition{{Code: 500}},
+					MeasuredAt:  time.Date(2019, 3, 30, 11, 50, 0, 0, time.UTC),
+				},
+			},
+		},
+		{
+			name:   "American report with clear sky and remarks",
+			report: "KJFK 021551Z VRB03KT 10SM CLR M02/M08 A3012 RMK AO2 SLP201 -RA",
+			expected: stationObservation{
+				Station: "KJFK",
+				Weather: Weather{
+					Temperature: 271.15,
+					TempMin:     271.15,
+					TempMax:     271.15,
+					Humidity:    float32Ptr(64),
+					Pressure:    float32Ptr(1020),
+					WindSpeed:   float32Ptr(1.5),
+					Source:      sourceMETAR,
+					Conditions:  []Condition{{Code: 800}},
+					MeasuredAt:  time.Date(2019, 3, 2, 15, 51, 0, 0, time.UTC),
+				},
+			},
+		},
+		{
+			name:   "Several phenomena without dew point",
+			report: "SPECI LKPR 010020Z 31008MPS 3000 +TSRA SHSN -RASN FG VCSH OVC005 05/ Q0998",
+			expected: stationObservation{
+				Station: "LKPR",
+				Weather: Weather{
+					Temperature: 278.15,
+					TempMin:     278.15,
+					TempMax:     278.15,
+					Pressure:    float32Ptr(998),
+					WindSpeed:   float32Ptr(8),
+					WindDeg:     intPtr(310),
+					Source:      sourceMETAR,
+					Conditions:  []Condition{{Code: 202}, {Code: 621}, {Code: 615}, {Code: 741}},
+					MeasuredAt:  time.Date(2019, 4, 1, 0, 20, 0, 0, time.UTC),
+				},
+			},
+		},
+		{
+			name:          "Missing station",
+			report:        "301150Z 24012KT 12/08 Q1015",
+			expectedError: errors.New("report must start with ICAO code of the station"),
+		},
+		{
+			name:          "Invalid time",
+			report:        "EGLL 3011Z 24012KT 12/08 Q1015",
+			expectedError: errors.New("time of the report must be in format DDHHMMZ, got '3011Z'"),
+		},
+		{
+			name:          "Day out of range",
+			report:        "EGLL 321150Z 24012KT 12/08 Q1015",
+			expectedError: errors.New("invalid time 321150Z"),
+		},
+		{
+			name:          "Missing temperature",
+			report:        "EGLL 301150Z 24012KT 9999 Q1015",
+			expectedError: errors.New("report does not contain temperature"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			o, err := parseMETAR(test.report, reference)
+
+			// Assert
+			if test.expectedError != nil {
+				assert.EqualError(t, err, test.expectedError.Error())
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, o)
+		})
+	}
+}
+
+func TestPhenomenonCode(t *testing.T) {
+	tests := []struct {
+		group    string
+		expected int
+		ok       bool
+	}{
+		{group: "TS", expected: 211, ok: true},
+		{group: "-TSRA", expected: 200, ok: true},
+		{group: "DZ", expected: 301, ok: true},
+		{group: "FZRA", expected: 511, ok: true},
+		{group: "+SHRA", expected: 522, ok: true},
+		{group: "-SN", expected: 600, ok: true},
+		{group: "PL", expected: 611, ok: true},
+		{group: "BR", expected: 701, ok: true},
+		{group: "HZ", expected: 721, ok: true},
+		{group: "VCSH", ok: false},
+		{group: "9999", ok: false},
+		{group: "AUTO", ok: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.group, func(t *testing.T) {
+			// Act
+			code, ok := phenomenonCode(test.group)
+
+			// Assert
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.expected, code)
+		})
+	}
+}
+
+func TestResolveDay(t *testing.T) {
+	reference := time.Date(2019, 3, 1, 6, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		day      int
+		expected time.Time
+	}{
+		{name: "Same month", day: 1, expected: time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{name: "Previous month", day: 28, expected: time.Date(2019, 2, 28, 12, 0, 0, 0, time.UTC)},
+		{name: "Day missing in previous month", day: 30, expected: time.Date(2019, 1, 30, 12, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			result, err := resolveDay(reference, test.day, 12, 0)
+
+			// Assert
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, result)
+		})
+	}
+}
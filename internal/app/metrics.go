@@ -0,0 +1,449 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/emicklei/go-restful-openapi"
+	"github.com/go-pg/pg"
+)
+
+// metricsContentType is the version of Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// defaultBuckets are upper bounds of latency histograms in seconds
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var metricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsRegistry writes registered metrics in Prometheus text exposition format
+type metricsRegistry struct {
+	mutex   sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func (r *metricsRegistry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *metricsRegistry) write(w io.Writer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
+
+// formatLabels returns '{name="value",...}', the extra label is appended when its name is not empty
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && len(extraName) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, metricsEscaper.Replace(values[i])))
+	}
+	if len(extraName) > 0 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// labelKey identifies values of labels in maps of series
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// metricFamily is a name, help and label names shared by all series of a metric
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (f metricFamily) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+}
+
+// series is a value of a counter or a gauge with values of labels
+type series struct {
+	labels []string
+	value  float64
+}
+
+// counterVec is a counter partitioned by labels
+type counterVec struct {
+	metricFamily
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+func (r *metricsRegistry) counter(name, help string, labels ...string) *counterVec {
+	c := &counterVec{metricFamily: metricFamily{name: name, help: help, kind: "counter", labels: labels}, series: make(map[string]*series)}
+	r.register(c)
+	return c
+}
+
+// add increases the counter of the label values, e.g. method and route
+func (c *counterVec) add(v float64, labels ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := labelKey(labels)
+	s, ok := c.series[key]
+	if !ok {
+		s = &series{labels: labels}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+func (c *counterVec) inc(labels ...string) {
+	c.add(1, labels...)
+}
+
+func (c *counterVec) value(labels ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if s, ok := c.series[labelKey(labels)]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeHeader(w)
+	for _, key := range sortedSeries(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labels, "", ""), formatValue(s.value))
+	}
+}
+
+// gaugeVec is a gauge partitioned by labels, reset removes all series before they are collected again
+type gaugeVec struct {
+	counterVec
+}
+
+func (r *metricsRegistry) gauge(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{counterVec{metricFamily: metricFamily{name: name, help: help, kind: "gauge", labels: labels}, series: make(map[string]*series)}}
+	r.register(g)
+	return g
+}
+
+func (g *gaugeVec) set(v float64, labels ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.series[labelKey(labels)] = &series{labels: labels, value: v}
+}
+
+func (g *gaugeVec) reset() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.series = make(map[string]*series)
+}
+
+func sortedSeries(m map[string]*series) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// histogramSeries are cumulative counts of observations in buckets
+type histogramSeries struct {
+	labels []string
+	counts []uint64 // observations less or equal to the bucket, without +Inf
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram partitioned by labels
+type histogramVec struct {
+	metricFamily
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+func (r *metricsRegistry) histogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		metricFamily: metricFamily{name: name, help: help, kind: "histogram", labels: labels},
+		buckets:      buckets,
+		series:       make(map[string]*histogramSeries),
+	}
+	r.register(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, labels ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := labelKey(labels)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// observeSince records seconds elapsed since the start
+func (h *histogramVec) observeSince(start time.Time, labels ...string) {
+	h.observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.writeHeader(w)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", formatValue(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels, "", ""), s.count)
+	}
+}
+
+// serviceMetrics are collected by the whole service and exposed by /metrics
+var serviceMetrics = &metricsRegistry{}
+
+var (
+	httpRequests = serviceMetrics.counter("weather_http_requests_total",
+		"Number of HTTP requests by method, route and status code.", "method", "route", "code")
+	httpDuration = serviceMetrics.histogram("weather_http_request_duration_seconds",
+		"Latency of HTTP requests by method and route.", defaultBuckets, "method", "route")
+	owmRequests = serviceMetrics.counter("weather_owm_requests_total",
+		"Number of requests to open weather map by endpoint and status code, 'error' means no response.", "endpoint", "code")
+	owmDuration = serviceMetrics.histogram("weather_owm_request_duration_seconds",
+		"Latency of requests to open weather map by endpoint.", defaultBuckets, "endpoint")
+	owmCacheRequests = serviceMetrics.counter("weather_owm_cache_requests_total",
+		"Number of requests for weather of open weather map by result: hit, miss or shared with a concurrent request.", "result")
+	owmAttempts = serviceMetrics.counter("weather_owm_attempts_total",
+		"Number of attempts of requests to open weather map by endpoint, attempt and result: final, retried or exhausted.",
+		"endpoint", "attempt", "result")
+	owmKeysDisabled = serviceMetrics.counter("weather_owm_keys_disabled_total",
+		"Number of times open weather map keys have been disabled by redacted key and status code: 401 or 429.", "key", "code")
+	owmQuotaRejections = serviceMetrics.counter("weather_owm_quota_rejections_total",
+		"Number of requests to open weather map which have not been sent because of the quota by priority.", "priority")
+	dbDuration = serviceMetrics.histogram("weather_db_query_duration_seconds",
+		"Latency of database queries by operation.", defaultBuckets, "operation")
+	dbErrors = serviceMetrics.counter("weather_db_query_errors_total",
+		"Number of failed database queries by operation.", "operation")
+	collectorRuns = serviceMetrics.counter("weather_collector_runs_total",
+		"Number of runs of background collectors by result.", "collector", "result")
+	collectorDuration = serviceMetrics.histogram("weather_collector_run_duration_seconds",
+		"Duration of runs of background collectors.", defaultBuckets, "collector")
+	collectorLastSuccess = serviceMetrics.gauge("weather_collector_last_success_timestamp_seconds",
+		"Unix time of the last successful run of background collectors.", "collector")
+	locationsGauge = serviceMetrics.gauge("weather_locations",
+		"Number of saved locations.")
+	lastSampleAge = serviceMetrics.gauge("weather_last_sample_age_seconds",
+		"Age of the newest weather sample of all locations.")
+
+	// collectMutex guards gauges which are read from database, so concurrent scrapes do not write them half-reset
+	collectMutex sync.Mutex
+)
+
+// observeCollectorRun records the run of the background collector, e.g. partition maintenance
+func observeCollectorRun(collector string, start time.Time, err error) {
+	collectorDuration.observeSince(start, collector)
+	if err != nil {
+		collectorRuns.inc(collector, "error")
+		return
+	}
+	collectorRuns.inc(collector, "success")
+	collectorLastSuccess.set(float64(time.Now().Unix()), collector)
+}
+
+// observeOWMRequest records the request to open weather map, the code is 'error' when there is no response
+func observeOWMRequest(endpoint string, start time.Time, resp *http.Response, err error) {
+	owmDuration.observeSince(start, endpoint)
+	code := "error"
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		code = "timeout"
+	}
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	owmRequests.inc(endpoint, code)
+}
+
+// queryMetrics is go-pg query hook which records latency of database queries and logs them with their requests.
+// Queries of traced requests are recorded as their spans.
+type queryMetrics struct{}
+
+type (
+	queryStartKey struct{}
+	querySpanKey  struct{}
+)
+
+func (queryMetrics) BeforeQuery(event *pg.QueryEvent) {
+	event.Data[queryStartKey{}] = time.Now()
+	if spanFrom(event.Ctx) != nil {
+		_, s := startSpan(event.Ctx, "query", spanKindClient)
+		event.Data[querySpanKey{}] = s
+	}
+}
+
+func (queryMetrics) AfterQuery(event *pg.QueryEvent) {
+	start, ok := event.Data[queryStartKey{}].(time.Time)
+	if !ok {
+		return
+	}
+	operation := "unknown"
+	if query, err := event.UnformattedQuery(); err == nil {
+		operation = queryOperation(query)
+	}
+	dbDuration.observeSince(start, operation)
+	if s, ok := event.Data[querySpanKey{}].(*span); ok {
+		s.name = strings.ToUpper(operation)
+		s.setAttributes("db.system", "postgresql", "db.operation", operation)
+		if event.Error != nil && event.Error != pg.ErrNoRows {
+			s.setError(event.Error)
+		}
+		s.finish()
+	}
+
+	log := loggerFrom(event.Ctx).With("operation", operation, "duration", time.Since(start), "attempt", event.Attempt)
+	if event.Error != nil && event.Error != pg.ErrNoRows {
+		dbErrors.inc(operation)
+		log.Warning("Database query has failed", "error", event.Error)
+		return
+	}
+	log.Debug("Database query")
+}
+
+// queryOperation returns the first keyword of the query in lower case, e.g. 'select'
+func queryOperation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	return strings.ToLower(strings.Trim(fields[0], "("))
+}
+
+// RequestMetrics returns container filter which counts requests and measures their latency by route.
+// Routes are selected again from web services of the container, so path parameters do not make new series.
+func RequestMetrics(container *restful.Container) restful.FilterFunction {
+	router := restful.CurlyRouter{}
+	return func(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+		start := time.Now()
+		chain.ProcessFilter(request, response)
+
+		route := "unmatched"
+		if _, r, err := router.SelectRoute(container.RegisteredWebServices(), request.Request); err == nil {
+			route = r.Path
+		}
+		method := request.Request.Method
+		httpDuration.observeSince(start, method, route)
+		httpRequests.inc(method, route, strconv.Itoa(response.StatusCode()))
+	}
+}
+
+// MetricsEndpoint exposes metrics of the service for Prometheus
+type MetricsEndpoint struct {
+	db databaseWeatherProvider
+}
+
+// NewMetricsEndpoint returns MetricsEndpoint instance
+func NewMetricsEndpoint(db databaseWeatherProvider) *MetricsEndpoint {
+	return &MetricsEndpoint{
+		db: db,
+	}
+}
+
+// Endpoint is a webservice with metrics in Prometheus text exposition format
+func (m *MetricsEndpoint) Endpoint() *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path("/metrics").
+		Produces("text/plain")
+
+	tags := []string{"metrics"}
+
+	ws.Route(ws.GET("").To(m.getMetrics).
+		Doc("get metrics of the service in Prometheus text exposition format").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Returns(http.StatusOK, "OK", nil))
+
+	ws.Route(ws.GET("/weather").To(m.getWeatherMetrics).
+		Doc("get the latest weather of all locations in Prometheus text exposition format").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Returns(http.StatusOK, "OK", nil).
+		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil))
+
+	return ws
+}
+
+// collect sets gauges which are read from database, they are dropped when database is unavailable.
+// collectMutex must be held.
+func collect(ctx context.Context, summary Summary, err error) {
+	locationsGauge.reset()
+	lastSampleAge.reset()
+
+	if err != nil {
+		loggerFrom(ctx).Error("Collect metrics", "error", err)
+		return
+	}
+	locationsGauge.set(float64(summary.Locations))
+	if !summary.LastMeasuredAt.IsZero() {
+		lastSampleAge.set(time.Since(summary.LastMeasuredAt).Seconds())
+	}
+}
+
+func (m *MetricsEndpoint) getMetrics(request *restful.Request, response *restful.Response) {
+	ctx := requestContext(request)
+	// database is queried before the lock is taken, so slow queries do not block other scrapes
+	summary, err := m.db.withContext(ctx).getSummary()
+
+	var b bytes.Buffer
+	collectMutex.Lock()
+	collect(ctx, summary, err)
+	serviceMetrics.write(&b)
+	collectMutex.Unlock()
+
+	response.AddHeader("Content-Type", metricsContentType)
+	response.WriteHeader(http.StatusOK)
+	response.Write(b.Bytes())
+}
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	// Arrange
+	r := &metricsRegistry{}
+	c := r.counter("test_requests_total", "Number of requests.", "route", "code")
+	g := r.gauge("test_locations", "Number of locations.")
+	h := r.histogram("test_duration_seconds", "Latency.", []float64{0.1, 1}, "route")
+
+	c.inc("/weather/{location_id}", "200")
+	c.inc("/weather/{location_id}", "200")
+	c.inc(`/a"b`, "404")
+	g.set(3)
+	h.observe(0.05, "/weather")
+	h.observe(0.5, "/weather")
+	buf := &bytes.Buffer{}
+
+	// Act
+	r.write(buf)
+
+	// Assert
+	assert.Equal(t, `# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{route="/a\"b",code="404"} 1
+test_requests_total{route="/weather/{location_id}",code="200"} 2
+# HELP test_locations Number of locations.
+# TYPE test_locations gauge
+test_locations 3
+# HELP test_duration_seconds Latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/weather",le="0.1"} 1
+test_duration_seconds_bucket{route="/weather",le="1"} 2
+test_duration_seconds_bucket{route="/weather",le="+Inf"} 2
+test_duration_seconds_sum{route="/weather"} 0.55
+test_duration_seconds_count{route="/weather"} 2
+`, buf.String())
+}
+
+func TestQueryOperation(t *testing.T) {
+	tests := map[string]string{
+		"SELECT max(measured_at) FROM weather":  "select",
+		"  insert INTO weather VALUES (?)":      "insert",
+		"(SELECT 1) UNION (SELECT 2)":           "select",
+		"":                                      "unknown",
+		"CREATE TABLE IF NOT EXISTS weather_x ": "create",
+	}
+
+	for query, expected := range tests {
+		t.Run(query, func(t *testing.T) {
+			assert.Equal(t, expected, queryOperation(query))
+		})
+	}
+}
+
+func TestObserveCollectorRun(t *testing.T) {
+	// Arrange
+	runs := collectorRuns.value("test", "error")
+
+	// Act
+	observeCollectorRun("test", time.Now(), errors.New("can not connect to database"))
+	observeCollectorRun("test", time.Now(), nil)
+
+	// Assert
+	assert.Equal(t, runs+1, collectorRuns.value("test", "error"))
+	assert.InDelta(t, float64(time.Now().Unix()), collectorLastSuccess.value("test"), 1)
+}
+
+func TestOpenWeatherAPIMetrics(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		rw.Write([]byte(`{"cod": 401, "message": "Invalid API key"}`))
+	}))
+	defer server.Close()
+	o, _ := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, Token: "exhausted"})
+	unauthorized := owmRequests.value("weather", "401")
+
+	// Act
+	_, status, err := o.getWeather(map[string]string{"id": "2643743"})
+
+	// Assert
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.EqualError(t, err, "Invalid API key")
+	assert.Equal(t, unauthorized+1, owmRequests.value("weather", "401"))
+}
+
+func TestRequestMetrics(t *testing.T) {
+	// Arrange
+	container := restful.NewContainer()
+	container.Add(NewLocationEndpoint(fakeDatabase{locations: []Location{{LocationID: 2643743}}}, nil).Endpoint())
+	container.Filter(RequestMetrics(container))
+	found := httpRequests.value("GET", "/locations/{location_id}", "200")
+	unmatched := httpRequests.value("GET", "unmatched", "404")
+
+	// Act
+	container.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/locations/2643743", nil))
+	container.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/locations/2988507", nil))
+	container.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/locations/2643743/unknown", nil))
+
+	// Assert
+	assert.Equal(t, found+2, httpRequests.value("GET", "/locations/{location_id}", "200"))
+	assert.Equal(t, unmatched+1, httpRequests.value("GET", "unmatched", "404"))
+}
+
+func TestGetMetrics(t *testing.T) {
+	tests := []struct {
+		name     string
+		db       fakeDatabase
+		expected []string
+		missing  []string
+	}{
+		{
+			name:     "Gauges from database",
+			db:       fakeDatabase{summary: Summary{Locations: 2, LastMeasuredAt: time.Now().Add(-time.Hour)}},
+			expected: []string{"\nweather_locations 2\n", "\nweather_last_sample_age_seconds 3600"},
+		},
+		{
+			name:    "Database is unavailable",
+			db:      fakeDatabase{err: errors.New("can not connect to database")},
+			missing: []string{"\nweather_locations ", "\nweather_last_sample_age_seconds "},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			container := restful.NewContainer()
+			container.Add(NewMetricsEndpoint(test.db).Endpoint())
+			httpRequest := httptest.NewRequest("GET", "/metrics", nil)
+			httpRequest.Header.Set("Accept", "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+			httpWriter := httptest.NewRecorder()
+
+			// Act
+			container.ServeHTTP(httpWriter, httpRequest)
+
+			// Assert
+			assert.Equal(t, http.StatusOK, httpWriter.Code)
+			assert.Equal(t, metricsContentType, httpWriter.Header().Get("Content-Type"))
+			assert.Contains(t, httpWriter.Body.String(), "# TYPE weather_http_requests_total counter")
+			for _, s := range test.expected {
+				assert.Contains(t, httpWriter.Body.String(), s)
+			}
+			for _, s := range test.missing {
+				assert.NotContains(t, httpWriter.Body.String(), s)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+// Migrate applies SQL scripts of the directory, e.g. 'configs/migrations', in the order of their names, each of them
+// in its own transaction. Scripts are idempotent, so all of them are applied to the database of any version,
+// including the one created by configs/database.sql. It returns names of applied scripts.
+func (d *Database) Migrate(dir string) ([]string, error) {
+	files, err := migrationFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []string
+	for _, file := range files {
+		script, err := ioutil.ReadFile(file)
+		if err != nil {
+			return applied, err
+		}
+		if err = d.migrate(string(script)); err != nil {
+			return applied, fmt.Errorf("migration %s has failed: %s", filepath.Base(file), err)
+		}
+		applied = append(applied, filepath.Base(file))
+	}
+	return applied, nil
+}
+
+// migrationFiles returns SQL scripts of the directory sorted by name, e.g. '001_conditions_date.sql'
+func migrationFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("there are no migrations in %s", dir)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (d *Database) migrate(script string) error {
+	tx, err := d.connect().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(script); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
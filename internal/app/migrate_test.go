@@ -0,0 +1,44 @@
+package app
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationFiles(t *testing.T) {
+	// Act
+	files, err := migrationFiles("../../configs/migrations")
+
+	// Assert
+	require.Nil(t, err)
+	var names []string
+	for _, file := range files {
+		names = append(names, filepath.Base(file))
+		script, err := ioutil.ReadFile(file)
+		require.Nil(t, err)
+		assert.False(t, strings.Contains(string(script), "?"), "%s: '?' is a placeholder of queries", file)
+	}
+	assert.Equal(t, []string{
+		"001_conditions_date.sql",
+		"002_descriptions.sql",
+		"003_conditions_code.sql",
+		"004_weather_measured_at.sql",
+		"005_weather_measurements.sql",
+		"006_personal_stations.sql",
+		"007_owm_usage.sql",
+	}, names)
+}
+
+func TestMigrationFilesMissing(t *testing.T) {
+	// Act
+	files, err := migrationFiles("../../configs/fake-owm")
+
+	// Assert
+	assert.Nil(t, files)
+	assert.EqualError(t, err, "there are no migrations in ../../configs/fake-owm")
+}
@@ -0,0 +1,421 @@
+package app
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// types of MQTT 3.1.1 control packets
+const (
+	mqttConnect     = 1
+	mqttConnAck     = 2
+	mqttPublish     = 3
+	mqttPubAck      = 4
+	mqttSubscribe   = 8
+	mqttSubAck      = 9
+	mqttPingReq     = 12
+	mqttPingResp    = 13
+	mqttDisconnect  = 14
+	mqttMaxLength   = 268435455 // maximum remaining length of a packet
+	mqttMaxQoS      = 1         // QoS 2 is not supported, so subscriptions are limited to QoS 1
+	mqttAckTimeout  = 10 * time.Second
+	mqttDialTimeout = 10 * time.Second
+	mqttInboxSize   = 100 // received messages waiting for the handler
+)
+
+// DefaultMQTTPacketSize is the maximum size of received packets, readings of sensors are much smaller
+const DefaultMQTTPacketSize = 64 * 1024
+
+var errMQTTClosed = errors.New("mqtt connection is closed")
+
+// mqttPacket is a control packet without the remaining length
+type mqttPacket struct {
+	header byte // type and flags
+	body   []byte
+}
+
+func (p mqttPacket) kind() byte {
+	return p.header >> 4
+}
+
+// writeMQTTPacket writes the packet with the variable length encoding of its size
+func writeMQTTPacket(w io.Writer, p mqttPacket) error {
+	if len(p.body) > mqttMaxLength {
+		return fmt.Errorf("mqtt packet is too large: %d bytes", len(p.body))
+	}
+	buf := []byte{p.header}
+	n := len(p.body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(buf, p.body...))
+	return err
+}
+
+// readMQTTPacket reads one control packet, packets larger than max bytes are refused before they are read
+func readMQTTPacket(r *bufio.Reader, max int) (mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+	n, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return mqttPacket{}, errors.New("malformed mqtt remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		n += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if n > max {
+		return mqttPacket{}, fmt.Errorf("mqtt packet is too large: %d bytes, maximum is %d", n, max)
+	}
+	body := make([]byte, n)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return mqttPacket{}, err
+	}
+	return mqttPacket{header: header, body: body}, nil
+}
+
+// appendMQTTString appends UTF-8 string prefixed by its length
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// readMQTTString returns the length-prefixed string and the rest of the buffer
+func readMQTTString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("malformed mqtt string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("malformed mqtt string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+// topicMatches returns true when the topic matches the filter with wildcards '+' and '#'
+func topicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// mqttOptions describes the connection to the broker
+type mqttOptions struct {
+	address   string // host:port
+	clientID  string
+	username  string
+	password  string
+	keepAlive time.Duration
+	maxPacket int // size of received packets, DefaultMQTTPacketSize when it is not set
+}
+
+// mqttMessage is a message received from the subscribed topic
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// mqttClient is a minimal MQTT 3.1.1 client, messages are published and received with QoS 0 or 1
+type mqttClient struct {
+	conn      net.Conn
+	maxPacket int
+	handler   func(topic string, payload []byte)
+	messages  chan mqttMessage // the handler runs aside, so pings and acknowledgements are delayed only by a full queue
+
+	mutex    sync.Mutex // guards writes, packetID and pending
+	packetID uint16
+	pending  map[uint16]chan mqttPacket
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// dialMQTT connects to the broker, the handler receives messages of subscribed topics
+func dialMQTT(o mqttOptions, handler func(topic string, payload []byte)) (*mqttClient, error) {
+	conn, err := net.DialTimeout("tcp", o.address, mqttDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// protocol name, level 4, clean session and optional credentials
+	flags := byte(0x02)
+	if len(o.username) > 0 {
+		flags |= 0x80
+		if len(o.password) > 0 {
+			flags |= 0x40
+		}
+	}
+	keepAlive := uint16(o.keepAlive / time.Second)
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendMQTTString(body, o.clientID)
+	if len(o.username) > 0 {
+		body = appendMQTTString(body, o.username)
+		if len(o.password) > 0 {
+			body = appendMQTTString(body, o.password)
+		}
+	}
+
+	maxPacket := o.maxPacket
+	if maxPacket <= 0 {
+		maxPacket = DefaultMQTTPacketSize
+	}
+
+	conn.SetDeadline(time.Now().Add(mqttDialTimeout))
+	r := bufio.NewReader(conn)
+	if err = writeMQTTPacket(conn, mqttPacket{header: mqttConnect << 4, body: body}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ack, err := readMQTTPacket(r, maxPacket)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ack.kind() != mqttConnAck || len(ack.body) < 2 {
+		conn.Close()
+		return nil, errors.New("mqtt broker did not acknowledge the connection")
+	}
+	if ack.body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt broker refused the connection, return code %d", ack.body[1])
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &mqttClient{
+		conn:      conn,
+		maxPacket: maxPacket,
+		handler:   handler,
+		messages:  make(chan mqttMessage, mqttInboxSize),
+		pending:   make(map[uint16]chan mqttPacket),
+		closed:    make(chan struct{}),
+	}
+	go c.handle()
+	go c.read(r)
+	if o.keepAlive > 0 {
+		go c.ping(o.keepAlive)
+	}
+	return c, nil
+}
+
+// done is closed when the connection is lost or closed
+func (c *mqttClient) done() <-chan struct{} {
+	return c.closed
+}
+
+// shutdown closes the connection, the first error is kept
+func (c *mqttClient) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		c.conn.Close()
+		close(c.closed)
+	})
+}
+
+func (c *mqttClient) close() error {
+	c.mutex.Lock()
+	writeMQTTPacket(c.conn, mqttPacket{header: mqttDisconnect << 4})
+	c.mutex.Unlock()
+	c.shutdown(errMQTTClosed)
+	return nil
+}
+
+func (c *mqttClient) write(p mqttPacket) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return writeMQTTPacket(c.conn, p)
+}
+
+func (c *mqttClient) ping(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.write(mqttPacket{header: mqttPingReq << 4}); err != nil {
+				c.shutdown(err)
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// handle passes received messages to the handler until the connection is lost and all of them are handled
+func (c *mqttClient) handle() {
+	for m := range c.messages {
+		c.handler(m.topic, m.payload)
+	}
+}
+
+func (c *mqttClient) read(r *bufio.Reader) {
+	defer close(c.messages)
+	for {
+		p, err := readMQTTPacket(r, c.maxPacket)
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+
+		switch p.kind() {
+		case mqttPublish:
+			topic, rest, err := readMQTTString(p.body)
+			if err != nil {
+				c.shutdown(err)
+				return
+			}
+			qos := (p.header >> 1) & 0x03
+			if qos > mqttMaxQoS {
+				c.shutdown(fmt.Errorf("mqtt broker sent a message with QoS %d, maximum is %d", qos, mqttMaxQoS))
+				return
+			}
+			if qos == 0 {
+				select {
+				case c.messages <- mqttMessage{topic: topic, payload: rest}:
+				default:
+					logger.Warning("MQTT client: queue is full, message is dropped", "topic", topic)
+				}
+				continue
+			}
+			if len(rest) < 2 {
+				c.shutdown(errors.New("malformed mqtt publish packet"))
+				return
+			}
+			// QoS 1 messages wait for the queue and are acknowledged once queued, so the broker resends lost ones
+			select {
+			case c.messages <- mqttMessage{topic: topic, payload: rest[2:]}:
+			case <-c.closed:
+				return
+			}
+			if err = c.write(mqttPacket{header: mqttPubAck << 4, body: rest[:2]}); err != nil {
+				c.shutdown(err)
+				return
+			}
+		case mqttPubAck, mqttSubAck:
+			if len(p.body) < 2 {
+				continue
+			}
+			id := binary.BigEndian.Uint16(p.body)
+			c.mutex.Lock()
+			ack, ok := c.pending[id]
+			delete(c.pending, id)
+			c.mutex.Unlock()
+			if ok {
+				ack <- p
+			}
+		}
+	}
+}
+
+// send writes the packet with a new identifier and waits for the acknowledgement
+func (c *mqttClient) send(header byte, build func(id uint16) []byte) (mqttPacket, error) {
+	select {
+	case <-c.closed:
+		return mqttPacket{}, errMQTTClosed
+	default:
+	}
+	ack := make(chan mqttPacket, 1)
+
+	c.mutex.Lock()
+	c.packetID++
+	if c.packetID == 0 {
+		c.packetID = 1
+	}
+	id := c.packetID
+	c.pending[id] = ack
+	err := writeMQTTPacket(c.conn, mqttPacket{header: header, body: build(id)})
+	c.mutex.Unlock()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+
+	timer := time.NewTimer(mqttAckTimeout)
+	defer timer.Stop()
+	select {
+	case p := <-ack:
+		return p, nil
+	case <-c.closed:
+		return mqttPacket{}, errMQTTClosed
+	case <-timer.C:
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		return mqttPacket{}, errors.New("mqtt broker did not acknowledge the packet")
+	}
+}
+
+// subscribe subscribes to the topic filters with the maximum QoS, it is limited to QoS 1
+func (c *mqttClient) subscribe(filters []string, qos byte) error {
+	if qos > mqttMaxQoS {
+		qos = mqttMaxQoS
+	}
+	ack, err := c.send(mqttSubscribe<<4|0x02, func(id uint16) []byte {
+		body := []byte{byte(id >> 8), byte(id)}
+		for _, f := range filters {
+			body = append(appendMQTTString(body, f), qos)
+		}
+		return body
+	})
+	if err != nil {
+		return err
+	}
+	for k, code := range ack.body[2:] {
+		if code == 0x80 && k < len(filters) {
+			return fmt.Errorf("mqtt broker refused subscription to '%s'", filters[k])
+		}
+	}
+	return nil
+}
+
+// publish sends the message, QoS 1 waits for the acknowledgement of the broker
+func (c *mqttClient) publish(topic string, payload []byte, qos byte, retain bool) error {
+	header := byte(mqttPublish<<4) | qos<<1
+	if retain {
+		header |= 0x01
+	}
+
+	if qos == 0 {
+		body := append(appendMQTTString(nil, topic), payload...)
+		return c.write(mqttPacket{header: header, body: body})
+	}
+
+	_, err := c.send(header, func(id uint16) []byte {
+		body := append(appendMQTTString(nil, topic), byte(id>>8), byte(id))
+		return append(body, payload...)
+	})
+	return err
+}
@@ -0,0 +1,256 @@
+package app
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mqttKeepAlive      = 60 * time.Second
+	mqttMaxBackoff     = time.Minute
+	mqttQueueSize      = 1000 // saved weather waiting for publishing
+	mqttLocationHolder = "{location_id}"
+)
+
+// mqttTopic maps the topic filter to the location which receives its readings
+type mqttTopic struct {
+	filter  string
+	options ImportOptions
+}
+
+// MQTTBridge ingests sensor readings in JSON from MQTT topics and publishes newly saved weather
+type MQTTBridge struct {
+	db           databaseWeatherProvider
+	options      mqttOptions
+	topics       []mqttTopic
+	qos          byte
+	publishTopic string // e.g. 'weather/{location_id}', empty means nothing is published
+	messages     chan Weather
+	quit         chan struct{}
+	wg           sync.WaitGroup
+}
+
+// MQTTBridgeOptions configures MQTTBridge, the bridge is disabled without the broker
+type MQTTBridgeOptions struct {
+	Broker       string         `yaml:"broker"` // host:port
+	ClientID     string         `yaml:"client_id"`
+	Username     string         `yaml:"username"`
+	Password     string         `yaml:"password"`
+	QoS          int            `yaml:"qos"`           // 0 or 1
+	MaxPacket    int            `yaml:"max_packet"`    // size of received packets in bytes, larger ones close the connection
+	Topics       map[string]int `yaml:"topics"`        // topic filter to location_id
+	Columns      string         `yaml:"columns"`       // mapping of fields of readings, e.g. temperature=temp
+	Units        string         `yaml:"units"`         // of temperature in readings
+	TimeLayout   string         `yaml:"time_layout"`   // of the time of measurement in readings
+	PublishTopic string         `yaml:"publish_topic"` // e.g. 'weather/{location_id}', empty means nothing is published
+}
+
+func (o MQTTBridgeOptions) validate(p *configProblems) {
+	if len(strings.TrimPrefix(o.Broker, "tcp://")) == 0 {
+		p.add("mqtt.broker", "is required")
+	}
+	if o.QoS != 0 && o.QoS != 1 {
+		p.add("mqtt.qos", "must be 0 or 1, got (%d)", o.QoS)
+	}
+	if o.MaxPacket < 0 || o.MaxPacket > mqttMaxLength {
+		p.add("mqtt.max_packet", "must be between 0 and %d bytes, got (%d)", mqttMaxLength, o.MaxPacket)
+	}
+	if len(o.Topics) == 0 && len(o.PublishTopic) == 0 {
+		p.add("mqtt.topics", "or mqtt.publish_topic must be provided")
+	}
+	for _, filter := range sortedKeys(o.Topics) {
+		if len(strings.TrimSpace(filter)) == 0 {
+			p.add("mqtt.topics", "must not contain an empty filter")
+		}
+	}
+	if len(o.Topics) > 0 {
+		if _, err := NewImportOptions(1, formatNDJSON, o.Columns, o.Units, o.TimeLayout, false); err != nil {
+			p.add("mqtt.columns", "or mqtt.units are invalid: %s", err)
+		}
+	}
+}
+
+// NewMQTTBridge returns MQTTBridge configured by the options
+func NewMQTTBridge(db databaseWeatherProvider, o MQTTBridgeOptions) (*MQTTBridge, error) {
+	var p configProblems
+	o.validate(&p)
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	var topics []mqttTopic
+	for _, filter := range sortedKeys(o.Topics) {
+		options, err := NewImportOptions(o.Topics[filter], formatNDJSON, o.Columns, o.Units, o.TimeLayout, false)
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, mqttTopic{filter: strings.TrimSpace(filter), options: options})
+	}
+
+	clientID := o.ClientID
+	if len(clientID) == 0 {
+		clientID = "weather"
+	}
+	options := mqttOptions{
+		address:   strings.TrimPrefix(o.Broker, "tcp://"),
+		clientID:  clientID,
+		username:  o.Username,
+		password:  o.Password,
+		keepAlive: mqttKeepAlive,
+		maxPacket: o.MaxPacket,
+	}
+	return newMQTTBridge(db, options, topics, byte(o.QoS), o.PublishTopic), nil
+}
+
+func newMQTTBridge(db databaseWeatherProvider, o mqttOptions, topics []mqttTopic, qos byte, publishTopic string) *MQTTBridge {
+	return &MQTTBridge{
+		db:           db,
+		options:      o,
+		topics:       topics,
+		qos:          qos,
+		publishTopic: publishTopic,
+		messages:     make(chan Weather, mqttQueueSize),
+		quit:         make(chan struct{}),
+	}
+}
+
+// Publish queues the saved weather for publishing, it is a save hook of Database
+func (b *MQTTBridge) Publish(w Weather) {
+	if len(b.publishTopic) == 0 {
+		return
+	}
+	select {
+	case b.messages <- w:
+	default:
+		logger.Warning("MQTT bridge: queue is full, weather is not published", "location_id", w.LocationID)
+	}
+}
+
+// ingest saves the reading received from the topic
+func (b *MQTTBridge) ingest(topic string, payload []byte) {
+	for _, t := range b.topics {
+		if !topicMatches(t.filter, topic) {
+			continue
+		}
+
+		record, err := jsonRecord(payload)
+		if err != nil {
+			logger.Error("MQTT ingest", "topic", topic, "error", err)
+			return
+		}
+		// live readings are measured when they are received unless they say otherwise
+		if _, ok := record[t.options.Columns[fieldMeasuredAt]]; !ok {
+			record[t.options.Columns[fieldMeasuredAt]] = time.Now().UTC().Format(time.RFC3339)
+		}
+
+		w, err := t.options.parseObservation(record)
+		if err != nil {
+			logger.Error("MQTT ingest", "topic", topic, "error", err)
+			return
+		}
+		w.Source = sourceMQTT
+
+		if err = b.db.saveWeather(w); err != nil && err != errDuplicateObservation {
+			logger.Error("MQTT ingest", "topic", topic, "error", err)
+		}
+		return
+	}
+}
+
+// publish sends the weather as JSON observation to the topic of its location
+func (b *MQTTBridge) publish(c *mqttClient, w Weather) error {
+	payload, err := json.Marshal(newObservation(w))
+	if err != nil {
+		return err
+	}
+	topic := strings.Replace(b.publishTopic, mqttLocationHolder, strconv.Itoa(w.LocationID), -1)
+	return c.publish(topic, payload, b.qos, false)
+}
+
+// wait returns false when the bridge is stopped before the timeout
+func (b *MQTTBridge) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-b.quit:
+		return false
+	}
+}
+
+// connect returns connection subscribed to all topics
+func (b *MQTTBridge) connect() (*mqttClient, error) {
+	c, err := dialMQTT(b.options, b.ingest)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b.topics) > 0 {
+		filters := make([]string, 0, len(b.topics))
+		for _, t := range b.topics {
+			filters = append(filters, t.filter)
+		}
+		if err = c.subscribe(filters, b.qos); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Start connects to the broker in the background and reconnects with exponential backoff
+func (b *MQTTBridge) Start() {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		backoff := time.Second
+		for {
+			c, err := b.connect()
+			if err != nil {
+				logger.Error("MQTT bridge", "error", err)
+				if !b.wait(backoff) {
+					return
+				}
+				if backoff *= 2; backoff > mqttMaxBackoff {
+					backoff = mqttMaxBackoff
+				}
+				continue
+			}
+			backoff = time.Second
+			logger.Info("MQTT bridge is connected", "broker", b.options.address)
+
+			if !b.serve(c) {
+				return
+			}
+		}
+	}()
+}
+
+// serve publishes queued weather until the connection is lost, false means the bridge is stopped
+func (b *MQTTBridge) serve(c *mqttClient) bool {
+	for {
+		select {
+		case w := <-b.messages:
+			if err := b.publish(c, w); err != nil {
+				logger.Error("MQTT bridge: weather is not published", "location_id", w.LocationID, "error", err)
+			}
+		case <-c.done():
+			logger.Error("MQTT bridge: connection is lost", "error", c.err)
+			return true
+		case <-b.quit:
+			c.close()
+			return false
+		}
+	}
+}
+
+// Stop disconnects from the broker, weather which has not been published yet is dropped
+func (b *MQTTBridge) Stop() {
+	close(b.quit)
+	b.wg.Wait()
+}
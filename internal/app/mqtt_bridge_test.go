@@ -0,0 +1,186 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingDatabase passes saved weather to the channel
+type recordingDatabase struct {
+	fakeDatabase
+	saved chan Weather
+}
+
+func (r recordingDatabase) saveWeather(w Weather) error {
+	r.saved <- w
+	return r.errSave
+}
+
+func TestNewMQTTBridge(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       MQTTBridgeOptions
+		expectedError error
+	}{
+		{
+			name:          "Missing broker",
+			options:       MQTTBridgeOptions{Topics: map[string]int{"sensors/roof": 2643743}},
+			expectedError: errors.New("invalid configuration: mqtt.broker is required"),
+		},
+		{
+			name:          "Invalid QoS",
+			options:       MQTTBridgeOptions{Broker: "localhost:1883", QoS: 2, Topics: map[string]int{"sensors/roof": 2643743}},
+			expectedError: errors.New("invalid configuration: mqtt.qos must be 0 or 1, got (2)"),
+		},
+		{
+			name:          "Invalid maximum packet size",
+			options:       MQTTBridgeOptions{Broker: "localhost:1883", MaxPacket: -1, Topics: map[string]int{"sensors/roof": 2643743}},
+			expectedError: errors.New("invalid configuration: mqtt.max_packet must be between 0 and 268435455 bytes, got (-1)"),
+		},
+		{
+			name:    "Invalid units",
+			options: MQTTBridgeOptions{Broker: "localhost:1883", Topics: map[string]int{"sensors/roof": 2643743}, Units: "rankine"},
+			expectedError: errors.New("invalid configuration: mqtt.columns or mqtt.units are invalid: " +
+				"units must be one of: kelvin, celsius, fahrenheit"),
+		},
+		{
+			name:          "Nothing to do",
+			options:       MQTTBridgeOptions{Broker: "localhost:1883"},
+			expectedError: errors.New("invalid configuration: mqtt.topics or mqtt.publish_topic must be provided"),
+		},
+		{
+			name: "Valid configuration",
+			options: MQTTBridgeOptions{Broker: "tcp://localhost:1883", QoS: 1, MaxPacket: 1024, PublishTopic: "weather/{location_id}",
+				Topics: map[string]int{"sensors/roof": 2643743, "sensors/+/garden": 2988507}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			bridge, err := NewMQTTBridge(fakeDatabase{}, test.options)
+
+			// Assert
+			if test.expectedError != nil {
+				assert.EqualError(t, err, test.expectedError.Error())
+				assert.Nil(t, bridge)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, "localhost:1883", bridge.options.address)
+			assert.Equal(t, "weather", bridge.options.clientID)
+			assert.Equal(t, 1024, bridge.options.maxPacket)
+			assert.Equal(t, byte(1), bridge.qos)
+			require.Len(t, bridge.topics, 2)
+			assert.Equal(t, "sensors/+/garden", bridge.topics[0].filter)
+			assert.Equal(t, 2988507, bridge.topics[0].options.LocationID)
+		})
+	}
+}
+
+func TestMQTTBridge(t *testing.T) {
+	// Arrange
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	db := recordingDatabase{saved: make(chan Weather, 1)}
+	options, err := NewImportOptions(2643743, formatNDJSON, "temperature=temp", unitsCelsius, "", false)
+	require.Nil(t, err)
+	bridge := newMQTTBridge(db, mqttOptions{address: broker.address(), clientID: "weather"},
+		[]mqttTopic{{filter: "sensors/+/roof", options: options}}, 1, "weather/{location_id}")
+	bridge.Start()
+	defer bridge.Stop()
+	require.True(t, waitFor(func() bool { return broker.subscribed("sensors/+/roof") }))
+
+	received := make(chan []byte, 1)
+	client, err := dialMQTT(mqttOptions{address: broker.address(), clientID: "platform"}, func(topic string, payload []byte) {
+		if topic == "weather/2643743" {
+			received <- payload
+		}
+	})
+	require.Nil(t, err)
+	defer client.close()
+	require.Nil(t, client.subscribe([]string{"weather/#"}, 0))
+
+	t.Run("Reading is saved", func(t *testing.T) {
+		// Act
+		err := client.publish("sensors/house/roof", []byte(`{"measured_at": "2019-03-30T12:00:00Z", "temp": 10, "humidity": 81}`), 1, false)
+
+		// Assert
+		require.Nil(t, err)
+		select {
+		case w := <-db.saved:
+			assert.Equal(t, 2643743, w.LocationID)
+			assert.Equal(t, float32(283.15), w.Temperature)
+			assert.Equal(t, float32Ptr(81), w.Humidity)
+			assert.Equal(t, sourceMQTT, w.Source)
+			assert.Equal(t, time.Date(2019, 3, 30, 12, 0, 0, 0, time.UTC), w.MeasuredAt)
+		case <-time.After(5 * time.Second):
+			t.Fatal("reading has not been saved")
+		}
+	})
+
+	t.Run("Reading without time is measured now", func(t *testing.T) {
+		// Act
+		err := client.publish("sensors/house/roof", []byte(`{"temp": 10}`), 0, false)
+
+		// Assert
+		require.Nil(t, err)
+		select {
+		case w := <-db.saved:
+			assert.WithinDuration(t, time.Now(), w.MeasuredAt, time.Minute)
+		case <-time.After(5 * time.Second):
+			t.Fatal("reading has not been saved")
+		}
+	})
+
+	t.Run("Saved weather is published", func(t *testing.T) {
+		// Act
+		bridge.Publish(Weather{ID: 7, LocationID: 2643743, Temperature: 283.15, Source: sourceOWM,
+			MeasuredAt: time.Date(2019, 3, 30, 12, 0, 0, 0, time.UTC), Date: time.Date(2019, 3, 30, 12, 0, 0, 0, time.UTC),
+			Conditions: []Condition{{Code: 500}}})
+
+		// Assert
+		select {
+		case payload := <-received:
+			o := Observation{}
+			require.Nil(t, json.Unmarshal(payload, &o))
+			assert.Equal(t, 7, o.ID)
+			assert.Equal(t, "2019-03-30", o.Date)
+			assert.Equal(t, sourceOWM, o.Source)
+			assert.Equal(t, []int{500}, o.Conditions)
+		case <-time.After(5 * time.Second):
+			t.Fatal("weather has not been published")
+		}
+	})
+}
+
+func TestMQTTBridgeReconnects(t *testing.T) {
+	// Arrange
+	broker := newTestBroker(t)
+	address := broker.address()
+	broker.close()
+
+	bridge := newMQTTBridge(fakeDatabase{}, mqttOptions{address: address, clientID: "weather"}, nil, 0, "weather/{location_id}")
+
+	// Act
+	bridge.Start()
+	time.Sleep(50 * time.Millisecond)
+
+	// Assert
+	done := make(chan struct{})
+	go func() {
+		bridge.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("bridge has not been stopped while waiting for the broker")
+	}
+}
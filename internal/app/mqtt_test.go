@@ -0,0 +1,484 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBroker is an embedded MQTT broker which forwards messages to subscribers with QoS 0
+type testBroker struct {
+	listener    net.Listener
+	mutex       sync.Mutex
+	subscribers map[net.Conn][]string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	b := &testBroker{listener: listener, subscribers: make(map[net.Conn][]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) address() string {
+	return b.listener.Addr().String()
+}
+
+func (b *testBroker) close() {
+	b.listener.Close()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for conn := range b.subscribers {
+		conn.Close()
+	}
+}
+
+// subscribed returns true when any client is subscribed to the filter
+func (b *testBroker) subscribed(filter string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, filters := range b.subscribers {
+		for _, f := range filters {
+			if f == filter {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *testBroker) write(conn net.Conn, p mqttPacket) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	writeMQTTPacket(conn, p)
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	b.mutex.Lock()
+	b.subscribers[conn] = nil
+	b.mutex.Unlock()
+	defer func() {
+		b.mutex.Lock()
+		delete(b.subscribers, conn)
+		b.mutex.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		p, err := readMQTTPacket(r, mqttMaxLength)
+		if err != nil {
+			return
+		}
+
+		switch p.kind() {
+		case mqttConnect:
+			b.write(conn, mqttPacket{header: mqttConnAck << 4, body: []byte{0, 0}})
+		case mqttSubscribe:
+			body := append([]byte{}, p.body[:2]...)
+			for rest := p.body[2:]; len(rest) > 0; {
+				var filter string
+				if filter, rest, err = readMQTTString(rest); err != nil {
+					return
+				}
+				body = append(body, rest[0])
+				rest = rest[1:]
+				b.mutex.Lock()
+				b.subscribers[conn] = append(b.subscribers[conn], filter)
+				b.mutex.Unlock()
+			}
+			b.write(conn, mqttPacket{header: mqttSubAck << 4, body: body})
+		case mqttPublish:
+			topic, rest, err := readMQTTString(p.body)
+			if err != nil {
+				return
+			}
+			if (p.header>>1)&0x03 > 0 {
+				b.write(conn, mqttPacket{header: mqttPubAck << 4, body: rest[:2]})
+				rest = rest[2:]
+			}
+			b.forward(topic, rest)
+		case mqttPingReq:
+			b.write(conn, mqttPacket{header: mqttPingResp << 4})
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+func (b *testBroker) forward(topic string, payload []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for conn, filters := range b.subscribers {
+		for _, f := range filters {
+			if topicMatches(f, topic) {
+				writeMQTTPacket(conn, mqttPacket{header: mqttPublish << 4, body: append(appendMQTTString(nil, topic), payload...)})
+				break
+			}
+		}
+	}
+}
+
+// scriptedBroker accepts one connection, acknowledges it and runs the script
+func scriptedBroker(t *testing.T, script func(conn net.Conn, r *bufio.Reader)) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if _, err = readMQTTPacket(r, mqttMaxLength); err != nil {
+			return
+		}
+		writeMQTTPacket(conn, mqttPacket{header: mqttConnAck << 4, body: []byte{0, 0}})
+		script(conn, r)
+	}()
+	return listener
+}
+
+// waitFor polls the condition for a while
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter   string
+		topic    string
+		expected bool
+	}{
+		{filter: "sensors/roof", topic: "sensors/roof", expected: true},
+		{filter: "sensors/roof", topic: "sensors/garden", expected: false},
+		{filter: "sensors/+/temperature", topic: "sensors/roof/temperature", expected: true},
+		{filter: "sensors/+", topic: "sensors/roof/temperature", expected: false},
+		{filter: "sensors/#", topic: "sensors/roof/temperature", expected: true},
+		{filter: "#", topic: "sensors", expected: true},
+		{filter: "sensors/roof/temperature", topic: "sensors/roof", expected: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.filter+" "+test.topic, func(t *testing.T) {
+			assert.Equal(t, test.expected, topicMatches(test.filter, test.topic))
+		})
+	}
+}
+
+func TestMQTTPacket(t *testing.T) {
+	for _, size := range []int{0, 127, 128, 16383, 16384, 2097152} {
+		// Arrange
+		buf := &bytes.Buffer{}
+		p := mqttPacket{header: mqttPublish << 4, body: bytes.Repeat([]byte{'x'}, size)}
+
+		// Act
+		require.Nil(t, writeMQTTPacket(buf, p))
+		result, err := readMQTTPacket(bufio.NewReader(buf), mqttMaxLength)
+
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, p.header, result.header)
+		assert.Equal(t, size, len(result.body))
+	}
+
+	t.Run("Malformed length", func(t *testing.T) {
+		_, err := readMQTTPacket(bufio.NewReader(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01})), mqttMaxLength)
+		assert.EqualError(t, err, "malformed mqtt remaining length")
+	})
+
+	t.Run("Too large packet", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		require.Nil(t, writeMQTTPacket(buf, mqttPacket{header: mqttPublish << 4, body: make([]byte, 129)}))
+		_, err := readMQTTPacket(bufio.NewReader(buf), 128)
+		assert.EqualError(t, err, "mqtt packet is too large: 129 bytes, maximum is 128")
+	})
+
+	t.Run("String", func(t *testing.T) {
+		s, rest, err := readMQTTString(append(appendMQTTString(nil, "sensors/roof"), 1))
+		assert.Nil(t, err)
+		assert.Equal(t, "sensors/roof", s)
+		assert.Equal(t, []byte{1}, rest)
+
+		_, _, err = readMQTTString([]byte{0, 5, 'a'})
+		assert.EqualError(t, err, "malformed mqtt string")
+	})
+}
+
+func TestMQTTClient(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	t.Run("Connection refused", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			readMQTTPacket(bufio.NewReader(conn), mqttMaxLength)
+			writeMQTTPacket(conn, mqttPacket{header: mqttConnAck << 4, body: []byte{0, 5}})
+			conn.Close()
+		}()
+		defer listener.Close()
+
+		_, err = dialMQTT(mqttOptions{address: listener.Addr().String(), clientID: "test", username: "user", password: "guess"}, nil)
+		assert.EqualError(t, err, "mqtt broker refused the connection, return code 5")
+	})
+
+	t.Run("Publish and subscribe", func(t *testing.T) {
+		// Arrange
+		received := make(chan string, 2)
+		subscriber, err := dialMQTT(mqttOptions{address: broker.address(), clientID: "subscriber", keepAlive: time.Second},
+			func(topic string, payload []byte) {
+				received <- topic + " " + string(payload)
+			})
+		require.Nil(t, err)
+		defer subscriber.close()
+		require.Nil(t, subscriber.subscribe([]string{"sensors/#"}, 1))
+
+		publisher, err := dialMQTT(mqttOptions{address: broker.address(), clientID: "publisher"}, nil)
+		require.Nil(t, err)
+		defer publisher.close()
+
+		// Act
+		err0 := publisher.publish("sensors/roof", []byte(`{"temperature": 12.5}`), 0, false)
+		err1 := publisher.publish("sensors/garden", []byte(`{"temperature": 11}`), 1, false)
+
+		// Assert
+		assert.Nil(t, err0)
+		assert.Nil(t, err1)
+		for _, expected := range []string{`sensors/roof {"temperature": 12.5}`, `sensors/garden {"temperature": 11}`} {
+			select {
+			case message := <-received:
+				assert.Equal(t, expected, message)
+			case <-time.After(5 * time.Second):
+				t.Fatal("message has not been received")
+			}
+		}
+	})
+
+	t.Run("Too large packet closes the connection", func(t *testing.T) {
+		// Arrange
+		listener := scriptedBroker(t, func(conn net.Conn, r *bufio.Reader) {
+			writeMQTTPacket(conn, mqttPacket{header: mqttPublish << 4, body: append(appendMQTTString(nil, "sensors/roof"), make([]byte, 64)...)})
+			readMQTTPacket(r, mqttMaxLength)
+		})
+		defer listener.Close()
+
+		// Act
+		c, err := dialMQTT(mqttOptions{address: listener.Addr().String(), clientID: "large", maxPacket: 64}, func(string, []byte) {
+			t.Error("message has been handled")
+		})
+
+		// Assert
+		require.Nil(t, err)
+		select {
+		case <-c.done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection has not been closed")
+		}
+		assert.EqualError(t, c.err, "mqtt packet is too large: 78 bytes, maximum is 64")
+	})
+
+	t.Run("Subscriptions are limited to QoS 1", func(t *testing.T) {
+		// Arrange
+		requested := make(chan byte, 1)
+		listener := scriptedBroker(t, func(conn net.Conn, r *bufio.Reader) {
+			p, err := readMQTTPacket(r, mqttMaxLength)
+			if err != nil {
+				return
+			}
+			requested <- p.body[len(p.body)-1]
+			writeMQTTPacket(conn, mqttPacket{header: mqttSubAck << 4, body: []byte{p.body[0], p.body[1], 1}})
+			// QoS 2 message is not acknowledged by PUBREC, so it closes the connection
+			body := append(appendMQTTString(nil, "sensors/roof"), 0, 1)
+			writeMQTTPacket(conn, mqttPacket{header: mqttPublish<<4 | 2<<1, body: append(body, "{}"...)})
+			readMQTTPacket(r, mqttMaxLength)
+		})
+		defer listener.Close()
+
+		c, err := dialMQTT(mqttOptions{address: listener.Addr().String(), clientID: "qos"}, func(string, []byte) {
+			t.Error("message has been handled")
+		})
+		require.Nil(t, err)
+
+		// Act
+		err = c.subscribe([]string{"sensors/#"}, 2)
+
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, byte(1), <-requested)
+		select {
+		case <-c.done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection has not been closed")
+		}
+		assert.EqualError(t, c.err, "mqtt broker sent a message with QoS 2, maximum is 1")
+	})
+
+	t.Run("Slow handler does not block acknowledgements", func(t *testing.T) {
+		// Arrange
+		handling := make(chan struct{}, 1)
+		release := make(chan struct{})
+		subscriber, err := dialMQTT(mqttOptions{address: broker.address(), clientID: "slow"}, func(topic string, payload []byte) {
+			handling <- struct{}{}
+			<-release
+		})
+		require.Nil(t, err)
+		defer subscriber.close()
+		defer close(release)
+		require.Nil(t, subscriber.subscribe([]string{"slow/#"}, 0))
+
+		publisher, err := dialMQTT(mqttOptions{address: broker.address(), clientID: "slow-publisher"}, nil)
+		require.Nil(t, err)
+		defer publisher.close()
+		require.Nil(t, publisher.publish("slow/roof", []byte("{}"), 0, false))
+		select {
+		case <-handling:
+		case <-time.After(5 * time.Second):
+			t.Fatal("message has not been received")
+		}
+
+		// Act
+		done := make(chan error, 1)
+		go func() {
+			done <- subscriber.subscribe([]string{"slow/garden"}, 0)
+		}()
+
+		// Assert
+		select {
+		case err = <-done:
+			assert.Nil(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("subscription has not been acknowledged while the handler is busy")
+		}
+	})
+
+	t.Run("Full queue holds back acknowledgements of QoS 1 messages", func(t *testing.T) {
+		// Arrange
+		n := mqttInboxSize + 3
+		acknowledged := make(chan uint16, n)
+		listener := scriptedBroker(t, func(conn net.Conn, r *bufio.Reader) {
+			for id := 1; id <= n; id++ {
+				body := append(appendMQTTString(nil, "sensors/roof"), byte(id>>8), byte(id))
+				writeMQTTPacket(conn, mqttPacket{header: mqttPublish<<4 | 1<<1, body: append(body, "{}"...)})
+			}
+			for {
+				p, err := readMQTTPacket(r, mqttMaxLength)
+				if err != nil {
+					return
+				}
+				if p.kind() == mqttPubAck {
+					acknowledged <- uint16(p.body[0])<<8 | uint16(p.body[1])
+				}
+			}
+		})
+		defer listener.Close()
+
+		release := make(chan struct{})
+		var mutex sync.Mutex
+		handled := 0
+		c, err := dialMQTT(mqttOptions{address: listener.Addr().String(), clientID: "full"}, func(string, []byte) {
+			<-release
+			mutex.Lock()
+			handled++
+			mutex.Unlock()
+		})
+		require.Nil(t, err)
+		defer c.close()
+
+		// Act
+		// one message is handled, the queue is full and one message waits for it
+		for id := 1; id <= mqttInboxSize+1; id++ {
+			select {
+			case <-acknowledged:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("message %d has not been acknowledged", id)
+			}
+		}
+		select {
+		case id := <-acknowledged:
+			t.Fatalf("message %d has been acknowledged before it was queued", id)
+		case <-time.After(100 * time.Millisecond):
+		}
+		close(release)
+
+		// Assert
+		for id := mqttInboxSize + 2; id <= n; id++ {
+			select {
+			case <-acknowledged:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("message %d has not been acknowledged", id)
+			}
+		}
+		assert.True(t, waitFor(func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return handled == n
+		}), "every message is handled")
+	})
+
+	t.Run("Closed connection", func(t *testing.T) {
+		// Arrange
+		c, err := dialMQTT(mqttOptions{address: broker.address(), clientID: "closed"}, nil)
+		require.Nil(t, err)
+
+		// Act
+		c.close()
+
+		// Assert
+		select {
+		case <-c.done():
+		case <-time.After(time.Second):
+			t.Fatal("connection has not been closed")
+		}
+		assert.Equal(t, errMQTTClosed, c.subscribe([]string{"sensors/#"}, 0))
+		assert.Equal(t, errMQTTClosed, c.err)
+	})
+}
+
+func TestMQTTPacketIdentifiers(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	c, err := dialMQTT(mqttOptions{address: broker.address(), clientID: "identifiers"}, nil)
+	require.Nil(t, err)
+	defer c.close()
+
+	// identifiers wrap around and skip zero
+	c.packetID = 65535
+	var ids []uint16
+	for i := 0; i < 2; i++ {
+		_, err = c.send(mqttSubscribe<<4|0x02, func(id uint16) []byte {
+			ids = append(ids, id)
+			return append(appendMQTTString([]byte{byte(id >> 8), byte(id)}, "sensors/#"), 0)
+		})
+		require.Nil(t, err)
+	}
+	assert.Equal(t, []uint16{1, 2}, ids)
+	assert.Equal(t, uint16(2), c.packetID)
+}
@@ -0,0 +1,250 @@
+package app
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+	dateLayout   = "2006-01-02"
+)
+
+// Observation is a raw weather sample with codes of weather conditions
+type Observation struct {
+	TableName   struct{}  `sql:"weather,alias:w" json:"-"`
+	ID          int       `json:"id"`
+	LocationID  int       `json:"location_id"`
+	MeasuredAt  time.Time `json:"measured_at"`
+	Date        string    `json:"date"`
+	Temperature float32   `json:"temperature"`
+	TempMin     float32   `json:"temp_min"`
+	TempMax     float32   `json:"temp_max"`
+	Humidity    *float32  `json:"humidity"`
+	Pressure    *float32  `json:"pressure"`
+	WindSpeed   *float32  `json:"wind_speed"`
+	WindDeg     *int      `json:"wind_deg"`
+	Source      string    `json:"source"`
+	Conditions  []int     `json:"conditions" sql:",array"`
+}
+
+// newObservation returns the observation of saved weather
+func newObservation(w Weather) Observation {
+	o := Observation{
+		ID:          w.ID,
+		LocationID:  w.LocationID,
+		MeasuredAt:  w.MeasuredAt,
+		Date:        w.Date.Format(dateLayout),
+		Temperature: w.Temperature,
+		TempMin:     w.TempMin,
+		TempMax:     w.TempMax,
+		Humidity:    w.Humidity,
+		Pressure:    w.Pressure,
+		WindSpeed:   w.WindSpeed,
+		WindDeg:     w.WindDeg,
+		Source:      w.Source,
+		Conditions:  make([]int, 0, len(w.Conditions)),
+	}
+	for _, c := range w.Conditions {
+		o.Conditions = append(o.Conditions, c.Code)
+	}
+	return o
+}
+
+// ObservationFilter narrows down exported observations
+type ObservationFilter struct {
+	LocationID int       // 0 means all locations
+	From       time.Time // zero means since the first observation
+	To         time.Time // zero means until the last observation, inclusive
+	Limit      int       // 0 means no limit
+	Offset     int
+}
+
+// NewObservationFilter validates date filters and pagination given as strings, empty strings are ignored
+func NewObservationFilter(from, to, limit, offset string) (f ObservationFilter, err error) {
+	if len(from) > 0 {
+		if f.From, err = time.Parse(dateLayout, from); err != nil {
+			return f, errors.New("'from' must be a date in format YYYY-MM-DD")
+		}
+	}
+	if len(to) > 0 {
+		if f.To, err = time.Parse(dateLayout, to); err != nil {
+			return f, errors.New("'to' must be a date in format YYYY-MM-DD")
+		}
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && f.To.Before(f.From) {
+		return f, errors.New("'to' must not be before 'from'")
+	}
+	if len(limit) > 0 {
+		if f.Limit, err = strconv.Atoi(limit); err != nil || f.Limit < 0 {
+			return f, errors.New("'limit' must be a non-negative integer")
+		}
+	}
+	if len(offset) > 0 {
+		if f.Offset, err = strconv.Atoi(offset); err != nil || f.Offset < 0 {
+			return f, errors.New("'offset' must be a non-negative integer")
+		}
+	}
+	return f, nil
+}
+
+// observationWriter writes observations one by one, so they are never buffered as a whole
+type observationWriter interface {
+	write(Observation) error
+	close() error
+}
+
+// contentType returns MIME type for the export format
+func contentType(format string) (string, error) {
+	switch format {
+	case formatJSON:
+		return "application/json", nil
+	case formatCSV:
+		return "text/csv", nil
+	case formatNDJSON:
+		return "application/x-ndjson", nil
+	}
+	return "", fmt.Errorf("format must be one of: %s, %s, %s", formatJSON, formatCSV, formatNDJSON)
+}
+
+func newObservationWriter(w io.Writer, format string) (observationWriter, error) {
+	switch format {
+	case formatJSON:
+		return &jsonObservationWriter{w: w, encoder: json.NewEncoder(w)}, nil
+	case formatCSV:
+		return &csvObservationWriter{w: csv.NewWriter(w)}, nil
+	case formatNDJSON:
+		return &ndjsonObservationWriter{encoder: json.NewEncoder(w)}, nil
+	}
+	_, err := contentType(format)
+	return nil, err
+}
+
+// jsonObservationWriter writes JSON array
+type jsonObservationWriter struct {
+	w       io.Writer
+	encoder *json.Encoder
+	count   int
+}
+
+func (j *jsonObservationWriter) write(o Observation) error {
+	separator := ","
+	if j.count == 0 {
+		separator = "["
+	}
+	j.count++
+	if _, err := io.WriteString(j.w, separator); err != nil {
+		return err
+	}
+	return j.encoder.Encode(o)
+}
+
+func (j *jsonObservationWriter) close() error {
+	if j.count == 0 {
+		_, err := io.WriteString(j.w, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(j.w, "]\n")
+	return err
+}
+
+// ndjsonObservationWriter writes one JSON object per line
+type ndjsonObservationWriter struct {
+	encoder *json.Encoder
+}
+
+func (n *ndjsonObservationWriter) write(o Observation) error {
+	return n.encoder.Encode(o)
+}
+
+func (n *ndjsonObservationWriter) close() error {
+	return nil
+}
+
+// csvObservationWriter writes CSV with header, codes of weather conditions are separated by ';'
+type csvObservationWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+var csvObservationHeader = []string{"id", "location_id", "measured_at", "date", "temperature", "temp_min", "temp_max",
+	"humidity", "pressure", "wind_speed", "wind_deg", "source", "conditions"}
+
+// formatOptional returns empty string for missing measurement
+func formatOptional(v *float32) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(float64(*v), 'f', 2, 32)
+}
+
+func (c *csvObservationWriter) write(o Observation) error {
+	if !c.header {
+		c.header = true
+		if err := c.w.Write(csvObservationHeader); err != nil {
+			return err
+		}
+	}
+
+	windDeg := ""
+	if o.WindDeg != nil {
+		windDeg = strconv.Itoa(*o.WindDeg)
+	}
+
+	codes := make([]string, 0, len(o.Conditions))
+	for _, code := range o.Conditions {
+		codes = append(codes, strconv.Itoa(code))
+	}
+
+	return c.w.Write([]string{
+		strconv.Itoa(o.ID),
+		strconv.Itoa(o.LocationID),
+		o.MeasuredAt.UTC().Format(time.RFC3339),
+		o.Date,
+		strconv.FormatFloat(float64(o.Temperature), 'f', 2, 32),
+		strconv.FormatFloat(float64(o.TempMin), 'f', 2, 32),
+		strconv.FormatFloat(float64(o.TempMax), 'f', 2, 32),
+		formatOptional(o.Humidity),
+		formatOptional(o.Pressure),
+		formatOptional(o.WindSpeed),
+		windDeg,
+		o.Source,
+		strings.Join(codes, ";"),
+	})
+}
+
+func (c *csvObservationWriter) close() error {
+	if !c.header {
+		c.header = true
+		if err := c.w.Write(csvObservationHeader); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// ExportObservations streams observations from database in the format: json, csv or ndjson
+func ExportObservations(d *Database, w io.Writer, format string, filter ObservationFilter) error {
+	return exportObservations(d, w, format, filter)
+}
+
+func exportObservations(db databaseWeatherProvider, w io.Writer, format string, filter ObservationFilter) error {
+	ow, err := newObservationWriter(w, format)
+	if err != nil {
+		return err
+	}
+
+	if err = db.getObservations(filter, ow.write); err != nil {
+		return err
+	}
+	return ow.close()
+}
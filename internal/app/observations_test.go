@@ -0,0 +1,277 @@
+package app
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testObservations = []Observation{
+	{
+		ID:          1,
+		LocationID:  2643743,
+		MeasuredAt:  time.Date(2019, time.March, 30, 12, 0, 0, 0, time.UTC),
+		Date:        "2019-03-30",
+		Temperature: 280.74,
+		TempMin:     278.71,
+		TempMax:     282.59,
+		Source:      sourceOWM,
+		Conditions:  []int{500, 801},
+	},
+	{
+		ID:          2,
+		LocationID:  2643743,
+		MeasuredAt:  time.Date(2019, time.March, 31, 12, 0, 0, 0, time.UTC),
+		Date:        "2019-03-31",
+		Temperature: 281,
+		TempMin:     280,
+		TempMax:     282,
+		Humidity:    float32Ptr(75),
+		Pressure:    float32Ptr(1012),
+		WindSpeed:   float32Ptr(2.5),
+		WindDeg:     intPtr(180),
+		Source:      sourceImport,
+		Conditions:  []int{},
+	},
+}
+
+func TestParseObservationFilter(t *testing.T) {
+	tests := []struct {
+		name          string
+		from, to      string
+		limit, offset string
+		expected      ObservationFilter
+		expectedError error
+	}{
+		{
+			name: "No filters",
+		},
+		{
+			name:   "All filters",
+			from:   "2019-03-01",
+			to:     "2019-03-31",
+			limit:  "100",
+			offset: "200",
+			expected: ObservationFilter{
+				From:   time.Date(2019, time.March, 1, 0, 0, 0, 0, time.UTC),
+				To:     time.Date(2019, time.March, 31, 0, 0, 0, 0, time.UTC),
+				Limit:  100,
+				Offset: 200,
+			},
+		},
+		{
+			name:          "Invalid date",
+			from:          "01.03.2019",
+			expectedError: errors.New("'from' must be a date in format YYYY-MM-DD"),
+		},
+		{
+			name:          "Reversed dates",
+			from:          "2019-03-31",
+			to:            "2019-03-01",
+			expectedError: errors.New("'to' must not be before 'from'"),
+		},
+		{
+			name:          "Negative limit",
+			limit:         "-1",
+			expectedError: errors.New("'limit' must be a non-negative integer"),
+		},
+		{
+			name:          "Invalid offset",
+			offset:        "abc",
+			expectedError: errors.New("'offset' must be a non-negative integer"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			f, err := NewObservationFilter(test.from, test.to, test.limit, test.offset)
+
+			// Assert
+			if test.expectedError != nil {
+				assert.EqualError(t, err, test.expectedError.Error())
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, f)
+		})
+	}
+}
+
+func TestExportObservations(t *testing.T) {
+	tests := []struct {
+		name         string
+		format       string
+		observations []Observation
+		expected     string
+	}{
+		{
+			name:         "JSON",
+			format:       formatJSON,
+			observations: testObservations,
+			expected: `[{"id":1,"location_id":2643743,"measured_at":"2019-03-30T12:00:00Z","date":"2019-03-30","temperature":280.74,"temp_min":278.71,"temp_max":282.59,"humidity":null,"pressure":null,"wind_speed":null,"wind_deg":null,"source":"owm","conditions":[500,801]}` + "\n" +
+				`,{"id":2,"location_id":2643743,"measured_at":"2019-03-31T12:00:00Z","date":"2019-03-31","temperature":281,"temp_min":280,"temp_max":282,"humidity":75,"pressure":1012,"wind_speed":2.5,"wind_deg":180,"source":"import","conditions":[]}` + "\n]\n",
+		},
+		{
+			name:     "Empty JSON",
+			format:   formatJSON,
+			expected: "[]\n",
+		},
+		{
+			name:         "NDJSON",
+			format:       formatNDJSON,
+			observations: testObservations,
+			expected: `{"id":1,"location_id":2643743,"measured_at":"2019-03-30T12:00:00Z","date":"2019-03-30","temperature":280.74,"temp_min":278.71,"temp_max":282.59,"humidity":null,"pressure":null,"wind_speed":null,"wind_deg":null,"source":"owm","conditions":[500,801]}` + "\n" +
+				`{"id":2,"location_id":2643743,"measured_at":"2019-03-31T12:00:00Z","date":"2019-03-31","temperature":281,"temp_min":280,"temp_max":282,"humidity":75,"pressure":1012,"wind_speed":2.5,"wind_deg":180,"source":"import","conditions":[]}` + "\n",
+		},
+		{
+			name:         "CSV",
+			format:       formatCSV,
+			observations: testObservations,
+			expected: "id,location_id,measured_at,date,temperature,temp_min,temp_max,humidity,pressure,wind_speed,wind_deg,source,conditions\n" +
+				"1,2643743,2019-03-30T12:00:00Z,2019-03-30,280.74,278.71,282.59,,,,,owm,500;801\n" +
+				"2,2643743,2019-03-31T12:00:00Z,2019-03-31,281.00,280.00,282.00,75.00,1012.00,2.50,180,import,\n",
+		},
+		{
+			name:     "Empty CSV",
+			format:   formatCSV,
+			expected: "id,location_id,measured_at,date,temperature,temp_min,temp_max,humidity,pressure,wind_speed,wind_deg,source,conditions\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			var b bytes.Buffer
+
+			// Act
+			err := exportObservations(fakeDatabase{observations: test.observations}, &b, test.format, ObservationFilter{})
+
+			// Assert
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, b.String())
+		})
+	}
+
+	t.Run("Invalid format", func(t *testing.T) {
+		// Act
+		err := exportObservations(fakeDatabase{}, &bytes.Buffer{}, "xml", ObservationFilter{})
+
+		// Assert
+		assert.NotNil(t, err)
+	})
+}
+
+func TestGetObservations(t *testing.T) {
+	// Arrange
+	tests := []struct {
+		name          string
+		expectedError error
+		LocationID    string
+		query         url.Values
+		db            fakeDatabase
+		HTTPStatus    int
+		contentType   string
+	}{
+		{
+			name:          "Bad request",
+			LocationID:    "abc",
+			expectedError: fmt.Errorf(locationInvalidID),
+			HTTPStatus:    http.StatusBadRequest,
+		},
+		{
+			name:          "Invalid format",
+			LocationID:    "123",
+			query:         url.Values{"format": {"xml"}},
+			expectedError: fmt.Errorf("format must be one of: json, csv, ndjson"),
+			HTTPStatus:    http.StatusBadRequest,
+		},
+		{
+			name:          "Invalid date filter",
+			LocationID:    "123",
+			query:         url.Values{"to": {"yesterday"}},
+			expectedError: fmt.Errorf("'to' must be a date in format YYYY-MM-DD"),
+			HTTPStatus:    http.StatusBadRequest,
+		},
+		{
+			name:          "Location does not exist",
+			LocationID:    "123",
+			expectedError: fmt.Errorf("location '123' does not exist"),
+			HTTPStatus:    http.StatusNotFound,
+			db: fakeDatabase{
+				err: sql.ErrNoRows,
+			},
+		},
+		{
+			name:          "Can not get location",
+			LocationID:    "123",
+			expectedError: fmt.Errorf(serviceIsUnavailable),
+			HTTPStatus:    http.StatusServiceUnavailable,
+			db: fakeDatabase{
+				err: errors.New("database error"),
+			},
+		},
+		{
+			name:        "Observations have been returned",
+			LocationID:  "2643743",
+			query:       url.Values{"from": {"2019-03-01"}},
+			HTTPStatus:  http.StatusOK,
+			contentType: "application/json",
+			db: fakeDatabase{
+				observations: testObservations,
+			},
+		},
+		{
+			name:        "Observations have been returned as CSV",
+			LocationID:  "2643743",
+			query:       url.Values{"format": {"csv"}},
+			HTTPStatus:  http.StatusOK,
+			contentType: "text/csv",
+			db: fakeDatabase{
+				observations: testObservations,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			w := NewWeatherEndpoint(test.db, nil, nil)
+			httpRequest, _ := http.NewRequest("GET", "/weather/"+test.LocationID+"/observations?"+test.query.Encode(), nil)
+			request := restful.NewRequest(httpRequest)
+			httpWriter := httptest.NewRecorder()
+			response := restful.NewResponse(httpWriter)
+			response.SetRequestAccepts(restful.MIME_JSON)
+			params := request.PathParameters()
+			params["location_id"] = test.LocationID
+
+			// Act
+			w.getObservations(request, response)
+
+			// Assert
+			assert.Equal(t, test.HTTPStatus, response.StatusCode())
+			if test.expectedError != nil {
+				assert.EqualError(t, response.Error(), test.expectedError.Error())
+				return
+			}
+
+			assert.Equal(t, test.contentType, httpWriter.Header().Get("Content-Type"))
+			if test.contentType == "application/json" {
+				var result []Observation
+				require.Nil(t, json.Unmarshal(httpWriter.Body.Bytes(), &result))
+				assert.Equal(t, test.db.observations, result)
+			}
+		})
+	}
+}
@@ -1,16 +1,22 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Description stores open weather map internal data
+// Description stores open weather map weather condition, it refers to database table 'descriptions'
 type Description struct {
 	ID          int    `json:"id"`
 	Main        string `json:"main"`
@@ -24,57 +30,306 @@ type OpenMapWeather struct {
 		Latitude  float32 `json:"lat"`
 		Longitude float32 `json:"lon"`
 	} `json:"coord"`
-	Description []struct {
-		Main        string `json:"main"`
-	} `json:"weather"`
-	Main struct {
-		Temp     float32 `json:"temp"`
-		TempMin  float32 `json:"temp_min"`
-		TempMax  float32 `json:"temp_max"`
+	Description []Description `json:"weather"`
+	Main        struct {
+		Temp     float32  `json:"temp"`
+		TempMin  float32  `json:"temp_min"`
+		TempMax  float32  `json:"temp_max"`
+		Humidity *float32 `json:"humidity"`
+		Pressure *float32 `json:"pressure"`
 	} `json:"main"`
+	Wind struct {
+		Speed *float32 `json:"speed"`
+		Deg   *int     `json:"deg"`
+	} `json:"wind"`
 	Sys struct {
-		Country string  `json:"country"`
+		Country string `json:"country"`
 	} `json:"sys"`
+	Dt   int64  `json:"dt"` // unix time of the calculation of the weather
 	ID   int    `json:"id"`
 	Name string `json:"name"`
 }
 
 // OpenWeatherAPI is a client for open weather map service
 type OpenWeatherAPI struct {
-	client  *http.Client
-	baseURL string
-	token   string
+	client       *http.Client
+	baseURL      string
+	keys         *keyPool
+	iconURL      string
+	geocodingURL string
+	lang         string
+	units        string
+	timeout      time.Duration   // of requests to the service
+	ctx          context.Context // of the request which needs open weather map, nil means background
+
+	cache    weatherCache // nil means that weather is not cached
+	cacheTTL time.Duration
+	flights  *weatherFlights
+	quota    *Quota // nil means that requests are not limited
+	retry    RetryOptions
 }
 
+// defaultIconURL is a location of weather condition icons in open weather map service
+const defaultIconURL = "http://openweathermap.org/img/wn"
+
+// maxIconSize is the limit of bytes of an icon, icons of open weather map have a few kilobytes
+const maxIconSize = 1 << 20
+
+// units of open weather map responses, they are converted to kelvins and m/s
+const (
+	owmUnitsStandard = "standard" // kelvins and m/s
+	owmUnitsMetric   = "metric"   // celsius and m/s
+	owmUnitsImperial = "imperial" // fahrenheit and miles per hour
+)
+
+// owmModeJSON is the only mode of responses which the client parses
+const owmModeJSON = "json"
+
+// owmLang is a language of descriptions of conditions, e.g. 'de' or 'zh_cn'
+var owmLang = regexp.MustCompile(`^[a-zA-Z]{2}(_[a-zA-Z]{2})?$`)
+
 // OpenMapWeatherError stores cause of error from open weather map service
 type OpenMapWeatherError struct {
 	Message string `json:"message"`
 }
 
-// NewOpenWeatherAPI returns new client to open weather map service
-func NewOpenWeatherAPI(client *http.Client) (*OpenWeatherAPI, error) {
-	baseURL := os.Getenv("OPEN_WEATHER_MAP_URL")
-	token := os.Getenv("OPEN_WEATHER_MAP_TOKEN")
+// OpenWeatherMapOptions configures the client of open weather map service
+type OpenWeatherMapOptions struct {
+	URL          string        `yaml:"url"`   // e.g. 'http://api.openweathermap.org/data/2.5'
+	Token        string        `yaml:"token"` // comma separated keys
+	Keys         KeyOptions    `yaml:"keys"`
+	IconURL      string        `yaml:"icon_url"`
+	GeocodingURL string        `yaml:"geocoding_url"` // e.g. 'http://api.openweathermap.org/geo/1.0'
+	Timeout      time.Duration `yaml:"timeout"`       // of requests to the service
+	Lang         string        `yaml:"lang"`          // of descriptions of conditions, empty means english
+	Units        string        `yaml:"units"`         // of responses: standard, metric or imperial
+	Cache        CacheOptions  `yaml:"cache"`
+	Quota        QuotaOptions  `yaml:"quota"`
+	Retry        RetryOptions  `yaml:"retry"`
+}
 
-	if len(baseURL) == 0 || len(token) == 0 {
+func (o OpenWeatherMapOptions) validate(p *configProblems) {
+	if len(o.URL) == 0 {
+		p.add("open_weather_map.url", "is required")
+	}
+	if len(o.Token) == 0 && len(o.Keys.File) == 0 {
+		p.add("open_weather_map.token", "or open_weather_map.keys.file is required")
+	}
+	p.positive("open_weather_map.timeout", o.Timeout)
+	if len(o.Lang) > 0 && !owmLang.MatchString(o.Lang) {
+		p.add("open_weather_map.lang", "must be a language code, e.g. de or zh_cn, got (%s)", o.Lang)
+	}
+	if len(o.Units) > 0 && o.Units != owmUnitsStandard && o.Units != owmUnitsMetric && o.Units != owmUnitsImperial {
+		p.add("open_weather_map.units", "must be one of: %s, %s, %s, got (%s)", owmUnitsStandard, owmUnitsMetric, owmUnitsImperial, o.Units)
+	}
+	o.Cache.validate(p)
+	o.Keys.validate(p)
+	o.Quota.validate(p)
+	o.Retry.validate(p)
+}
+
+// NewOpenWeatherAPI returns new client to open weather map service
+func NewOpenWeatherAPI(client *http.Client, o OpenWeatherMapOptions) (*OpenWeatherAPI, error) {
+	if len(o.URL) == 0 || (len(o.Token) == 0 && len(o.Keys.File) == 0) {
 		return nil, errors.New("configuration for open weather map client is not provided")
 	}
+	keys, err := newKeyPool(o.Token, o.Keys, keyReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	iconURL := o.IconURL
+	if len(iconURL) == 0 {
+		iconURL = defaultIconURL
+	}
+	geocodingURL := o.GeocodingURL
+	if len(geocodingURL) == 0 {
+		geocodingURL = defaultGeocodingURL
+	}
 
 	return &OpenWeatherAPI{
-		client:  client,
-		baseURL: baseURL,
-		token:   token,
+		client:       client,
+		baseURL:      o.URL,
+		keys:         keys,
+		iconURL:      iconURL,
+		geocodingURL: geocodingURL,
+		lang:         o.Lang,
+		units:        o.Units,
+		timeout:      o.Timeout,
+		cache:        newWeatherCache(o.Cache),
+		cacheTTL:     o.Cache.TTL,
+		flights:      newWeatherFlights(),
+		retry:        o.Retry,
 	}, nil
 }
 
+// buildURI returns the URI of the endpoint with encoded parameters, the key is added by send
 func (o *OpenWeatherAPI) buildURI(endpoint string, params map[string]string) string {
-	uri := fmt.Sprintf("%s/%s?appid=%s", o.baseURL, endpoint, o.token)
-	for k, v := range params {
-		uri += fmt.Sprintf("&%s=%s", k, v)
+	return buildURL(o.baseURL, endpoint, params)
+}
+
+// buildURL returns the URL of the endpoint of the API with encoded parameters
+func buildURL(base, endpoint string, params map[string]string) string {
+	uri := strings.TrimSuffix(base, "/") + "/" + endpoint
+	if query := encodeParams(params); len(query) > 0 {
+		uri += "?" + query
 	}
 	return uri
 }
 
+// encodeParams returns the query of parameters sorted by name
+func encodeParams(params map[string]string) string {
+	query := url.Values{}
+	for k, v := range params {
+		query.Set(k, v)
+	}
+	return query.Encode()
+}
+
+// weatherParams returns parameters of the weather query with lang and units of the client unless they are given,
+// standard units are the default of open weather map, so they are not sent
+func (o *OpenWeatherAPI) weatherParams(params map[string]string) map[string]string {
+	p := map[string]string{}
+	if len(o.lang) > 0 {
+		p["lang"] = o.lang
+	}
+	if len(o.units) > 0 && o.units != owmUnitsStandard {
+		p["units"] = o.units
+	}
+	for k, v := range params {
+		p[k] = v
+	}
+	return p
+}
+
+// SetQuota limits requests to open weather map API by budgets of the quota, icons are not limited
+func (o *OpenWeatherAPI) SetQuota(quota *Quota) {
+	o.quota = quota
+}
+
+// withContext returns the client which sends requests with the context, so they are logged with its request
+func (o *OpenWeatherAPI) withContext(ctx context.Context) *OpenWeatherAPI {
+	if o == nil {
+		return nil
+	}
+	c := *o
+	c.ctx = ctx
+	return &c
+}
+
+// get sends the request to the endpoint of open weather map, records its span and logs it without the token.
+// Timeouts, connection errors and 5xx responses are retried with backoff, every attempt waits for the quota.
+func (o *OpenWeatherAPI) get(endpoint, uri string, priority int) (*http.Response, error) {
+	ctx := o.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, s := startSpan(ctx, "open_weather_map "+endpoint, spanKindClient)
+	defer s.finish()
+	s.setAttributes("http.method", "GET", "peer.service", "open_weather_map")
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		resp, err := o.attempt(ctx, endpoint, uri, priority, s)
+		reason := retryReason(resp, err)
+		backoff := o.retry.backoff(attempt)
+		result := "retried"
+		if len(reason) == 0 {
+			result = "final"
+		} else if attempt >= o.retry.MaxAttempts || time.Since(start)+backoff > o.retry.MaxElapsed || ctx.Err() != nil {
+			result = "exhausted"
+		}
+		owmAttempts.inc(endpoint, strconv.Itoa(attempt), result)
+
+		if result != "retried" {
+			s.setAttributes("attempts", attempt)
+			if err != nil {
+				s.setError(err)
+			} else {
+				s.setAttributes("http.status_code", resp.StatusCode)
+			}
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		loggerFrom(ctx).Warning("Open weather map request will be retried",
+			"endpoint", endpoint, "attempt", attempt, "reason", reason, "backoff", backoff, "error", err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			s.setError(ctx.Err())
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// attempt sends the request once with the next key, it is sent again with another key when open weather map
+// rejects the key with 401 or 429
+func (o *OpenWeatherAPI) attempt(ctx context.Context, endpoint, uri string, priority int, s *span) (*http.Response, error) {
+	if endpoint == "icon" {
+		return o.send(ctx, endpoint, uri, "", s)
+	}
+	for tried := 1; ; tried++ {
+		if err := o.quota.acquire(ctx, priority); err != nil {
+			loggerFrom(ctx).Warning("Open weather map request has not been sent", "endpoint", endpoint, "error", err)
+			return nil, err
+		}
+		key, err := o.keys.pick()
+		if err != nil {
+			loggerFrom(ctx).Warning("Open weather map request has not been sent", "endpoint", endpoint, "error", err)
+			return nil, err
+		}
+		resp, err := o.send(ctx, endpoint, uri, key, s)
+		if err != nil || (resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusTooManyRequests) {
+			return resp, err
+		}
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		wait := o.keys.disable(key, resp.StatusCode, retryAfter)
+		if wait > 0 || tried >= o.keys.size() {
+			if resp.StatusCode == http.StatusTooManyRequests {
+				// 429 of the last key stops requests for its Retry-After
+				o.quota.pause(wait)
+				loggerFrom(ctx).Warning("Open weather map quota is exceeded", "endpoint", endpoint, "retry_after", wait)
+			}
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
+
+// send sends the request with the key, records its metrics and logs it. The key is redacted from errors.
+func (o *OpenWeatherAPI) send(ctx context.Context, endpoint, uri, key string, s *span) (*http.Response, error) {
+	request, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > 0 {
+		query := request.URL.Query()
+		query.Set("appid", key)
+		request.URL.RawQuery = query.Encode()
+	}
+	request.Header.Set(traceparentHeader, s.context.traceparent())
+
+	start := time.Now()
+	resp, err := o.client.Do(request.WithContext(ctx))
+	observeOWMRequest(endpoint, start, resp, err)
+	if e, ok := err.(*url.Error); ok && len(key) > 0 {
+		e.URL = strings.Replace(e.URL, url.QueryEscape(key), redactKey(key), -1)
+	}
+
+	log := loggerFrom(ctx).With("endpoint", endpoint, "duration", time.Since(start))
+	if err != nil {
+		log.Warning("Open weather map request has failed", "error", err)
+		return nil, err
+	}
+	log.Debug("Open weather map request", "status", resp.StatusCode)
+	return resp, nil
+}
+
 func (o *OpenWeatherAPI) parseErrorResponse(response *http.Response) error {
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
@@ -101,10 +356,104 @@ func (o *OpenWeatherAPI) parseResponse(response *http.Response) (*OpenMapWeather
 	return weather, nil
 }
 
+// getWeather returns the weather from the cache or requests it, concurrent identical requests are sent once
 func (o *OpenWeatherAPI) getWeather(params map[string]string) (*OpenMapWeather, int, error) {
+	params = o.weatherParams(params)
+	key := weatherCacheKey("weather", params)
+	if w, ok := o.cachedWeather(key); ok {
+		owmCacheRequests.inc("hit")
+		return w, http.StatusOK, nil
+	}
+
+	// no attempt is started after the maximum elapsed time of retries, so the last one ends by the timeout after it
+	timeout := o.retry.MaxElapsed + o.timeout
+	result, shared := o.flights.do(o.ctx, key, timeout, func(ctx context.Context) weatherResult {
+		c := o.withContext(ctx)
+		w, status, err := c.requestWeather(params)
+		if err == nil {
+			c.cacheWeather(key, w)
+		}
+		return weatherResult{weather: w, status: status, err: err}
+	})
+	if shared {
+		owmCacheRequests.inc("shared")
+	} else {
+		owmCacheRequests.inc("miss")
+	}
+	// every request gets its own copy, so changes of one request are not seen by the others
+	return result.weather.clone(), result.status, result.err
+}
+
+// clone returns a deep copy of the weather
+func (w *OpenMapWeather) clone() *OpenMapWeather {
+	if w == nil {
+		return nil
+	}
+	c := *w
+	c.Description = append([]Description(nil), w.Description...)
+	c.Main.Humidity = cloneFloat32(w.Main.Humidity)
+	c.Main.Pressure = cloneFloat32(w.Main.Pressure)
+	c.Wind.Speed = cloneFloat32(w.Wind.Speed)
+	if w.Wind.Deg != nil {
+		deg := *w.Wind.Deg
+		c.Wind.Deg = &deg
+	}
+	return &c
+}
+
+func cloneFloat32(v *float32) *float32 {
+	if v == nil {
+		return nil
+	}
+	c := *v
+	return &c
+}
+
+// cachedWeather returns the cached weather, failures of the cache are logged and the weather is requested then
+func (o *OpenWeatherAPI) cachedWeather(key string) (*OpenMapWeather, bool) {
+	if o.cache == nil {
+		return nil, false
+	}
+	value, ok, err := o.cache.get(key)
+	if err != nil {
+		loggerFrom(o.ctx).Warning("Open weather map cache has failed", "error", err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	w := &OpenMapWeather{}
+	if err = json.Unmarshal(value, w); err != nil {
+		loggerFrom(o.ctx).Warning("Open weather map cache has failed", "error", err)
+		return nil, false
+	}
+	return w, true
+}
+
+func (o *OpenWeatherAPI) cacheWeather(key string, w *OpenMapWeather) {
+	if o.cache == nil {
+		return
+	}
+	value, err := json.Marshal(w)
+	if err == nil {
+		err = o.cache.set(key, value, weatherTTL(w, o.cacheTTL, time.Now()))
+	}
+	if err != nil {
+		loggerFrom(o.ctx).Warning("Open weather map cache has failed", "error", err)
+	}
+}
+
+// requestWeather requests the weather, it is converted to kelvins and m/s
+func (o *OpenWeatherAPI) requestWeather(params map[string]string) (*OpenMapWeather, int, error) {
+	if mode, ok := params["mode"]; ok && mode != owmModeJSON {
+		return nil, http.StatusBadRequest, fmt.Errorf("mode (%s) is not supported, only %s responses are parsed", mode, owmModeJSON)
+	}
 	uri := o.buildURI("weather", params)
-	resp, err := o.client.Get(uri)
+	resp, err := o.get("weather", uri, priorityUser)
 	if err != nil {
+		if _, ok := err.(*quotaError); ok {
+			return nil, http.StatusTooManyRequests, err
+		}
 		if e, ok := err.(net.Error); ok && e.Timeout() {
 			return nil, http.StatusGatewayTimeout, err
 		}
@@ -116,6 +465,10 @@ func (o *OpenWeatherAPI) getWeather(params map[string]string) (*OpenMapWeather,
 		if resp.StatusCode == http.StatusNotFound {
 			return nil, http.StatusNotFound, o.parseErrorResponse(resp)
 		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return nil, http.StatusTooManyRequests, &quotaError{reason: o.parseErrorResponse(resp).Error(),
+				retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+		}
 		return nil, http.StatusBadGateway, o.parseErrorResponse(resp)
 	}
 
@@ -123,6 +476,77 @@ func (o *OpenWeatherAPI) getWeather(params map[string]string) (*OpenMapWeather,
 	if err != nil {
 		return nil, http.StatusBadGateway, err
 	}
+	toStandardUnits(response, params["units"])
 	return response, http.StatusOK, nil
+}
+
+// toStandardUnits converts the weather in the units to kelvins and m/s
+func toStandardUnits(w *OpenMapWeather, units string) {
+	temperature := unitsKelvin
+	switch units {
+	case owmUnitsMetric:
+		temperature = unitsCelsius
+	case owmUnitsImperial:
+		temperature = unitsFahrenheit
+		if w.Wind.Speed != nil {
+			speed := *w.Wind.Speed * 0.44704
+			w.Wind.Speed = &speed
+		}
+	}
+	w.Main.Temp = float32(toKelvin(float64(w.Main.Temp), temperature))
+	w.Main.TempMin = float32(toKelvin(float64(w.Main.TempMin), temperature))
+	w.Main.TempMax = float32(toKelvin(float64(w.Main.TempMax), temperature))
+}
+
+// credentialsCity is requested to check the token, it is London
+const credentialsCity = "2643743"
+
+// checkCredentials returns false when open weather map rejects the token,
+// the error without rejection means that the token could not be checked
+func (o *OpenWeatherAPI) checkCredentials() (bool, error) {
+	resp, err := o.get("credentials", o.buildURI("weather", map[string]string{"id": credentialsCity}), priorityBackground)
+	if err == errKeysRejected {
+		return false, err
+	}
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotFound:
+		return true, nil
+	case http.StatusUnauthorized:
+		return false, o.parseErrorResponse(resp)
+	default:
+		return true, fmt.Errorf("open weather map responded with status=(%d)", resp.StatusCode)
+	}
+}
 
+// getIcon downloads PNG icon of weather condition, e.g. '10d'
+func (o *OpenWeatherAPI) getIcon(icon string) ([]byte, int, error) {
+	resp, err := o.get("icon", fmt.Sprintf("%s/%s@2x.png", o.iconURL, icon), priorityUser)
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil, http.StatusGatewayTimeout, err
+		}
+		return nil, http.StatusBadGateway, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("can not get icon '%s', status=(%d)", icon, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxIconSize+1))
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	if len(body) > maxIconSize {
+		return nil, http.StatusBadGateway, fmt.Errorf("icon '%s' is larger than %d bytes", icon, maxIconSize)
+	}
+	if contentType := http.DetectContentType(body); contentType != "image/png" {
+		return nil, http.StatusBadGateway, fmt.Errorf("icon '%s' is not an image, content type=(%s)", icon, contentType)
+	}
+	return body, http.StatusOK, nil
 }
@@ -3,55 +3,143 @@ package app
 import (
 	"encoding/json"
 
+	"github.com/mieczyslaw1980/weather/internal/fakeowm"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"net/url"
 	"testing"
 )
 
 func TestBuildURI(t *testing.T) {
-	URLOriginal := os.Getenv("OPEN_WEATHER_MAP_URL")
-	tokenOriginal := os.Getenv("OPEN_WEATHER_MAP_TOKEN")
-
-	defer func() {
-		os.Setenv("OPEN_WEATHER_MAP_URL", URLOriginal)
-		os.Setenv("OPEN_WEATHER_MAP_TOKEN", tokenOriginal)
-	}()
-
-	os.Setenv("OPEN_WEATHER_MAP_URL", "http://test_url")
-	os.Setenv("OPEN_WEATHER_MAP_TOKEN", "test_token")
+	tests := []struct {
+		name     string
+		params   map[string]string
+		expected string
+	}{
+		{name: "Without parameters", expected: "http://test_url/endpoint"},
+		{name: "Sorted parameters", params: map[string]string{"q": "London", "lang": "de"}, expected: "http://test_url/endpoint?lang=de&q=London"},
+		{name: "Accents", params: map[string]string{"q": "Saint-Étienne"}, expected: "http://test_url/endpoint?q=Saint-%C3%89tienne"},
+		{name: "Comma and spaces", params: map[string]string{"q": "Washington, D.C."}, expected: "http://test_url/endpoint?q=Washington%2C+D.C."},
+		{name: "Injected parameter", params: map[string]string{"q": "London&appid=other"}, expected: "http://test_url/endpoint?q=London%26appid%3Dother"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			o, _ := NewOpenWeatherAPI(nil, OpenWeatherMapOptions{URL: "http://test_url/", Token: "test_token"})
+
+			// Act
+			uri := o.buildURI("endpoint", test.params)
+
+			// Assert
+			assert.Equal(t, test.expected, uri)
+		})
+	}
+}
 
-	t.Run("check build url", func(t *testing.T) {
-		// Arrange
-		o, _ := NewOpenWeatherAPI(nil)
+func TestWeatherParams(t *testing.T) {
+	// Arrange
+	o, _ := NewOpenWeatherAPI(nil, OpenWeatherMapOptions{URL: "http://test_url", Token: "test_token", Lang: "de", Units: owmUnitsMetric})
+	standard, _ := NewOpenWeatherAPI(nil, OpenWeatherMapOptions{URL: "http://test_url", Token: "test_token", Units: owmUnitsStandard})
+
+	// Act
+	defaults := o.weatherParams(map[string]string{"id": "2643743"})
+	given := o.weatherParams(map[string]string{"id": "2643743", "lang": "fr", "units": owmUnitsImperial})
+	omitted := standard.weatherParams(map[string]string{"id": "2643743"})
+
+	// Assert
+	assert.Equal(t, map[string]string{"id": "2643743", "lang": "de", "units": "metric"}, defaults)
+	assert.Equal(t, map[string]string{"id": "2643743", "lang": "fr", "units": "imperial"}, given)
+	assert.Equal(t, map[string]string{"id": "2643743"}, omitted)
+	assert.Equal(t, "weather?id=2643743&lang=de&units=metric", weatherCacheKey("weather", defaults))
+}
 
-		// Act
-		uri := o.buildURI("enpoint", map[string]string{
-			"key1": "value1",
+func TestToStandardUnits(t *testing.T) {
+	tests := []struct {
+		name          string
+		units         string
+		temp          float32
+		speed         float32
+		expectedTemp  float32
+		expectedSpeed float32
+	}{
+		{name: "Standard", units: owmUnitsStandard, temp: 284.15, speed: 4.1, expectedTemp: 284.15, expectedSpeed: 4.1},
+		{name: "Default", temp: 284.15, speed: 4.1, expectedTemp: 284.15, expectedSpeed: 4.1},
+		{name: "Metric", units: owmUnitsMetric, temp: 11, speed: 4.1, expectedTemp: 284.15, expectedSpeed: 4.1},
+		{name: "Imperial", units: owmUnitsImperial, temp: 51.8, speed: 10, expectedTemp: 284.15, expectedSpeed: 4.4704},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			w := &OpenMapWeather{}
+			w.Main.Temp, w.Main.TempMin, w.Main.TempMax = test.temp, test.temp, test.temp
+			w.Wind.Speed = &test.speed
+
+			// Act
+			toStandardUnits(w, test.units)
+
+			// Assert
+			assert.InDelta(t, test.expectedTemp, w.Main.Temp, 0.001)
+			assert.InDelta(t, test.expectedTemp, w.Main.TempMin, 0.001)
+			assert.InDelta(t, test.expectedTemp, w.Main.TempMax, 0.001)
+			assert.InDelta(t, test.expectedSpeed, *w.Wind.Speed, 0.001)
 		})
+	}
+}
 
-		// Assert
-		assert.Equal(t, "http://test_url/enpoint?appid=test_token&key1=value1", uri)
-	})
+func TestOpenWeatherMapQuery(t *testing.T) {
+	// Arrange
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		query = req.URL.Query()
+		rw.Write([]byte(`{"id": 2980291, "name": "Saint-Étienne", "main": {"temp": 11, "temp_min": 10, "temp_max": 12}}`))
+	}))
+	defer server.Close()
+	o, err := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, Token: "secret-key", Lang: "fr", Units: owmUnitsMetric})
+	require.Nil(t, err)
+
+	// Act
+	w, status, err := o.getWeather(map[string]string{"q": "Saint-Étienne,FR"})
+	_, unsupportedStatus, unsupported := o.getWeather(map[string]string{"q": "Saint-Étienne,FR", "mode": "xml"})
+
+	// Assert
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, url.Values{"q": {"Saint-Étienne,FR"}, "appid": {"secret-key"}, "lang": {"fr"}, "units": {"metric"}}, query)
+	assert.Equal(t, "Saint-Étienne", w.Name)
+	assert.InDelta(t, 284.15, w.Main.Temp, 0.001)
+	assert.Equal(t, http.StatusBadRequest, unsupportedStatus)
+	assert.EqualError(t, unsupported, "mode (xml) is not supported, only json responses are parsed")
+}
+
+func TestOpenWeatherMapKeyRedaction(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	server.Close()
+	o, err := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, Token: "secret-key-1234"})
+	require.Nil(t, err)
+	logs, restore := captureLogs()
+	defer restore()
+
+	// Act
+	_, status, err := o.getWeather(map[string]string{"id": "2643743"})
+
+	// Assert
+	assert.Equal(t, http.StatusBadGateway, status)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "appid=***1234")
+	assert.NotContains(t, err.Error(), "secret-key")
+	assert.NotContains(t, logs.String(), "secret-key")
 }
 
 func TestNewOpenWeatherAPI(t *testing.T) {
 	t.Run("Invalid configuration for open weather map client", func(t *testing.T) {
 		// Arrange
-		URLOriginal := os.Getenv("OPEN_WEATHER_MAP_URL")
-		tokenOriginal := os.Getenv("OPEN_WEATHER_MAP_TOKEN")
-
-		defer func() {
-			os.Setenv("OPEN_WEATHER_MAP_URL", URLOriginal)
-			os.Setenv("OPEN_WEATHER_MAP_TOKEN", tokenOriginal)
-		}()
-
-		os.Setenv("OPEN_WEATHER_MAP_URL", "http://test_url")
-		os.Setenv("OPEN_WEATHER_MAP_TOKEN", "")
-		o, err := NewOpenWeatherAPI(nil)
+		o, err := NewOpenWeatherAPI(nil, OpenWeatherMapOptions{URL: "http://test_url"})
 
 		assert.Nil(t, o)
 		assert.NotNil(t, err)
@@ -61,17 +149,7 @@ func TestNewOpenWeatherAPI(t *testing.T) {
 func TestParseErrorResponse(t *testing.T) {
 	t.Run("Parse valid error response", func(t *testing.T) {
 		// Arrange
-		URLOriginal := os.Getenv("OPEN_WEATHER_MAP_URL")
-		tokenOriginal := os.Getenv("OPEN_WEATHER_MAP_TOKEN")
-
-		defer func() {
-			os.Setenv("OPEN_WEATHER_MAP_URL", URLOriginal)
-			os.Setenv("OPEN_WEATHER_MAP_TOKEN", tokenOriginal)
-		}()
-
-		os.Setenv("OPEN_WEATHER_MAP_URL", "http://test_url")
-		os.Setenv("OPEN_WEATHER_MAP_TOKEN", "token")
-		o, _ := NewOpenWeatherAPI(nil)
+		o, _ := NewOpenWeatherAPI(nil, OpenWeatherMapOptions{URL: "http://test_url", Token: "token"})
 		require.NotNil(t, o)
 		test := &OpenMapWeatherError{
 			Message: "unknown error from open weather map service",
@@ -93,18 +171,7 @@ func TestParseErrorResponse(t *testing.T) {
 
 	t.Run("Parse invalid error response", func(t *testing.T) {
 		// Arrange
-		URLOriginal := os.Getenv("OPEN_WEATHER_MAP_URL")
-		tokenOriginal := os.Getenv("OPEN_WEATHER_MAP_TOKEN")
-
-		defer func() {
-			os.Setenv("OPEN_WEATHER_MAP_URL", URLOriginal)
-			os.Setenv("OPEN_WEATHER_MAP_TOKEN", tokenOriginal)
-		}()
-
-		os.Setenv("OPEN_WEATHER_MAP_URL", "http://test_url")
-		os.Setenv("OPEN_WEATHER_MAP_TOKEN", "token")
-
-		o, _ := NewOpenWeatherAPI(nil)
+		o, _ := NewOpenWeatherAPI(nil, OpenWeatherMapOptions{URL: "http://test_url", Token: "token"})
 		require.NotNil(t, o)
 		response := httptest.NewRecorder()
 		response.WriteHeader(http.StatusOK)
@@ -121,17 +188,7 @@ func TestParseErrorResponse(t *testing.T) {
 func TestParseResponse(t *testing.T) {
 	t.Run("Parse valid response", func(t *testing.T) {
 		// Arrange
-		URLOriginal := os.Getenv("OPEN_WEATHER_MAP_URL")
-		tokenOriginal := os.Getenv("OPEN_WEATHER_MAP_TOKEN")
-
-		defer func() {
-			os.Setenv("OPEN_WEATHER_MAP_URL", URLOriginal)
-			os.Setenv("OPEN_WEATHER_MAP_TOKEN", tokenOriginal)
-		}()
-
-		os.Setenv("OPEN_WEATHER_MAP_URL", "http://test_url")
-		os.Setenv("OPEN_WEATHER_MAP_TOKEN", "token")
-		o, _ := NewOpenWeatherAPI(nil)
+		o, _ := NewOpenWeatherAPI(nil, OpenWeatherMapOptions{URL: "http://test_url", Token: "token"})
 		require.NotNil(t, o)
 		test := &OpenMapWeather{
 			Name: "City",
@@ -155,18 +212,7 @@ func TestParseResponse(t *testing.T) {
 
 	t.Run("Parse invalid response", func(t *testing.T) {
 		// Arrange
-		URLOriginal := os.Getenv("OPEN_WEATHER_MAP_URL")
-		tokenOriginal := os.Getenv("OPEN_WEATHER_MAP_TOKEN")
-
-		defer func() {
-			os.Setenv("OPEN_WEATHER_MAP_URL", URLOriginal)
-			os.Setenv("OPEN_WEATHER_MAP_TOKEN", tokenOriginal)
-		}()
-
-		os.Setenv("OPEN_WEATHER_MAP_URL", "http://test_url")
-		os.Setenv("OPEN_WEATHER_MAP_TOKEN", "token")
-
-		o, _ := NewOpenWeatherAPI(nil)
+		o, _ := NewOpenWeatherAPI(nil, OpenWeatherMapOptions{URL: "http://test_url", Token: "token"})
 		require.NotNil(t, o)
 		response := httptest.NewRecorder()
 		response.WriteHeader(http.StatusOK)
@@ -181,3 +227,63 @@ func TestParseResponse(t *testing.T) {
 	})
 
 }
+
+func TestOpenWeatherMapFake(t *testing.T) {
+	tests := []struct {
+		name           string
+		options        fakeowm.Options
+		token          string
+		id             string
+		expectedStatus int
+		expectedName   string
+	}{
+		{
+			name:           "Weather",
+			token:          "fake",
+			id:             "2988507",
+			expectedStatus: http.StatusOK,
+			expectedName:   "Paris",
+		},
+		{
+			name:           "Location is not found",
+			token:          "fake",
+			id:             "0",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Revoked key is rotated",
+			options:        fakeowm.Options{Keys: []string{"valid"}},
+			token:          "revoked,valid",
+			id:             "2643743",
+			expectedStatus: http.StatusOK,
+			expectedName:   "London",
+		},
+		{
+			name:           "Provider is failing",
+			options:        fakeowm.Options{ErrorRate: 1},
+			token:          "fake",
+			id:             "2643743",
+			expectedStatus: http.StatusBadGateway,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			test.options.Fixtures = "../../configs/fake-owm"
+			server := httptest.NewServer(fakeowm.New(test.options))
+			defer server.Close()
+			o, err := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL + "/data/2.5", Token: test.token})
+			require.Nil(t, err)
+
+			// Act
+			w, status, _ := o.getWeather(map[string]string{"id": test.id})
+
+			// Assert
+			assert.Equal(t, test.expectedStatus, status)
+			if test.expectedStatus == http.StatusOK {
+				assert.Equal(t, test.expectedName, w.Name)
+			}
+		})
+	}
+}
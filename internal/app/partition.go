@@ -0,0 +1,152 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// tables partitioned by month, conditions go first because they are detached first
+var partitionedTables = []string{"conditions", "weather"}
+
+// partitioning stores the policy for monthly range partitions of tables 'weather' and 'conditions'
+type partitioning struct {
+	ahead     int // number of next months which have partitions created in advance
+	retention int // number of months which stay attached, 0 means forever
+}
+
+// monthStart returns the first day of the month in UTC
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// partitionName returns name of the partition, e.g. 'weather_y2019m03'
+func partitionName(table string, month time.Time) string {
+	return fmt.Sprintf("%s_y%04dm%02d", table, month.Year(), month.Month())
+}
+
+// parsePartitionName returns the month of the partition created by partitionName
+func parsePartitionName(table, name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, table+"_y") {
+		return time.Time{}, false
+	}
+
+	month, err := time.Parse("2006m01", strings.TrimPrefix(name, table+"_y"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return month, true
+}
+
+// expired returns true when the partition for the month is older than the retention period
+func (p *partitioning) expired(month, now time.Time) bool {
+	if p.retention <= 0 {
+		return false
+	}
+	return month.Before(monthStart(now).AddDate(0, -p.retention+1, 0))
+}
+
+// createPartitions creates partitions of all tables for the month if they do not exist
+func createPartitions(db *pg.DB, month time.Time) error {
+	month = monthStart(month)
+	for _, table := range partitionedTables {
+		_, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM (?) TO (?)",
+			partitionName(table, month), table),
+			month.Format("2006-01-02"), month.AddDate(0, 1, 0).Format("2006-01-02"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isMissingPartition returns true when a row does not fit into any partition
+func isMissingPartition(err error) bool {
+	pgErr, ok := err.(pg.Error)
+	return ok && pgErr.Field('C') == "23514" && strings.Contains(pgErr.Field('M'), "no partition")
+}
+
+func (d *Database) maintainPartitions(now time.Time) error {
+	db := d.connect()
+
+	for i := 0; i <= d.partitioning.ahead; i++ {
+		if err := createPartitions(db, monthStart(now).AddDate(0, i, 0)); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range partitionedTables {
+		var names []string
+		_, err := db.Query(&names, "SELECT c.relname FROM pg_inherits AS i "+
+			"JOIN pg_class AS c ON c.oid = i.inhrelid JOIN pg_class AS p ON p.oid = i.inhparent "+
+			"WHERE p.relname = ?", table)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			month, ok := parsePartitionName(table, name)
+			if !ok || !d.partitioning.expired(month, now) {
+				continue
+			}
+
+			if _, err = db.Exec(fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", table, name)); err != nil {
+				return err
+			}
+			logger.Info("Partition has been detached", "partition", name)
+		}
+	}
+	return nil
+}
+
+// PartitionMaintainer periodically creates partitions ahead of time and detaches expired ones
+type PartitionMaintainer struct {
+	db       *Database
+	interval time.Duration
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewPartitionMaintainer returns PartitionMaintainer instance
+func NewPartitionMaintainer(db *Database, interval time.Duration) *PartitionMaintainer {
+	return &PartitionMaintainer{
+		db:       db,
+		interval: interval,
+		quit:     make(chan struct{}),
+	}
+}
+
+// Start runs maintenance immediately and then every interval
+func (m *PartitionMaintainer) Start() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			start := time.Now()
+			err := m.db.maintainPartitions(start)
+			if err != nil {
+				logger.Error("Partition maintenance", "error", err)
+			}
+			observeCollectorRun("partitions", start, err)
+
+			select {
+			case <-ticker.C:
+			case <-m.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits until the running maintenance is finished
+func (m *PartitionMaintainer) Stop() {
+	close(m.quit)
+	m.wg.Wait()
+}
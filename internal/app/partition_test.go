@@ -0,0 +1,85 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionName(t *testing.T) {
+	t.Run("Build and parse partition name", func(t *testing.T) {
+		// Arrange
+		month := monthStart(time.Date(2019, time.March, 30, 23, 10, 0, 0, time.UTC))
+
+		// Act
+		name := partitionName("weather", month)
+		parsed, ok := parsePartitionName("weather", name)
+
+		// Assert
+		assert.Equal(t, "weather_y2019m03", name)
+		assert.True(t, ok)
+		assert.Equal(t, month, parsed)
+	})
+
+	t.Run("Parse name of other table", func(t *testing.T) {
+		// Act
+		_, ok := parsePartitionName("weather", "conditions_y2019m03")
+
+		// Assert
+		assert.False(t, ok)
+	})
+
+	t.Run("Parse invalid name", func(t *testing.T) {
+		// Act
+		_, ok := parsePartitionName("weather", "weather_old")
+
+		// Assert
+		assert.False(t, ok)
+	})
+}
+
+func TestPartitionExpired(t *testing.T) {
+	now := time.Date(2019, time.March, 15, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		retention int
+		month     time.Time
+		expired   bool
+	}{
+		{
+			name:      "Retention is disabled",
+			retention: 0,
+			month:     time.Date(2010, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "Current month",
+			retention: 1,
+			month:     time.Date(2019, time.March, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "The oldest month within retention",
+			retention: 3,
+			month:     time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "Month older than retention",
+			retention: 3,
+			month:     time.Date(2018, time.December, 1, 0, 0, 0, 0, time.UTC),
+			expired:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			p := partitioning{retention: test.retention}
+
+			// Act
+			expired := p.expired(test.month, now)
+
+			// Assert
+			assert.Equal(t, test.expired, expired)
+		})
+	}
+}
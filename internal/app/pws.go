@@ -0,0 +1,327 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/emicklei/go-restful-openapi"
+)
+
+const (
+	// pwsSuccess is the response expected by weather stations
+	pwsSuccess = "success"
+	// pwsUnauthorized is the response of Weather Underground for invalid credentials
+	pwsUnauthorized = "INVALID PASSWORDID|Password or key and/or id are incorrect"
+
+	pwsDateLayout = "2006-01-02 15:04:05"
+
+	minStationHashKey = 16 // characters of the secret of hashes of station keys
+
+	stationNotFound = "station '%s' not found"
+	// stationHashKeyMissing is returned when keys of stations can not be hashed
+	stationHashKeyMissing = "personal stations require stations.hash_key"
+)
+
+// PersonalStation refers to database table 'personal_stations', it binds a weather station to a location
+type PersonalStation struct {
+	TableName  struct{} `sql:"personal_stations" json:"-"`
+	StationID  string   `json:"station_id" sql:",pk" description:"identifier of the station, 'ID' of Weather Underground protocol"`
+	Key        string   `json:"key,omitempty" sql:"-" description:"key of the station, 'PASSWORD' of Weather Underground protocol or 'PASSKEY' of Ecowitt protocol, it is never returned"`
+	KeyHash    string   `json:"-"`
+	LocationID int      `json:"location_id" description:"identifier of the location which receives observations of the station"`
+}
+
+// hashStationKey returns HMAC-SHA256 of the key with the secret of the server, keys are never stored in plain text
+// and leaked hashes can not be checked against guessed keys without the secret
+func hashStationKey(secret []byte, key string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// valid compares the key with the stored hash in constant time
+func (s PersonalStation) valid(secret []byte, key string) bool {
+	return len(key) > 0 && len(secret) > 0 &&
+		subtle.ConstantTimeCompare([]byte(s.KeyHash), []byte(hashStationKey(secret, key))) == 1
+}
+
+// pwsFields are names of form fields which differ between protocols
+type pwsFields struct {
+	source   string
+	pressure []string // pressures in inches of mercury, the first given one is used
+}
+
+var (
+	wundergroundFields = pwsFields{source: sourceWunderground, pressure: []string{"baromin"}}
+	ecowittFields      = pwsFields{source: sourceEcowitt, pressure: []string{"baromrelin", "baromabsin"}}
+)
+
+// pwsValue parses the field in imperial units, false means the field is missing
+func pwsValue(values url.Values, field string) (float64, bool, error) {
+	v := strings.TrimSpace(values.Get(field))
+	if len(v) == 0 {
+		return 0, false, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false, fmt.Errorf("'%s' must be a number, got '%s'", field, v)
+	}
+	return f, true, nil
+}
+
+// parsePWSObservation maps fields of Weather Underground or Ecowitt protocol to weather,
+// both send imperial units and the time in UTC
+func parsePWSObservation(values url.Values, fields pwsFields, now time.Time) (Weather, error) {
+	w := Weather{Source: fields.source}
+
+	switch v := values.Get("dateutc"); v {
+	case "", "now":
+		w.MeasuredAt = now.UTC().Truncate(time.Second)
+	default:
+		t, err := time.Parse(pwsDateLayout, v)
+		if err != nil {
+			return w, fmt.Errorf("'dateutc' must be 'now' or in format YYYY-MM-DD HH:MM:SS, got '%s'", v)
+		}
+		w.MeasuredAt = t
+	}
+
+	temperature, ok, err := pwsValue(values, "tempf")
+	if err != nil {
+		return w, err
+	}
+	if !ok {
+		return w, errors.New("'tempf' is required")
+	}
+	w.Temperature = float32(toKelvin(temperature, unitsFahrenheit))
+	w.TempMin = w.Temperature
+	w.TempMax = w.Temperature
+
+	if humidity, ok, err := pwsValue(values, "humidity"); err != nil {
+		return w, err
+	} else if ok {
+		h := float32(humidity)
+		w.Humidity = &h
+	}
+
+	for _, field := range fields.pressure {
+		pressure, ok, err := pwsValue(values, field)
+		if err != nil {
+			return w, err
+		}
+		if ok {
+			p := float32(math.Round(pressure*338.639) / 10)
+			w.Pressure = &p
+			break
+		}
+	}
+
+	if speed, ok, err := pwsValue(values, "windspeedmph"); err != nil {
+		return w, err
+	} else if ok {
+		s := float32(math.Round(speed*4.4704) / 10)
+		w.WindSpeed = &s
+	}
+
+	if direction, ok, err := pwsValue(values, "winddir"); err != nil {
+		return w, err
+	} else if ok {
+		// e.g. -90 is 270 and 360 is 0
+		deg := (int(math.Round(direction))%360 + 360) % 360
+		w.WindDeg = &deg
+	}
+	return w, nil
+}
+
+// PersonalStationEndpoint receives observations of personal weather stations
+type PersonalStationEndpoint struct {
+	db      databaseWeatherProvider
+	hashKey []byte
+}
+
+// NewPersonalStationEndpoint returns PersonalStationEndpoint instance, keys of stations are hashed with the secret
+func NewPersonalStationEndpoint(db databaseWeatherProvider, hashKey string) *PersonalStationEndpoint {
+	return &PersonalStationEndpoint{
+		db:      db,
+		hashKey: []byte(hashKey),
+	}
+}
+
+// Endpoint is a webservice compatible with Weather Underground and Ecowitt upload protocols,
+// stations are registered at /stations/personal
+func (p *PersonalStationEndpoint) Endpoint() *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path("/weatherstation").
+		Produces("text/plain")
+
+	tags := []string{"stations"}
+
+	ws.Route(ws.GET("/updateweatherstation.php").To(p.updateWeatherStation).
+		Doc("upload an observation with Weather Underground protocol").
+		Param(ws.QueryParameter("ID", "identifier of the station").DataType("string").Required(true)).
+		Param(ws.QueryParameter("PASSWORD", "key of the station").DataType("string").Required(true)).
+		Param(ws.QueryParameter("dateutc", "'now' or time in UTC, YYYY-MM-DD HH:MM:SS").DataType("string")).
+		Param(ws.QueryParameter("tempf", "temperature in °F").DataType("number").Required(true)).
+		Param(ws.QueryParameter("humidity", "relative humidity in %").DataType("number")).
+		Param(ws.QueryParameter("baromin", "pressure in inches of mercury").DataType("number")).
+		Param(ws.QueryParameter("windspeedmph", "wind speed in mph").DataType("number")).
+		Param(ws.QueryParameter("winddir", "wind direction in degrees").DataType("number")).
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Returns(http.StatusOK, pwsSuccess, nil).
+		Returns(http.StatusBadRequest, "invalid observation", nil).
+		Returns(http.StatusUnauthorized, pwsUnauthorized, nil).
+		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil))
+
+	ws.Route(ws.POST("/ecowitt/{station_id}").To(p.ecowitt).
+		Doc("upload an observation with Ecowitt protocol, the path is set as customized server path of the station").
+		Param(ws.PathParameter("station_id", "identifier of the station").DataType("string")).
+		Param(ws.FormParameter("PASSKEY", "key of the station").DataType("string").Required(true)).
+		Param(ws.FormParameter("dateutc", "time in UTC, YYYY-MM-DD HH:MM:SS").DataType("string")).
+		Param(ws.FormParameter("tempf", "temperature in °F").DataType("number").Required(true)).
+		Param(ws.FormParameter("humidity", "relative humidity in %").DataType("number")).
+		Param(ws.FormParameter("baromrelin", "relative pressure in inches of mercury").DataType("number")).
+		Param(ws.FormParameter("baromabsin", "absolute pressure in inches of mercury").DataType("number")).
+		Param(ws.FormParameter("windspeedmph", "wind speed in mph").DataType("number")).
+		Param(ws.FormParameter("winddir", "wind direction in degrees").DataType("number")).
+		Consumes("application/x-www-form-urlencoded").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Returns(http.StatusOK, pwsSuccess, nil).
+		Returns(http.StatusBadRequest, "invalid observation", nil).
+		Returns(http.StatusUnauthorized, pwsUnauthorized, nil).
+		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil))
+
+	return ws
+}
+
+func (p *PersonalStationEndpoint) updateWeatherStation(request *restful.Request, response *restful.Response) {
+	values := request.Request.URL.Query()
+	p.save(request, response, values.Get("ID"), values.Get("PASSWORD"), values, wundergroundFields)
+}
+
+func (p *PersonalStationEndpoint) ecowitt(request *restful.Request, response *restful.Response) {
+	if err := request.Request.ParseForm(); err != nil {
+		response.WriteErrorString(http.StatusBadRequest, "invalid form")
+		return
+	}
+	values := request.Request.PostForm
+	p.save(request, response, request.PathParameter("station_id"), values.Get("PASSKEY"), values, ecowittFields)
+}
+
+// save authenticates the station and stores its observation at the bound location
+func (p *PersonalStationEndpoint) save(request *restful.Request, response *restful.Response, stationID, key string,
+	values url.Values, fields pwsFields) {
+	db := p.db.withContext(requestContext(request))
+
+	station, err := db.getPersonalStation(stationID)
+	if err != nil && err != sql.ErrNoRows {
+		requestLogger(request).Error("Save station observation", "error", err)
+		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
+		return
+	}
+	if err == sql.ErrNoRows || !station.valid(p.hashKey, key) {
+		response.WriteErrorString(http.StatusUnauthorized, pwsUnauthorized)
+		return
+	}
+
+	w, err := parsePWSObservation(values, fields, time.Now())
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+	w.LocationID = station.LocationID
+
+	// stations resend observations which were not acknowledged, so duplicates are accepted
+	if err = db.saveWeather(w); err != nil && err != errDuplicateObservation {
+		requestLogger(request).Error("Save station observation", "error", err)
+		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
+		return
+	}
+	response.Write([]byte(pwsSuccess))
+}
+
+func (s *StationEndpoint) getPersonalStations(request *restful.Request, response *restful.Response) {
+	db := s.db.withContext(requestContext(request))
+
+	list, err := db.getPersonalStations()
+	if err != nil {
+		requestLogger(request).Error("Get personal stations", "error", err)
+		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
+		return
+	}
+
+	if list == nil {
+		response.WriteEntity(make([]PersonalStation, 0))
+		return
+	}
+	response.WriteEntity(list)
+}
+
+func (s *StationEndpoint) savePersonalStation(request *restful.Request, response *restful.Response) {
+	db := s.db.withContext(requestContext(request))
+
+	station := PersonalStation{}
+	if err := request.ReadEntity(&station); err != nil {
+		response.WriteErrorString(http.StatusBadRequest, "invalid data input")
+		return
+	}
+	station.StationID = request.PathParameter("station_id")
+	if len(station.Key) == 0 {
+		response.WriteErrorString(http.StatusBadRequest, "input data field 'key' is required")
+		return
+	}
+	if len(s.hashKey) == 0 {
+		requestLogger(request).Error("Save personal station", "error", stationHashKeyMissing)
+		response.WriteErrorString(http.StatusServiceUnavailable, stationHashKeyMissing)
+		return
+	}
+
+	if _, err := db.getLocation(station.LocationID); err != nil {
+		if err == sql.ErrNoRows {
+			response.WriteErrorString(http.StatusNotFound,
+				fmt.Sprintf("location '%d' does not exist", station.LocationID))
+			return
+		}
+		requestLogger(request).Error("Save personal station", "error", err)
+		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
+		return
+	}
+
+	station.KeyHash = hashStationKey(s.hashKey, station.Key)
+	if err := db.savePersonalStation(station); err != nil {
+		requestLogger(request).Error("Save personal station", "error", err)
+		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
+		return
+	}
+
+	requestLogger(request).Info("Personal station has been bound", "station_id", station.StationID, "location_id", station.LocationID)
+	station.Key = ""
+	response.WriteEntity(&station)
+}
+
+func (s *StationEndpoint) deletePersonalStation(request *restful.Request, response *restful.Response) {
+	db := s.db.withContext(requestContext(request))
+
+	stationID := request.PathParameter("station_id")
+	if err := db.deletePersonalStation(stationID); err != nil {
+		if err == sql.ErrNoRows {
+			response.WriteErrorString(http.StatusNotFound, fmt.Sprintf(stationNotFound, stationID))
+			return
+		}
+		requestLogger(request).Error("Delete personal station", "error", err)
+		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
+		return
+	}
+
+	response.WriteEntity(nil)
+}
@@ -0,0 +1,364 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testHashKey = "0123456789abcdef"
+
+var rooftop = PersonalStation{StationID: "KROOF1", KeyHash: hashStationKey([]byte(testHashKey), "secret"), LocationID: 2643743}
+
+func TestPersonalStationValid(t *testing.T) {
+	secret := []byte(testHashKey)
+	assert.True(t, rooftop.valid(secret, "secret"))
+	assert.False(t, rooftop.valid(secret, "Secret"))
+	assert.False(t, rooftop.valid(secret, ""))
+	assert.False(t, rooftop.valid([]byte("fedcba9876543210"), "secret"))
+	assert.False(t, rooftop.valid(nil, "secret"))
+	assert.False(t, PersonalStation{}.valid(secret, ""))
+}
+
+func TestParsePWSObservation(t *testing.T) {
+	now := time.Date(2019, 3, 30, 12, 0, 0, 500, time.UTC)
+
+	tests := []struct {
+		name          string
+		query         string
+		fields        pwsFields
+		expected      Weather
+		expectedError error
+	}{
+		{
+			name:   "Weather Underground",
+			query:  "dateutc=2019-03-30+11%3A50%3A00&tempf=50&humidity=80&baromin=29.92&windspeedmph=10&winddir=270&rainin=0",
+			fields: wundergroundFields,
+			expected: Weather{
+				Temperature: 283.15,
+				TempMin:     283.15,
+				TempMax:     283.15,
+				Humidity:    float32Ptr(80),
+				Pressure:    float32Ptr(1013.2),
+				WindSpeed:   float32Ptr(4.5),
+				WindDeg:     intPtr(270),
+				Source:      sourceWunderground,
+				MeasuredAt:  time.Date(2019, 3, 30, 11, 50, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:   "Ecowitt prefers relative pressure",
+			query:  "dateutc=2019-03-30+11:50:00&tempf=50&baromabsin=29.50&baromrelin=30.00",
+			fields: ecowittFields,
+			expected: Weather{
+				Temperature: 283.15,
+				TempMin:     283.15,
+				TempMax:     283.15,
+				Pressure:    float32Ptr(1015.9),
+				Source:      sourceEcowitt,
+				MeasuredAt:  time.Date(2019, 3, 30, 11, 50, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:   "Current time",
+			query:  "dateutc=now&tempf=32",
+			fields: wundergroundFields,
+			expected: Weather{
+				Temperature: 273.15,
+				TempMin:     273.15,
+				TempMax:     273.15,
+				Source:      sourceWunderground,
+				MeasuredAt:  time.Date(2019, 3, 30, 12, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:   "Negative wind direction",
+			query:  "dateutc=now&tempf=32&winddir=-90.2",
+			fields: wundergroundFields,
+			expected: Weather{
+				Temperature: 273.15,
+				TempMin:     273.15,
+				TempMax:     273.15,
+				WindDeg:     intPtr(270),
+				Source:      sourceWunderground,
+				MeasuredAt:  time.Date(2019, 3, 30, 12, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:   "Wind direction of the north",
+			query:  "dateutc=now&tempf=32&winddir=360",
+			fields: wundergroundFields,
+			expected: Weather{
+				Temperature: 273.15,
+				TempMin:     273.15,
+				TempMax:     273.15,
+				WindDeg:     intPtr(0),
+				Source:      sourceWunderground,
+				MeasuredAt:  time.Date(2019, 3, 30, 12, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:          "Missing temperature",
+			query:         "humidity=80",
+			fields:        wundergroundFields,
+			expectedError: errors.New("'tempf' is required"),
+		},
+		{
+			name:          "Invalid time",
+			query:         "dateutc=yesterday&tempf=50",
+			fields:        wundergroundFields,
+			expectedError: errors.New("'dateutc' must be 'now' or in format YYYY-MM-DD HH:MM:SS, got 'yesterday'"),
+		},
+		{
+			name:          "Invalid number",
+			query:         "tempf=50&windspeedmph=NaN",
+			fields:        wundergroundFields,
+			expectedError: errors.New("'windspeedmph' must be a number, got 'NaN'"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			values, err := url.ParseQuery(test.query)
+			require.Nil(t, err)
+
+			// Act
+			w, err := parsePWSObservation(values, test.fields, now)
+
+			// Assert
+			if test.expectedError != nil {
+				assert.EqualError(t, err, test.expectedError.Error())
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, w)
+		})
+	}
+}
+
+func TestUpdateWeatherStation(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		db         fakeDatabase
+		HTTPStatus int
+		body       string
+	}{
+		{
+			name:       "Unknown station",
+			query:      "?ID=KROOF1&PASSWORD=secret&tempf=50",
+			db:         fakeDatabase{err: sql.ErrNoRows},
+			HTTPStatus: http.StatusUnauthorized,
+			body:       pwsUnauthorized,
+		},
+		{
+			name:       "Invalid key",
+			query:      "?ID=KROOF1&PASSWORD=guess&tempf=50",
+			db:         fakeDatabase{stations: []PersonalStation{rooftop}},
+			HTTPStatus: http.StatusUnauthorized,
+			body:       pwsUnauthorized,
+		},
+		{
+			name:       "Database error",
+			query:      "?ID=KROOF1&PASSWORD=secret&tempf=50",
+			db:         fakeDatabase{err: errors.New("can not connect to database")},
+			HTTPStatus: http.StatusServiceUnavailable,
+			body:       serviceIsUnavailable,
+		},
+		{
+			name:       "Invalid observation",
+			query:      "?ID=KROOF1&PASSWORD=secret",
+			db:         fakeDatabase{stations: []PersonalStation{rooftop}},
+			HTTPStatus: http.StatusBadRequest,
+			body:       "'tempf' is required",
+		},
+		{
+			name:       "Observation has been saved",
+			query:      "?ID=KROOF1&PASSWORD=secret&dateutc=now&tempf=50&action=updateraw",
+			db:         fakeDatabase{stations: []PersonalStation{rooftop}},
+			HTTPStatus: http.StatusOK,
+			body:       pwsSuccess,
+		},
+		{
+			name:       "Repeated observation",
+			query:      "?ID=KROOF1&PASSWORD=secret&dateutc=2019-03-30+11:50:00&tempf=50",
+			db:         fakeDatabase{stations: []PersonalStation{rooftop}, errSave: errDuplicateObservation},
+			HTTPStatus: http.StatusOK,
+			body:       pwsSuccess,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			container := restful.NewContainer()
+			container.Add(NewPersonalStationEndpoint(test.db, testHashKey).Endpoint())
+			httpRequest := httptest.NewRequest("GET", "/weatherstation/updateweatherstation.php"+test.query, nil)
+			httpWriter := httptest.NewRecorder()
+
+			// Act
+			container.ServeHTTP(httpWriter, httpRequest)
+
+			// Assert
+			assert.Equal(t, test.HTTPStatus, httpWriter.Code)
+			assert.Equal(t, test.body, httpWriter.Body.String())
+		})
+	}
+}
+
+func TestEcowitt(t *testing.T) {
+	tests := []struct {
+		name       string
+		form       string
+		db         fakeDatabase
+		HTTPStatus int
+	}{
+		{
+			name:       "Invalid key",
+			form:       "PASSKEY=guess&stationtype=EasyWeatherV1.4.0&tempf=50",
+			db:         fakeDatabase{stations: []PersonalStation{rooftop}},
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Observation has been saved",
+			form:       "PASSKEY=secret&stationtype=EasyWeatherV1.4.0&dateutc=2019-03-30+11:50:00&tempf=50&humidity=80&baromrelin=30.00",
+			db:         fakeDatabase{stations: []PersonalStation{rooftop}},
+			HTTPStatus: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			container := restful.NewContainer()
+			container.Add(NewPersonalStationEndpoint(test.db, testHashKey).Endpoint())
+			httpRequest := httptest.NewRequest("POST", "/weatherstation/ecowitt/KROOF1", strings.NewReader(test.form))
+			httpRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			httpWriter := httptest.NewRecorder()
+
+			// Act
+			container.ServeHTTP(httpWriter, httpRequest)
+
+			// Assert
+			assert.Equal(t, test.HTTPStatus, httpWriter.Code)
+		})
+	}
+}
+
+func TestPersonalStations(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		authorization string
+		body          string
+		hashKey       string
+		db            fakeDatabase
+		HTTPStatus    int
+	}{
+		{
+			name:       "Unauthorized",
+			method:     "GET",
+			path:       "/stations/personal",
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "Get stations",
+			method:        "GET",
+			path:          "/stations/personal",
+			authorization: "Bearer token",
+			db:            fakeDatabase{stations: []PersonalStation{rooftop}},
+			HTTPStatus:    http.StatusOK,
+		},
+		{
+			name:          "Missing key",
+			method:        "PUT",
+			path:          "/stations/personal/KROOF1",
+			authorization: "Bearer token",
+			body:          `{"location_id": 2643743}`,
+			HTTPStatus:    http.StatusBadRequest,
+		},
+		{
+			name:          "Location does not exist",
+			method:        "PUT",
+			path:          "/stations/personal/KROOF1",
+			authorization: "Bearer token",
+			body:          `{"key": "secret", "location_id": 1}`,
+			db:            fakeDatabase{err: sql.ErrNoRows},
+			hashKey:       testHashKey,
+			HTTPStatus:    http.StatusNotFound,
+		},
+		{
+			name:          "Missing hash key",
+			method:        "PUT",
+			path:          "/stations/personal/KROOF1",
+			authorization: "Bearer token",
+			body:          `{"key": "secret", "location_id": 2643743}`,
+			db:            fakeDatabase{locations: []Location{london}},
+			HTTPStatus:    http.StatusServiceUnavailable,
+		},
+		{
+			name:          "Station has been saved",
+			method:        "PUT",
+			path:          "/stations/personal/KROOF1",
+			authorization: "Bearer token",
+			body:          `{"key": "secret", "location_id": 2643743}`,
+			hashKey:       testHashKey,
+			db:            fakeDatabase{locations: []Location{london}},
+			HTTPStatus:    http.StatusOK,
+		},
+		{
+			name:          "Delete unknown station",
+			method:        "DELETE",
+			path:          "/stations/personal/KROOF1",
+			authorization: "Bearer token",
+			db:            fakeDatabase{err: sql.ErrNoRows},
+			HTTPStatus:    http.StatusNotFound,
+		},
+		{
+			name:          "Station has been deleted",
+			method:        "DELETE",
+			path:          "/stations/personal/KROOF1",
+			authorization: "Bearer token",
+			HTTPStatus:    http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			container := restful.NewContainer()
+			container.Add(NewStationEndpoint(test.db, nil, DefaultStationDistance, test.hashKey, NewAuthenticator("token")).Endpoint())
+			httpRequest := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			httpRequest.Header.Set("Content-Type", "application/json")
+			if len(test.authorization) > 0 {
+				httpRequest.Header.Set("Authorization", test.authorization)
+			}
+			httpWriter := httptest.NewRecorder()
+
+			// Act
+			container.ServeHTTP(httpWriter, httpRequest)
+
+			// Assert
+			assert.Equal(t, test.HTTPStatus, httpWriter.Code)
+			if test.HTTPStatus == http.StatusOK && test.method != "DELETE" {
+				// keys are never returned
+				assert.NotContains(t, httpWriter.Body.String(), "secret")
+				assert.NotContains(t, httpWriter.Body.String(), rooftop.KeyHash)
+				var result interface{}
+				assert.Nil(t, json.Unmarshal(httpWriter.Body.Bytes(), &result))
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+const (
+	quotaSyncInterval     = 30 * time.Second
+	defaultQuotaRetryWait = time.Minute // when open weather map responds with 429 without Retry-After
+	quotaExhausted        = "open weather map quota is exhausted, retry later"
+	quotaDayLayout        = "2006-01-02"
+)
+
+// priorities of requests to open weather map, background requests can not use the reserve of budgets
+const (
+	priorityUser = iota
+	priorityBackground
+)
+
+var priorityNames = []string{"user", "background"}
+
+// quotaError is returned when a request to open weather map is not sent because of the quota
+type quotaError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("open weather map quota is exhausted: %s, retry after %s", e.reason, e.retryAfter)
+}
+
+// QuotaOptions configures budgets of requests to open weather map API, 0 means unlimited
+type QuotaOptions struct {
+	PerMinute int           `yaml:"per_minute"`
+	PerDay    int           `yaml:"per_day"`  // UTC days, it is shared by instances through the database
+	Reserve   float64       `yaml:"reserve"`  // share of budgets which background requests can not use
+	MaxWait   time.Duration `yaml:"max_wait"` // of user requests for the per-minute budget
+}
+
+func (o QuotaOptions) validate(p *configProblems) {
+	if o.PerMinute < 0 {
+		p.add("open_weather_map.quota.per_minute", "must not be negative, got (%d)", o.PerMinute)
+	}
+	if o.PerDay < 0 {
+		p.add("open_weather_map.quota.per_day", "must not be negative, got (%d)", o.PerDay)
+	}
+	if o.Reserve < 0 || o.Reserve >= 1 {
+		p.add("open_weather_map.quota.reserve", "must be at least 0 and less than 1, got (%g)", o.Reserve)
+	}
+	if o.MaxWait < 0 {
+		p.add("open_weather_map.quota.max_wait", "must not be negative, got (%s)", o.MaxWait)
+	}
+}
+
+// quotaStore accumulates requests of all instances by day
+type quotaStore interface {
+	addOWMUsage(day string, calls int) (int, error)
+}
+
+// QuotaReport describes budgets of requests to open weather map
+type QuotaReport struct {
+	PerMinute      int        `json:"per_minute" description:"budget of requests per minute, 0 means unlimited"`
+	PerDay         int        `json:"per_day" description:"budget of requests per UTC day, 0 means unlimited"`
+	Reserve        float64    `json:"reserve" description:"share of budgets which background requests can not use"`
+	Available      float64    `json:"available" description:"requests which may be sent now within the per-minute budget"`
+	Day            string     `json:"day" description:"UTC day of usage, YYYY-MM-DD"`
+	UsedToday      int        `json:"used_today" description:"requests of all instances sent today"`
+	RemainingToday *int       `json:"remaining_today,omitempty" description:"requests which may be sent today, it is missing without the per-day budget"`
+	PausedUntil    *time.Time `json:"paused_until,omitempty" description:"requests are not sent until this time, open weather map responded with 429"`
+}
+
+// Quota is a token bucket of the per-minute budget and a counter of the per-day budget of open weather map API
+type Quota struct {
+	perMinute int
+	perDay    int
+	reserve   float64
+	maxWait   time.Duration
+	store     quotaStore // nil means that usage is not persisted
+	now       func() time.Time
+
+	mutex       sync.Mutex
+	tokens      float64
+	refilledAt  time.Time
+	day         string
+	used        int            // requests of the day of all instances, including pending ones
+	pending     map[string]int // requests by day which are not stored yet
+	pausedUntil time.Time
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewQuota returns Quota with full budgets, usage of the day is loaded from the store when it is started
+func NewQuota(o QuotaOptions, store quotaStore) *Quota {
+	return &Quota{
+		perMinute: o.PerMinute,
+		perDay:    o.PerDay,
+		reserve:   o.Reserve,
+		maxWait:   o.MaxWait,
+		store:     store,
+		now:       time.Now,
+		tokens:    float64(o.PerMinute),
+		pending:   make(map[string]int),
+		quit:      make(chan struct{}),
+	}
+}
+
+// acquire waits for the budget of the request, background requests and requests which would wait
+// longer than the maximum are rejected with quotaError
+func (q *Quota) acquire(ctx context.Context, priority int) error {
+	if q == nil {
+		return nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	maxWait := q.maxWait
+	if priority == priorityBackground {
+		maxWait = 0
+	}
+
+	waited := time.Duration(0)
+	for {
+		q.mutex.Lock()
+		wait, reason, err := q.take(priority)
+		q.mutex.Unlock()
+		if err == nil && wait > 0 && waited+wait > maxWait {
+			err = &quotaError{reason: reason, retryAfter: wait}
+		}
+		if err != nil {
+			owmQuotaRejections.inc(priorityNames[priority])
+			return err
+		}
+		if wait == 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			waited += wait
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// take takes a token of the request, it returns how long and why to wait for it or the error when the day
+// is exhausted. The mutex must be locked.
+func (q *Quota) take(priority int) (time.Duration, string, error) {
+	now := q.now()
+	q.rollDay(now)
+
+	if now.Before(q.pausedUntil) {
+		return q.pausedUntil.Sub(now), "open weather map responded with 429", nil
+	}
+
+	if q.perDay > 0 {
+		limit := q.perDay
+		if priority == priorityBackground {
+			limit -= int(float64(q.perDay) * q.reserve)
+		}
+		if q.used >= limit {
+			tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+			return 0, "", &quotaError{reason: "per-day budget", retryAfter: tomorrow.Sub(now)}
+		}
+	}
+
+	if q.perMinute > 0 {
+		q.refill(now)
+		reserved := 0.0
+		if priority == priorityBackground {
+			reserved = float64(q.perMinute) * q.reserve
+		}
+		if q.tokens-1 < reserved {
+			missing := 1 + reserved - q.tokens
+			return time.Duration(missing * float64(time.Minute) / float64(q.perMinute)), "per-minute budget", nil
+		}
+		q.tokens--
+	}
+
+	q.used++
+	q.pending[q.day]++
+	return 0, "", nil
+}
+
+// refill adds tokens of the time since the last refill, the bucket holds the per-minute budget at most
+func (q *Quota) refill(now time.Time) {
+	if !q.refilledAt.IsZero() {
+		q.tokens += now.Sub(q.refilledAt).Minutes() * float64(q.perMinute)
+		if max := float64(q.perMinute); q.tokens > max {
+			q.tokens = max
+		}
+	}
+	q.refilledAt = now
+}
+
+// rollDay starts the usage of the new UTC day
+func (q *Quota) rollDay(now time.Time) {
+	if day := now.UTC().Format(quotaDayLayout); day != q.day {
+		q.day, q.used = day, 0
+	}
+}
+
+// pause stops requests until open weather map accepts them again
+func (q *Quota) pause(retryAfter time.Duration) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if until := q.now().Add(retryAfter); until.After(q.pausedUntil) {
+		q.pausedUntil = until
+	}
+}
+
+// parseRetryAfter returns the delay of Retry-After header in seconds or as HTTP date
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return defaultQuotaRetryWait
+}
+
+// report returns current budgets, requests are unlimited without the quota
+func (q *Quota) report() QuotaReport {
+	if q == nil {
+		return QuotaReport{}
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := q.now()
+	q.rollDay(now)
+	if q.perMinute > 0 {
+		q.refill(now)
+	}
+	r := QuotaReport{
+		PerMinute: q.perMinute,
+		PerDay:    q.perDay,
+		Reserve:   q.reserve,
+		Available: q.tokens,
+		Day:       q.day,
+		UsedToday: q.used,
+	}
+	if q.perDay > 0 {
+		remaining := q.perDay - q.used
+		if remaining < 0 {
+			remaining = 0
+		}
+		r.RemainingToday = &remaining
+	}
+	if now.Before(q.pausedUntil) {
+		until := q.pausedUntil
+		r.PausedUntil = &until
+	}
+	return r
+}
+
+// sync stores pending requests and loads usage of the day by all instances
+func (q *Quota) sync() (err error) {
+	start := time.Now()
+	defer func() {
+		observeCollectorRun("quota", start, err)
+	}()
+
+	q.mutex.Lock()
+	q.rollDay(q.now())
+	day, pending := q.day, q.pending
+	q.pending = make(map[string]int)
+	q.mutex.Unlock()
+
+	if _, ok := pending[day]; !ok {
+		pending[day] = 0
+	}
+	for d, calls := range pending {
+		total, e := q.store.addOWMUsage(d, calls)
+		q.mutex.Lock()
+		if e != nil {
+			// requests are stored with the next sync
+			q.pending[d] += calls
+			err = e
+		} else if d == q.day {
+			q.used = total + q.pending[d]
+		}
+		q.mutex.Unlock()
+	}
+	return err
+}
+
+// Start loads usage of the day and then stores and loads it periodically, so the per-day budget is kept
+// across restarts and shared by instances
+func (q *Quota) Start() {
+	if q.store == nil {
+		return
+	}
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+
+		ticker := time.NewTicker(quotaSyncInterval)
+		defer ticker.Stop()
+		for {
+			if err := q.sync(); err != nil {
+				logger.Error("Quota", "error", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-q.quit:
+				if err := q.sync(); err != nil {
+					logger.Error("Quota", "error", err)
+				}
+				return
+			}
+		}
+	}()
+}
+
+// Stop stores pending requests and waits until it is finished
+func (q *Quota) Stop() {
+	close(q.quit)
+	q.wg.Wait()
+}
+
+// writeQuotaError writes 429 with Retry-After when the request is rejected because of the quota,
+// false means that the error is not caused by the quota
+func writeQuotaError(response *restful.Response, err error) bool {
+	e, ok := err.(*quotaError)
+	if !ok {
+		return false
+	}
+	seconds := int(e.retryAfter.Seconds())
+	if time.Duration(seconds)*time.Second < e.retryAfter {
+		seconds++
+	}
+	response.AddHeader("Retry-After", strconv.Itoa(seconds))
+	response.WriteErrorString(http.StatusTooManyRequests, quotaExhausted)
+	return true
+}
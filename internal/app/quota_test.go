@@ -0,0 +1,205 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeQuotaStore keeps usage of open weather map by day
+type fakeQuotaStore struct {
+	err   error
+	usage map[string]int
+}
+
+func (f *fakeQuotaStore) addOWMUsage(day string, calls int) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	f.usage[day] += calls
+	return f.usage[day], nil
+}
+
+func TestQuotaAcquire(t *testing.T) {
+	now := time.Date(2026, 10, 18, 23, 59, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		options       QuotaOptions
+		priority      int
+		requests      int
+		paused        time.Duration
+		expectedSent  int
+		expectedError string
+	}{
+		{
+			name:         "Unlimited",
+			requests:     100,
+			expectedSent: 100,
+		},
+		{
+			name:          "Per-minute budget",
+			options:       QuotaOptions{PerMinute: 10},
+			requests:      11,
+			expectedSent:  10,
+			expectedError: "open weather map quota is exhausted: per-minute budget, retry after 6s",
+		},
+		{
+			name:          "Reserve of per-minute budget",
+			options:       QuotaOptions{PerMinute: 10, Reserve: 0.2},
+			priority:      priorityBackground,
+			requests:      10,
+			expectedSent:  8,
+			expectedError: "open weather map quota is exhausted: per-minute budget, retry after 6s",
+		},
+		{
+			name:          "Per-day budget",
+			options:       QuotaOptions{PerDay: 5, Reserve: 0.2},
+			requests:      6,
+			expectedSent:  5,
+			expectedError: "open weather map quota is exhausted: per-day budget, retry after 1m0s",
+		},
+		{
+			name:          "Reserve of per-day budget",
+			options:       QuotaOptions{PerDay: 5, Reserve: 0.2},
+			priority:      priorityBackground,
+			requests:      5,
+			expectedSent:  4,
+			expectedError: "open weather map quota is exhausted: per-day budget, retry after 1m0s",
+		},
+		{
+			name:          "Paused by open weather map",
+			options:       QuotaOptions{PerMinute: 10},
+			requests:      1,
+			paused:        30 * time.Second,
+			expectedError: "open weather map quota is exhausted: open weather map responded with 429, retry after 30s",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			q := NewQuota(test.options, nil)
+			q.now = func() time.Time { return now }
+			q.pause(test.paused)
+
+			// Act
+			sent := 0
+			var err error
+			for i := 0; i < test.requests && err == nil; i++ {
+				if err = q.acquire(context.Background(), test.priority); err == nil {
+					sent++
+				}
+			}
+
+			// Assert
+			assert.Equal(t, test.expectedSent, sent)
+			if len(test.expectedError) > 0 {
+				assert.EqualError(t, err, test.expectedError)
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, test.expectedSent, q.report().UsedToday)
+		})
+	}
+}
+
+func TestQuotaWait(t *testing.T) {
+	// Arrange
+	q := NewQuota(QuotaOptions{PerMinute: 1200, MaxWait: time.Second}, nil)
+	q.tokens = 0
+	impatient := NewQuota(QuotaOptions{PerMinute: 1200, MaxWait: 10 * time.Millisecond}, nil)
+	impatient.tokens = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Act
+	start := time.Now()
+	waited := q.acquire(context.Background(), priorityUser)
+	elapsed := time.Since(start)
+	rejected := impatient.acquire(context.Background(), priorityUser)
+	canceled := q.acquire(ctx, priorityUser)
+
+	// Assert
+	assert.Nil(t, waited)
+	assert.True(t, elapsed >= 40*time.Millisecond, elapsed)
+	assert.IsType(t, &quotaError{}, rejected)
+	assert.Equal(t, context.Canceled, canceled)
+}
+
+func TestQuotaSync(t *testing.T) {
+	// Arrange
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	store := &fakeQuotaStore{usage: map[string]int{"2026-10-18": 40}}
+	q := NewQuota(QuotaOptions{PerDay: 50}, store)
+	q.now = func() time.Time { return now }
+
+	// Act
+	require.Nil(t, q.sync())
+	loaded := q.report().UsedToday
+	for i := 0; i < 3; i++ {
+		require.Nil(t, q.acquire(context.Background(), priorityUser))
+	}
+	store.err = errors.New("connection refused")
+	failed := q.sync()
+	store.err = nil
+	require.Nil(t, q.acquire(context.Background(), priorityUser))
+	now = now.Add(12 * time.Hour)
+	require.Nil(t, q.sync())
+
+	// Assert
+	assert.Equal(t, 40, loaded)
+	assert.EqualError(t, failed, "connection refused")
+	assert.Equal(t, map[string]int{"2026-10-18": 44, "2026-10-19": 0}, store.usage)
+	assert.Equal(t, 0, q.report().UsedToday)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter("Sun, 18 Oct 2026 12:01:30 GMT", now))
+	assert.Equal(t, defaultQuotaRetryWait, parseRetryAfter("", now))
+	assert.Equal(t, defaultQuotaRetryWait, parseRetryAfter("Sun, 18 Oct 2026 11:00:00 GMT", now))
+}
+
+func TestOpenWeatherMapTooManyRequests(t *testing.T) {
+	// Arrange
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.Header().Set("Retry-After", "120")
+		rw.WriteHeader(http.StatusTooManyRequests)
+		rw.Write([]byte(`{"cod": 429, "message": "Your account is temporary blocked"}`))
+	}))
+	defer server.Close()
+	o, err := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, Token: "secret"})
+	require.Nil(t, err)
+	o.SetQuota(NewQuota(QuotaOptions{PerMinute: 60}, nil))
+	recorder := httptest.NewRecorder()
+
+	// Act
+	_, status, exceeded := o.getWeather(map[string]string{"id": "2643743"})
+	_, pausedStatus, paused := o.getWeather(map[string]string{"id": "2643743"})
+	written := writeQuotaError(restful.NewResponse(recorder), paused)
+
+	// Assert
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.EqualError(t, exceeded, "open weather map quota is exhausted: Your account is temporary blocked, retry after 2m0s")
+	assert.Equal(t, http.StatusTooManyRequests, pausedStatus)
+	assert.IsType(t, &quotaError{}, paused)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.True(t, written)
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "120", recorder.Header().Get("Retry-After"))
+	assert.Equal(t, quotaExhausted, recorder.Body.String())
+	assert.False(t, writeQuotaError(restful.NewResponse(httptest.NewRecorder()), errors.New("timeout")))
+}
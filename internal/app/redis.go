@@ -0,0 +1,163 @@
+package app
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisKeyPrefix separates keys of the service from other keys of the shared Redis
+const redisKeyPrefix = "weather:owm:"
+
+// redisError is an error reply of Redis, the connection is still usable after it
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisCache is weatherCache stored in Redis, it speaks RESP over a single connection which is
+// dialled again after failures
+type redisCache struct {
+	address  string
+	password string
+	db       int
+	timeout  time.Duration
+
+	mutex  sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRedisCache(o RedisOptions) *redisCache {
+	return &redisCache{
+		address:  o.Address,
+		password: o.Password,
+		db:       o.DB,
+		timeout:  o.Timeout,
+	}
+}
+
+func (r *redisCache) get(key string) ([]byte, bool, error) {
+	reply, err := r.do("GET", redisKeyPrefix+key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected reply to GET (%v)", reply)
+	}
+	return value, true, nil
+}
+
+func (r *redisCache) set(key string, value []byte, ttl time.Duration) error {
+	_, err := r.do("SET", redisKeyPrefix+key, string(value), "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return err
+}
+
+// do sends the command and returns its reply, the connection is closed when it is broken
+func (r *redisCache) do(args ...string) (interface{}, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.conn == nil {
+		if err := r.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := r.command(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		r.conn.Close()
+		r.conn = nil
+	}
+	return reply, err
+}
+
+// connect dials Redis, authenticates and selects the database
+func (r *redisCache) connect() error {
+	conn, err := net.DialTimeout("tcp", r.address, r.timeout)
+	if err != nil {
+		return err
+	}
+	r.conn, r.reader = conn, bufio.NewReader(conn)
+
+	if len(r.password) > 0 {
+		_, err = r.command("AUTH", r.password)
+	}
+	if err == nil && r.db > 0 {
+		_, err = r.command("SELECT", strconv.Itoa(r.db))
+	}
+	if err != nil {
+		conn.Close()
+		r.conn = nil
+	}
+	return err
+}
+
+func (r *redisCache) command(args ...string) (interface{}, error) {
+	if err := r.conn.SetDeadline(time.Now().Add(r.timeout)); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(r.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(r.reader)
+}
+
+// readRedisReply reads the reply in RESP, nil bulk strings and arrays are returned as nil
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		value := make([]byte, n+2)
+		if _, err = io.ReadFull(reader, value); err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(reader); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: invalid reply (%s)", line)
+}
@@ -0,0 +1,161 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis is a Redis server which supports commands used by redisCache
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mutex    sync.Mutex
+	values   map[string]string
+	commands []string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	r := &fakeRedis{listener: listener, password: password, values: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := len(r.password) == 0
+	for {
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+
+		r.mutex.Lock()
+		r.commands = append(r.commands, strings.Join(args, " "))
+		switch {
+		case args[0] == "AUTH" && args[1] == r.password:
+			authenticated = true
+			fmt.Fprint(conn, "+OK\r\n")
+		case !authenticated:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case args[0] == "SELECT":
+			fmt.Fprint(conn, "+OK\r\n")
+		case args[0] == "GET":
+			if v, ok := r.values[args[1]]; ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				fmt.Fprint(conn, "$-1\r\n")
+			}
+		case args[0] == "SET":
+			r.values[args[1]] = args[2]
+			fmt.Fprint(conn, "+OK\r\n")
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		r.mutex.Unlock()
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	// Arrange
+	server := newFakeRedis(t, "secret")
+	defer server.listener.Close()
+	c := newRedisCache(RedisOptions{Address: server.listener.Addr().String(), Password: "secret", DB: 2, Timeout: time.Second})
+
+	// Act
+	_, missing, missingErr := c.get("weather?id=1")
+	setErr := c.set("weather?id=1", []byte(`{"name": "London"}`), 90*time.Second)
+	value, cached, err := c.get("weather?id=1")
+
+	// Assert
+	assert.Nil(t, missingErr)
+	assert.False(t, missing)
+	assert.Nil(t, setErr)
+	assert.Nil(t, err)
+	assert.True(t, cached)
+	assert.Equal(t, `{"name": "London"}`, string(value))
+	assert.Equal(t, []string{
+		"AUTH secret",
+		"SELECT 2",
+		"GET weather:owm:weather?id=1",
+		`SET weather:owm:weather?id=1 {"name": "London"} PX 90000`,
+		"GET weather:owm:weather?id=1",
+	}, server.commands)
+}
+
+func TestRedisCacheFailures(t *testing.T) {
+	// Arrange
+	server := newFakeRedis(t, "secret")
+	address := server.listener.Addr().String()
+	rejected := newRedisCache(RedisOptions{Address: address, Password: "wrong", Timeout: time.Second})
+	unauthenticated := newRedisCache(RedisOptions{Address: address, Timeout: time.Second})
+
+	// Act
+	_, _, authErr := rejected.get("key")
+	_, _, commandErr := unauthenticated.get("key")
+	server.listener.Close()
+	unauthenticated.conn.Close()
+	_, _, brokenErr := unauthenticated.get("key")
+
+	// Assert
+	assert.EqualError(t, authErr, "redis: NOAUTH Authentication required.")
+	assert.Nil(t, rejected.conn)
+	assert.EqualError(t, commandErr, "redis: NOAUTH Authentication required.")
+	assert.NotNil(t, brokenErr)
+	assert.Nil(t, unauthenticated.conn)
+}
+
+func TestReadRedisReply(t *testing.T) {
+	tests := []struct {
+		name          string
+		reply         string
+		expected      interface{}
+		expectedError string
+	}{
+		{name: "Simple string", reply: "+OK\r\n", expected: "OK"},
+		{name: "Integer", reply: ":42\r\n", expected: int64(42)},
+		{name: "Bulk string", reply: "$5\r\nhe\r\nl\r\n", expected: []byte("he\r\nl")},
+		{name: "Nil", reply: "$-1\r\n"},
+		{name: "Array", reply: "*2\r\n$1\r\na\r\n:1\r\n", expected: []interface{}{[]byte("a"), int64(1)}},
+		{name: "Error", reply: "-ERR wrong\r\n", expectedError: "redis: ERR wrong"},
+		{name: "Invalid", reply: "?\r\n", expectedError: "redis: invalid reply (?)"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			reply, err := readRedisReply(bufio.NewReader(strings.NewReader(test.reply)))
+
+			// Assert
+			if len(test.expectedError) > 0 {
+				assert.EqualError(t, err, test.expectedError)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, reply)
+		})
+	}
+}
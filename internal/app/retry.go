@@ -0,0 +1,80 @@
+package app
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryOptions configures retries of idempotent requests to open weather map, 1 attempt disables them
+type RetryOptions struct {
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"` // it doubles with every attempt
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	MaxElapsed     time.Duration `yaml:"max_elapsed"` // since the first attempt, no attempt is started after it
+}
+
+func (o RetryOptions) validate(p *configProblems) {
+	if o.MaxAttempts < 1 {
+		p.add("open_weather_map.retry.max_attempts", "must be at least 1, got (%d)", o.MaxAttempts)
+	}
+	if o.MaxAttempts > 1 {
+		p.positive("open_weather_map.retry.initial_backoff", o.InitialBackoff)
+		p.positive("open_weather_map.retry.max_backoff", o.MaxBackoff)
+		p.positive("open_weather_map.retry.max_elapsed", o.MaxElapsed)
+	}
+}
+
+// backoff returns the delay after the failed attempt, it grows exponentially up to the maximum.
+// Half of it is random, so retries of concurrent requests are spread.
+func (o RetryOptions) backoff(attempt int) time.Duration {
+	d := o.InitialBackoff
+	for i := 1; i < attempt && d < o.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > o.MaxBackoff {
+		d = o.MaxBackoff
+	}
+	return d/2 + time.Duration(randomRatio()*float64(d/2))
+}
+
+// retryReason returns why the attempt may be retried: 'timeout', 'connection' or the status code of 5xx response,
+// empty reason means that the result is final
+func retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return "timeout"
+		}
+		if isConnectionError(err) {
+			return "connection"
+		}
+		return ""
+	}
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return strconv.Itoa(resp.StatusCode)
+	}
+	return ""
+}
+
+// isConnectionError returns true when the connection has been refused, reset or closed by open weather map
+func isConnectionError(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		default:
+			return err == syscall.ECONNREFUSED || err == syscall.ECONNRESET || err == syscall.EPIPE ||
+				err == io.EOF || err == io.ErrUnexpectedEOF
+		}
+	}
+}
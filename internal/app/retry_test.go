@@ -0,0 +1,193 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	o := RetryOptions{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{attempt: 1, expected: 100 * time.Millisecond},
+		{attempt: 2, expected: 200 * time.Millisecond},
+		{attempt: 4, expected: 800 * time.Millisecond},
+		{attempt: 5, expected: time.Second},
+		{attempt: 30, expected: time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			// Act
+			backoff := o.backoff(test.attempt)
+
+			// Assert
+			assert.True(t, backoff >= test.expected/2 && backoff <= test.expected, "attempt %d: %s", test.attempt, backoff)
+		}
+	}
+}
+
+// timeoutError is net.Error of a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryReason(t *testing.T) {
+	reset := &url.Error{Op: "Get", URL: "http://owm", Err: &net.OpError{Op: "read", Net: "tcp",
+		Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}}
+
+	tests := []struct {
+		name     string
+		status   int
+		err      error
+		expected string
+	}{
+		{name: "Timeout", err: &url.Error{Op: "Get", URL: "http://owm", Err: timeoutError{}}, expected: "timeout"},
+		{name: "Connection reset", err: reset, expected: "connection"},
+		{name: "Connection closed", err: &url.Error{Op: "Get", URL: "http://owm", Err: io.EOF}, expected: "connection"},
+		{name: "Other error", err: errors.New("unsupported protocol scheme")},
+		{name: "Quota", err: &quotaError{reason: "per-minute budget"}},
+		{name: "Service unavailable", status: http.StatusServiceUnavailable, expected: "503"},
+		{name: "Bad gateway", status: http.StatusBadGateway, expected: "502"},
+		{name: "Not found", status: http.StatusNotFound},
+		{name: "Too many requests", status: http.StatusTooManyRequests},
+		{name: "OK", status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			var resp *http.Response
+			if test.err == nil {
+				resp = &http.Response{StatusCode: test.status}
+			}
+
+			// Act
+			reason := retryReason(resp, test.err)
+
+			// Assert
+			assert.Equal(t, test.expected, reason)
+		})
+	}
+}
+
+func TestOpenWeatherMapRetries(t *testing.T) {
+	retry := RetryOptions{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, MaxElapsed: time.Second}
+
+	tests := []struct {
+		name             string
+		retry            RetryOptions
+		failures         int
+		failure          int // status of failed attempts, 0 closes the connection
+		expectedStatus   int
+		expectedRequests int32
+	}{
+		{
+			name:             "Retried after 503",
+			retry:            retry,
+			failures:         2,
+			failure:          http.StatusServiceUnavailable,
+			expectedStatus:   http.StatusOK,
+			expectedRequests: 3,
+		},
+		{
+			name:             "Retried after connection reset",
+			retry:            retry,
+			failures:         1,
+			expectedStatus:   http.StatusOK,
+			expectedRequests: 2,
+		},
+		{
+			name:             "Attempts are exhausted",
+			retry:            retry,
+			failures:         5,
+			failure:          http.StatusInternalServerError,
+			expectedStatus:   http.StatusBadGateway,
+			expectedRequests: 3,
+		},
+		{
+			name:             "Not found is final",
+			retry:            retry,
+			failures:         5,
+			failure:          http.StatusNotFound,
+			expectedStatus:   http.StatusNotFound,
+			expectedRequests: 1,
+		},
+		{
+			name:             "Too many requests is final",
+			retry:            retry,
+			failures:         5,
+			failure:          http.StatusTooManyRequests,
+			expectedStatus:   http.StatusTooManyRequests,
+			expectedRequests: 1,
+		},
+		{
+			name:             "Elapsed time is exceeded",
+			retry:            RetryOptions{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Second, MaxElapsed: 100 * time.Millisecond},
+			failures:         5,
+			failure:          http.StatusServiceUnavailable,
+			expectedStatus:   http.StatusBadGateway,
+			expectedRequests: 1,
+		},
+		{
+			name:             "Retries are disabled",
+			retry:            RetryOptions{MaxAttempts: 1},
+			failures:         5,
+			failure:          http.StatusServiceUnavailable,
+			expectedStatus:   http.StatusBadGateway,
+			expectedRequests: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if int(atomic.AddInt32(&requests, 1)) > test.failures {
+					rw.Write([]byte(`{"id": 2643743, "name": "London", "main": {"temp": 284.15}}`))
+					return
+				}
+				if test.failure == 0 {
+					conn, _, err := rw.(http.Hijacker).Hijack()
+					require.Nil(t, err)
+					conn.(*net.TCPConn).SetLinger(0)
+					conn.Close()
+					return
+				}
+				rw.WriteHeader(test.failure)
+				rw.Write([]byte(`{"message": "failure"}`))
+			}))
+			defer server.Close()
+			o, err := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, Token: "secret", Retry: test.retry})
+			require.Nil(t, err)
+
+			// Act
+			w, status, _ := o.getWeather(map[string]string{"id": "2643743"})
+
+			// Assert
+			assert.Equal(t, test.expectedStatus, status)
+			assert.Equal(t, test.expectedRequests, atomic.LoadInt32(&requests))
+			if test.expectedStatus == http.StatusOK {
+				assert.Equal(t, "London", w.Name)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ServerOptions configures HTTP server of the service
+type ServerOptions struct {
+	Address         string        `yaml:"address"`          // e.g. ':8080'
+	ReadTimeout     time.Duration `yaml:"read_timeout"`     // reading of the whole request including the body
+	WriteTimeout    time.Duration `yaml:"write_timeout"`    // from the end of reading of the request until the response is written
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`     // keep-alive connections waiting for the next request
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // draining of requests in flight after SIGTERM
+	TLS             TLSOptions    `yaml:"tls"`
+}
+
+// DefaultServerOptions are used when the configuration does not override them
+var DefaultServerOptions = ServerOptions{
+	Address:         ":8080",
+	ReadTimeout:     15 * time.Second,
+	WriteTimeout:    60 * time.Second,
+	IdleTimeout:     120 * time.Second,
+	ShutdownTimeout: 30 * time.Second,
+}
+
+func (o ServerOptions) validate(p *configProblems) {
+	if len(o.Address) == 0 {
+		p.add("server.address", "is required")
+	}
+	p.positive("server.read_timeout", o.ReadTimeout)
+	p.positive("server.write_timeout", o.WriteTimeout)
+	p.positive("server.idle_timeout", o.IdleTimeout)
+	p.positive("server.shutdown_timeout", o.ShutdownTimeout)
+	o.TLS.validate(p)
+}
+
+// Serve handles requests until a signal is received, then it stops accepting connections
+// and waits for requests in flight up to the shutdown timeout
+func Serve(o ServerOptions, handler http.Handler, signals <-chan os.Signal) error {
+	server := newServer(o, handler)
+	if o.TLS.Enabled() {
+		reloader, err := newCertificateReloader(o.TLS, tlsReloadInterval)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = reloader.config()
+	}
+
+	listener, err := net.Listen("tcp", o.Address)
+	if err != nil {
+		return err
+	}
+	return serve(listener, server, o.ShutdownTimeout, signals)
+}
+
+func newServer(o ServerOptions, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         o.Address,
+		Handler:      handler,
+		ReadTimeout:  o.ReadTimeout,
+		WriteTimeout: o.WriteTimeout,
+		IdleTimeout:  o.IdleTimeout,
+	}
+}
+
+func serve(listener net.Listener, server *http.Server, timeout time.Duration, signals <-chan os.Signal) error {
+	errs := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			errs <- server.ServeTLS(listener, "", "")
+			return
+		}
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case s := <-signals:
+		logger.Info("Signal has been received, requests in flight are drained", "signal", s.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("requests have not been drained: %s", err)
+	}
+	if err := <-errs; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeDrainsRequests(t *testing.T) {
+	// Arrange
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("drained"))
+	})
+	signals := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(listener, newServer(DefaultServerOptions, handler), 5*time.Second, signals)
+	}()
+
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+	<-started
+
+	// Act
+	signals <- syscall.SIGTERM
+
+	// Assert
+	select {
+	case err := <-served:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server has not been shut down")
+	}
+	assert.Equal(t, "drained", <-responses)
+
+	_, err = http.Get("http://" + listener.Addr().String())
+	assert.NotNil(t, err, "new connections are refused")
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	// Arrange
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	signals := make(chan os.Signal, 1)
+	go http.Get("http://" + listener.Addr().String())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(listener, newServer(DefaultServerOptions, handler), 50*time.Millisecond, signals)
+	}()
+	<-started
+
+	// Act
+	signals <- syscall.SIGTERM
+
+	// Assert
+	select {
+	case err := <-served:
+		assert.EqualError(t, err, "requests have not been drained: context deadline exceeded")
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown has not timed out")
+	}
+}
@@ -0,0 +1,360 @@
+package app
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/emicklei/go-restful-openapi"
+)
+
+const (
+	formatMETAR = "metar"
+	formatISD   = "isd"
+
+	// DefaultStationDistance is the default maximum distance in km between a station and its location
+	DefaultStationDistance = 25.0
+
+	earthRadius = 6371.0 // km
+)
+
+// stationCoordinates is a position of the weather station
+type stationCoordinates struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// StationDirectory stores coordinates of weather stations by ICAO code and by USAF-WBAN identifier
+type StationDirectory struct {
+	stations map[string]stationCoordinates
+}
+
+// NewStationDirectory reads stations from CSV with columns USAF, WBAN, ICAO, LAT and LON,
+// e.g. NOAA isd-history.csv. Stations without coordinates are skipped.
+func NewStationDirectory(r io.Reader) (*StationDirectory, error) {
+	s := &StationDirectory{stations: make(map[string]stationCoordinates)}
+
+	c := csv.NewReader(r)
+	c.FieldsPerRecord = -1
+	header, err := c.Read()
+	if err != nil {
+		return nil, fmt.Errorf("can not read header of stations: %s", err)
+	}
+	columns := make(map[string]int)
+	for k, h := range header {
+		columns[strings.ToUpper(strings.TrimSpace(h))] = k
+	}
+	for _, h := range []string{"LAT", "LON"} {
+		if _, ok := columns[h]; !ok {
+			return nil, fmt.Errorf("stations must have column '%s'", h)
+		}
+	}
+
+	value := func(row []string, column string) string {
+		if k, ok := columns[column]; ok && k < len(row) {
+			return strings.TrimSpace(row[k])
+		}
+		return ""
+	}
+
+	for {
+		row, err := c.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can not read stations: %s", err)
+		}
+
+		lat, err := strconv.ParseFloat(value(row, "LAT"), 64)
+		if err != nil {
+			continue
+		}
+		lon, err := strconv.ParseFloat(value(row, "LON"), 64)
+		if err != nil {
+			continue
+		}
+		coordinates := stationCoordinates{Latitude: lat, Longitude: lon}
+
+		if icao := value(row, "ICAO"); len(icao) > 0 {
+			s.stations[strings.ToUpper(icao)] = coordinates
+		}
+		if usaf, wban := value(row, "USAF"), value(row, "WBAN"); len(usaf) > 0 && len(wban) > 0 {
+			s.stations[usaf+"-"+wban] = coordinates
+		}
+	}
+	return s, nil
+}
+
+// LoadStationDirectory reads stations from the file, empty name means no known stations
+func LoadStationDirectory(name string) (*StationDirectory, error) {
+	if len(name) == 0 {
+		return &StationDirectory{stations: make(map[string]stationCoordinates)}, nil
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return NewStationDirectory(file)
+}
+
+// coordinates returns the position of the station, coordinates given by the record take precedence
+func (s *StationDirectory) coordinates(o stationObservation) (stationCoordinates, bool) {
+	if o.Latitude != nil && o.Longitude != nil {
+		return stationCoordinates{Latitude: *o.Latitude, Longitude: *o.Longitude}, true
+	}
+	if s == nil {
+		return stationCoordinates{}, false
+	}
+	c, ok := s.stations[o.Station]
+	return c, ok
+}
+
+// distance returns the great-circle distance in km (haversine formula)
+func distance(a, b stationCoordinates) float64 {
+	radians := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := radians(b.Latitude - a.Latitude)
+	dLon := radians(b.Longitude - a.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(radians(a.Latitude))*math.Cos(radians(b.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// nearestLocation returns the location closest to the station within the maximum distance
+func nearestLocation(locations []Location, station stationCoordinates, maxDistance float64) (Location, bool) {
+	var nearest Location
+	found := false
+	best := maxDistance
+	for _, l := range locations {
+		d := distance(station, stationCoordinates{Latitude: float64(l.Latitude), Longitude: float64(l.Longitude)})
+		if d <= best {
+			nearest, best, found = l, d, true
+		}
+	}
+	return nearest, found
+}
+
+// StationImportOptions describes imported station observations
+type StationImportOptions struct {
+	Format      string    // metar or isd
+	MaxDistance float64   // maximum distance in km between a station and its location
+	Reference   time.Time // resolves the month of METAR reports without a preceding date line
+	DryRun      bool      // observations are validated but not saved
+}
+
+// NewStationImportOptions validates options of the import, zero distance means DefaultStationDistance
+func NewStationImportOptions(format string, maxDistance float64, dryRun bool) (StationImportOptions, error) {
+	o := StationImportOptions{
+		Format:      format,
+		MaxDistance: maxDistance,
+		Reference:   time.Now().UTC(),
+		DryRun:      dryRun,
+	}
+
+	if o.Format != formatMETAR && o.Format != formatISD {
+		return o, fmt.Errorf("format must be one of: %s, %s", formatMETAR, formatISD)
+	}
+	if o.MaxDistance == 0 {
+		o.MaxDistance = DefaultStationDistance
+	}
+	if o.MaxDistance < 0 {
+		return o, errors.New("maximum distance must be positive")
+	}
+	return o, nil
+}
+
+// ImportStationObservations loads METAR reports or ISD records, one per line,
+// and attaches them to the nearest saved locations
+func ImportStationObservations(d *Database, r io.Reader, stations *StationDirectory, o StationImportOptions) (ImportReport, error) {
+	return importStationObservations(d, r, stations, o)
+}
+
+func importStationObservations(db databaseWeatherProvider, r io.Reader, stations *StationDirectory,
+	o StationImportOptions) (ImportReport, error) {
+	i, err := newImporter(db, o.DryRun)
+	if err != nil {
+		return ImportReport{}, err
+	}
+
+	locations, err := db.getLocations()
+	if err != nil {
+		return i.report, err
+	}
+
+	reference := o.Reference
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		var observation stationObservation
+		if o.Format == formatMETAR {
+			// NOAA files precede every report with its date
+			if t, err := time.Parse(metarHeaderLayout, line); err == nil {
+				reference = t.Add(24 * time.Hour)
+				continue
+			}
+			observation, err = parseMETAR(line, reference)
+		} else {
+			observation, err = parseISD(scanner.Text())
+		}
+		if err != nil {
+			i.invalid(n, err)
+			continue
+		}
+
+		coordinates, ok := stations.coordinates(observation)
+		if !ok {
+			i.invalid(n, fmt.Errorf("unknown station '%s'", observation.Station))
+			continue
+		}
+		location, ok := nearestLocation(locations, coordinates, o.MaxDistance)
+		if !ok {
+			i.report.Unmatched++
+			continue
+		}
+
+		observation.Weather.LocationID = location.LocationID
+		if err = i.save(n, observation.Weather); err != nil {
+			return i.report, err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return i.report, invalidFileError{err}
+	}
+	return i.report, i.flush()
+}
+
+// StationEndpoint receives observations of weather stations
+type StationEndpoint struct {
+	db          databaseWeatherProvider
+	stations    *StationDirectory
+	maxDistance float64
+	hashKey     []byte // of hashes of keys of personal stations
+	auth        *Authenticator
+}
+
+// NewStationEndpoint returns StationEndpoint instance, the authenticator protects all routes
+func NewStationEndpoint(db databaseWeatherProvider, stations *StationDirectory, maxDistance float64, hashKey string,
+	auth *Authenticator) *StationEndpoint {
+	return &StationEndpoint{
+		db:          db,
+		stations:    stations,
+		maxDistance: maxDistance,
+		hashKey:     []byte(hashKey),
+		auth:        auth,
+	}
+}
+
+// Endpoint is a webservice for observations of weather stations
+func (s *StationEndpoint) Endpoint() *restful.WebService {
+	ws := new(restful.WebService)
+	ws.Path("/stations").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	tags := []string{"stations"}
+
+	ws.Route(ws.POST("/observations").To(s.pushObservations).
+		Filter(s.auth.Filter).
+		Doc("push METAR reports or NOAA ISD records, one per line, observations are attached to the nearest locations").
+		Param(ws.HeaderParameter("Authorization", "Bearer <token>").DataType("string").Required(true)).
+		Param(ws.QueryParameter("format", "metar or isd").DataType("string").Required(true)).
+		Param(ws.QueryParameter("dry_run", "validate observations without saving them").DataType("boolean").DefaultValue("false")).
+		Consumes("text/plain").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(ImportReport{}).
+		Returns(http.StatusOK, "OK", ImportReport{}).
+		Returns(http.StatusBadRequest, "invalid query parameters or body", nil).
+		Returns(http.StatusRequestEntityTooLarge, importBodyTooLarge, nil).
+		Returns(http.StatusUnauthorized, unauthorized, nil).
+		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil))
+
+	ws.Route(ws.GET("/personal").To(s.getPersonalStations).
+		Filter(s.auth.Filter).
+		Doc("get personal weather stations").
+		Param(ws.HeaderParameter("Authorization", "Bearer <token>").DataType("string").Required(true)).
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes([]PersonalStation{}).
+		Returns(http.StatusOK, "OK", []PersonalStation{}).
+		Returns(http.StatusUnauthorized, unauthorized, nil).
+		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil))
+
+	ws.Route(ws.PUT("/personal/{station_id}").To(s.savePersonalStation).
+		Filter(s.auth.Filter).
+		Doc("register a personal weather station or change its key and location").
+		Param(ws.PathParameter("station_id", "identifier of the station").DataType("string")).
+		Param(ws.HeaderParameter("Authorization", "Bearer <token>").DataType("string").Required(true)).
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Reads(PersonalStation{}).
+		Writes(PersonalStation{}).
+		Returns(http.StatusOK, "OK", PersonalStation{}).
+		Returns(http.StatusBadRequest, "invalid input data", nil).
+		Returns(http.StatusUnauthorized, unauthorized, nil).
+		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil).
+		Returns(http.StatusNotFound, "location does not exist", nil))
+
+	ws.Route(ws.DELETE("/personal/{station_id}").To(s.deletePersonalStation).
+		Filter(s.auth.Filter).
+		Doc("delete a personal weather station").
+		Param(ws.PathParameter("station_id", "identifier of the station").DataType("string")).
+		Param(ws.HeaderParameter("Authorization", "Bearer <token>").DataType("string").Required(true)).
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Returns(http.StatusOK, "OK", nil).
+		Returns(http.StatusUnauthorized, unauthorized, nil).
+		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil).
+		Returns(http.StatusNotFound, "station does not exist", nil))
+
+	return ws
+}
+
+func (s *StationEndpoint) pushObservations(request *restful.Request, response *restful.Response) {
+	db := s.db.withContext(requestContext(request))
+
+	var err error
+	dryRun := false
+	if v := request.QueryParameter("dry_run"); len(v) > 0 {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			response.WriteErrorString(http.StatusBadRequest, "'dry_run' must be a boolean")
+			return
+		}
+	}
+
+	options, err := NewStationImportOptions(request.QueryParameter("format"), s.maxDistance, dryRun)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	body := http.MaxBytesReader(response, request.Request.Body, maxImportBody)
+	report, err := importStationObservations(db, body, s.stations, options)
+	if err != nil {
+		if bodyTooLarge(err) {
+			response.WriteErrorString(http.StatusRequestEntityTooLarge, importBodyTooLarge)
+			return
+		}
+		if _, ok := err.(invalidFileError); ok {
+			response.WriteErrorString(http.StatusBadRequest, err.Error())
+			return
+		}
+		requestLogger(request).Error("Push station observations", "error", err)
+		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
+		return
+	}
+
+	requestLogger(request).Info("Station observations have been imported", "report", report)
+	response.WriteHeaderAndEntity(http.StatusOK, &report)
+}
@@ -0,0 +1,323 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const stationsCSV = `"USAF","WBAN","STATION NAME","CTRY","STATE","ICAO","LAT","LON","ELEV(M)","BEGIN","END"
+"037720","99999","HEATHROW","UK","","EGLL","+51.478","-000.461","+0025.3","19480101","20190330"
+"071570","99999","PARIS-CHARLES DE GAULLE","FR","","LFPG","+49.010","+002.548","+0119.2","19730101","20190330"
+"744860","94789","JOHN F KENNEDY INTERNATIONAL AIRPORT","US","NY","KJFK","+40.639","-073.762","+0003.4","19730101","20190330"
+"999999","99999","BOGUS","","","","","","","",""
+`
+
+var (
+	london = Location{CityName: "London", CountryCode: "GB", LocationID: 2643743, Latitude: 51.5074, Longitude: -0.1278}
+	paris  = Location{CityName: "Paris", CountryCode: "FR", LocationID: 2988507, Latitude: 48.8566, Longitude: 2.3522}
+)
+
+func TestNewStationDirectory(t *testing.T) {
+	t.Run("NOAA station history", func(t *testing.T) {
+		// Act
+		s, err := NewStationDirectory(strings.NewReader(stationsCSV))
+
+		// Assert
+		require.Nil(t, err)
+		assert.Len(t, s.stations, 6)
+		assert.Equal(t, stationCoordinates{Latitude: 51.478, Longitude: -0.461}, s.stations["EGLL"])
+		assert.Equal(t, stationCoordinates{Latitude: 51.478, Longitude: -0.461}, s.stations["037720-99999"])
+	})
+
+	t.Run("Missing coordinates", func(t *testing.T) {
+		// Act
+		_, err := NewStationDirectory(strings.NewReader("ICAO,LAT\nEGLL,51.478\n"))
+
+		// Assert
+		assert.EqualError(t, err, "stations must have column 'LON'")
+	})
+
+	t.Run("Empty file name", func(t *testing.T) {
+		// Act
+		s, err := LoadStationDirectory("")
+
+		// Assert
+		require.Nil(t, err)
+		_, ok := s.coordinates(stationObservation{Station: "EGLL"})
+		assert.False(t, ok)
+	})
+}
+
+func TestStationCoordinates(t *testing.T) {
+	s, err := NewStationDirectory(strings.NewReader(stationsCSV))
+	require.Nil(t, err)
+	lat, lon := 10.0, 20.0
+
+	tests := []struct {
+		name        string
+		directory   *StationDirectory
+		observation stationObservation
+		expected    stationCoordinates
+		ok          bool
+	}{
+		{
+			name:        "Known station",
+			directory:   s,
+			observation: stationObservation{Station: "LFPG"},
+			expected:    stationCoordinates{Latitude: 49.010, Longitude: 2.548},
+			ok:          true,
+		},
+		{
+			name:        "Unknown station",
+			directory:   s,
+			observation: stationObservation{Station: "ZZZZ"},
+		},
+		{
+			name:        "Coordinates in the record",
+			observation: stationObservation{Station: "ZZZZ", Latitude: &lat, Longitude: &lon},
+			expected:    stationCoordinates{Latitude: lat, Longitude: lon},
+			ok:          true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			c, ok := test.directory.coordinates(test.observation)
+
+			// Assert
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.expected, c)
+		})
+	}
+}
+
+func TestNearestLocation(t *testing.T) {
+	locations := []Location{paris, london}
+	heathrow := stationCoordinates{Latitude: 51.478, Longitude: -0.461}
+
+	t.Run("Distance", func(t *testing.T) {
+		assert.InDelta(t, 343.6, distance(stationCoordinates{Latitude: 51.5074, Longitude: -0.1278},
+			stationCoordinates{Latitude: 48.8566, Longitude: 2.3522}), 0.1)
+	})
+
+	t.Run("Nearest location", func(t *testing.T) {
+		location, ok := nearestLocation(locations, heathrow, 400)
+		assert.True(t, ok)
+		assert.Equal(t, london, location)
+	})
+
+	t.Run("Too far", func(t *testing.T) {
+		_, ok := nearestLocation(locations, heathrow, 20)
+		assert.False(t, ok)
+	})
+}
+
+func TestNewStationImportOptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		format        string
+		maxDistance   float64
+		expected      float64
+		expectedError error
+	}{
+		{
+			name:          "Invalid format",
+			format:        "csv",
+			expectedError: errors.New("format must be one of: metar, isd"),
+		},
+		{
+			name:          "Negative distance",
+			format:        formatISD,
+			maxDistance:   -1,
+			expectedError: errors.New("maximum distance must be positive"),
+		},
+		{
+			name:     "Default distance",
+			format:   formatMETAR,
+			expected: DefaultStationDistance,
+		},
+		{
+			name:        "Custom distance",
+			format:      formatISD,
+			maxDistance: 5,
+			expected:    5,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			o, err := NewStationImportOptions(test.format, test.maxDistance, false)
+
+			// Assert
+			if test.expectedError != nil {
+				assert.EqualError(t, err, test.expectedError.Error())
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, o.MaxDistance)
+		})
+	}
+}
+
+func TestImportStationObservations(t *testing.T) {
+	stations, err := NewStationDirectory(strings.NewReader(stationsCSV))
+	require.Nil(t, err)
+
+	metar := "2019/03/30 11:50\n" +
+		"EGLL 301150Z 24012KT 9999 -RA BKN020 12/08 Q1015\n" +
+		"\n" +
+		"LFPG 301130Z 18005KT CAVOK 15/05 Q1020\n" +
+		"KJFK 301151Z 00000KT 10SM CLR 10/05 A3012\n" +
+		"ZZZZ 301150Z 00000KT 10/05 Q1000\n" +
+		"EGLL 301150Z 24012KT 9999 -RA BKN020 12/08 Q1015\n" +
+		"garbage\n"
+
+	tests := []struct {
+		name          string
+		format        string
+		body          string
+		db            fakeDatabase
+		expected      ImportReport
+		expectedError error
+	}{
+		{
+			name:   "METAR reports",
+			format: formatMETAR,
+			body:   metar,
+			db:     fakeDatabase{locations: []Location{london, paris}, descriptions: importDictionary},
+			expected: ImportReport{Imported: 2, Duplicates: 1, Invalid: 2, Unmatched: 1, Errors: []string{
+				"record 6: unknown station 'ZZZZ'",
+				"record 8: report must start with ICAO code of the station",
+			}},
+		},
+		{
+			name:     "ISD records",
+			format:   formatISD,
+			body:     isdHeathrow + "\n" + withField(isdHeathrow, 24, "1250") + "\n",
+			db:       fakeDatabase{locations: []Location{london}},
+			expected: ImportReport{Imported: 2, Errors: []string{}},
+		},
+		{
+			name:     "Dry run with existing observation",
+			format:   formatISD,
+			body:     isdHeathrow + "\n",
+			db:       fakeDatabase{locations: []Location{london}, exists: true},
+			expected: ImportReport{Duplicates: 1, Errors: []string{}, DryRun: true},
+		},
+		{
+			name:          "Database error",
+			format:        formatISD,
+			body:          isdHeathrow + "\n",
+			db:            fakeDatabase{err: errors.New("can not connect to database")},
+			expectedError: errors.New("can not connect to database"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			o, err := NewStationImportOptions(test.format, 0, test.expected.DryRun)
+			require.Nil(t, err)
+			o.Reference = time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+
+			// Act
+			report, err := importStationObservations(test.db, strings.NewReader(test.body), stations, o)
+
+			// Assert
+			if test.expectedError != nil {
+				assert.EqualError(t, err, test.expectedError.Error())
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, report)
+		})
+	}
+}
+
+func TestPushStationObservations(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		query         string
+		body          string
+		db            fakeDatabase
+		HTTPStatus    int
+	}{
+		{
+			name:       "Unauthorized",
+			query:      "?format=isd",
+			HTTPStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "Unknown format",
+			authorization: "Bearer secret",
+			query:         "?format=csv",
+			HTTPStatus:    http.StatusBadRequest,
+		},
+		{
+			name:          "Invalid dry run",
+			authorization: "Bearer secret",
+			query:         "?format=isd&dry_run=maybe",
+			HTTPStatus:    http.StatusBadRequest,
+		},
+		{
+			name:          "Database error",
+			authorization: "Bearer secret",
+			query:         "?format=isd",
+			db:            fakeDatabase{err: errors.New("can not connect to database")},
+			HTTPStatus:    http.StatusServiceUnavailable,
+		},
+		{
+			name:          "Too large body",
+			authorization: "Bearer secret",
+			query:         "?format=isd",
+			body:          strings.Repeat("\n", maxImportBody+1),
+			db:            fakeDatabase{locations: []Location{london}},
+			HTTPStatus:    http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "Observations have been imported",
+			authorization: "Bearer secret",
+			query:         "?format=isd",
+			body:          isdHeathrow,
+			db:            fakeDatabase{locations: []Location{london}},
+			HTTPStatus:    http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			container := restful.NewContainer()
+			container.Add(NewStationEndpoint(test.db, nil, DefaultStationDistance, "", NewAuthenticator("secret")).Endpoint())
+			httpRequest := httptest.NewRequest("POST", "/stations/observations"+test.query, strings.NewReader(test.body))
+			httpRequest.Header.Set("Content-Type", "text/plain")
+			if len(test.authorization) > 0 {
+				httpRequest.Header.Set("Authorization", test.authorization)
+			}
+			httpWriter := httptest.NewRecorder()
+
+			// Act
+			container.ServeHTTP(httpWriter, httpRequest)
+
+			// Assert
+			assert.Equal(t, test.HTTPStatus, httpWriter.Code)
+			if test.HTTPStatus == http.StatusOK {
+				report := ImportReport{}
+				require.Nil(t, json.Unmarshal(httpWriter.Body.Bytes(), &report))
+				assert.Equal(t, 1, report.Imported)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloadInterval limits checks of modification of certificate files to one per interval
+const tlsReloadInterval = 10 * time.Second
+
+// client authentication modes of mTLS
+const (
+	clientAuthRequire  = "require"  // connections without a valid client certificate are rejected
+	clientAuthOptional = "optional" // client certificates are verified when they are given
+)
+
+// TLSOptions configures HTTPS, the service uses plain HTTP without a certificate
+type TLSOptions struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"` // CA of client certificates, empty means no client certificates
+	ClientAuth   string `yaml:"client_auth"`    // require (default) or optional
+}
+
+func (o TLSOptions) validate(p *configProblems) {
+	if (len(o.CertFile) == 0) != (len(o.KeyFile) == 0) {
+		p.add("server.tls.cert_file", "and server.tls.key_file must be provided together")
+	}
+	if len(o.ClientCAFile) > 0 && len(o.CertFile) == 0 {
+		p.add("server.tls.client_ca_file", "requires server.tls.cert_file and server.tls.key_file")
+	}
+	if len(o.ClientAuth) > 0 && o.ClientAuth != clientAuthRequire && o.ClientAuth != clientAuthOptional {
+		p.add("server.tls.client_auth", "must be one of: %s, %s, got (%s)", clientAuthRequire, clientAuthOptional, o.ClientAuth)
+	}
+}
+
+// Enabled returns true when the certificate is configured
+func (o TLSOptions) Enabled() bool {
+	return len(o.CertFile) > 0
+}
+
+// certificateReloader serves the certificate and client CA which are loaded again when their files are modified,
+// so rotated certificates are used without a restart
+type certificateReloader struct {
+	options  TLSOptions
+	interval time.Duration
+
+	mutex       sync.Mutex
+	checkedAt   time.Time
+	modified    map[string]time.Time // modification time of loaded files
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+// newCertificateReloader loads the files, errors are returned, so invalid files stop the service
+func newCertificateReloader(o TLSOptions, interval time.Duration) (*certificateReloader, error) {
+	r := &certificateReloader{options: o, interval: interval}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certificateReloader) files() []string {
+	files := []string{r.options.CertFile, r.options.KeyFile}
+	if len(r.options.ClientCAFile) > 0 {
+		files = append(files, r.options.ClientCAFile)
+	}
+	return files
+}
+
+// load reads all files, the previous certificate is kept when any of them is invalid
+func (r *certificateReloader) load() error {
+	modified := make(map[string]time.Time)
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modified[f] = info.ModTime()
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.options.CertFile, r.options.KeyFile)
+	if err != nil {
+		return fmt.Errorf("can not load certificate: %s", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if len(r.options.ClientCAFile) > 0 {
+		pem, err := ioutil.ReadFile(r.options.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("can not load client CA: no certificates in %s", r.options.ClientCAFile)
+		}
+	}
+
+	r.modified, r.certificate, r.clientCAs = modified, &certificate, clientCAs
+	return nil
+}
+
+// reload loads files again when any of them is modified, it is checked once per interval
+func (r *certificateReloader) reload() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.checkedAt) < r.interval {
+		return
+	}
+	r.checkedAt = time.Now()
+
+	changed := false
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil || !info.ModTime().Equal(r.modified[f]) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return
+	}
+
+	if err := r.load(); err != nil {
+		logger.Error("Reload certificate", "error", err)
+		return
+	}
+	logger.Info("Certificate has been reloaded", "file", r.options.CertFile)
+}
+
+// config returns TLS configuration of the server which uses the current certificate for every handshake
+func (r *certificateReloader) config() *tls.Config {
+	clientAuth := tls.NoClientCert
+	if len(r.options.ClientCAFile) > 0 {
+		clientAuth = tls.RequireAndVerifyClientCert
+		if r.options.ClientAuth == clientAuthOptional {
+			clientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// it is not used for handshakes, but http.Server requires a certificate in the configuration
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			return r.certificate, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.reload()
+
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.certificate},
+				ClientAuth:   clientAuth,
+				ClientCAs:    r.clientCAs,
+				NextProtos:   []string{"h2", "http/1.1"},
+			}, nil
+		},
+	}
+}
@@ -0,0 +1,234 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate is a certificate signed by the parent, a CA signs itself
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pem         []byte
+	keyPEM      []byte
+}
+
+func newTestCertificate(t *testing.T, name string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.Nil(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	return &testCertificate{
+		certificate: certificate,
+		key:         key,
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.certificate.Raw}, PrivateKey: c.key}
+}
+
+// write writes the certificate and its key, modification time is moved, so the change is detected
+func (c *testCertificate) write(t *testing.T, o TLSOptions, modified time.Time) {
+	require.Nil(t, ioutil.WriteFile(o.CertFile, c.pem, 0600))
+	require.Nil(t, ioutil.WriteFile(o.KeyFile, c.keyPEM, 0600))
+	require.Nil(t, os.Chtimes(o.CertFile, modified, modified))
+	require.Nil(t, os.Chtimes(o.KeyFile, modified, modified))
+}
+
+// serveTLS starts HTTPS server with the reloader, it is stopped by the returned function
+func serveTLS(t *testing.T, r *certificateReloader) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	server := newServer(DefaultServerOptions, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	server.TLSConfig = r.config()
+	signals := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(listener, server, time.Second, signals)
+	}()
+	return "https://" + listener.Addr().String(), func() {
+		signals <- os.Interrupt
+		<-served
+	}
+}
+
+// tlsClient presents the certificate even when it is not signed by CAs accepted by the server
+func tlsClient(ca *testCertificate, certificates ...tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	config := &tls.Config{RootCAs: roots}
+	if len(certificates) > 0 {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &certificates[0], nil
+		}
+	}
+	return &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true},
+	}
+}
+
+func tlsTempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "weather-tls")
+	require.Nil(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestCertificateReload(t *testing.T) {
+	// Arrange
+	dir, remove := tlsTempDir(t)
+	defer remove()
+	o := TLSOptions{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+
+	ca := newTestCertificate(t, "weather CA", nil)
+	first := newTestCertificate(t, "first", ca)
+	first.write(t, o, time.Now().Add(-time.Minute))
+
+	r, err := newCertificateReloader(o, 0)
+	require.Nil(t, err)
+	url, stop := serveTLS(t, r)
+	defer stop()
+	client := tlsClient(ca)
+
+	resp, err := client.Get(url)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, "first", resp.TLS.PeerCertificates[0].Subject.CommonName)
+
+	t.Run("Rotated certificate is served", func(t *testing.T) {
+		// Arrange
+		newTestCertificate(t, "second", ca).write(t, o, time.Now())
+
+		// Act
+		resp, err := client.Get(url)
+
+		// Assert
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "second", resp.TLS.PeerCertificates[0].Subject.CommonName)
+	})
+
+	t.Run("Invalid certificate is not loaded", func(t *testing.T) {
+		// Arrange
+		require.Nil(t, ioutil.WriteFile(o.CertFile, []byte("invalid"), 0600))
+		require.Nil(t, os.Chtimes(o.CertFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+
+		// Act
+		resp, err := client.Get(url)
+
+		// Assert
+		require.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "second", resp.TLS.PeerCertificates[0].Subject.CommonName)
+	})
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, remove := tlsTempDir(t)
+	defer remove()
+
+	ca := newTestCertificate(t, "weather CA", nil)
+	other := newTestCertificate(t, "other CA", nil)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "ca.crt"), ca.pem, 0600))
+	server := newTestCertificate(t, "weather", ca)
+	client := newTestCertificate(t, "platform", ca)
+	stranger := newTestCertificate(t, "stranger", other)
+
+	tests := []struct {
+		name         string
+		clientAuth   string
+		certificates []tls.Certificate
+		valid        bool
+	}{
+		{name: "Required certificate is missing", clientAuth: clientAuthRequire, valid: false},
+		{name: "Certificate of unknown CA", clientAuth: clientAuthRequire, certificates: []tls.Certificate{stranger.tlsCertificate()}, valid: false},
+		{name: "Valid certificate", clientAuth: clientAuthRequire, certificates: []tls.Certificate{client.tlsCertificate()}, valid: true},
+		{name: "Optional certificate is missing", clientAuth: clientAuthOptional, valid: true},
+		{name: "Optional certificate of unknown CA", clientAuth: clientAuthOptional, certificates: []tls.Certificate{stranger.tlsCertificate()}, valid: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			o := TLSOptions{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key"),
+				ClientCAFile: filepath.Join(dir, "ca.crt"), ClientAuth: test.clientAuth}
+			server.write(t, o, time.Now())
+			r, err := newCertificateReloader(o, tlsReloadInterval)
+			require.Nil(t, err)
+			url, stop := serveTLS(t, r)
+			defer stop()
+
+			// Act
+			resp, err := tlsClient(ca, test.certificates...).Get(url)
+
+			// Assert
+			if !test.valid {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, "secure", string(body))
+		})
+	}
+}
+
+func TestNewCertificateReloader(t *testing.T) {
+	// Arrange
+	dir, remove := tlsTempDir(t)
+	defer remove()
+	o := TLSOptions{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key"), ClientCAFile: filepath.Join(dir, "ca.crt")}
+	newTestCertificate(t, "weather", nil).write(t, o, time.Now())
+	require.Nil(t, ioutil.WriteFile(o.ClientCAFile, []byte("invalid"), 0600))
+
+	// Act
+	_, err := newCertificateReloader(o, tlsReloadInterval)
+
+	// Assert
+	assert.EqualError(t, err, "can not load client CA: no certificates in "+o.ClientCAFile)
+}
@@ -0,0 +1,494 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+const (
+	traceparentHeader = "traceparent"
+
+	tracingScope         = "github.com/mieczyslaw1980/weather"
+	tracingFlushInterval = 5 * time.Second
+	tracingBatchSize     = 512
+	tracingBufferSize    = 4096 // the oldest spans are dropped when the collector is unavailable
+)
+
+// kinds of spans and codes of their statuses as defined by OTLP
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+
+	spanStatusError = 2
+)
+
+// spanContext identifies the span in its trace, it is propagated as W3C trace context
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+func (c spanContext) valid() bool {
+	return c.traceID != [16]byte{} && c.spanID != [8]byte{}
+}
+
+// traceparent returns the value of W3C traceparent header, e.g. '00-<trace id>-<span id>-01'
+func (c spanContext) traceparent() string {
+	flags := "00"
+	if c.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(c.traceID[:]), hex.EncodeToString(c.spanID[:]), flags)
+}
+
+// parseTraceparent parses W3C traceparent header, false means that the header is missing or invalid
+func parseTraceparent(header string) (spanContext, bool) {
+	var c spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return c, false
+	}
+	if _, err := hex.DecodeString(parts[0]); err != nil {
+		return c, false
+	}
+	if !decodeLowerHex(c.traceID[:], parts[1]) || !decodeLowerHex(c.spanID[:], parts[2]) {
+		return c, false
+	}
+	var flags [1]byte
+	if !decodeLowerHex(flags[:], parts[3]) {
+		return c, false
+	}
+	c.sampled = flags[0]&1 == 1
+	return c, c.valid()
+}
+
+// decodeLowerHex fills dst with the value, W3C trace context allows only lower case hex
+func decodeLowerHex(dst []byte, value string) bool {
+	if len(value) != 2*len(dst) || strings.ToLower(value) != value {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(value))
+	return err == nil
+}
+
+// spanAttribute is a key-value pair which describes the span, e.g. 'http.status_code'
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+// span measures an operation of the trace, it is exported when it is ended and sampled
+type span struct {
+	tracer     *Tracer
+	name       string
+	kind       int
+	context    spanContext
+	parentID   [8]byte
+	start      time.Time
+	end        time.Time
+	attributes []spanAttribute
+	status     int
+	message    string
+}
+
+// setAttributes adds key-value pairs to the span
+func (s *span) setAttributes(keyvals ...interface{}) {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		s.attributes = append(s.attributes, spanAttribute{key: fmt.Sprint(keyvals[i]), value: keyvals[i+1]})
+	}
+}
+
+// setError marks the span as failed
+func (s *span) setError(err error) {
+	s.status, s.message = spanStatusError, err.Error()
+}
+
+// finish ends the span and queues it for the exporter
+func (s *span) finish() {
+	s.end = time.Now()
+	s.tracer.queue(s)
+}
+
+type spanKey struct{}
+
+// spanFrom returns the span stored in the context, nil means that the context is not traced
+func spanFrom(ctx context.Context) *span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startSpan starts the span as a child of the span of the context or as a root of a new trace
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	var parent spanContext
+	if p := spanFrom(ctx); p != nil {
+		parent = p.context
+	}
+	return tracer.start(ctx, name, kind, parent)
+}
+
+// spanExporter sends ended spans to a tracing backend
+type spanExporter interface {
+	export(spans []*span) error
+}
+
+// Tracer creates spans and exports them in batches, spans are only propagated without the exporter
+type Tracer struct {
+	exporter    spanExporter
+	sampleRatio float64
+	interval    time.Duration
+
+	mutex   sync.Mutex
+	spans   []*span
+	trimmed int // spans dropped from the front of the queue, so flush knows which of its spans are still queued
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// tracer is the tracer of the service, it does not export spans until the configuration is applied
+var tracer = newTracer(nil, 0, tracingFlushInterval)
+
+func newTracer(exporter spanExporter, sampleRatio float64, interval time.Duration) *Tracer {
+	return &Tracer{
+		exporter:    exporter,
+		sampleRatio: sampleRatio,
+		interval:    interval,
+		quit:        make(chan struct{}),
+	}
+}
+
+// TracingOptions configures export of traces, traces are exported with OTLP over HTTP
+type TracingOptions struct {
+	Endpoint    string        `yaml:"endpoint"`     // e.g. http://otel-collector:4318, tracing is disabled without it
+	ServiceName string        `yaml:"service_name"` // service.name of exported spans
+	SampleRatio float64       `yaml:"sample_ratio"` // of new traces, sampling of propagated traces is respected
+	Timeout     time.Duration `yaml:"timeout"`      // of exports
+}
+
+func (o TracingOptions) validate(p *configProblems) {
+	if !strings.HasPrefix(o.Endpoint, "http://") && !strings.HasPrefix(o.Endpoint, "https://") {
+		p.add("tracing.endpoint", "must be an http or https URL, got (%s)", o.Endpoint)
+	}
+	if len(o.ServiceName) == 0 {
+		p.add("tracing.service_name", "is required")
+	}
+	if o.SampleRatio < 0 || o.SampleRatio > 1 {
+		p.add("tracing.sample_ratio", "must be between 0 and 1, got (%g)", o.SampleRatio)
+	}
+	p.positive("tracing.timeout", o.Timeout)
+}
+
+// SetupTracing exports spans of the service to the endpoint of the options,
+// the returned function exports queued spans and stops the export
+func SetupTracing(o TracingOptions) (func(), error) {
+	if len(o.Endpoint) == 0 {
+		return func() {}, nil
+	}
+	var p configProblems
+	o.validate(&p)
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+
+	exporter := &otlpExporter{
+		client:  &http.Client{Timeout: o.Timeout},
+		url:     strings.TrimSuffix(o.Endpoint, "/") + "/v1/traces",
+		service: o.ServiceName,
+	}
+	tracer = newTracer(exporter, o.SampleRatio, tracingFlushInterval)
+	tracer.Start()
+	return tracer.Stop, nil
+}
+
+// start starts the span, a valid parent is continued and its sampling decision is respected
+func (t *Tracer) start(ctx context.Context, name string, kind int, parent spanContext) (context.Context, *span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent.valid() {
+		s.context.traceID, s.context.sampled, s.parentID = parent.traceID, parent.sampled, parent.spanID
+	} else {
+		randomID(s.context.traceID[:])
+		s.context.sampled = t.exporter != nil && randomRatio() < t.sampleRatio
+	}
+	randomID(s.context.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// randomID fills the identifier with random bytes, it is never zero
+func randomID(id []byte) {
+	if _, err := rand.Read(id); err != nil {
+		binary.BigEndian.PutUint64(id[len(id)-8:], uint64(time.Now().UnixNano()))
+	}
+	id[len(id)-1] |= 1
+}
+
+// randomRatio returns a random number in [0, 1)
+func randomRatio() float64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+}
+
+// queue keeps the ended span until it is exported
+func (t *Tracer) queue(s *span) {
+	if t.exporter == nil || !s.context.sampled {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.spans = append(t.spans, s)
+	if dropped := len(t.spans) - tracingBufferSize; dropped > 0 {
+		t.spans = t.spans[dropped:]
+		t.trimmed += dropped
+		logger.Warning("Tracing: spans have been dropped", "dropped", dropped)
+	}
+}
+
+// flush exports queued spans in batches, spans which are not exported stay in the queue
+func (t *Tracer) flush() (err error) {
+	start := time.Now()
+	defer func() {
+		observeCollectorRun("tracing", start, err)
+	}()
+	for {
+		t.mutex.Lock()
+		n := len(t.spans)
+		if n > tracingBatchSize {
+			n = tracingBatchSize
+		}
+		batch := append([]*span(nil), t.spans[:n]...)
+		trimmed := t.trimmed
+		t.mutex.Unlock()
+
+		if len(batch) == 0 {
+			return nil
+		}
+		if err = t.exporter.export(batch); err != nil {
+			return err
+		}
+
+		t.mutex.Lock()
+		// the queue may have been trimmed while exporting, only exported spans which are still queued are removed
+		if exported := n - (t.trimmed - trimmed); exported > 0 {
+			t.spans = t.spans[exported:]
+		}
+		t.mutex.Unlock()
+	}
+}
+
+// Start exports queued spans periodically
+func (t *Tracer) Start() {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-t.quit:
+				if err := t.flush(); err != nil {
+					logger.Error("Tracing", "error", err)
+				}
+				return
+			}
+			if err := t.flush(); err != nil {
+				logger.Error("Tracing", "error", err)
+			}
+		}
+	}()
+}
+
+// Stop exports queued spans and waits until it is finished
+func (t *Tracer) Stop() {
+	close(t.quit)
+	t.wg.Wait()
+}
+
+// Tracing returns container filter which continues W3C trace context of requests or starts new traces.
+// Spans are named by routes of web services of the container, so path parameters do not make new names.
+func Tracing(container *restful.Container) restful.FilterFunction {
+	router := restful.CurlyRouter{}
+	return func(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+		parent, _ := parseTraceparent(request.Request.Header.Get(traceparentHeader))
+		ctx, s := tracer.start(request.Request.Context(), request.Request.Method, spanKindServer, parent)
+		request.Request = request.Request.WithContext(ctx)
+
+		chain.ProcessFilter(request, response)
+
+		route := "unmatched"
+		if _, r, err := router.SelectRoute(container.RegisteredWebServices(), request.Request); err == nil {
+			route = r.Path
+		}
+		s.name = request.Request.Method + " " + route
+		s.setAttributes(
+			"http.method", request.Request.Method,
+			"http.route", route,
+			"http.target", request.Request.URL.Path,
+			"http.status_code", response.StatusCode())
+		if response.StatusCode() >= http.StatusInternalServerError {
+			s.setError(fmt.Errorf("status=(%d)", response.StatusCode()))
+		}
+		s.finish()
+	}
+}
+
+// memoryExporter keeps exported spans in memory, it is used by tests
+type memoryExporter struct {
+	mutex sync.Mutex
+	spans []*span
+}
+
+func (e *memoryExporter) export(spans []*span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+// exported returns spans which have been exported so far
+func (e *memoryExporter) exported() []*span {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]*span(nil), e.spans...)
+}
+
+// otlpExporter sends spans to OpenTelemetry collector with OTLP over HTTP in JSON encoding
+type otlpExporter struct {
+	client  *http.Client
+	url     string
+	service string
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// newOTLPAttribute returns the attribute with the value of its type, 64-bit integers are strings in OTLP JSON
+func newOTLPAttribute(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case string:
+		a.Value = map[string]interface{}{"stringValue": v}
+	case bool:
+		a.Value = map[string]interface{}{"boolValue": v}
+	case int:
+		a.Value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		a.Value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		a.Value = map[string]interface{}{"doubleValue": v}
+	default:
+		a.Value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+	return a
+}
+
+// payload returns the request of the spans, they are sent by the resource of the service
+func (e *otlpExporter) payload(spans []*span) otlpTraces {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name, scope.Scope.Version = tracingScope, Version
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.context.traceID[:]),
+			SpanID:            hex.EncodeToString(s.context.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attributes {
+			o.Attributes = append(o.Attributes, newOTLPAttribute(a.key, a.value))
+		}
+		o.Status.Code, o.Status.Message = s.status, s.message
+		scope.Spans = append(scope.Spans, o)
+	}
+
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = []otlpAttribute{newOTLPAttribute("service.name", e.service)}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{resource}}
+}
+
+func (e *otlpExporter) export(spans []*span) error {
+	payload, err := json.Marshal(e.payload(spans))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", e.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("export of spans failed, status=(%d) body=(%s)", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package app
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/go-pg/pg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+// captureSpans directs spans of the service to the memory exporter until the returned function is called
+func captureSpans() (*memoryExporter, func()) {
+	exporter := &memoryExporter{}
+	previous := tracer
+	tracer = newTracer(exporter, 1, tracingFlushInterval)
+	return exporter, func() {
+		tracer = previous
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name            string
+		header          string
+		expectedValid   bool
+		expectedSampled bool
+	}{
+		{name: "Sampled", header: "00-" + testTraceID + "-" + testSpanID + "-01", expectedValid: true, expectedSampled: true},
+		{name: "Not sampled", header: "00-" + testTraceID + "-" + testSpanID + "-00", expectedValid: true},
+		{name: "Future version", header: "cc-" + testTraceID + "-" + testSpanID + "-01-extra", expectedValid: true, expectedSampled: true},
+		{name: "Missing", header: ""},
+		{name: "Invalid version", header: "ff-" + testTraceID + "-" + testSpanID + "-01"},
+		{name: "Extra field of version 00", header: "00-" + testTraceID + "-" + testSpanID + "-01-extra"},
+		{name: "Upper case", header: "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + testSpanID + "-01"},
+		{name: "Zero trace", header: "00-00000000000000000000000000000000-" + testSpanID + "-01"},
+		{name: "Short span", header: "00-" + testTraceID + "-00f067aa-01"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Act
+			c, valid := parseTraceparent(test.header)
+
+			// Assert
+			assert.Equal(t, test.expectedValid, valid)
+			if valid {
+				assert.Equal(t, testTraceID, hex.EncodeToString(c.traceID[:]))
+				assert.Equal(t, testSpanID, hex.EncodeToString(c.spanID[:]))
+				assert.Equal(t, test.expectedSampled, c.sampled)
+			}
+		})
+	}
+}
+
+func TestTracing(t *testing.T) {
+	tests := []struct {
+		name             string
+		traceparent      string
+		expectedSpans    int
+		expectedContinue bool
+	}{
+		{name: "Propagated trace", traceparent: "00-" + testTraceID + "-" + testSpanID + "-01", expectedSpans: 2, expectedContinue: true},
+		{name: "New trace", expectedSpans: 2},
+		{name: "Trace is not sampled by the caller", traceparent: "00-" + testTraceID + "-" + testSpanID + "-00", expectedContinue: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			exporter, restore := captureSpans()
+			defer restore()
+
+			var received string
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				received = req.Header.Get(traceparentHeader)
+				rw.WriteHeader(http.StatusNotFound)
+				rw.Write([]byte(`{"message": "city not found"}`))
+			}))
+			defer server.Close()
+			o, err := NewOpenWeatherAPI(server.Client(), OpenWeatherMapOptions{URL: server.URL, Token: "secret"})
+			require.Nil(t, err)
+
+			ws := new(restful.WebService)
+			ws.Path("/locations").Route(ws.GET("/{id}").To(func(request *restful.Request, response *restful.Response) {
+				o.withContext(requestContext(request)).getWeather(map[string]string{"id": request.PathParameter("id")})
+				response.WriteHeader(http.StatusNotFound)
+			}))
+			container := restful.NewContainer()
+			container.Add(ws)
+			container.Filter(Tracing(container))
+
+			req := httptest.NewRequest("GET", "/locations/2643743", nil)
+			if len(test.traceparent) > 0 {
+				req.Header.Set(traceparentHeader, test.traceparent)
+			}
+
+			// Act
+			container.ServeHTTP(httptest.NewRecorder(), req)
+			require.Nil(t, tracer.flush())
+
+			// Assert
+			propagated, valid := parseTraceparent(received)
+			require.True(t, valid, received)
+			if test.expectedContinue {
+				assert.Equal(t, testTraceID, hex.EncodeToString(propagated.traceID[:]))
+			}
+
+			spans := exporter.exported()
+			require.Len(t, spans, test.expectedSpans)
+			if test.expectedSpans == 0 {
+				assert.False(t, propagated.sampled)
+				return
+			}
+			outbound, inbound := spans[0], spans[1]
+			assert.Equal(t, "open_weather_map weather", outbound.name)
+			assert.Equal(t, spanKindClient, outbound.kind)
+			assert.Equal(t, propagated, outbound.context)
+			assert.Equal(t, inbound.context.spanID, outbound.parentID)
+			assert.Contains(t, outbound.attributes, spanAttribute{key: "http.status_code", value: http.StatusNotFound})
+
+			assert.Equal(t, "GET /locations/{id}", inbound.name)
+			assert.Equal(t, spanKindServer, inbound.kind)
+			assert.Equal(t, propagated.traceID, inbound.context.traceID)
+			assert.Contains(t, inbound.attributes, spanAttribute{key: "http.target", value: "/locations/2643743"})
+			if test.expectedContinue {
+				assert.Equal(t, testSpanID, hex.EncodeToString(inbound.parentID[:]))
+			} else {
+				assert.Equal(t, [8]byte{}, inbound.parentID)
+			}
+		})
+	}
+}
+
+// hookExporter calls the hook before spans are exported
+type hookExporter struct {
+	memoryExporter
+	hook func()
+}
+
+func (e *hookExporter) export(spans []*span) error {
+	e.hook()
+	return e.memoryExporter.export(spans)
+}
+
+func TestTracerTrimmedWhileExporting(t *testing.T) {
+	// Arrange
+	var tr *Tracer
+	queue := func(from, to int) {
+		for i := from; i < to; i++ {
+			tr.queue(&span{tracer: tr, name: strconv.Itoa(i), context: spanContext{sampled: true}})
+		}
+	}
+	exporter := &hookExporter{}
+	exporter.hook = func() {
+		if len(exporter.exported()) == 0 {
+			// the full queue is trimmed by new spans while the first batch is exported
+			queue(tracingBufferSize, tracingBufferSize+100)
+		}
+	}
+	tr = newTracer(exporter, 1, time.Hour)
+	queue(0, tracingBufferSize)
+
+	// Act
+	err := tr.flush()
+
+	// Assert
+	require.Nil(t, err)
+	assert.Empty(t, tr.spans)
+	exported := map[string]int{}
+	for _, s := range exporter.exported() {
+		exported[s.name]++
+	}
+	assert.Len(t, exported, tracingBufferSize+100, "every span is exported")
+	for name, n := range exported {
+		assert.Equal(t, 1, n, "span is exported once: %s", name)
+	}
+}
+
+func TestQuerySpans(t *testing.T) {
+	// Arrange
+	exporter, restore := captureSpans()
+	defer restore()
+	ctx, parent := startSpan(context.Background(), "GET /locations", spanKindServer)
+	traced := &pg.QueryEvent{Ctx: ctx, Query: "SELECT 1", Data: make(map[interface{}]interface{}), Error: errors.New("connection refused")}
+	background := &pg.QueryEvent{Query: "DELETE FROM weather", Data: make(map[interface{}]interface{})}
+
+	// Act
+	for _, event := range []*pg.QueryEvent{traced, background} {
+		queryMetrics{}.BeforeQuery(event)
+		queryMetrics{}.AfterQuery(event)
+	}
+	require.Nil(t, tracer.flush())
+
+	// Assert
+	spans := exporter.exported()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "SELECT", spans[0].name)
+	assert.Equal(t, parent.context.traceID, spans[0].context.traceID)
+	assert.Equal(t, parent.context.spanID, spans[0].parentID)
+	assert.Equal(t, spanStatusError, spans[0].status)
+	assert.Equal(t, "connection refused", spans[0].message)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	// Arrange
+	var payload otlpTraces
+	var path string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+		json.NewDecoder(req.Body).Decode(&payload)
+		rw.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	stop, err := SetupTracing(TracingOptions{Endpoint: server.URL + "/", ServiceName: "weather", SampleRatio: 1, Timeout: time.Second})
+	require.Nil(t, err)
+	defer func() {
+		tracer = newTracer(nil, 0, tracingFlushInterval)
+	}()
+	parent, _ := parseTraceparent("00-" + testTraceID + "-" + testSpanID + "-01")
+	_, s := tracer.start(context.Background(), "GET /locations", spanKindServer, parent)
+	s.setAttributes("http.status_code", 503, "http.route", "/locations")
+	s.setError(errors.New("status=(503)"))
+	s.finish()
+
+	// Act
+	status = http.StatusServiceUnavailable
+	failed := tracer.flush()
+	status = http.StatusOK
+	stop()
+
+	// Assert
+	assert.EqualError(t, failed, "export of spans failed, status=(503) body=()")
+	assert.Equal(t, "/v1/traces", path)
+	require.Len(t, payload.ResourceSpans, 1)
+	assert.Equal(t, []otlpAttribute{newOTLPAttribute("service.name", "weather")}, payload.ResourceSpans[0].Resource.Attributes)
+	require.Len(t, payload.ResourceSpans[0].ScopeSpans, 1)
+	spans := payload.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 1)
+	assert.Equal(t, testTraceID, spans[0].TraceID)
+	assert.Equal(t, testSpanID, spans[0].ParentSpanID)
+	assert.Equal(t, hex.EncodeToString(s.context.spanID[:]), spans[0].SpanID)
+	assert.Equal(t, spanKindServer, spans[0].Kind)
+	assert.Equal(t, spanStatusError, spans[0].Status.Code)
+	assert.Equal(t, []otlpAttribute{
+		{Key: "http.status_code", Value: map[string]interface{}{"intValue": "503"}},
+		{Key: "http.route", Value: map[string]interface{}{"stringValue": "/locations"}},
+	}, spans[0].Attributes)
+}
+
+func TestSetupTracing(t *testing.T) {
+	// Act
+	stop, disabled := SetupTracing(TracingOptions{})
+	_, invalid := SetupTracing(TracingOptions{Endpoint: "otel-collector:4318", ServiceName: "weather", Timeout: time.Second})
+
+	// Assert
+	assert.Nil(t, disabled)
+	assert.NotNil(t, stop)
+	assert.Nil(t, tracer.exporter)
+	assert.EqualError(t, invalid, "invalid configuration: tracing.endpoint must be an http or https URL, got (otel-collector:4318)")
+}
@@ -5,13 +5,39 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/emicklei/go-restful"
 	"github.com/emicklei/go-restful-openapi"
-	"github.com/google/logger"
 )
 
-// Weather refers to database table 'locations'
+// origins of weather samples
+const (
+	sourceOWM    = "owm"
+	sourceImport = "import"
+	sourceMETAR  = "metar"
+	sourceISD    = "isd"
+
+	sourceWunderground = "wunderground"
+	sourceEcowitt      = "ecowitt"
+	sourceMQTT         = "mqtt"
+	sourceInflux       = "influx"
+)
+
+// sources are all origins of weather samples, clients may only send these
+var sources = []string{sourceOWM, sourceImport, sourceMETAR, sourceISD, sourceWunderground, sourceEcowitt, sourceMQTT, sourceInflux}
+
+func validSource(source string) bool {
+	for _, s := range sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// Weather refers to database table 'weather'
 type Weather struct {
 	TableName   struct{} `sql:"weather" json:"-"`
 	ID          int      `json:"-"`
@@ -19,13 +45,25 @@ type Weather struct {
 	LocationID  int
 	TempMin     float32     `json:"temp_min"`
 	TempMax     float32     `json:"temp_max"`
+	Humidity    *float32    `json:"humidity,omitempty" description:"relative humidity in %"`
+	Pressure    *float32    `json:"pressure,omitempty" description:"atmospheric pressure in hPa"`
+	WindSpeed   *float32    `json:"wind_speed,omitempty" description:"wind speed in m/s"`
+	WindDeg     *int        `json:"wind_deg,omitempty" description:"wind direction in degrees"`
+	Source      string      `json:"-"`
 	Conditions  []Condition `json:"conditions" sql:"-"`
+	MeasuredAt  time.Time   `json:"-"`
+	Date        time.Time   `json:"-"`
 }
 
 // Condition refers to database table 'conditions'
 type Condition struct {
-	StatisticID int    `json:"-"`
-	Type        string `json:"type"`
+	StatisticID int       `json:"-"`
+	Code        int       `json:"code" description:"weather condition code, see /conditions"`
+	Type        string    `json:"type" sql:"-" description:"group of weather conditions"`
+	Description string    `json:"description" sql:"-"`
+	Icon        string    `json:"-" sql:"-"`
+	IconURL     string    `json:"icon_url" sql:"-" description:"link to the icon of weather condition"`
+	Date        time.Time `json:"-"`
 }
 
 // Statistics provides overall statistics
@@ -35,6 +73,25 @@ type Statistics struct {
 	DailyCondition   map[string][]string
 }
 
+// Summary describes all saved weather
+type Summary struct {
+	Locations      int
+	LastMeasuredAt time.Time // zero when there is no weather
+}
+
+// LatestWeather is the newest weather sample of the location
+type LatestWeather struct {
+	LocationID  int
+	CityName    string
+	CountryCode string
+	MeasuredAt  time.Time
+	Temperature float32
+	Humidity    *float32
+	Pressure    *float32
+	WindSpeed   *float32
+	WindDeg     *int
+}
+
 // MonthTemperatureStatistics contains temperature statistics for each month
 type MonthTemperatureStatistics struct {
 	TableName struct{} `sql:"weather" json:"-"`
@@ -54,13 +111,15 @@ type DailyConditionStatistics struct {
 type WeatherEndpoint struct {
 	db                databaseWeatherProvider
 	openWeatherMapAPI *OpenWeatherAPI
+	auth              *Authenticator
 }
 
-// NewWeatherEndpoint returns WeatherEndpoint instance
-func NewWeatherEndpoint(db databaseWeatherProvider, o *OpenWeatherAPI) *WeatherEndpoint {
+// NewWeatherEndpoint returns WeatherEndpoint instance, the authenticator protects the import of observations
+func NewWeatherEndpoint(db databaseWeatherProvider, o *OpenWeatherAPI, auth *Authenticator) *WeatherEndpoint {
 	return &WeatherEndpoint{
 		db:                db,
 		openWeatherMapAPI: o,
+		auth:              auth,
 	}
 }
 
@@ -83,7 +142,8 @@ func (w *WeatherEndpoint) Endpoint() *restful.WebService {
 		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil).
 		Returns(http.StatusNotFound, "location does not exist", nil).
 		Returns(http.StatusGatewayTimeout, "open weather api timeout", nil).
-		Returns(http.StatusBadGateway, "open weather api error", nil))
+		Returns(http.StatusBadGateway, "open weather api error", nil).
+		Returns(http.StatusTooManyRequests, quotaExhausted, nil))
 
 	ws.Route(ws.GET("/{location_id}/statistics").To(w.getStatistics).
 		Doc("get the weather").
@@ -95,19 +155,57 @@ func (w *WeatherEndpoint) Endpoint() *restful.WebService {
 		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil).
 		Returns(http.StatusNotFound, "location does not exist", nil))
 
+	ws.Route(ws.GET("/{location_id}/observations").To(w.getObservations).
+		Doc("export raw weather samples").
+		Param(ws.PathParameter("location_id", "identifier of the location").DataType("integer")).
+		Param(ws.QueryParameter("from", "the first date, inclusive (YYYY-MM-DD)").DataType("string")).
+		Param(ws.QueryParameter("to", "the last date, inclusive (YYYY-MM-DD)").DataType("string")).
+		Param(ws.QueryParameter("limit", "maximum number of samples").DataType("integer")).
+		Param(ws.QueryParameter("offset", "number of samples to skip").DataType("integer")).
+		Param(ws.QueryParameter("format", "json, csv or ndjson").DataType("string").DefaultValue(formatJSON)).
+		Produces(restful.MIME_JSON, "text/csv", "application/x-ndjson").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes([]Observation{}).
+		Returns(http.StatusOK, "OK", []Observation{}).
+		Returns(http.StatusBadRequest, "invalid query parameters", nil).
+		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil).
+		Returns(http.StatusNotFound, "location does not exist", nil))
+
+	ws.Route(ws.POST("/{location_id}/observations:import").To(w.importObservations).
+		Filter(w.auth.Filter).
+		Doc("import historical weather samples from CSV or NDJSON").
+		Param(ws.PathParameter("location_id", "identifier of the location").DataType("integer")).
+		Param(ws.HeaderParameter("Authorization", "Bearer <token>").DataType("string").Required(true)).
+		Param(ws.QueryParameter("format", "csv or ndjson, by default it is taken from Content-Type").DataType("string")).
+		Param(ws.QueryParameter("columns", "mapping of fields to columns, e.g. measured_at=time,temperature=temp").DataType("string")).
+		Param(ws.QueryParameter("units", "units of temperature: kelvin, celsius or fahrenheit").DataType("string").DefaultValue(unitsKelvin)).
+		Param(ws.QueryParameter("time_layout", "layout of the time of measurement in Go format, e.g. 2006-01-02 15:04").DataType("string")).
+		Param(ws.QueryParameter("dry_run", "validate observations without saving them").DataType("boolean").DefaultValue("false")).
+		Consumes("text/csv", "application/x-ndjson").
+		Metadata(restfulspec.KeyOpenAPITags, tags).
+		Writes(ImportReport{}).
+		Returns(http.StatusOK, "OK", ImportReport{}).
+		Returns(http.StatusBadRequest, "invalid query parameters or file", nil).
+		Returns(http.StatusRequestEntityTooLarge, importBodyTooLarge, nil).
+		Returns(http.StatusUnauthorized, unauthorized, nil).
+		Returns(http.StatusServiceUnavailable, serviceIsUnavailable, nil).
+		Returns(http.StatusNotFound, "location does not exist", nil))
+
 	return ws
 }
 
 func (w *WeatherEndpoint) getStatistics(request *restful.Request, response *restful.Response) {
+	db := w.db.withContext(requestContext(request))
+
 	locationID, err := strconv.Atoi(request.PathParameter("location_id"))
 	if err != nil {
-		logger.Error("Get statistics: ", err)
+		requestLogger(request).Error("Get statistics", "error", err)
 		response.WriteErrorString(http.StatusBadRequest, locationInvalidID)
 		return
 	}
 
-	if _, err = w.db.getLocation(locationID); err != nil {
-		logger.Error("Get statistics: ", err)
+	if _, err = db.getLocation(locationID); err != nil {
+		requestLogger(request).Error("Get statistics", "error", err)
 		if err == sql.ErrNoRows {
 			response.WriteErrorString(http.StatusNotFound,
 				fmt.Sprintf("location '%d' does not exist", locationID))
@@ -117,9 +215,9 @@ func (w *WeatherEndpoint) getStatistics(request *restful.Request, response *rest
 		return
 	}
 
-	s, err := w.db.getStatistics(locationID)
+	s, err := db.getStatistics(locationID)
 	if err != nil {
-		logger.Error("Get statistics: ", err)
+		requestLogger(request).Error("Get statistics", "error", err)
 		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
 		return
 	}
@@ -127,28 +225,34 @@ func (w *WeatherEndpoint) getStatistics(request *restful.Request, response *rest
 }
 
 func (w *WeatherEndpoint) getWeather(request *restful.Request, response *restful.Response) {
+	db := w.db.withContext(requestContext(request))
+	api := w.openWeatherMapAPI.withContext(requestContext(request))
+
 	locationID, err := strconv.Atoi(request.PathParameter("location_id"))
 	if err != nil {
-		logger.Error("Get weather: ", err)
+		requestLogger(request).Error("Get weather", "error", err)
 		response.WriteErrorString(http.StatusBadRequest, locationInvalidID)
 		return
 	}
 
-	_, err = w.db.getLocation(locationID)
+	_, err = db.getLocation(locationID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			response.WriteErrorString(http.StatusNotFound, fmt.Sprintf(locationNotFound, strconv.Itoa(locationID)))
 			return
 		}
 
-		logger.Error("Get weather: ", err)
+		requestLogger(request).Error("Get weather", "error", err)
 		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
 		return
 	}
 
-	result, status, err := w.openWeatherMapAPI.getWeather(map[string]string{"id": strconv.Itoa(locationID)})
+	result, status, err := api.getWeather(map[string]string{"id": strconv.Itoa(locationID)})
 	if err != nil {
-		logger.Error("Get weather: ", err)
+		requestLogger(request).Error("Get weather", "error", err)
+		if writeQuotaError(response, err) {
+			return
+		}
 		if status == http.StatusNotFound {
 			response.WriteErrorString(status, fmt.Sprintf(locationNotFound, strconv.Itoa(locationID)))
 		} else {
@@ -162,20 +266,141 @@ func (w *WeatherEndpoint) getWeather(request *restful.Request, response *restful
 		LocationID:  locationID,
 		TempMin:     result.Main.TempMin,
 		TempMax:     result.Main.TempMax,
+		Humidity:    result.Main.Humidity,
+		Pressure:    result.Main.Pressure,
+		WindSpeed:   result.Wind.Speed,
+		WindDeg:     result.Wind.Deg,
+		Source:      sourceOWM,
 	}
 
 	for _, v := range result.Description {
 		s.Conditions = append(s.Conditions, Condition{
-			Type: v.Main,
+			Code:        v.ID,
+			Type:        v.Main,
+			Description: v.Description,
+			Icon:        v.Icon,
+			IconURL:     iconURL(v.ID, v.Icon),
 		})
 	}
 
-	err = w.db.saveWeather(s)
+	err = db.saveWeather(s)
 	if err != nil {
-		logger.Error("Get weather: ", err)
+		requestLogger(request).Error("Get weather", "error", err)
 		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
 		return
 	}
 
 	response.WriteHeaderAndEntity(http.StatusOK, &s)
 }
+
+func (w *WeatherEndpoint) getObservations(request *restful.Request, response *restful.Response) {
+	db := w.db.withContext(requestContext(request))
+
+	locationID, err := strconv.Atoi(request.PathParameter("location_id"))
+	if err != nil {
+		requestLogger(request).Error("Get observations", "error", err)
+		response.WriteErrorString(http.StatusBadRequest, locationInvalidID)
+		return
+	}
+
+	filter, err := NewObservationFilter(request.QueryParameter("from"), request.QueryParameter("to"),
+		request.QueryParameter("limit"), request.QueryParameter("offset"))
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.LocationID = locationID
+
+	format := request.QueryParameter("format")
+	if len(format) == 0 {
+		format = formatJSON
+	}
+	mime, err := contentType(format)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err = db.getLocation(locationID); err != nil {
+		if err == sql.ErrNoRows {
+			response.WriteErrorString(http.StatusNotFound,
+				fmt.Sprintf("location '%d' does not exist", locationID))
+			return
+		}
+		requestLogger(request).Error("Get observations", "error", err)
+		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
+		return
+	}
+
+	// the status is sent before the first sample, so later errors can only be logged
+	response.AddHeader("Content-Type", mime)
+	if format == formatCSV {
+		response.AddHeader("Content-Disposition",
+			fmt.Sprintf("attachment; filename=\"observations-%d.csv\"", locationID))
+	}
+	response.WriteHeader(http.StatusOK)
+
+	if err = exportObservations(db, response, format, filter); err != nil {
+		requestLogger(request).Error("Get observations", "error", err)
+	}
+}
+
+func (w *WeatherEndpoint) importObservations(request *restful.Request, response *restful.Response) {
+	db := w.db.withContext(requestContext(request))
+
+	locationID, err := strconv.Atoi(request.PathParameter("location_id"))
+	if err != nil {
+		requestLogger(request).Error("Import observations", "error", err)
+		response.WriteErrorString(http.StatusBadRequest, locationInvalidID)
+		return
+	}
+
+	format := request.QueryParameter("format")
+	if len(format) == 0 {
+		switch strings.Split(request.HeaderParameter("Content-Type"), ";")[0] {
+		case "text/csv":
+			format = formatCSV
+		case "application/x-ndjson":
+			format = formatNDJSON
+		}
+	}
+
+	dryRun := false
+	if v := request.QueryParameter("dry_run"); len(v) > 0 {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			response.WriteErrorString(http.StatusBadRequest, "'dry_run' must be a boolean")
+			return
+		}
+	}
+
+	options, err := NewImportOptions(locationID, format, request.QueryParameter("columns"),
+		request.QueryParameter("units"), request.QueryParameter("time_layout"), dryRun)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	body := http.MaxBytesReader(response, request.Request.Body, maxImportBody)
+	report, err := importObservations(db, body, options)
+	if err != nil {
+		if bodyTooLarge(err) {
+			response.WriteErrorString(http.StatusRequestEntityTooLarge, importBodyTooLarge)
+			return
+		}
+		if err == sql.ErrNoRows {
+			response.WriteErrorString(http.StatusNotFound,
+				fmt.Sprintf("location '%d' does not exist", locationID))
+			return
+		}
+		if _, ok := err.(invalidFileError); ok {
+			response.WriteErrorString(http.StatusBadRequest, err.Error())
+			return
+		}
+		requestLogger(request).Error("Import observations", "error", err)
+		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
+		return
+	}
+
+	requestLogger(request).Info("Observations have been imported", "location_id", locationID, "report", report)
+	response.WriteHeaderAndEntity(http.StatusOK, &report)
+}
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/emicklei/go-restful"
+)
+
+// decimal converts float32 to the nearest float64 of its shortest decimal form, e.g. 4.1 instead of 4.099999904632568
+func decimal(v float32) float64 {
+	f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'f', -1, 32), 64)
+	return f
+}
+
+// weatherMetrics returns registry with the latest weather of the locations, missing values are left out
+func weatherMetrics(latest []LatestWeather) *metricsRegistry {
+	r := &metricsRegistry{}
+	labels := []string{"location_id", "city", "country"}
+	temperature := r.gauge("weather_temperature_celsius", "Temperature of the latest sample.", labels...)
+	humidity := r.gauge("weather_humidity_percent", "Relative humidity of the latest sample.", labels...)
+	pressure := r.gauge("weather_pressure_hectopascals", "Atmospheric pressure of the latest sample.", labels...)
+	windSpeed := r.gauge("weather_wind_speed_meters_per_second", "Wind speed of the latest sample.", labels...)
+	windDeg := r.gauge("weather_wind_direction_degrees", "Meteorological wind direction of the latest sample.", labels...)
+	measuredAt := r.gauge("weather_measured_timestamp_seconds", "Unix time of measurement of the latest sample.", labels...)
+
+	for _, w := range latest {
+		l := []string{strconv.Itoa(w.LocationID), w.CityName, w.CountryCode}
+		temperature.set(math.Round((decimal(w.Temperature)-273.15)*100)/100, l...)
+		if w.Humidity != nil {
+			humidity.set(decimal(*w.Humidity), l...)
+		}
+		if w.Pressure != nil {
+			pressure.set(decimal(*w.Pressure), l...)
+		}
+		if w.WindSpeed != nil {
+			windSpeed.set(decimal(*w.WindSpeed), l...)
+		}
+		if w.WindDeg != nil {
+			windDeg.set(float64(*w.WindDeg), l...)
+		}
+		measuredAt.set(float64(w.MeasuredAt.Unix()), l...)
+	}
+	return r
+}
+
+func (m *MetricsEndpoint) getWeatherMetrics(request *restful.Request, response *restful.Response) {
+	db := m.db.withContext(requestContext(request))
+
+	latest, err := db.getLatestWeather()
+	if err != nil {
+		requestLogger(request).Error("Get latest weather", "error", err)
+		response.WriteErrorString(http.StatusServiceUnavailable, serviceIsUnavailable)
+		return
+	}
+
+	response.AddHeader("Content-Type", metricsContentType)
+	response.WriteHeader(http.StatusOK)
+	w := bufio.NewWriter(response)
+	weatherMetrics(latest).write(w)
+	w.Flush()
+}
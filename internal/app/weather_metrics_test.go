@@ -0,0 +1,77 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetWeatherMetrics(t *testing.T) {
+	measuredAt := time.Date(2019, 3, 30, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		db         fakeDatabase
+		HTTPStatus int
+		body       string
+	}{
+		{
+			name:       "Database error",
+			db:         fakeDatabase{err: errors.New("can not connect to database")},
+			HTTPStatus: http.StatusServiceUnavailable,
+			body:       serviceIsUnavailable,
+		},
+		{
+			name: "Latest weather of locations",
+			db: fakeDatabase{latest: []LatestWeather{
+				{LocationID: 2643743, CityName: "London", CountryCode: "GB", MeasuredAt: measuredAt, Temperature: 283.15,
+					Humidity: float32Ptr(81), Pressure: float32Ptr(1012), WindSpeed: float32Ptr(4.1), WindDeg: intPtr(240)},
+				{LocationID: 2988507, CityName: "Paris", CountryCode: "FR", MeasuredAt: measuredAt, Temperature: 270.65},
+			}},
+			HTTPStatus: http.StatusOK,
+			body: `# HELP weather_temperature_celsius Temperature of the latest sample.
+# TYPE weather_temperature_celsius gauge
+weather_temperature_celsius{location_id="2643743",city="London",country="GB"} 10
+weather_temperature_celsius{location_id="2988507",city="Paris",country="FR"} -2.5
+# HELP weather_humidity_percent Relative humidity of the latest sample.
+# TYPE weather_humidity_percent gauge
+weather_humidity_percent{location_id="2643743",city="London",country="GB"} 81
+# HELP weather_pressure_hectopascals Atmospheric pressure of the latest sample.
+# TYPE weather_pressure_hectopascals gauge
+weather_pressure_hectopascals{location_id="2643743",city="London",country="GB"} 1012
+# HELP weather_wind_speed_meters_per_second Wind speed of the latest sample.
+# TYPE weather_wind_speed_meters_per_second gauge
+weather_wind_speed_meters_per_second{location_id="2643743",city="London",country="GB"} 4.1
+# HELP weather_wind_direction_degrees Meteorological wind direction of the latest sample.
+# TYPE weather_wind_direction_degrees gauge
+weather_wind_direction_degrees{location_id="2643743",city="London",country="GB"} 240
+# HELP weather_measured_timestamp_seconds Unix time of measurement of the latest sample.
+# TYPE weather_measured_timestamp_seconds gauge
+weather_measured_timestamp_seconds{location_id="2643743",city="London",country="GB"} 1553947200
+weather_measured_timestamp_seconds{location_id="2988507",city="Paris",country="FR"} 1553947200
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			container := restful.NewContainer()
+			container.Add(NewMetricsEndpoint(test.db).Endpoint())
+			httpRequest := httptest.NewRequest("GET", "/metrics/weather", nil)
+			httpWriter := httptest.NewRecorder()
+
+			// Act
+			container.ServeHTTP(httpWriter, httpRequest)
+
+			// Assert
+			assert.Equal(t, test.HTTPStatus, httpWriter.Code)
+			assert.Equal(t, test.body, httpWriter.Body.String())
+		})
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"os"
 
 	"github.com/emicklei/go-restful"
 	"github.com/stretchr/testify/assert"
@@ -21,8 +20,8 @@ import (
 func TestStatisticsEndpoint(t *testing.T) {
 	t.Run("Check statistics endpoint settings", func(t *testing.T) {
 		// Arrange
-		externalAPI, _ := NewOpenWeatherAPI(nil)
-		l := NewWeatherEndpoint(nil, externalAPI)
+		externalAPI, _ := NewOpenWeatherAPI(nil, OpenWeatherMapOptions{URL: "http://test_url", Token: "token"})
+		l := NewWeatherEndpoint(nil, externalAPI, nil)
 
 		// Act
 		ws := l.Endpoint()
@@ -31,7 +30,7 @@ func TestStatisticsEndpoint(t *testing.T) {
 		require.NotNil(t, ws)
 		assert.Equal(t, "/weather", ws.RootPath())
 		routes := ws.Routes()
-		assert.Len(t, routes, 2)
+		assert.Len(t, routes, 4)
 	})
 }
 
@@ -143,13 +142,16 @@ func TestGetWeather(t *testing.T) {
 			HTTPStatus: http.StatusOK,
 			externalAPI: ExternalAPI{
 				HTTPStatus: http.StatusOK,
-				response:   `{ "weather": [ { "main": "Rain", "id": 501 } ], "main": { "temp": 290.85, "temp_min": 288.71, "temp_max": 293.15 } }`,
+				response:   `{ "weather": [ { "main": "Rain", "id": 501, "description": "moderate rain", "icon": "10n" } ], "main": { "temp": 290.85, "temp_min": 288.71, "temp_max": 293.15 } }`,
 			},
 			db: fakeDatabase{
 				weather: Weather{
 					Conditions: []Condition{
 						{
-							Type: "Rain",
+							Code:        501,
+							Type:        "Rain",
+							Description: "moderate rain",
+							IconURL:     "/icons/501?variant=night",
 						},
 					},
 					LocationID:  123,
@@ -161,14 +163,6 @@ func TestGetWeather(t *testing.T) {
 		},
 	}
 
-	URLOriginal := os.Getenv("OPEN_WEATHER_MAP_URL")
-	URLToken := os.Getenv("OPEN_WEATHER_MAP_TOKEN")
-	defer func() {
-		os.Setenv("OPEN_WEATHER_MAP_URL", URLOriginal)
-		os.Setenv("OPEN_WEATHER_MAP_TOKEN", URLToken)
-	}()
-	os.Setenv("OPEN_WEATHER_MAP_TOKEN", "token")
-
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			// Arrange
@@ -185,9 +179,8 @@ func TestGetWeather(t *testing.T) {
 			client := server.Client()
 			client.Timeout = time.Second
 
-			os.Setenv("OPEN_WEATHER_MAP_URL", server.URL)
-			fakeAPI, _ := NewOpenWeatherAPI(client)
-			l := NewWeatherEndpoint(test.db, fakeAPI)
+			fakeAPI, _ := NewOpenWeatherAPI(client, OpenWeatherMapOptions{URL: server.URL, Token: "token"})
+			l := NewWeatherEndpoint(test.db, fakeAPI, nil)
 
 			bodyString := fmt.Sprintf(`{"location_id": "%s"}`, test.LocationID)
 			bodyReader := strings.NewReader(bodyString)
@@ -294,7 +287,7 @@ func TestGetStatistics(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			// Arrange
-			w := NewWeatherEndpoint(test.db, nil)
+			w := NewWeatherEndpoint(test.db, nil, nil)
 			request := restful.NewRequest(nil)
 			httpWriter := httptest.NewRecorder()
 			response := restful.NewResponse(httpWriter)
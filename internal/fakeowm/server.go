@@ -0,0 +1,244 @@
+// Package fakeowm serves open weather map API from fixture files, so the service can be run and tested
+// without network access or an API key. Live responses may be recorded into fixtures.
+package fakeowm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultFixture is served when there is no fixture of the query
+const defaultFixture = "default"
+
+// Options configures the fake server
+type Options struct {
+	Fixtures string   // directory of fixtures, e.g. 'configs/fake-owm'
+	Upstream string   // responses of it are recorded into fixtures, e.g. 'https://api.openweathermap.org'
+	Keys     []string // accepted keys, empty means that any key is accepted
+
+	Latency             time.Duration // of every response
+	ErrorRate           float64       // share of requests which get 500
+	TooManyRequestsRate float64       // share of requests which get 429
+	RetryAfter          time.Duration // of 429 responses
+	Seed                int64         // of injected failures, 0 means the current time
+}
+
+// Fixture is a response of open weather map, it is stored as '<path>/<query>.json' of the request without
+// the key, e.g. 'data/2.5/weather/id=2643743.json', or '<path>/default.json' of any query
+type Fixture struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// Server is http.Handler of the fake open weather map API
+type Server struct {
+	options Options
+	client  *http.Client
+
+	mutex  sync.Mutex
+	random *rand.Rand
+}
+
+// New returns the server of fixtures of the options
+func New(o Options) *Server {
+	seed := o.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Server{
+		options: o,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		random:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// ServeHTTP responds with the fixture of the request, failures are injected before fixtures are read
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if path.Ext(req.URL.Path) == "" && !s.accepted(req.URL.Query().Get("appid")) {
+		writeError(rw, http.StatusUnauthorized, "Invalid API key. Please see https://openweathermap.org/faq#error401 for more info.")
+		return
+	}
+
+	if s.options.Latency > 0 {
+		timer := time.NewTimer(s.options.Latency)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return
+		}
+	}
+
+	switch {
+	case s.inject(s.options.TooManyRequestsRate):
+		rw.Header().Set("Retry-After", strconv.Itoa(int(s.options.RetryAfter.Seconds())))
+		writeError(rw, http.StatusTooManyRequests, "Your account is temporary blocked due to exceeding of requests limitation of your subscription type.")
+		return
+	case s.inject(s.options.ErrorRate):
+		writeError(rw, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	if len(s.options.Upstream) > 0 {
+		s.record(rw, req)
+		return
+	}
+	s.serveFixture(rw, req)
+}
+
+// accepted returns true when the key is one of accepted keys
+func (s *Server) accepted(key string) bool {
+	if len(key) == 0 || len(s.options.Keys) == 0 {
+		return len(key) > 0
+	}
+	for _, k := range s.options.Keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// inject returns true for the share of requests
+func (s *Server) inject(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.random.Float64() < rate
+}
+
+// serveFixture writes the fixture of the query or the default fixture of the path, files of paths with an extension
+// (e.g. icons) are written as they are
+func (s *Server) serveFixture(rw http.ResponseWriter, req *http.Request) {
+	if path.Ext(req.URL.Path) != "" {
+		content, err := ioutil.ReadFile(s.file(req.URL.Path))
+		if err != nil {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Write(content)
+		return
+	}
+
+	for _, name := range []string{fixtureName(req.URL.Query()), defaultFixture} {
+		f, err := s.load(req.URL.Path, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			writeError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+		rw.WriteHeader(f.Status)
+		rw.Write(f.Body)
+		return
+	}
+	writeError(rw, http.StatusNotFound, "city not found")
+}
+
+// record sends the request to the upstream, its response is written and stored as the fixture of the query
+func (s *Server) record(rw http.ResponseWriter, req *http.Request) {
+	resp, err := s.get(req.Context(), s.options.Upstream+req.URL.RequestURI())
+	if err != nil {
+		writeError(rw, http.StatusBadGateway, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		writeError(rw, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	if path.Ext(req.URL.Path) != "" {
+		if resp.StatusCode == http.StatusOK {
+			err = s.store(s.file(req.URL.Path), body)
+		}
+	} else if json.Valid(body) {
+		err = s.save(req.URL.Path, fixtureName(req.URL.Query()), Fixture{Status: resp.StatusCode, Body: body})
+	}
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); len(contentType) > 0 {
+		rw.Header().Set("Content-Type", contentType)
+	}
+	rw.WriteHeader(resp.StatusCode)
+	rw.Write(body)
+}
+
+func (s *Server) get(ctx context.Context, uri string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.client.Do(req.WithContext(ctx))
+}
+
+// file returns the name of the file of the path in the directory of fixtures
+func (s *Server) file(p string) string {
+	return filepath.Join(s.options.Fixtures, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+func (s *Server) load(p, name string) (Fixture, error) {
+	f := Fixture{}
+	content, err := ioutil.ReadFile(filepath.Join(s.file(p), name+".json"))
+	if err != nil {
+		return f, err
+	}
+	if err = json.Unmarshal(content, &f); err != nil {
+		return f, fmt.Errorf("invalid fixture %s/%s.json: %s", p, name, err)
+	}
+	if f.Status == 0 {
+		f.Status = http.StatusOK
+	}
+	return f, nil
+}
+
+func (s *Server) save(p, name string, f Fixture) error {
+	content, err := json.MarshalIndent(f, "", " ")
+	if err != nil {
+		return err
+	}
+	return s.store(filepath.Join(s.file(p), name+".json"), append(content, '\n'))
+}
+
+func (s *Server) store(file string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, content, 0644)
+}
+
+// fixtureName returns the sorted query without the key, e.g. 'id=2643743&units=metric'
+func fixtureName(query url.Values) string {
+	query.Del("appid")
+	if len(query) == 0 {
+		return defaultFixture
+	}
+	return query.Encode()
+}
+
+// writeError writes the error as open weather map does
+func writeError(rw http.ResponseWriter, status int, message string) {
+	body, _ := json.Marshal(map[string]interface{}{"cod": status, "message": message})
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(status)
+	rw.Write(body)
+}
@@ -0,0 +1,184 @@
+package fakeowm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fixtures are fixtures of the service
+const fixtures = "../../configs/fake-owm"
+
+func TestServerFixtures(t *testing.T) {
+	tests := []struct {
+		name           string
+		options        Options
+		uri            string
+		expectedStatus int
+		expectedName   string
+		expectedBody   string
+	}{
+		{
+			name:           "Fixture of the query",
+			options:        Options{Fixtures: fixtures},
+			uri:            "/data/2.5/weather?appid=key&id=2988507",
+			expectedStatus: http.StatusOK,
+			expectedName:   "Paris",
+		},
+		{
+			name:           "Default fixture",
+			options:        Options{Fixtures: fixtures},
+			uri:            "/data/2.5/weather?appid=key&id=2643743",
+			expectedStatus: http.StatusOK,
+			expectedName:   "London",
+		},
+		{
+			name:           "Fixture of an error",
+			options:        Options{Fixtures: fixtures},
+			uri:            "/data/2.5/weather?appid=key&id=0",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `{"cod": "404", "message": "city not found"}`,
+		},
+		{
+			name:           "Missing fixture",
+			options:        Options{Fixtures: fixtures},
+			uri:            "/data/3.0/onecall?appid=key&lat=51.5&lon=-0.13",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `{"cod":404,"message":"city not found"}`,
+		},
+		{
+			name:           "Missing key",
+			options:        Options{Fixtures: fixtures},
+			uri:            "/data/2.5/weather?id=2643743",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Key is not accepted",
+			options:        Options{Fixtures: fixtures, Keys: []string{"valid"}},
+			uri:            "/data/2.5/weather?appid=revoked&id=2643743",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Accepted key",
+			options:        Options{Fixtures: fixtures, Keys: []string{"revoked", "valid"}},
+			uri:            "/data/2.5/weather?appid=valid&id=2643743",
+			expectedStatus: http.StatusOK,
+			expectedName:   "London",
+		},
+		{
+			name:           "Injected 429",
+			options:        Options{Fixtures: fixtures, TooManyRequestsRate: 1, RetryAfter: time.Minute},
+			uri:            "/data/2.5/weather?appid=key&id=2643743",
+			expectedStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:           "Injected error",
+			options:        Options{Fixtures: fixtures, ErrorRate: 1},
+			uri:            "/data/2.5/weather?appid=key&id=2643743",
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   `{"cod":500,"message":"Internal error"}`,
+		},
+		{
+			name:           "Missing icon",
+			options:        Options{Fixtures: fixtures, Keys: []string{"valid"}},
+			uri:            "/img/wn/10d@2x.png",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Arrange
+			server := New(test.options)
+			recorder := httptest.NewRecorder()
+
+			// Act
+			server.ServeHTTP(recorder, httptest.NewRequest("GET", test.uri, nil))
+
+			// Assert
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			if len(test.expectedName) > 0 {
+				body := struct {
+					Name string `json:"name"`
+				}{}
+				require.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+				assert.Equal(t, test.expectedName, body.Name)
+			}
+			if len(test.expectedBody) > 0 {
+				assert.Equal(t, test.expectedBody, recorder.Body.String())
+			}
+			if test.expectedStatus == http.StatusTooManyRequests {
+				assert.Equal(t, "60", recorder.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestServerLatency(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(New(Options{Fixtures: fixtures, Latency: 50 * time.Millisecond}))
+	defer server.Close()
+
+	// Act
+	start := time.Now()
+	resp, err := http.Get(server.URL + "/geo/1.0/direct?appid=key&q=London")
+	elapsed := time.Since(start)
+
+	// Assert
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, elapsed >= 50*time.Millisecond, elapsed)
+}
+
+func TestServerRecord(t *testing.T) {
+	// Arrange
+	dir, err := ioutil.TempDir("", "fake-owm")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	var keys []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		keys = append(keys, req.URL.Query().Get("appid"))
+		switch req.URL.Path {
+		case "/img/wn/10d@2x.png":
+			rw.Write([]byte("\x89PNG\r\n\x1a\n"))
+		case "/data/2.5/weather":
+			rw.Write([]byte(`{"id": 2643743, "name": "London"}`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte(`{"cod": "404", "message": "city not found"}`))
+		}
+	}))
+	defer upstream.Close()
+	recorder := httptest.NewServer(New(Options{Fixtures: dir, Upstream: upstream.URL}))
+	defer recorder.Close()
+	replay := New(Options{Fixtures: dir})
+
+	// Act
+	for _, uri := range []string{"/data/2.5/weather?id=2643743&appid=secret&units=metric", "/data/2.5/forecast?appid=secret&id=0", "/img/wn/10d@2x.png"} {
+		resp, err := http.Get(recorder.URL + uri)
+		require.Nil(t, err)
+		resp.Body.Close()
+	}
+	weather, err := ioutil.ReadFile(filepath.Join(dir, "data", "2.5", "weather", "id=2643743&units=metric.json"))
+	require.Nil(t, err)
+	replayed := httptest.NewRecorder()
+	replay.ServeHTTP(replayed, httptest.NewRequest("GET", "/data/2.5/forecast?id=0&appid=other", nil))
+	icon := httptest.NewRecorder()
+	replay.ServeHTTP(icon, httptest.NewRequest("GET", "/img/wn/10d@2x.png", nil))
+
+	// Assert
+	assert.Equal(t, []string{"secret", "secret", ""}, keys)
+	assert.Equal(t, "{\n \"status\": 200,\n \"body\": {\n  \"id\": 2643743,\n  \"name\": \"London\"\n }\n}\n", string(weather))
+	assert.Equal(t, http.StatusNotFound, replayed.Code)
+	assert.JSONEq(t, `{"cod": "404", "message": "city not found"}`, replayed.Body.String())
+	assert.Equal(t, "\x89PNG\r\n\x1a\n", icon.Body.String())
+}
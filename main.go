@@ -1,55 +1,161 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/emicklei/go-restful"
-	"github.com/emicklei/go-restful-openapi"
-	"github.com/google/logger"
 	"github.com/mieczyslaw1980/weather/internal/app"
-
-	"time"
 )
 
 func main() {
-	file, err := os.OpenFile("/tmp/weather.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	if err := serve(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// commands are run instead of the service when the first argument is the name of the command
+var commands = map[string]func(args []string) error{
+	"export":          export,
+	"import":          importCommand,
+	"import-stations": importStations,
+	"config":          printConfig,
+	"fake-owm":        fakeOWM,
+	"migrate":         migrate,
+}
+
+// loadConfig parses flags of the configuration and returns the configuration, flags.Args are left for the command
+func loadConfig(flags *flag.FlagSet, args []string) (app.Config, error) {
+	configFlags := app.NewConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return app.Config{}, err
+	}
+	return configFlags.Load(os.Getenv)
+}
+
+// printConfig writes the effective configuration with secrets redacted
+func printConfig(args []string) error {
+	config, err := loadConfig(flag.NewFlagSet("config", flag.ContinueOnError), args)
 	if err != nil {
-		logger.Fatalf("Failed to open log file: %v", err)
+		return err
 	}
-	defer file.Close()
+	fmt.Print(config)
+	return config.Validate()
+}
 
-	logFile := logger.Init("Logger", true, false, file)
-	defer logFile.Close()
+// serve runs the service, errors of the configuration are returned before logs are set up
+func serve(args []string) error {
+	config, err := loadConfig(flag.NewFlagSet("weather", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	if err = config.Validate(); err != nil {
+		return err
+	}
 
-	client := &http.Client{
-		Timeout: time.Duration(10 * time.Second),
+	closeLog, err := app.SetupLogger(config.Log)
+	if err != nil {
+		return err
 	}
-	externalAPI, err := app.NewOpenWeatherAPI(client)
+	defer closeLog()
+	logger := app.ServiceLogger()
+
+	stopTracing, err := app.SetupTracing(config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+
+	externalAPI, err := app.NewOpenWeatherAPI(&http.Client{Timeout: config.OpenWeatherMap.Timeout}, config.OpenWeatherMap)
 	if err != nil {
-		logger.Error(err)
-		return
+		return err
 	}
 
-	db, err := app.NewDB()
+	db, err := app.NewDB(config.Database)
 	if err != nil {
-		logger.Error(err)
-		return
+		return err
+	}
+	defer db.Close()
+
+	quota := app.NewQuota(config.OpenWeatherMap.Quota, db)
+	externalAPI.SetQuota(quota)
+	quota.Start()
+	defer quota.Stop()
+
+	if db.Partitioned() {
+		maintainer := app.NewPartitionMaintainer(db, config.Database.MaintenanceInterval)
+		maintainer.Start()
+		defer maintainer.Stop()
+	}
+
+	if len(config.MQTT.Broker) > 0 {
+		bridge, err := app.NewMQTTBridge(db, config.MQTT)
+		if err != nil {
+			return err
+		}
+		db.AddSaveHook(bridge.Publish)
+		bridge.Start()
+		defer bridge.Stop()
+	}
+
+	if len(config.Influx.URL) > 0 {
+		mirror, err := app.NewInfluxMirror(config.Influx)
+		if err != nil {
+			return err
+		}
+		db.AddSaveHook(mirror.Mirror)
+		mirror.Start()
+		defer mirror.Stop()
 	}
 
 	l := app.NewLocationEndpoint(db, externalAPI)
-	w := app.NewWeatherEndpoint(db, externalAPI)
+	g := app.NewGeocodeEndpoint(externalAPI)
+	auth := app.NewAuthenticator(config.APITokens...)
+	w := app.NewWeatherEndpoint(db, externalAPI, auth)
+	c := app.NewConditionEndpoint(db)
+	i := app.NewIconEndpoint(db, externalAPI, config.IconsDir)
 
-	restful.DefaultContainer.Add(l.Endpoint())
-	restful.DefaultContainer.Add(w.Endpoint())
+	stations, err := app.LoadStationDirectory(config.Stations.File)
+	if err != nil {
+		return err
+	}
+	s := app.NewStationEndpoint(db, stations, config.Stations.MaxDistance, config.Stations.HashKey, auth)
+	p := app.NewPersonalStationEndpoint(db, config.Stations.HashKey)
+	x := app.NewInfluxEndpoint(db, auth)
+	m := app.NewMetricsEndpoint(db)
+	h := app.NewHealthEndpoint(db, externalAPI)
+	a := app.NewAdminEndpoint(auth, quota)
 
-	config := restfulspec.Config{
-		WebServices: restful.RegisteredWebServices(),
+	services := []*restful.WebService{l.Endpoint(), g.Endpoint(), w.Endpoint(), c.Endpoint(), i.Endpoint(), s.Endpoint(),
+		p.Endpoint(), x.Endpoint(), m.Endpoint(), a.Endpoint()}
+	services = append(services, h.Endpoints()...)
+	if err = app.Register(restful.DefaultContainer, services...); err != nil {
+		return err
 	}
 
-	restful.DefaultContainer.Add(restfulspec.NewOpenAPIService(config))
+	// background workers and connections to database are stopped by deferred calls after requests are drained
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
 
-	logger.Info("Weather service start")
-	err = http.ListenAndServe(":8080", nil)
-	logger.Fatal(err)
+	logger.Info("Weather service start", "address", config.Server.Address, "version", app.Version)
+	if err = app.Serve(config.Server, nil, signals); err != nil {
+		logger.Error("Serve", "error", err)
+		return err
+	}
+	logger.Info("Weather service stop")
+	return nil
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/mieczyslaw1980/weather/internal/app"
+)
+
+// migrate applies migrations of the database schema, it is run before the service of a new version is started
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dir := flags.String("dir", "configs/migrations", "directory of migration scripts")
+	config, err := loadConfig(flags, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := app.NewDB(config.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	applied, err := db.Migrate(*dir)
+	for _, name := range applied {
+		fmt.Println("Applied", name)
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/mieczyslaw1980/weather/internal/app"
+)
+
+// importStations loads METAR reports or NOAA ISD records from files or from the standard input
+// and attaches them to the nearest locations
+func importStations(args []string) error {
+	flags := flag.NewFlagSet("import-stations", flag.ContinueOnError)
+	format := flags.String("format", "metar", "input format: metar or isd")
+	stations := flags.String("stations", "", "CSV with coordinates of stations, e.g. NOAA isd-history.csv")
+	maxDistance := flags.Float64("max-distance", app.DefaultStationDistance, "maximum distance in km between a station and its location")
+	dryRun := flags.Bool("dry-run", false, "validate observations without saving them")
+	config, err := loadConfig(flags, args)
+	if err != nil {
+		return err
+	}
+
+	options, err := app.NewStationImportOptions(*format, *maxDistance, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	directory, err := app.LoadStationDirectory(*stations)
+	if err != nil {
+		return err
+	}
+
+	db, err := app.NewDB(config.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", " ")
+	for _, name := range files {
+		var r io.Reader = os.Stdin
+		if name != "-" {
+			file, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			r = file
+		}
+
+		report, err := app.ImportStationObservations(db, r, directory, options)
+		if err != nil {
+			return err
+		}
+		if err = encoder.Encode(report); err != nil {
+			return err
+		}
+	}
+	return nil
+}